@@ -1,17 +1,25 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 
 	"nihil/internal/api"
+	"nihil/internal/audit"
+	"nihil/internal/buildinfo"
 	"nihil/internal/config"
 	"nihil/internal/firebase"
+	"nihil/internal/logging"
 	redisdb "nihil/internal/redis"
+	"nihil/internal/storage"
 	stripeClient "nihil/internal/stripe"
 	"nihil/internal/websocket"
 )
@@ -20,45 +28,144 @@ func main() {
 	godotenv.Load()
 
 	cfg := config.Load()
+	logger := logging.New(cfg.LogLevel)
+
+	// Refuse to start half-configured
+	if err := cfg.Validate(); err != nil {
+		logger.Error("invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	auditSink, err := audit.Open(cfg.AuditLog)
+	if err != nil {
+		logger.Error("failed to set up audit log", "error", err)
+		os.Exit(1)
+	}
+	audit.SetSink(auditSink)
+	audit.SetSalt(cfg.AuditSalt)
 
 	if cfg.Environment == "production" {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
-	redis, err := redisdb.NewClient(cfg.RedisURL)
+	redis, err := redisdb.NewClientWithOptions(cfg.RedisURL, redisdb.Options{
+		PoolSize:      cfg.RedisPoolSize,
+		MinIdleConns:  cfg.RedisMinIdleConns,
+		DialTimeout:   cfg.RedisDialTimeout,
+		MaxRetries:    cfg.RedisMaxRetries,
+		SentinelAddrs: splitAddrs(cfg.RedisSentinelAddrs),
+		MasterName:    cfg.RedisMasterName,
+		ClusterAddrs:  splitAddrs(cfg.RedisClusterAddrs),
+		Password:      cfg.RedisPassword,
+	})
 	if err != nil {
+		logger.Error("failed to connect to redis", "error", err)
 		os.Exit(1)
 	}
 	defer redis.Close()
+	redis.SetSubscriptionGrace(cfg.SubscriptionGrace)
+	redis.SetAuthWindow(cfg.AuthTimestampWindow)
+	redis.SetMaxChatsPerDevice(cfg.MaxChatsPerDevice)
+	redis.SetCodeRetention(cfg.ActivationCodeTTL, cfg.UsedCodeRetention)
+	redis.SetClaimSecret(cfg.ClaimRetrySecret)
+	redis.SetInvitationTTL(cfg.InvitationTTL)
+	redis.SetMaxPreKeys(cfg.MaxPreKeys)
+	redis.SetAbuseThresholds(redisdb.AbuseThresholds{
+		SpamDuplicates:    cfg.AbuseSpamDuplicates,
+		BotInterval:       cfg.AbuseBotInterval,
+		BotCount:          cfg.AbuseBotCount,
+		Window:            cfg.AbuseWindow,
+		WarningsBeforeBan: cfg.AbuseWarnings,
+		QuietPeriod:       cfg.AbuseQuietPeriod,
+	})
+
+	healthCtx, stopHealthCheck := context.WithCancel(context.Background())
+	defer stopHealthCheck()
+	go redis.RunHealthCheck(healthCtx, cfg.RedisHealthInterval, logger)
 
-	if firebaseJSON, err := os.ReadFile(cfg.FirebaseKeyPath); err == nil {
-		firebase.Initialize(cfg.FirebaseProject, firebaseJSON)
+	firebase.SetRetryPolicy(firebase.RetryPolicy{
+		MaxAttempts: cfg.PushMaxAttempts,
+		BaseDelay:   cfg.PushRetryDelay,
+	})
+	firebase.SetBreakerPolicy(firebase.BreakerPolicy{
+		Failures: cfg.PushBreakerFailures,
+		Cooldown: cfg.PushBreakerCooldown,
+	})
+	firebase.SetLogger(logger)
+	if firebaseJSON, err := cfg.FirebaseCredentials(); err != nil {
+		logger.Warn("firebase disabled", "error", err)
+	} else if firebaseJSON == nil {
+		logger.Info("firebase disabled: no service account key")
+	} else if err := firebase.Initialize(cfg.FirebaseProject, firebaseJSON); err != nil {
+		logger.Warn("firebase disabled", "error", err)
 	}
 
-	hub := websocket.NewHub(redis, cfg.RateLimitPerMinute)
+	hub := websocket.NewHub(redis, cfg, logger)
 	go hub.Run()
 
+	stripeClient.SetTeamDiscountPolicy(stripeClient.TeamDiscountPolicy{
+		Tiers:        cfg.TeamDiscountTiers,
+		MaxPercent:   cfg.TeamDiscountMax,
+		FloorPercent: cfg.TeamPriceFloor,
+	})
 	if cfg.StripeSecretKey != "" {
-		stripeClient.NewClient(cfg.StripeSecretKey)
+		stripeClient.NewClient(cfg.StripeSecretKey, cfg.PromoCodesEnabled)
+	}
+
+	// Attachments need an object storage backend installed with storage.SetBackend
+	if storage.GetBackend() == nil {
+		logger.Info("attachments disabled: no storage backend")
 	}
 
 	router := gin.New()
-	api.SetupRoutes(router, redis, hub, cfg.CORSOrigins, cfg.RateLimitPerMinute)
+	api.SetupRoutes(router, redis, hub, cfg, logger)
 
 	if cfg.StripeWebhookSecret != "" {
 		webhookHandler := stripeClient.NewWebhookHandler(redis, cfg.StripeWebhookSecret)
 		webhookHandler.RegisterRoutes(router)
 	}
 
-	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	srv := &http.Server{
+		Addr:    ":" + cfg.Port,
+		Handler: router,
+	}
 
 	go func() {
-		<-quit
-		redis.Close()
-		os.Exit(0)
+		logger.Info("server listening", "addr", srv.Addr, "version", buildinfo.Version, "commit", buildinfo.Commit)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server failed", "error", err)
+			os.Exit(1)
+		}
 	}()
 
-	addr := ":" + cfg.Port
-	router.Run(addr)
-}
\ No newline at end of file
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	logger.Info("shutting down", "grace_period", cfg.ShutdownGracePeriod)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownGracePeriod)
+	defer cancel()
+
+	// Stop taking new requests first; hijacked WebSockets are left for the hub to drain
+	if err := srv.Shutdown(ctx); err != nil {
+		logger.Warn("http shutdown incomplete", "error", err)
+	}
+	if err := hub.Shutdown(ctx); err != nil {
+		logger.Warn("websocket drain incomplete", "error", err)
+	}
+	// Last, so pushes for clients the hub just dropped still go out
+	if err := firebase.Shutdown(ctx); err != nil {
+		logger.Warn("push drain incomplete", "error", err)
+	}
+}
+// splitAddrs parses a comma-separated host:port list, ignoring blanks
+func splitAddrs(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
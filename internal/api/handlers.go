@@ -3,44 +3,185 @@ package api
 import (
 	"crypto/rand"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
 
+	"nihil/internal/buildinfo"
+	"nihil/internal/config"
+	"nihil/internal/errcode"
+	"nihil/internal/firebase"
 	redisdb "nihil/internal/redis"
+	"nihil/internal/signal"
+	"nihil/internal/storage"
 	stripeClient "nihil/internal/stripe"
 	"nihil/internal/websocket"
 )
 
 type Handlers struct {
-	redis *redisdb.Client
-	hub   *websocket.Hub
+	redis               *redisdb.Client
+	hub                 *websocket.Hub
+	maxChatParticipants int
+	origins             *OriginAllowlist // shared with CORS and the WebSocket upgrader
+	logger              *slog.Logger
+
+	// Optional dependencies reported by Health, replaced in tests
+	pushReady   func() bool
+	stripeReady func() bool
+
+	verifiers map[string]PaymentVerifier // by provider, see RestoreSubscription
 }
 
-func NewHandlers(redis *redisdb.Client, hub *websocket.Hub) *Handlers {
+func NewHandlers(redis *redisdb.Client, hub *websocket.Hub, cfg *config.Config, logger *slog.Logger) *Handlers {
 	return &Handlers{
-		redis: redis,
-		hub:   hub,
+		redis:               redis,
+		hub:                 hub,
+		maxChatParticipants: cfg.MaxChatParticipants,
+		origins:             NewOriginAllowlist(cfg.CORSOrigins, allowLocalhostOrigins(cfg.Environment)),
+		logger:              logger,
+		pushReady:           firebase.IsInitialized,
+		stripeReady:         func() bool { return stripeClient.GetClient() != nil },
+		verifiers:           defaultVerifiers(),
+	}
+}
+
+// respondError writes the error envelope: a stable code for clients to branch on and human-readable text
+func respondError(c *gin.Context, status int, code errcode.Code, message string) {
+	c.JSON(status, gin.H{"error": message, "code": code})
+}
+
+// joinErrorCode maps a JoinChat failure to its error code
+func joinErrorCode(err error) errcode.Code {
+	switch {
+	case errors.Is(err, redisdb.ErrInvitationNotFound):
+		return errcode.InvitationNotFound
+	case errors.Is(err, redisdb.ErrInvitationExpired):
+		return errcode.InvitationExpired
+	case errors.Is(err, redisdb.ErrInvitationUsed):
+		return errcode.InvitationUsed
+	case errors.Is(err, redisdb.ErrChatFull):
+		return errcode.ChatFull
+	default:
+		return errcode.InvalidRequest
 	}
 }
 
+// preKeyErrorCode maps a prekey the client got wrong to its error code
+// ok is false for failures that aren't the client's
+func preKeyErrorCode(err error) (code errcode.Code, ok bool) {
+	switch {
+	case errors.Is(err, redisdb.ErrInvalidPreKeyID):
+		return errcode.InvalidPreKeyID, true
+	case errors.Is(err, redisdb.ErrDuplicatePreKeyID):
+		return errcode.DuplicatePreKeyID, true
+	case errors.Is(err, redisdb.ErrTooManyPreKeys):
+		return errcode.TooManyPreKeys, true
+	default:
+		return "", false
+	}
+}
+
+// claimErrorCode maps a ClaimActivationCode failure to its error code
+func claimErrorCode(err error) errcode.Code {
+	switch {
+	case errors.Is(err, redisdb.ErrCodeNotFound):
+		return errcode.CodeNotFound
+	case errors.Is(err, redisdb.ErrCodeRevoked):
+		return errcode.CodeRevoked
+	case errors.Is(err, redisdb.ErrCodeUsed):
+		return errcode.CodeUsed
+	default:
+		return errcode.InvalidRequest
+	}
+}
+
+// Time reports the server's clock so devices can correct for their own when signing requests
+func (h *Handlers) Time(c *gin.Context) {
+	now := time.Now()
+	c.JSON(http.StatusOK, gin.H{
+		"unix":    now.Unix(),
+		"unix_ms": now.UnixMilli(),
+	})
+}
+
+// Version reports which build is running
+// Public, so it says nothing beyond what was built and when
+func (h *Handlers) Version(c *gin.Context) {
+	c.JSON(http.StatusOK, buildinfo.Get())
+}
+
 func (h *Handlers) Health(c *gin.Context) {
 	ctx := c.Request.Context()
 
+	// The background check already knows Redis is down - don't wait on a dial timeout
+	if !h.redis.Healthy() {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"status":  "unhealthy",
+			"error":   "redis unavailable",
+			"code":    errcode.Unavailable,
+			"version": buildinfo.Version,
+		})
+		return
+	}
+
 	if err := h.redis.Ping(ctx); err != nil {
+		h.logger.Error("health check failed", "error", err)
 		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"status": "unhealthy",
-			"error":  "redis unavailable",
+			"status":  "unhealthy",
+			"error":   "redis unavailable",
+			"code":    errcode.Unavailable,
+			"version": buildinfo.Version,
 		})
 		return
 	}
 
+	// Messaging only needs Redis; without push or billing the server is degraded, not down
+	status := "ok"
+	firebaseState := "initialized"
+	if !h.pushReady() {
+		firebaseState = "disabled"
+		status = "degraded"
+	}
+	stripeState := "configured"
+	if !h.stripeReady() {
+		stripeState = "disabled"
+		status = "degraded"
+	}
+
+	stats := h.redis.PoolStats()
 	c.JSON(http.StatusOK, gin.H{
-		"status": "ok",
-		"time":   time.Now().Unix(),
+		"status":  status,
+		"version": buildinfo.Version,
+		"time":    time.Now().Unix(),
+		"dependencies": gin.H{
+			"redis":    "ok",
+			"firebase": firebaseState,
+			"stripe":   stripeState,
+		},
+		"redis_pool": gin.H{
+			"total":    stats.TotalConns,
+			"idle":     stats.IdleConns,
+			"timeouts": stats.Timeouts,
+		},
+		"websocket": gin.H{
+			"buffer_full_evictions": h.hub.BufferFullEvictions(),
+			"chat_mappings":         h.hub.ChatMappings(),
+			"stale_mappings_reaped": h.hub.StaleMappingsReaped(),
+			"connections":           h.hub.Connections(),
+			"connections_refused":   h.hub.ConnectionsRefused(),
+		},
+		"push": gin.H{
+			"breaker":         firebase.BreakerState(),
+			"breaker_opens":   firebase.BreakerOpens(),
+			"token_refreshes": firebase.TokenRefreshes(),
+		},
 	})
 }
 
@@ -51,7 +192,7 @@ type ValidateCodeRequest struct {
 func (h *Handlers) ValidateActivationCode(c *gin.Context) {
 	var req ValidateCodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
@@ -61,6 +202,16 @@ func (h *Handlers) ValidateActivationCode(c *gin.Context) {
 		c.JSON(http.StatusNotFound, gin.H{
 			"valid": false,
 			"error": "code not found",
+			"code":  errcode.CodeNotFound,
+		})
+		return
+	}
+
+	if code.Status == "revoked" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"valid": false,
+			"error": "code revoked",
+			"code":  errcode.CodeRevoked,
 		})
 		return
 	}
@@ -69,6 +220,7 @@ func (h *Handlers) ValidateActivationCode(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{
 			"valid": false,
 			"error": "code already used",
+			"code":  errcode.CodeUsed,
 		})
 		return
 	}
@@ -89,39 +241,75 @@ type ClaimCodeRequest struct {
 func (h *Handlers) ClaimActivationCode(c *gin.Context) {
 	var req ClaimCodeRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
 	ctx := c.Request.Context()
 	sub, sessionID, err := h.redis.ClaimActivationCode(ctx, req.Code, req.DeviceUUID, req.PublicKey)
+	if errors.Is(err, redisdb.ErrDuoLink) {
+		h.logger.Error("failed to link duo partner", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to link duo partner")
+		return
+	}
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, claimErrorCode(err), err.Error())
 		return
 	}
+	h.hub.NotifySubscriptionUpdated(ctx, req.DeviceUUID)
+
+	subResp := gin.H{
+		"plan":       sub.Plan,
+		"plan_type":  sub.PlanType,
+		"status":     sub.Status,
+		"expires_at": sub.ExpiresAt.Unix(),
+	}
+	if partner := sub.DuoPartner(); partner != "" {
+		subResp["duo_partner_uuid"] = partner
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"success":    true,
-		"session_id": sessionID,
-		"subscription": gin.H{
-			"plan":       sub.Plan,
-			"plan_type":  sub.PlanType,
-			"status":     sub.Status,
-			"expires_at": sub.ExpiresAt.Unix(),
-		},
+		"success":      true,
+		"session_id":   sessionID,
+		"subscription": subResp,
 	})
 }
 
+// RestoreSubscriptionRequest proves a purchase with a Stripe session ID, or with
+// a store receipt when Provider is "apple" or "google"
 type RestoreSubscriptionRequest struct {
-	SessionID  string `json:"session_id" binding:"required"`
+	Provider   string `json:"provider"` // defaults to "stripe"
+	SessionID  string `json:"session_id"`
+	Receipt    string `json:"receipt"`
 	DeviceUUID string `json:"device_uuid" binding:"required"`
 	PublicKey  string `json:"public_key" binding:"required"`
 }
 
+// proof is what the provider's verifier checks
+func (r *RestoreSubscriptionRequest) proof() string {
+	if r.Provider == ProviderStripe {
+		return r.SessionID
+	}
+	return r.Receipt
+}
+
 func (h *Handlers) RestoreSubscription(c *gin.Context) {
 	var req RestoreSubscriptionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+	if req.Provider == "" {
+		req.Provider = ProviderStripe
+	}
+	verifier, ok := h.verifiers[req.Provider]
+	if !ok {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "unknown payment provider")
+		return
+	}
+	proof := req.proof()
+	if proof == "" {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
@@ -141,52 +329,44 @@ func (h *Handlers) RestoreSubscription(c *gin.Context) {
 		return
 	}
 
-	session, err := stripeClient.GetClient().GetCheckoutSession(req.SessionID)
-	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session"})
-		return
-	}
-
-	if session.PaymentStatus != "paid" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "payment not completed"})
-		return
-	}
-
-	plan, ok := session.Metadata["plan"]
-	if !ok {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid session metadata"})
-		return
-	}
-
-	planType := "solo"
-	if t, ok := session.Metadata["type"]; ok {
-		planType = t
+	// A refunded or disputed session still reads as paid at Stripe
+	if req.Provider == ProviderStripe {
+		revoked, err := h.redis.IsSessionRevoked(ctx, req.SessionID)
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to restore subscription")
+			return
+		}
+		if revoked {
+			respondError(c, http.StatusBadRequest, errcode.PaymentRevoked, "payment refunded or disputed")
+			return
+		}
 	}
 
-	var duration time.Duration
-	if planType == "team" {
-		if d, ok := session.Metadata["duration"]; ok {
-			duration = getTeamDurationFromMeta(d)
-		} else {
-			duration = 24 * time.Hour
+	plan, planType, expiresAt, err := verifier.Verify(ctx, proof)
+	if err != nil {
+		switch {
+		case errors.Is(err, errPaymentNotCompleted):
+			respondError(c, http.StatusBadRequest, errcode.PaymentNotCompleted, "payment not completed")
+		case errors.Is(err, errVerifierUnavailable):
+			respondError(c, http.StatusNotImplemented, errcode.Unavailable, "payment provider not supported")
+		default:
+			h.logger.Debug("purchase verification failed", "provider", req.Provider, "error", err)
+			respondError(c, http.StatusBadRequest, errcode.InvalidSession, "invalid session")
 		}
-	} else {
-		duration = getPlanDurationFromMeta(plan)
+		return
 	}
 
-	purchaseTime := time.Unix(session.Created, 0)
-	expiresAt := purchaseTime.Add(duration)
-
 	if time.Now().After(expiresAt) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "subscription expired"})
+		respondError(c, http.StatusBadRequest, errcode.SubscriptionExpired, "subscription expired")
 		return
 	}
 
 	sub, err := h.redis.RestoreSubscription(ctx, req.DeviceUUID, req.PublicKey, plan, planType, expiresAt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to restore subscription"})
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to restore subscription")
 		return
 	}
+	h.hub.NotifySubscriptionUpdated(ctx, req.DeviceUUID)
 
 	c.JSON(http.StatusOK, gin.H{
 		"success": true,
@@ -241,18 +421,29 @@ type CreateChatRequest struct {
 	TTL               int    `json:"ttl" binding:"required"`
 	ParticipantID     string `json:"participant_id" binding:"required"`
 	ParticipantSecret string `json:"participant_secret" binding:"required"`
+	MaxParticipants   int    `json:"max_participants"` // optional, omitted means a two-party chat
+	// Optional; a retry with the same ID returns the chat from the first attempt
+	RequestID string `json:"request_id" binding:"max=64"`
 }
 
 func (h *Handlers) CreateChat(c *gin.Context) {
 	var req CreateChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	if !redisdb.ValidChatTTL(req.TTL) {
+		respondError(c, http.StatusBadRequest, errcode.InvalidTTL, "invalid TTL, must be 5, 30, 60, 180, or 300")
 		return
 	}
 
-	validTTLs := map[int]bool{5: true, 30: true, 60: true, 180: true, 300: true}
-	if !validTTLs[req.TTL] {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid TTL, must be 5, 30, 60, 180, or 300"})
+	maxParticipants := req.MaxParticipants
+	if maxParticipants == 0 {
+		maxParticipants = redisdb.DefaultMaxParticipants
+	}
+	if maxParticipants < redisdb.DefaultMaxParticipants || maxParticipants > h.maxChatParticipants {
+		respondError(c, http.StatusBadRequest, errcode.InvalidMaxParticipants, "invalid max_participants, must be between 2 and "+strconv.Itoa(h.maxChatParticipants))
 		return
 	}
 
@@ -262,13 +453,48 @@ func (h *Handlers) CreateChat(c *gin.Context) {
 	chatUUID := uuid.New().String()
 	invitationToken, err := generateSecureToken()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to generate token")
 		return
 	}
 
-	if err := h.redis.CreateChat(ctx, chatUUID, req.ParticipantID, req.ParticipantSecret, deviceUUID, invitationToken, req.TTL); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create chat"})
-		return
+	// A retried request gets the chat from the first attempt, keeping its invitation link stable
+	replayed := false
+	if req.RequestID != "" {
+		existing, err := h.redis.ReserveChatRequest(ctx, deviceUUID, req.RequestID, redisdb.ChatRequest{
+			ChatUUID:        chatUUID,
+			InvitationToken: invitationToken,
+		})
+		if err != nil {
+			h.logger.Error("failed to reserve chat request", "error", err)
+			respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create chat")
+			return
+		}
+		if existing != nil {
+			chat, err := h.redis.GetChat(ctx, existing.ChatUUID)
+			if err != nil {
+				// The first attempt hasn't stored the chat yet
+				respondError(c, http.StatusConflict, errcode.ChatPending, "chat creation in progress")
+				return
+			}
+			chatUUID, invitationToken = existing.ChatUUID, existing.InvitationToken
+			req.TTL, maxParticipants = chat.TTLSeconds, chat.MaxParticipants
+			replayed = true
+		}
+	}
+
+	if !replayed {
+		if err := h.redis.CreateChat(ctx, chatUUID, req.ParticipantID, req.ParticipantSecret, deviceUUID, invitationToken, req.TTL, maxParticipants); err != nil {
+			if req.RequestID != "" {
+				h.redis.ReleaseChatRequest(ctx, deviceUUID, req.RequestID)
+			}
+			if errors.Is(err, redisdb.ErrTooManyChats) {
+				respondError(c, http.StatusTooManyRequests, errcode.TooManyChats, "too many active chats")
+				return
+			}
+			h.logger.Error("failed to create chat", "error", err)
+			respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create chat")
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -277,6 +503,7 @@ func (h *Handlers) CreateChat(c *gin.Context) {
 		"invitation_token": invitationToken,
 		"ttl":              req.TTL,
 		"participant_id":   req.ParticipantID,
+		"max_participants": maxParticipants,
 	})
 }
 
@@ -289,7 +516,7 @@ type JoinChatRequest struct {
 func (h *Handlers) JoinChat(c *gin.Context) {
 	var req JoinChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
@@ -299,26 +526,24 @@ func (h *Handlers) JoinChat(c *gin.Context) {
 	// Pass joinerDeviceUUID so it gets stored in the chat
 	chat, creatorDeviceUUID, err := h.redis.JoinChat(ctx, req.InvitationToken, joinerDeviceUUID, req.ParticipantID, req.ParticipantSecret)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, joinErrorCode(err), err.Error())
 		return
 	}
 
-	if client, ok := h.hub.GetClient(creatorDeviceUUID); ok {
-		client.SendMessage(&websocket.WSMessage{
-			Type: "chat.joined",
-			Payload: gin.H{
-				"chat_uuid":          chat.ChatUUID,
-				"participant_id":     req.ParticipantID,
-				"joiner_device_uuid": joinerDeviceUUID,
-			},
-		})
+	// Let everyone already in the chat know someone joined, queued for any who are offline
+	h.hub.NotifyChatJoined(ctx, chat, req.ParticipantID, joinerDeviceUUID)
+
+	otherDevices := make([]string, 0, len(chat.Participants)-1)
+	for _, p := range chat.OtherParticipants(req.ParticipantID) {
+		otherDevices = append(otherDevices, p.DeviceUUID)
 	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"chat_uuid":         chat.ChatUUID,
-		"ttl":               chat.TTLSeconds,
-		"other_device_uuid": creatorDeviceUUID,
-		"participant_id":    req.ParticipantID,
+		"chat_uuid":          chat.ChatUUID,
+		"ttl":                chat.TTLSeconds,
+		"other_device_uuid":  creatorDeviceUUID,
+		"other_device_uuids": otherDevices,
+		"participant_id":     req.ParticipantID,
 	})
 }
 
@@ -328,7 +553,7 @@ func (h *Handlers) ListChats(c *gin.Context) {
 
 	chatUUIDs, err := h.redis.GetUserChats(ctx, deviceUUID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get chats"})
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to get chats")
 		return
 	}
 
@@ -339,25 +564,281 @@ func (h *Handlers) ListChats(c *gin.Context) {
 			continue
 		}
 
+		// other_device is kept for two-party clients; groups use other_devices
+		otherDevices := make([]string, 0, len(chat.Participants))
+		for _, p := range chat.Participants {
+			if p.DeviceUUID != deviceUUID && p.DeviceUUID != "" {
+				otherDevices = append(otherDevices, p.DeviceUUID)
+			}
+		}
 		otherDevice := ""
-		if chat.ParticipantA == deviceUUID {
-			otherDevice = chat.ParticipantB
-		} else {
-			otherDevice = chat.ParticipantA
+		if len(otherDevices) > 0 {
+			otherDevice = otherDevices[0]
 		}
 
 		chats = append(chats, gin.H{
-			"chat_uuid":    chat.ChatUUID,
-			"ttl_seconds":  chat.TTLSeconds,
-			"status":       chat.Status,
-			"created_at":   chat.CreatedAt,
-			"other_device": otherDevice,
+			"chat_uuid":        chat.ChatUUID,
+			"ttl_seconds":      chat.TTLSeconds,
+			"status":           chat.Status,
+			"created_at":       chat.CreatedAt,
+			"other_device":     otherDevice,
+			"other_devices":    otherDevices,
+			"participants":     len(chat.Participants),
+			"max_participants": chat.MaxParticipants,
 		})
 	}
 
 	c.JSON(http.StatusOK, gin.H{"chats": chats})
 }
 
+// GetChatStatus reports the server's view of one chat to a device taking part in it
+// participant is "a" for the creator and "b" for anyone who joined
+func (h *Handlers) GetChatStatus(c *gin.Context) {
+	chatUUID := c.Param("chat_uuid")
+	deviceUUID := c.GetString("device_uuid")
+	ctx := c.Request.Context()
+
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil {
+		respondError(c, http.StatusNotFound, errcode.ChatNotFound, "chat not found")
+		return
+	}
+
+	isParticipant, participantID, err := h.redis.IsDeviceParticipant(ctx, chatUUID, deviceUUID)
+	if err != nil || !isParticipant {
+		respondError(c, http.StatusForbidden, errcode.NotParticipant, "not a participant")
+		return
+	}
+
+	participant := "b"
+	if chat.Participants[0].ID == participantID {
+		participant = "a"
+	}
+
+	// The sweeper may not have reached it yet
+	status := chat.Status
+	remaining := time.Until(chat.ExpiresAt())
+	if remaining <= 0 {
+		status = "expired"
+		remaining = 0
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"chat_uuid":         chat.ChatUUID,
+		"status":            status,
+		"ttl_seconds":       chat.TTLSeconds,
+		"remaining_seconds": int64(remaining.Seconds()),
+		"participant":       participant,
+		"participant_id":    participantID,
+		"participants":      len(chat.Participants),
+		"max_participants":  chat.MaxParticipants,
+	})
+}
+
+// AttachmentURLTTL is how long an upload or download URL works; the reference itself lives as long as the chat
+const AttachmentURLTTL = 15 * time.Minute
+
+// chatParticipant loads a chat the device takes part in, responding with the error otherwise
+func (h *Handlers) chatParticipant(c *gin.Context) (*redisdb.Chat, string, bool) {
+	ctx := c.Request.Context()
+	chat, err := h.redis.GetChat(ctx, c.Param("chat_uuid"))
+	if err != nil || time.Now().After(chat.ExpiresAt()) {
+		respondError(c, http.StatusNotFound, errcode.ChatNotFound, "chat not found")
+		return nil, "", false
+	}
+
+	isParticipant, participantID, err := h.redis.IsDeviceParticipant(ctx, chat.ChatUUID, c.GetString("device_uuid"))
+	if err != nil || !isParticipant {
+		respondError(c, http.StatusForbidden, errcode.NotParticipant, "not a participant")
+		return nil, "", false
+	}
+	return chat, participantID, true
+}
+
+// CreateAttachment issues a chat-scoped reference and an upload URL for one encrypted blob
+// The client uploads to storage directly and sends only the attachment ID in message.send
+func (h *Handlers) CreateAttachment(c *gin.Context) {
+	backend := storage.GetBackend()
+	if backend == nil {
+		respondError(c, http.StatusServiceUnavailable, errcode.Unavailable, "attachments are not enabled")
+		return
+	}
+
+	chat, participantID, ok := h.chatParticipant(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	att := &redisdb.Attachment{
+		AttachmentID:        uuid.New().String(),
+		ChatUUID:            chat.ChatUUID,
+		UploaderParticipant: participantID,
+		CreatedAt:           time.Now().Unix(),
+	}
+	att.ObjectKey = fmt.Sprintf("chats/%s/%s", chat.ChatUUID, att.AttachmentID)
+
+	uploadURL, err := backend.UploadURL(ctx, att.ObjectKey, AttachmentURLTTL)
+	if err != nil {
+		h.logger.Error("failed to issue upload url", "chat_uuid", chat.ChatUUID, "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create attachment")
+		return
+	}
+	if err := h.redis.CreateAttachment(ctx, chat, att); err != nil {
+		h.logger.Error("failed to store attachment", "chat_uuid", chat.ChatUUID, "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create attachment")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"attachment_id":     att.AttachmentID,
+		"upload_url":        uploadURL,
+		"upload_expires_at": time.Now().Add(AttachmentURLTTL).Unix(),
+		"expires_at":        chat.ExpiresAt().Unix(),
+	})
+}
+
+// GetAttachment issues a download URL for an attachment of a chat the device is in
+func (h *Handlers) GetAttachment(c *gin.Context) {
+	backend := storage.GetBackend()
+	if backend == nil {
+		respondError(c, http.StatusServiceUnavailable, errcode.Unavailable, "attachments are not enabled")
+		return
+	}
+
+	chat, _, ok := h.chatParticipant(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	att, err := h.redis.GetAttachment(ctx, chat.ChatUUID, c.Param("attachment_id"))
+	if errors.Is(err, redisdb.ErrAttachmentNotFound) {
+		respondError(c, http.StatusNotFound, errcode.AttachmentNotFound, "attachment not found")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to read attachment")
+		return
+	}
+
+	downloadURL, err := backend.DownloadURL(ctx, att.ObjectKey, AttachmentURLTTL)
+	if err != nil {
+		h.logger.Error("failed to issue download url", "chat_uuid", chat.ChatUUID, "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to read attachment")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"attachment_id":       att.AttachmentID,
+		"download_url":        downloadURL,
+		"download_expires_at": time.Now().Add(AttachmentURLTTL).Unix(),
+	})
+}
+
+type ReopenChatRequest struct {
+	ParticipantID string `json:"participant_id" binding:"required"`
+	// Optional from the device that joined with ParticipantID, required from any other
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+type LeaveChatRequest struct {
+	ParticipantID string `json:"participant_id" binding:"required"`
+	// Optional from the device that joined with ParticipantID, required from any other
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+// LeaveChat takes the caller out of a chat while the others keep it
+// The last one to leave deletes the chat; until then whoever remains can reopen it
+func (h *Handlers) LeaveChat(c *gin.Context) {
+	chatUUID := c.Param("chat_uuid")
+	deviceUUID := c.GetString("device_uuid")
+	ctx := c.Request.Context()
+
+	var req LeaveChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	chat, err := h.redis.LeaveChat(ctx, chatUUID, req.ParticipantID, req.ParticipantSecret, deviceUUID)
+	if errors.Is(err, redisdb.ErrInvalidSecret) {
+		respondError(c, http.StatusForbidden, errcode.NotParticipant, "not a participant")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusNotFound, errcode.ChatNotFound, "chat not found")
+		return
+	}
+
+	if chat != nil {
+		for _, p := range chat.Participants {
+			if p.DeviceUUID == "" {
+				continue
+			}
+			h.hub.SendToDevice(ctx, p.DeviceUUID, &websocket.WSMessage{
+				Type: websocket.TypeParticipantLeft,
+				Payload: websocket.ParticipantLeftPayload{
+					ChatUUID:      chatUUID,
+					ParticipantID: req.ParticipantID,
+					Remaining:     len(chat.Participants),
+				},
+			})
+		}
+	}
+
+	h.logger.Info("participant left chat", "chat_uuid", chatUUID, "deleted", chat == nil)
+	c.JSON(http.StatusOK, gin.H{"success": true, "deleted": chat == nil})
+}
+
+// ReopenChat lets the participant left behind once everyone else has left invite
+// someone new into the same chat. The previous invitation stops working
+func (h *Handlers) ReopenChat(c *gin.Context) {
+	chatUUID := c.Param("chat_uuid")
+	deviceUUID := c.GetString("device_uuid")
+	ctx := c.Request.Context()
+
+	var req ReopenChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	invitationToken, err := generateSecureToken()
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to generate token")
+		return
+	}
+
+	chat, err := h.redis.ReopenChat(ctx, chatUUID, req.ParticipantID, req.ParticipantSecret, deviceUUID, invitationToken)
+	if errors.Is(err, redisdb.ErrInvalidSecret) {
+		respondError(c, http.StatusForbidden, errcode.NotParticipant, "not a participant")
+		return
+	}
+	if errors.Is(err, redisdb.ErrPeersRemain) {
+		respondError(c, http.StatusConflict, errcode.PeersRemain, "other participants are still in the chat")
+		return
+	}
+	if errors.Is(err, redisdb.ErrChatNotActive) {
+		respondError(c, http.StatusConflict, errcode.ChatPending, "chat is still waiting for someone to join")
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusNotFound, errcode.ChatNotFound, "chat not found")
+		return
+	}
+
+	h.logger.Info("chat reopened", "chat_uuid", chatUUID)
+	c.JSON(http.StatusOK, gin.H{
+		"chat_uuid":        chat.ChatUUID,
+		"invitation_link":  "https://nihil.app/join/" + invitationToken,
+		"invitation_token": invitationToken,
+		"ttl":              chat.TTLSeconds,
+		"participant_id":   req.ParticipantID,
+		"max_participants": chat.MaxParticipants,
+	})
+}
+
 type DeleteChatRequest struct {
 	ParticipantID     string `json:"participant_id" binding:"required"`
 	ParticipantSecret string `json:"participant_secret" binding:"required"`
@@ -371,14 +852,14 @@ func (h *Handlers) DeleteChat(c *gin.Context) {
 	// Parse request body for participant credentials (backward compatibility)
 	var req DeleteChatRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request - participant credentials required"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request - participant credentials required")
 		return
 	}
 
 	// Get chat first (needed for BroadcastToChat before deletion)
 	chat, err := h.redis.GetChat(ctx, chatUUID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "chat not found"})
+		respondError(c, http.StatusNotFound, errcode.ChatNotFound, "chat not found")
 		return
 	}
 
@@ -388,15 +869,12 @@ func (h *Handlers) DeleteChat(c *gin.Context) {
 		// Fallback to credential validation (for backward compatibility)
 		valid, err := h.redis.ValidateParticipant(ctx, chatUUID, req.ParticipantID, req.ParticipantSecret)
 		if err != nil || !valid {
-			c.JSON(http.StatusForbidden, gin.H{"error": "not a participant"})
+			respondError(c, http.StatusForbidden, errcode.NotParticipant, "not a participant")
 			return
 		}
 	}
 
-	// Delete push registrations first
-	h.redis.DeleteAllPushForChat(ctx, chatUUID)
-
-	// Notify BOTH participants BEFORE deleting the chat using device UUIDs
+	// Notify ALL participants BEFORE deleting the chat using device UUIDs
 	expiredMsg := &websocket.WSMessage{
 		Type: "chat.expired",
 		Payload: gin.H{
@@ -405,23 +883,19 @@ func (h *Handlers) DeleteChat(c *gin.Context) {
 		},
 	}
 
-	// Send to participant A if connected
-	if chat.ParticipantADevice != "" {
-		if client, ok := h.hub.GetClient(chat.ParticipantADevice); ok {
-			client.SendMessage(expiredMsg)
+	// Send to each participant that is connected
+	for _, p := range chat.Participants {
+		if p.DeviceUUID == "" {
+			continue
 		}
-	}
-
-	// Send to participant B if connected
-	if chat.ParticipantBDevice != "" {
-		if client, ok := h.hub.GetClient(chat.ParticipantBDevice); ok {
+		if client, ok := h.hub.GetClient(p.DeviceUUID); ok {
 			client.SendMessage(expiredMsg)
 		}
 	}
 
-	// Now delete the chat from Redis
+	// Now delete the chat from Redis, its push registrations along with it
 	if err := h.redis.DeleteChat(ctx, chatUUID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to delete chat"})
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to delete chat")
 		return
 	}
 
@@ -434,16 +908,25 @@ func (h *Handlers) GetSubscriptionStatus(c *gin.Context) {
 
 	sub, err := h.redis.GetSubscription(ctx, deviceUUID)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "subscription not found"})
+		respondError(c, http.StatusNotFound, errcode.SubscriptionNotFound, "subscription not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
+	status := h.redis.SubscriptionState(sub, time.Now())
+	resp := gin.H{
 		"plan":       sub.Plan,
 		"plan_type":  sub.PlanType,
-		"status":     sub.Status,
+		"status":     status,
 		"expires_at": sub.ExpiresAt.Unix(),
-	})
+	}
+	if status == redisdb.SubscriptionGrace {
+		resp["grace_ends_at"] = h.redis.SubscriptionGraceEnds(sub).Unix()
+	}
+	if partner := sub.DuoPartner(); partner != "" {
+		resp["duo_partner_uuid"] = partner
+	}
+
+	c.JSON(http.StatusOK, resp)
 }
 
 // ============================================
@@ -451,27 +934,28 @@ func (h *Handlers) GetSubscriptionStatus(c *gin.Context) {
 // ============================================
 
 type CreateCheckoutRequest struct {
-	Plan string `json:"plan" binding:"required"`
+	Plan      string `json:"plan" binding:"required"`
+	PromoCode string `json:"promo_code"`
 }
 
 func (h *Handlers) CreateCheckout(c *gin.Context) {
 	var req CreateCheckoutRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
 	if !stripeClient.IsPlanValid(req.Plan) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid plan"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidPlan, "invalid plan")
 		return
 	}
 
 	successURL := "https://nihil.app/activate?session_id={CHECKOUT_SESSION_ID}"
 	cancelURL := "https://nihil.app/#pricing"
 
-	sess, err := stripeClient.GetClient().CreateCheckoutSession(req.Plan, successURL, cancelURL)
+	sess, err := stripeClient.GetClient().CreateCheckoutSession(req.Plan, req.PromoCode, successURL, cancelURL)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create checkout session"})
+		checkoutError(c, err)
 		return
 	}
 
@@ -484,31 +968,32 @@ func (h *Handlers) CreateCheckout(c *gin.Context) {
 type CreateTeamCheckoutRequest struct {
 	Duration    string `json:"duration" binding:"required"`
 	DeviceCount int    `json:"device_count" binding:"required"`
+	PromoCode   string `json:"promo_code"`
 }
 
 func (h *Handlers) CreateTeamCheckout(c *gin.Context) {
 	var req CreateTeamCheckoutRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
 	if !stripeClient.IsTeamDurationValid(req.Duration) {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid duration"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid duration")
 		return
 	}
 
 	if req.DeviceCount < 3 || req.DeviceCount > 50 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "device count must be between 3 and 50"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "device count must be between 3 and 50")
 		return
 	}
 
 	successURL := "https://nihil.app/activate?session_id={CHECKOUT_SESSION_ID}"
 	cancelURL := "https://nihil.app/#pricing"
 
-	sess, err := stripeClient.GetClient().CreateTeamCheckoutSession(req.Duration, req.DeviceCount, successURL, cancelURL)
+	sess, err := stripeClient.GetClient().CreateTeamCheckoutSession(req.Duration, req.DeviceCount, req.PromoCode, successURL, cancelURL)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create checkout session"})
+		checkoutError(c, err)
 		return
 	}
 
@@ -518,24 +1003,36 @@ func (h *Handlers) CreateTeamCheckout(c *gin.Context) {
 	})
 }
 
+// checkoutError maps a failed checkout to a response - promo code problems are the customer's to fix
+func checkoutError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, stripeClient.ErrInvalidPromoCode):
+		respondError(c, http.StatusBadRequest, errcode.InvalidPromoCode, "invalid or expired promo code")
+	case errors.Is(err, stripeClient.ErrPromoCodesDisabled):
+		respondError(c, http.StatusBadRequest, errcode.PromoCodesDisabled, "promo codes are not available")
+	default:
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create checkout session")
+	}
+}
+
 func (h *Handlers) CalculateTeamPrice(c *gin.Context) {
 	duration := c.Query("duration")
 	deviceCountStr := c.Query("device_count")
 
 	if duration == "" || deviceCountStr == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "duration and device_count required"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "duration and device_count required")
 		return
 	}
 
 	deviceCount, err := strconv.Atoi(deviceCountStr)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid device_count"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid device_count")
 		return
 	}
 
 	pricePerDevice, totalPrice, discountPercent, err := stripeClient.CalculateTeamPrice(duration, deviceCount)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, err.Error())
 		return
 	}
 
@@ -557,21 +1054,46 @@ func generateSecureToken() (string, error) {
 	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20], nil
 }
 
+// Page sizes for listing a session's activation codes
+// The largest page holds a whole team purchase
+const (
+	defaultCodesPageLimit = 20
+	maxCodesPageLimit     = 50
+)
+
+// GetActivationCodes lists a checkout session's codes, a page at a time
+// Codes never record the device that claimed them, so this reveals nothing past the purchase
 func (h *Handlers) GetActivationCodes(c *gin.Context) {
 	sessionID := c.Query("session_id")
 	if sessionID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "session_id required"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "session_id required")
+		return
+	}
+
+	offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if err != nil || offset < 0 {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid offset")
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultCodesPageLimit)))
+	if err != nil || limit < 1 || limit > maxCodesPageLimit {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("limit must be between 1 and %d", maxCodesPageLimit))
 		return
 	}
 
 	ctx := c.Request.Context()
-	codes, err := h.redis.GetActivationCodesBySession(ctx, sessionID)
-	if err != nil || len(codes) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "codes not found"})
+	codes, total, err := h.redis.GetActivationCodesPage(ctx, sessionID, offset, limit)
+	if err != nil || total == 0 {
+		respondError(c, http.StatusNotFound, errcode.NotFound, "codes not found")
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"codes": codes})
+	c.JSON(http.StatusOK, gin.H{
+		"codes":  codes,
+		"total":  total,
+		"offset": offset,
+		"limit":  limit,
+	})
 }
 
 // ============================================
@@ -599,7 +1121,13 @@ type PreKeyData struct {
 func (h *Handlers) RegisterKeys(c *gin.Context) {
 	var req RegisterKeysRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	// Reject bundles no peer could ever establish a session with
+	if err := signal.VerifySignedPreKey(req.IdentityKey, req.SignedPreKey.PublicKey, req.SignedPreKey.Signature); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidPreKeySignature, "invalid signed prekey signature")
 		return
 	}
 
@@ -622,7 +1150,11 @@ func (h *Handlers) RegisterKeys(c *gin.Context) {
 	}
 
 	if err := h.redis.StoreKeyBundle(ctx, deviceUUID, req.RegistrationID, req.IdentityKey, signedPreKey, preKeys); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store keys"})
+		if code, ok := preKeyErrorCode(err); ok {
+			respondError(c, http.StatusBadRequest, code, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to store keys")
 		return
 	}
 
@@ -642,7 +1174,13 @@ type RegisterKeysPublicRequest struct {
 func (h *Handlers) RegisterKeysPublic(c *gin.Context) {
 	var req RegisterKeysPublicRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	// Reject bundles no peer could ever establish a session with
+	if err := signal.VerifySignedPreKey(req.IdentityKey, req.SignedPreKey.PublicKey, req.SignedPreKey.Signature); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidPreKeySignature, "invalid signed prekey signature")
 		return
 	}
 
@@ -651,7 +1189,7 @@ func (h *Handlers) RegisterKeysPublic(c *gin.Context) {
 	// Verify device has an active subscription (prevents abuse)
 	active, _ := h.redis.IsSubscriptionActive(ctx, req.DeviceUUID)
 	if !active {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "no active subscription"})
+		respondError(c, http.StatusUnauthorized, errcode.NoSubscription, "no active subscription")
 		return
 	}
 
@@ -671,7 +1209,11 @@ func (h *Handlers) RegisterKeysPublic(c *gin.Context) {
 	}
 
 	if err := h.redis.StoreKeyBundle(ctx, req.DeviceUUID, req.RegistrationID, req.IdentityKey, signedPreKey, preKeys); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to store keys"})
+		if code, ok := preKeyErrorCode(err); ok {
+			respondError(c, http.StatusBadRequest, code, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to store keys")
 		return
 	}
 
@@ -685,10 +1227,13 @@ func (h *Handlers) GetKeyBundle(c *gin.Context) {
 	// GetKeyBundle now includes consuming one prekey atomically
 	bundle, err := h.redis.GetKeyBundle(ctx, targetUUID)
 	if err != nil || bundle == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "key bundle not found"})
+		respondError(c, http.StatusNotFound, errcode.KeysNotFound, "key bundle not found")
 		return
 	}
 
+	// Owner is told to top up before new sessions lose their one-time prekey
+	h.hub.CheckPreKeySupply(ctx, targetUUID)
+
 	response := gin.H{
 		"registration_id": bundle.RegistrationID,
 		"identity_key":    bundle.IdentityKey,
@@ -707,6 +1252,11 @@ func (h *Handlers) GetKeyBundle(c *gin.Context) {
 		}
 	}
 
+	// Left after this fetch - 0 means the next session gets no one-time prekey
+	if remaining, err := h.redis.GetPreKeyCount(ctx, targetUUID); err == nil {
+		response["prekeys_remaining"] = remaining
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
@@ -717,7 +1267,7 @@ type ReplenishKeysRequest struct {
 func (h *Handlers) ReplenishKeys(c *gin.Context) {
 	var req ReplenishKeysRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
 		return
 	}
 
@@ -733,26 +1283,80 @@ func (h *Handlers) ReplenishKeys(c *gin.Context) {
 	}
 
 	if err := h.redis.AddPreKeys(ctx, deviceUUID, preKeys); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to add prekeys"})
+		if code, ok := preKeyErrorCode(err); ok {
+			respondError(c, http.StatusBadRequest, code, err.Error())
+			return
+		}
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to add prekeys")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
+type UpdateSignedPreKeyRequest struct {
+	SignedPreKey SignedPreKeyData `json:"signed_prekey" binding:"required"`
+}
+
+// UpdateSignedPreKey rotates the device's signed prekey without touching its one-time prekeys
+// The new key must be signed by the identity key registered with the bundle
+func (h *Handlers) UpdateSignedPreKey(c *gin.Context) {
+	var req UpdateSignedPreKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	deviceUUID := c.GetString("device_uuid")
+
+	err := h.redis.UpdateSignedPreKey(c.Request.Context(), deviceUUID, redisdb.SignedPreKey{
+		ID:        req.SignedPreKey.ID,
+		PublicKey: req.SignedPreKey.PublicKey,
+		Signature: req.SignedPreKey.Signature,
+	})
+	switch {
+	case err == nil:
+		c.JSON(http.StatusOK, gin.H{"success": true})
+	case errors.Is(err, signal.ErrInvalidKey), errors.Is(err, signal.ErrInvalidSignature):
+		respondError(c, http.StatusBadRequest, errcode.InvalidPreKeySignature, "invalid signed prekey signature")
+	case errors.Is(err, redisdb.ErrKeyBundleNotFound):
+		respondError(c, http.StatusNotFound, errcode.KeysNotFound, "key bundle not found")
+	case errors.Is(err, redisdb.ErrKeyBundleChanged):
+		respondError(c, http.StatusConflict, errcode.KeyBundleChanged, "keys were registered again during the update")
+	default:
+		h.logger.Error("failed to update signed prekey", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to update signed prekey")
+	}
+}
+
 func (h *Handlers) GetPreKeyCount(c *gin.Context) {
 	deviceUUID := c.GetString("device_uuid")
 	ctx := c.Request.Context()
 
 	count, err := h.redis.GetPreKeyCount(ctx, deviceUUID)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to get prekey count"})
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to get prekey count")
 		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"count": count})
 }
 
+// GetPeerPreKeyCount reports another device's one-time prekeys left without consuming one
+// Lets a client warn before starting a session that would fall back to the signed prekey only
+func (h *Handlers) GetPeerPreKeyCount(c *gin.Context) {
+	targetUUID := c.Param("device_uuid")
+	ctx := c.Request.Context()
+
+	count, err := h.redis.GetPreKeyCount(ctx, targetUUID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to get prekey count")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"device_uuid": targetUUID, "count": count})
+}
+
 // ============================================
 // PUSH NOTIFICATIONS - DEPRECATED
 // ============================================
@@ -773,9 +1377,370 @@ func (h *Handlers) PurgeDevice(c *gin.Context) {
 	h.hub.DisconnectDevice(deviceUUID)
 
 	if err := h.redis.PurgeDevice(ctx, deviceUUID); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to purge device"})
+		h.logger.Error("failed to purge device", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to purge device")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// Device standings reported by GetDeviceStanding
+const (
+	StandingClean  = "clean"
+	StandingWarned = "warned"
+	StandingBanned = "banned"
+)
+
+// GetDeviceStanding tells a device whether it is banned or warned, and why, so the app
+// can show an accurate status screen. Served to banned devices too, see StandingAuth
+// expires_in is omitted for a permanent ban
+func (h *Handlers) GetDeviceStanding(c *gin.Context) {
+	deviceUUID := c.GetString("device_uuid")
+	ctx := c.Request.Context()
+
+	banned, reason, remaining, _ := h.redis.IsBanned(ctx, deviceUUID)
+	if banned {
+		resp := gin.H{"status": StandingBanned, "reason": reason, "permanent": remaining == 0}
+		if remaining > 0 {
+			resp["expires_in"] = int64(remaining.Seconds())
+		}
+		c.JSON(http.StatusOK, resp)
+		return
+	}
+
+	warning, err := h.redis.GetWarning(ctx, deviceUUID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to read warnings")
+		return
+	}
+	if warning != nil {
+		expiresIn := time.Until(h.redis.WarningExpiresAt(warning))
+		c.JSON(http.StatusOK, gin.H{
+			"status":       StandingWarned,
+			"warnings":     warning.Count,
+			"reason":       warning.Reason,
+			"last_warning": warning.LastWarning.Unix(),
+			"expires_in":   max(int64(expiresIn.Seconds()), 0),
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"status": StandingClean})
+}
+
+// ListDeviceSessions returns the device's open WebSocket connections across all instances
+func (h *Handlers) ListDeviceSessions(c *gin.Context) {
+	deviceUUID := c.GetString("device_uuid")
+
+	sessions, err := h.redis.GetDeviceSessions(c.Request.Context(), deviceUUID)
+	if err != nil {
+		h.logger.Error("failed to list sessions", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to list sessions")
 		return
 	}
 
+	c.JSON(http.StatusOK, gin.H{"sessions": sessions})
+}
+
+// CloseDeviceSessions closes every WebSocket connection the device has, on any instance
+func (h *Handlers) CloseDeviceSessions(c *gin.Context) {
+	deviceUUID := c.GetString("device_uuid")
+
+	h.hub.CloseDeviceSessions(deviceUUID)
+
 	c.JSON(http.StatusOK, gin.H{"success": true})
-}
\ No newline at end of file
+}
+
+// ============================================
+// KEY ROTATION
+// ============================================
+
+// CreateKeyRotationChallenge issues the challenge a device signs with its new key
+func (h *Handlers) CreateKeyRotationChallenge(c *gin.Context) {
+	deviceUUID := c.GetString("device_uuid")
+
+	challenge, err := h.redis.CreateKeyRotationChallenge(c.Request.Context(), deviceUUID)
+	if err != nil {
+		h.logger.Error("failed to create key rotation challenge", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to create challenge")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"challenge":  challenge,
+		"expires_in": int64(redisdb.KeyRotationChallengeTTL.Seconds()),
+	})
+}
+
+// RotateKeyRequest proves possession of the new key: Signature is computed like a
+// request signature, keyed by NewPublicKey with the challenge in place of the nonce
+type RotateKeyRequest struct {
+	NewPublicKey string `json:"new_public_key" binding:"required"`
+	Challenge    string `json:"challenge" binding:"required"`
+	Timestamp    int64  `json:"timestamp" binding:"required"`
+	Signature    string `json:"signature" binding:"required"`
+}
+
+// RotateKey replaces the device's public key, e.g. after the old one was compromised
+// The request itself is signed with the old key; open sessions are closed so the
+// device re-authenticates with the new one
+func (h *Handlers) RotateKey(c *gin.Context) {
+	deviceUUID := c.GetString("device_uuid")
+	ctx := c.Request.Context()
+
+	var req RotateKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	oldKey, err := h.redis.GetDevicePublicKey(ctx, deviceUUID)
+	if err != nil {
+		respondError(c, http.StatusNotFound, errcode.DeviceNotFound, "device not found")
+		return
+	}
+	if req.NewPublicKey == oldKey {
+		respondError(c, http.StatusBadRequest, errcode.KeyUnchanged, "new key must differ from the current key")
+		return
+	}
+
+	// The challenge is spent whether or not the proof checks out
+	if err := h.redis.ConsumeKeyRotationChallenge(ctx, deviceUUID, req.Challenge); err != nil {
+		if errors.Is(err, redisdb.ErrChallengeInvalid) {
+			respondError(c, http.StatusUnauthorized, errcode.ChallengeInvalid, "invalid or expired challenge")
+			return
+		}
+		h.logger.Error("failed to check key rotation challenge", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to rotate key")
+		return
+	}
+
+	if !h.redis.TimestampFresh(req.Timestamp, time.Now()) {
+		respondError(c, http.StatusUnauthorized, errcode.TimestampExpired, "timestamp expired")
+		return
+	}
+	if req.Signature != computeSignature(req.NewPublicKey, deviceUUID, req.Timestamp, req.Challenge) {
+		h.logger.Info("key rotation rejected", "reason", "invalid_proof")
+		respondError(c, http.StatusUnauthorized, errcode.InvalidProof, "invalid proof signature")
+		return
+	}
+
+	if err := h.redis.RotatePublicKey(ctx, deviceUUID, oldKey, req.NewPublicKey); err != nil {
+		if errors.Is(err, redisdb.ErrKeyChanged) {
+			respondError(c, http.StatusConflict, errcode.KeyChanged, "key changed during rotation")
+			return
+		}
+		h.logger.Error("failed to rotate key", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to rotate key")
+		return
+	}
+
+	h.hub.RevokeDeviceSessions(deviceUUID)
+	h.logger.Info("device key rotated", "device_uuid", deviceUUID)
+
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ============================================
+// ADMIN ENDPOINTS (guarded by AdminAuth)
+// ============================================
+
+func (h *Handlers) UnbanDevice(c *gin.Context) {
+	deviceUUID := c.Param("device_uuid")
+	ctx := c.Request.Context()
+
+	if err := h.redis.Unban(ctx, deviceUUID); err != nil {
+		h.logger.Error("failed to unban device", "device_uuid", deviceUUID, "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to unban device")
+		return
+	}
+
+	h.logger.Info("device unbanned", "device_uuid", deviceUUID)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetTeamRoster reports how many of a team purchase's devices have been provisioned
+// Only counts are kept, so this can't say which devices they are
+func (h *Handlers) GetTeamRoster(c *gin.Context) {
+	sessionID := c.Param("session_id")
+	ctx := c.Request.Context()
+
+	roster, err := h.redis.GetTeamRoster(ctx, sessionID)
+	if err != nil {
+		h.logger.Error("failed to get team roster", "error", err)
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to get team roster")
+		return
+	}
+	if roster == nil {
+		respondError(c, http.StatusNotFound, errcode.NotFound, "no devices provisioned for this session")
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"session_id": sessionID,
+		"purchased":  roster.Purchased,
+		"active":     roster.Active,
+	})
+}
+
+type SetCORSOriginsRequest struct {
+	Origins []string `json:"origins" binding:"required"`
+}
+
+// SetCORSOrigins replaces the origins CORS and WebSocket upgrades accept, without a restart
+// Only this instance changes and nothing is persisted; CORS_ORIGINS applies again on restart
+func (h *Handlers) SetCORSOrigins(c *gin.Context) {
+	var req SetCORSOriginsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+	for _, origin := range req.Origins {
+		if !validOrigin(origin) {
+			respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid origin: "+origin)
+			return
+		}
+	}
+
+	h.origins.Set(req.Origins)
+	h.logger.Info("cors origins updated", "origins", len(req.Origins))
+	c.JSON(http.StatusOK, gin.H{"origins": h.origins.Origins()})
+}
+
+// maxAnnouncementLength bounds an announcement's text in bytes
+const maxAnnouncementLength = 500
+
+type BroadcastRequest struct {
+	Text     string `json:"text" binding:"required"`
+	Severity string `json:"severity"` // info when unset
+}
+
+// Broadcast sends a system.announcement to every connected client on every instance
+// e.g. to warn of a brief disconnect before a deploy
+func (h *Handlers) Broadcast(c *gin.Context) {
+	var req BroadcastRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+	if len(req.Text) > maxAnnouncementLength {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("text must be at most %d bytes", maxAnnouncementLength))
+		return
+	}
+	switch req.Severity {
+	case "":
+		req.Severity = websocket.SeverityInfo
+	case websocket.SeverityInfo, websocket.SeverityWarning, websocket.SeverityCritical:
+	default:
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "severity must be info, warning or critical")
+		return
+	}
+
+	sent := h.hub.Broadcast(c.Request.Context(), &websocket.WSMessage{
+		Type:    websocket.TypeAnnouncement,
+		Payload: websocket.AnnouncementPayload{Text: req.Text, Severity: req.Severity},
+	})
+
+	h.logger.Info("announcement broadcast", "severity", req.Severity, "local_clients", sent)
+	c.JSON(http.StatusOK, gin.H{"success": true, "local_clients": sent})
+}
+
+// GetAbuseState reports a device's current warning and ban
+func (h *Handlers) GetAbuseState(c *gin.Context) {
+	deviceUUID := c.Param("device_uuid")
+	ctx := c.Request.Context()
+
+	resp := gin.H{"device_uuid": deviceUUID, "warnings": 0}
+
+	warning, err := h.redis.GetWarning(ctx, deviceUUID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to read warnings")
+		return
+	}
+	if warning != nil {
+		resp["warnings"] = warning.Count
+		resp["last_reason"] = warning.Reason
+		resp["last_warning"] = warning.LastWarning.Unix()
+	}
+
+	banned, reason, remaining, _ := h.redis.IsBanned(ctx, deviceUUID)
+	resp["banned"] = banned
+	if banned {
+		resp["ban_reason"] = reason
+		resp["ban_remaining"] = int64(remaining.Seconds()) // 0 for a permanent ban
+	}
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// maxMintCount caps how many codes (or duo pairs) one request can mint
+const maxMintCount = 100
+
+type MintCodesRequest struct {
+	Plan  string `json:"plan" binding:"required"`
+	Count int    `json:"count" binding:"required"`
+}
+
+// MintActivationCodes creates pending codes without a Stripe payment, e.g. for events
+// Codes are marked with the admin origin; a duo plan mints owner/guest pairs
+func (h *Handlers) MintActivationCodes(c *gin.Context) {
+	var req MintCodesRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, "invalid request")
+		return
+	}
+
+	if !stripeClient.IsPlanValid(req.Plan) {
+		respondError(c, http.StatusBadRequest, errcode.InvalidPlan, "invalid plan")
+		return
+	}
+	if req.Count < 1 || req.Count > maxMintCount {
+		respondError(c, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("count must be between 1 and %d", maxMintCount))
+		return
+	}
+
+	ctx := c.Request.Context()
+	isDuo := strings.HasSuffix(req.Plan, "_duo")
+
+	var codes []gin.H
+	for i := 0; i < req.Count; i++ {
+		ac := &redisdb.ActivationCode{
+			Code:      stripeClient.GenerateActivationCode(),
+			Plan:      req.Plan,
+			Type:      "solo",
+			Status:    "pending",
+			CreatedAt: time.Now(),
+			Origin:    redisdb.CodeOriginAdmin,
+		}
+		batch := []*redisdb.ActivationCode{ac}
+
+		if isDuo {
+			ac.Type = "duo_owner"
+			batch = append(batch, &redisdb.ActivationCode{
+				Code:         stripeClient.GenerateActivationCode(),
+				Plan:         req.Plan,
+				Type:         "duo_guest",
+				Status:       "pending",
+				CreatedAt:    time.Now(),
+				DuoOwnerCode: ac.Code,
+				Origin:       redisdb.CodeOriginAdmin,
+			})
+		}
+
+		for _, code := range batch {
+			if err := h.redis.CreateActivationCode(ctx, code); err != nil {
+				h.logger.Error("failed to mint activation code", "plan", req.Plan, "error", err)
+				respondError(c, http.StatusInternalServerError, errcode.Internal, "failed to mint codes")
+				return
+			}
+			codes = append(codes, gin.H{"code": code.Code, "type": code.Type})
+		}
+	}
+
+	h.logger.Info("activation codes minted", "plan", req.Plan, "count", len(codes), "origin", redisdb.CodeOriginAdmin)
+	c.JSON(http.StatusOK, gin.H{
+		"plan":  req.Plan,
+		"codes": codes,
+	})
+}
@@ -0,0 +1,1320 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+
+	"nihil/internal/buildinfo"
+	"nihil/internal/config"
+	"nihil/internal/errcode"
+	"nihil/internal/logging"
+	redisdb "nihil/internal/redis"
+	"nihil/internal/storage"
+	ws "nihil/internal/websocket"
+)
+
+// To run these tests, you need Redis running locally:
+// docker run -d -p 6379:6379 redis:7-alpine
+
+const testAdminToken = "test-admin-token"
+
+func setupTestRouter(t *testing.T) (*redisdb.Client, *gin.Engine) {
+	client, err := redisdb.NewClient("redis://localhost:6379")
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	cfg := &config.Config{
+		CORSOrigins:         "https://nihil.app",
+		RateLimitPerMinute:  120,
+		MaxChatParticipants: 8,
+		AdminToken:          testAdminToken,
+	}
+	SetupRoutes(router, client, ws.NewHub(client, cfg, logging.Discard()), cfg, logging.Discard())
+	return client, router
+}
+
+// doSigned makes a request authenticated as deviceUUID with its key
+func doSigned(router *gin.Engine, method, path, deviceUUID, key string, body any) *httptest.ResponseRecorder {
+	return doSignedAt(router, method, path, deviceUUID, key, time.Now().Unix(), body)
+}
+
+// doSignedAt is doSigned with the signed timestamp chosen by the caller
+func doSignedAt(router *gin.Engine, method, path, deviceUUID, key string, timestamp int64, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+
+	nonce := uuid.New().String()
+	req.Header.Set("X-Device-UUID", deviceUUID)
+	req.Header.Set("X-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Nonce", nonce)
+	req.Header.Set("X-Signature", computeSignature(key, deviceUUID, timestamp, nonce))
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func doJSON(router *gin.Engine, method, path, token string, body any) *httptest.ResponseRecorder {
+	data, _ := json.Marshal(body)
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestMintActivationCodes(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	t.Run("missing_token", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/admin/codes", "", gin.H{"plan": "1_week_solo", "count": 1})
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 without admin token, got %d", w.Code)
+		}
+	})
+
+	t.Run("mint_and_claim", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/admin/codes", testAdminToken, gin.H{"plan": "1_week_solo", "count": 2})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var resp struct {
+			Codes []struct {
+				Code string `json:"code"`
+				Type string `json:"type"`
+			} `json:"codes"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Codes) != 2 {
+			t.Fatalf("Expected 2 codes, got %d", len(resp.Codes))
+		}
+
+		ac, err := client.GetActivationCode(ctx, resp.Codes[0].Code)
+		if err != nil {
+			t.Fatalf("Minted code not stored: %v", err)
+		}
+		if ac.Origin != redisdb.CodeOriginAdmin || ac.Status != "pending" {
+			t.Errorf("Expected pending admin code, got origin=%q status=%q", ac.Origin, ac.Status)
+		}
+
+		deviceUUID := "test-admin-mint-" + time.Now().Format("150405.000000")
+		sub, _, err := client.ClaimActivationCode(ctx, resp.Codes[0].Code, deviceUUID, "test-public-key")
+		if err != nil {
+			t.Fatalf("Failed to claim minted code: %v", err)
+		}
+		if sub.Plan != "1_week_solo" || sub.Status != "active" {
+			t.Errorf("Unexpected subscription %+v", sub)
+		}
+	})
+
+	t.Run("duo_pairs", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/admin/codes", testAdminToken, gin.H{"plan": "1_week_duo", "count": 1})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if !bytes.Contains(w.Body.Bytes(), []byte("duo_owner")) || !bytes.Contains(w.Body.Bytes(), []byte("duo_guest")) {
+			t.Errorf("Expected an owner/guest pair, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid_count", func(t *testing.T) {
+		w := doJSON(router, http.MethodPost, "/admin/codes", testAdminToken, gin.H{"plan": "1_week_solo", "count": maxMintCount + 1})
+		if w.Code != http.StatusBadRequest {
+			t.Fatalf("Expected 400 for too many codes, got %d", w.Code)
+		}
+	})
+
+	t.Logf("✓ Admin minted codes are claimable and require the admin token")
+}
+
+func TestGetActivationCodes_Paginated(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "test-codes-session-" + suffix
+	for i := 1; i <= 50; i++ {
+		code := fmt.Sprintf("TEAM-%s-%02d", suffix, i)
+		client.CreateActivationCode(ctx, &redisdb.ActivationCode{
+			Code: code, StripeSessionID: sessionID, Plan: "team", Type: "team",
+			Status: "pending", TeamIndex: i, TeamTotal: 50, Duration: "1_week",
+		})
+		client.AddToCodePool(ctx, code, sessionID)
+	}
+
+	get := func(query string) *httptest.ResponseRecorder {
+		return doJSON(router, http.MethodGet, "/activation/codes?session_id="+sessionID+query, "", nil)
+	}
+
+	t.Run("pages", func(t *testing.T) {
+		w := get("&offset=40&limit=20")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Codes []redisdb.ActivationCode `json:"codes"`
+			Total int                      `json:"total"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp.Total != 50 || len(resp.Codes) != 10 {
+			t.Fatalf("Expected last 10 of 50 codes, got %d of %d", len(resp.Codes), resp.Total)
+		}
+		if resp.Codes[0].TeamIndex != 41 {
+			t.Errorf("Expected page to start at team index 41, got %d", resp.Codes[0].TeamIndex)
+		}
+	})
+
+	t.Run("default_limit", func(t *testing.T) {
+		w := get("")
+		var resp struct {
+			Codes []redisdb.ActivationCode `json:"codes"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if len(resp.Codes) != defaultCodesPageLimit {
+			t.Errorf("Expected %d codes by default, got %d", defaultCodesPageLimit, len(resp.Codes))
+		}
+	})
+
+	t.Run("invalid_limit", func(t *testing.T) {
+		if w := get(fmt.Sprintf("&limit=%d", maxCodesPageLimit+1)); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for oversized limit, got %d", w.Code)
+		}
+		if w := get("&offset=-1"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for negative offset, got %d", w.Code)
+		}
+	})
+
+	t.Logf("✓ Team session codes are listed a page at a time")
+}
+
+func TestGetTeamRoster(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "test-roster-session-" + suffix
+	for i := 1; i <= 3; i++ {
+		client.CreateActivationCode(ctx, &redisdb.ActivationCode{
+			Code: fmt.Sprintf("ROSTER-%s-%d", suffix, i), StripeSessionID: sessionID, Plan: "team", Type: "team",
+			Status: "pending", TeamIndex: i, TeamTotal: 3, Duration: "1_week",
+		})
+	}
+
+	path := "/admin/teams/" + sessionID
+	if w := doJSON(router, http.MethodGet, path, "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin token, got %d", w.Code)
+	}
+	if w := doJSON(router, http.MethodGet, path, testAdminToken, nil); w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 before any claim, got %d", w.Code)
+	}
+
+	deviceUUID := "test-roster-device-" + suffix
+	if _, _, err := client.ClaimActivationCode(ctx, fmt.Sprintf("ROSTER-%s-1", suffix), deviceUUID, "test-public-key"); err != nil {
+		t.Fatalf("Failed to claim team code: %v", err)
+	}
+
+	w := doJSON(router, http.MethodGet, path, testAdminToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp struct {
+		Purchased int `json:"purchased"`
+		Active    int `json:"active"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Purchased != 3 || resp.Active != 1 {
+		t.Errorf("Expected 1 of 3 devices active, got %+v", resp)
+	}
+	if strings.Contains(w.Body.String(), deviceUUID) {
+		t.Error("Roster leaked the claiming device")
+	}
+
+	t.Logf("✓ Team roster reports counts only")
+}
+
+func TestGetKeyBundle_PreKeysRemaining(t *testing.T) {
+	client, _ := setupTestRouter(t)
+	ctx := context.Background()
+
+	cfg := &config.Config{PreKeyLowThreshold: 1}
+	handlers := NewHandlers(client, ws.NewHub(client, cfg, logging.Discard()), cfg, logging.Discard())
+	router := gin.New()
+	router.GET("/keys/:device_uuid", handlers.GetKeyBundle)
+
+	deviceUUID := "test-prekeys-remaining-" + time.Now().Format("150405.000000")
+	err := client.StoreKeyBundle(ctx, deviceUUID, 1, "identity", redisdb.SignedPreKey{ID: 1, PublicKey: "spk", Signature: "sig"},
+		[]redisdb.PreKey{{ID: 1, PublicKey: "pk1"}, {ID: 2, PublicKey: "pk2"}})
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+	defer client.DeleteKeyBundle(ctx, deviceUUID)
+
+	for i, want := range []float64{1, 0, 0} {
+		w := doJSON(router, http.MethodGet, "/keys/"+deviceUUID, "", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Fetch %d: expected 200, got %d", i+1, w.Code)
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp["prekeys_remaining"] != want {
+			t.Errorf("Fetch %d: expected %v prekeys remaining, got %v", i+1, want, resp["prekeys_remaining"])
+		}
+		if _, hasPreKey := resp["prekey"]; hasPreKey != (i < 2) {
+			t.Errorf("Fetch %d: unexpected prekey presence %v", i+1, hasPreKey)
+		}
+	}
+
+	t.Logf("✓ Key bundle fetch reports the prekeys left")
+}
+
+func TestGetPeerPreKeyCount_DoesNotConsume(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	deviceUUID := "test-peer-count-" + suffix
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	peerUUID := "test-peer-count-peer-" + suffix
+	err := client.StoreKeyBundle(ctx, peerUUID, 1, "identity", redisdb.SignedPreKey{ID: 1, PublicKey: "spk", Signature: "sig"},
+		[]redisdb.PreKey{{ID: 1, PublicKey: "pk1"}, {ID: 2, PublicKey: "pk2"}})
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+	defer client.DeleteKeyBundle(ctx, peerUUID)
+
+	count := func() float64 {
+		t.Helper()
+		w := doSigned(router, http.MethodGet, "/keys/"+peerUUID+"/count", deviceUUID, "test-key", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		n, _ := resp["count"].(float64)
+		return n
+	}
+
+	if first, second := count(), count(); first != 2 || second != 2 {
+		t.Fatalf("Expected the count to stay at 2, got %v then %v", first, second)
+	}
+
+	if w := doSigned(router, http.MethodGet, "/keys/"+peerUUID, deviceUUID, "test-key", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for the bundle, got %d", w.Code)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected the bundle fetch to consume one prekey, got %v left", n)
+	}
+
+	if w := doJSON(router, http.MethodGet, "/keys/"+peerUUID+"/count", "", nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected 401 without device auth, got %d", w.Code)
+	}
+
+	t.Logf("✓ Peer prekey count read without consuming")
+}
+
+func TestGetAbuseState(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-admin-abuse-" + time.Now().Format("150405.000000")
+	defer client.Unban(ctx, deviceUUID)
+	client.AddWarning(ctx, deviceUUID, "spam detected")
+
+	if w := doJSON(router, http.MethodGet, "/admin/devices/"+deviceUUID+"/abuse", "", nil); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin token, got %d", w.Code)
+	}
+
+	w := doJSON(router, http.MethodGet, "/admin/devices/"+deviceUUID+"/abuse", testAdminToken, nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp["warnings"] != float64(1) || resp["banned"] != false {
+		t.Errorf("Expected one warning and no ban, got %v", resp)
+	}
+
+	t.Logf("✓ Admin can read a device's warning count")
+}
+
+func TestRotateKey(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	rotate := func(t *testing.T, deviceUUID, oldKey, newKey, proofKey string) *httptest.ResponseRecorder {
+		w := doSigned(router, http.MethodPost, "/device/rotate-key/challenge", deviceUUID, oldKey, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for challenge, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Challenge string `json:"challenge"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+
+		timestamp := time.Now().Unix()
+		return doSigned(router, http.MethodPost, "/device/rotate-key", deviceUUID, oldKey, gin.H{
+			"new_public_key": newKey,
+			"challenge":      resp.Challenge,
+			"timestamp":      timestamp,
+			"signature":      computeSignature(proofKey, deviceUUID, timestamp, resp.Challenge),
+		})
+	}
+
+	newDevice := func(t *testing.T, name string) string {
+		deviceUUID := "test-rotate-" + name + "-" + time.Now().Format("150405.000000")
+		if _, err := client.RestoreSubscription(ctx, deviceUUID, "old-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Failed to create subscription: %v", err)
+		}
+		t.Cleanup(func() { client.PurgeDevice(ctx, deviceUUID) })
+		return deviceUUID
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		deviceUUID := newDevice(t, "valid")
+		if w := rotate(t, deviceUUID, "old-key", "new-key", "new-key"); w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		if key, _ := client.GetDevicePublicKey(ctx, deviceUUID); key != "new-key" {
+			t.Errorf("Expected the new key stored, got %q", key)
+		}
+		if w := doSigned(router, http.MethodGet, "/subscription/status", deviceUUID, "old-key", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected the old key rejected, got %d", w.Code)
+		}
+		if w := doSigned(router, http.MethodGet, "/subscription/status", deviceUUID, "new-key", nil); w.Code != http.StatusOK {
+			t.Errorf("Expected the new key accepted, got %d", w.Code)
+		}
+	})
+
+	t.Run("wrong_proof", func(t *testing.T) {
+		deviceUUID := newDevice(t, "wrong")
+		if w := rotate(t, deviceUUID, "old-key", "new-key", "some-other-key"); w.Code != http.StatusUnauthorized {
+			t.Fatalf("Expected 401 for a bad proof, got %d", w.Code)
+		}
+		if key, _ := client.GetDevicePublicKey(ctx, deviceUUID); key != "old-key" {
+			t.Errorf("Expected the old key kept, got %q", key)
+		}
+	})
+
+	t.Logf("✓ Key rotation requires proof of the new key")
+}
+
+func TestCreateChat_RequestIDIdempotent(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-chat-request-" + time.Now().Format("150405.000000")
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	create := func(requestID string) (string, string) {
+		w := doSigned(router, http.MethodPost, "/chat/create", deviceUUID, "test-key", gin.H{
+			"ttl":                60,
+			"participant_id":     "p-" + requestID,
+			"participant_secret": "s-" + requestID,
+			"request_id":         requestID,
+		})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			ChatUUID        string `json:"chat_uuid"`
+			InvitationToken string `json:"invitation_token"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.ChatUUID, resp.InvitationToken
+	}
+
+	firstChat, firstToken := create("req-1")
+	retryChat, retryToken := create("req-1")
+	if retryChat != firstChat || retryToken != firstToken {
+		t.Errorf("Expected the retry to return chat %s/%s, got %s/%s", firstChat, firstToken, retryChat, retryToken)
+	}
+	if chats, _ := client.GetUserChats(ctx, deviceUUID); len(chats) != 1 {
+		t.Errorf("Expected one chat stored, got %d", len(chats))
+	}
+
+	if otherChat, _ := create("req-2"); otherChat == firstChat {
+		t.Error("Expected a new request ID to create a new chat")
+	}
+
+	t.Logf("✓ Chat creation retried with the same request ID returns the same chat")
+}
+
+func TestErrorCodes(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	deviceUUID := "test-errcode-" + suffix
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	// A chat the test device isn't part of
+	otherChat := "test-errcode-chat-" + suffix
+	if err := client.CreateChat(ctx, otherChat, "pa", "sa", "test-errcode-other-"+suffix, "test-errcode-inv-"+suffix, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, otherChat)
+
+	signed := func(method, path string, body any) func() *httptest.ResponseRecorder {
+		return func() *httptest.ResponseRecorder {
+			return doSigned(router, method, path, deviceUUID, "test-key", body)
+		}
+	}
+	public := func(method, path string, body any) func() *httptest.ResponseRecorder {
+		return func() *httptest.ResponseRecorder {
+			return doJSON(router, method, path, "", body)
+		}
+	}
+	creds := gin.H{"participant_id": "px", "participant_secret": "sx"}
+
+	cases := []struct {
+		name   string
+		do     func() *httptest.ResponseRecorder
+		status int
+		code   errcode.Code
+	}{
+		{"invalid_request", public(http.MethodPost, "/activation/validate", gin.H{}), http.StatusBadRequest, errcode.InvalidRequest},
+		{"code_not_found", public(http.MethodPost, "/activation/validate", gin.H{"code": "NOPE-" + suffix}), http.StatusNotFound, errcode.CodeNotFound},
+		{"claim_not_found", public(http.MethodPost, "/activation/claim", gin.H{"code": "NOPE-" + suffix, "device_uuid": "d", "public_key": "k"}), http.StatusBadRequest, errcode.CodeNotFound},
+		{"not_authenticated", public(http.MethodGet, "/chat/list", nil), http.StatusUnauthorized, errcode.NotAuthenticated},
+		{"device_unknown", func() *httptest.ResponseRecorder {
+			return doSigned(router, http.MethodGet, "/chat/list", "test-errcode-unknown-"+suffix, "test-key", nil)
+		}, http.StatusUnauthorized, errcode.DeviceUnknown},
+		{"invalid_signature", func() *httptest.ResponseRecorder {
+			return doSigned(router, http.MethodGet, "/chat/list", deviceUUID, "wrong-key", nil)
+		}, http.StatusUnauthorized, errcode.InvalidSignature},
+		{"invalid_ttl", signed(http.MethodPost, "/chat/create", gin.H{"ttl": 7, "participant_id": "p", "participant_secret": "s"}), http.StatusBadRequest, errcode.InvalidTTL},
+		{"invalid_max_participants", signed(http.MethodPost, "/chat/create", gin.H{"ttl": 60, "participant_id": "p", "participant_secret": "s", "max_participants": 99}), http.StatusBadRequest, errcode.InvalidMaxParticipants},
+		{"invitation_not_found", signed(http.MethodPost, "/chat/join", gin.H{"invitation_token": "nope-" + suffix, "participant_id": "p", "participant_secret": "s"}), http.StatusBadRequest, errcode.InvitationNotFound},
+		{"chat_not_found", signed(http.MethodDelete, "/chat/nope-"+suffix, creds), http.StatusNotFound, errcode.ChatNotFound},
+		{"not_participant", signed(http.MethodDelete, "/chat/"+otherChat, creds), http.StatusForbidden, errcode.NotParticipant},
+		{"keys_not_found", signed(http.MethodGet, "/keys/nope-"+suffix, nil), http.StatusNotFound, errcode.KeysNotFound},
+		{"key_unchanged", signed(http.MethodPost, "/device/rotate-key", gin.H{"new_public_key": "test-key", "challenge": "c", "timestamp": time.Now().Unix(), "signature": "s"}), http.StatusBadRequest, errcode.KeyUnchanged},
+		{"challenge_invalid", signed(http.MethodPost, "/device/rotate-key", gin.H{"new_public_key": "new-key", "challenge": "c", "timestamp": time.Now().Unix(), "signature": "s"}), http.StatusUnauthorized, errcode.ChallengeInvalid},
+		{"invalid_admin_token", func() *httptest.ResponseRecorder {
+			return doJSON(router, http.MethodPost, "/admin/codes", "wrong-token", gin.H{"plan": "1_week_solo", "count": 1})
+		}, http.StatusUnauthorized, errcode.InvalidAdminToken},
+		{"invalid_plan", func() *httptest.ResponseRecorder {
+			return doJSON(router, http.MethodPost, "/admin/codes", testAdminToken, gin.H{"plan": "forever", "count": 1})
+		}, http.StatusBadRequest, errcode.InvalidPlan},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := tc.do()
+			var resp struct {
+				Error string       `json:"error"`
+				Code  errcode.Code `json:"code"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != tc.status || resp.Code != tc.code {
+				t.Errorf("Expected %d %s, got %d %s: %s", tc.status, tc.code, w.Code, resp.Code, w.Body.String())
+			}
+			if resp.Error == "" {
+				t.Error("Expected human-readable error text alongside the code")
+			}
+		})
+	}
+
+	t.Logf("✓ Every error path carries its stable code")
+}
+
+func TestGetChatStatus_ParticipantsOnly(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-status-" + suffix
+	token := "test-chat-status-token-" + suffix
+	devices := map[string]string{
+		"creator":  "test-chat-status-a-" + suffix,
+		"joiner":   "test-chat-status-b-" + suffix,
+		"stranger": "test-chat-status-c-" + suffix,
+	}
+	for _, deviceUUID := range devices {
+		if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Failed to create subscription: %v", err)
+		}
+		defer client.PurgeDevice(ctx, deviceUUID)
+	}
+
+	if err := client.CreateChat(ctx, chatUUID, "pa", "sa", devices["creator"], token, 300, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	if _, _, err := client.JoinChat(ctx, token, devices["joiner"], "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	for role, want := range map[string]string{"creator": "a", "joiner": "b"} {
+		w := doSigned(router, http.MethodGet, "/chat/"+chatUUID, devices[role], "test-key", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for the %s, got %d: %s", role, w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		if resp["status"] != "active" || resp["ttl_seconds"] != float64(300) || resp["participant"] != want {
+			t.Errorf("Unexpected status for the %s: %v", role, resp)
+		}
+		if remaining, _ := resp["remaining_seconds"].(float64); remaining <= 0 || remaining > 300 {
+			t.Errorf("Expected time remaining within the TTL, got %v", resp["remaining_seconds"])
+		}
+	}
+
+	w := doSigned(router, http.MethodGet, "/chat/"+chatUUID, devices["stranger"], "test-key", nil)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected 403 for a non-participant, got %d", w.Code)
+	}
+
+	// The static route still wins over the parameter
+	if w := doSigned(router, http.MethodGet, "/chat/list", devices["creator"], "test-key", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected /chat/list still served, got %d", w.Code)
+	}
+
+	t.Logf("✓ Chat status served to participants and refused to others")
+}
+
+func TestAttachments_ChatScoped(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-attach-" + suffix
+	otherChat := "test-attach-other-" + suffix
+	devices := map[string]string{
+		"creator":  "test-attach-a-" + suffix,
+		"joiner":   "test-attach-b-" + suffix,
+		"stranger": "test-attach-c-" + suffix,
+	}
+	for _, deviceUUID := range devices {
+		if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Failed to create subscription: %v", err)
+		}
+		defer client.PurgeDevice(ctx, deviceUUID)
+	}
+
+	if err := client.CreateChat(ctx, chatUUID, "pa", "sa", devices["creator"], "token-"+chatUUID, 300, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	if _, _, err := client.JoinChat(ctx, "token-"+chatUUID, devices["joiner"], "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	if err := client.CreateChat(ctx, otherChat, "pc", "sc", devices["creator"], "token-"+otherChat, 300, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, otherChat)
+
+	// Disabled until a storage backend is installed
+	if w := doSigned(router, http.MethodPost, "/chat/"+chatUUID+"/attachments", devices["creator"], "test-key", nil); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 without a backend, got %d", w.Code)
+	}
+	storage.SetBackend(storage.NewMemory())
+	t.Cleanup(func() { storage.SetBackend(nil) })
+
+	w := doSigned(router, http.MethodPost, "/chat/"+chatUUID+"/attachments", devices["creator"], "test-key", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var created struct {
+		AttachmentID string `json:"attachment_id"`
+		UploadURL    string `json:"upload_url"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &created)
+	if created.AttachmentID == "" || !strings.Contains(created.UploadURL, chatUUID) {
+		t.Fatalf("Unexpected attachment: %s", w.Body.String())
+	}
+
+	cases := []struct {
+		name   string
+		chat   string
+		id     string
+		device string
+		status int
+	}{
+		{"other_participant", chatUUID, created.AttachmentID, devices["joiner"], http.StatusOK},
+		{"stranger", chatUUID, created.AttachmentID, devices["stranger"], http.StatusForbidden},
+		{"other_chat", otherChat, created.AttachmentID, devices["creator"], http.StatusNotFound},
+		{"unknown", chatUUID, "no-such-attachment", devices["creator"], http.StatusNotFound},
+	}
+	for _, tc := range cases {
+		w := doSigned(router, http.MethodGet, "/chat/"+tc.chat+"/attachments/"+tc.id, tc.device, "test-key", nil)
+		if w.Code != tc.status {
+			t.Errorf("%s: expected %d, got %d: %s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+	}
+
+	t.Logf("✓ Attachment references are issued and resolved within their chat only")
+}
+
+func TestDeviceAuth_UnknownVsKeyExpired(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	subscribed := "test-key-expired-" + suffix
+	if _, err := client.RestoreSubscription(ctx, subscribed, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, subscribed)
+
+	purged := "test-key-purged-" + suffix
+	if _, err := client.RestoreSubscription(ctx, purged, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	client.PurgeDevice(ctx, purged)
+
+	// Subscribed, but the key is gone
+	client.GetRedis().Del(ctx, "pubkey:"+subscribed)
+
+	cases := []struct {
+		name       string
+		deviceUUID string
+		code       errcode.Code
+	}{
+		{"never_registered", "test-key-unknown-" + suffix, errcode.DeviceUnknown},
+		{"purged", purged, errcode.DeviceUnknown},
+		{"key_expired", subscribed, errcode.KeyExpired},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := doSigned(router, http.MethodGet, "/chat/list", tc.deviceUUID, "test-key", nil)
+			var resp map[string]interface{}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+			if w.Code != http.StatusUnauthorized || resp["code"] != string(tc.code) {
+				t.Errorf("Expected 401 %s, got %d %v", tc.code, w.Code, resp)
+			}
+		})
+	}
+
+	t.Logf("✓ Unknown devices and expired keys reported apart")
+}
+
+func TestHealth_ReportsDependencies(t *testing.T) {
+	client, _ := setupTestRouter(t)
+	cfg := &config.Config{CORSOrigins: "https://nihil.app", MaxChatParticipants: 8}
+	h := NewHandlers(client, ws.NewHub(client, cfg, logging.Discard()), cfg, logging.Discard())
+
+	router := gin.New()
+	router.GET("/health", h.Health)
+
+	cases := []struct {
+		name        string
+		push        bool
+		stripe      bool
+		wantStatus  string
+		wantFCM     string
+		wantBilling string
+	}{
+		{"healthy", true, true, "ok", "initialized", "configured"},
+		{"push_disabled", false, true, "degraded", "disabled", "configured"},
+		{"stripe_disabled", true, false, "degraded", "initialized", "disabled"},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			h.pushReady = func() bool { return tc.push }
+			h.stripeReady = func() bool { return tc.stripe }
+
+			w := doJSON(router, http.MethodGet, "/health", "", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Status       string            `json:"status"`
+				Version      string            `json:"version"`
+				Dependencies map[string]string `json:"dependencies"`
+				Push         map[string]any    `json:"push"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &resp)
+
+			if resp.Status != tc.wantStatus {
+				t.Errorf("expected status %q, got %q", tc.wantStatus, resp.Status)
+			}
+			if resp.Version != buildinfo.Version {
+				t.Errorf("expected version %q, got %q", buildinfo.Version, resp.Version)
+			}
+			if resp.Dependencies["redis"] != "ok" || resp.Dependencies["firebase"] != tc.wantFCM || resp.Dependencies["stripe"] != tc.wantBilling {
+				t.Errorf("unexpected dependencies: %v", resp.Dependencies)
+			}
+			if _, ok := resp.Push["token_refreshes"]; !ok {
+				t.Errorf("expected push.token_refreshes, got %v", resp.Push)
+			}
+		})
+	}
+	t.Logf("✓ /health reports dependency status and degrades on optional outages")
+}
+
+func TestDeviceAuth_TimestampWindow(t *testing.T) {
+	client, router := setupTestRouter(t)
+	client.SetAuthWindow(60 * time.Second)
+	t.Cleanup(func() { client.SetAuthWindow(redisdb.DefaultAuthWindow) })
+	ctx := context.Background()
+
+	deviceUUID := "test-auth-window-" + time.Now().Format("150405.000000")
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	// Ahead of the clock, so a second ticking over mid-test can only move it back inside
+	if w := doSignedAt(router, http.MethodGet, "/chat/list", deviceUUID, "test-key", time.Now().Unix()+60, nil); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 at the edge of the window, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w := doSignedAt(router, http.MethodGet, "/chat/list", deviceUUID, "test-key", time.Now().Unix()-61, nil)
+	var resp map[string]interface{}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if w.Code != http.StatusUnauthorized || resp["code"] != string(errcode.TimestampExpired) {
+		t.Errorf("Expected 401 %s one second past the window, got %d: %s", errcode.TimestampExpired, w.Code, w.Body.String())
+	}
+
+	t.Logf("✓ Signed requests honour the configured timestamp window")
+}
+
+func TestDeviceSessions_ListAndClose(t *testing.T) {
+	client, err := redisdb.NewClient("redis://localhost:6379")
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+	ctx := context.Background()
+
+	// The hub has to run for /ws to register connections
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	cfg := &config.Config{
+		CORSOrigins:         "https://nihil.app",
+		RateLimitPerMinute:  120,
+		MaxChatParticipants: 8,
+	}
+	hub := ws.NewHub(client, cfg, logging.Discard())
+	go hub.Run()
+	SetupRoutes(router, client, hub, cfg, logging.Discard())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	deviceUUID := "test-sessions-" + time.Now().Format("150405.000000")
+	key := "test-sessions-key"
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, key, "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	connect := func() *websocket.Conn {
+		dialer := websocket.Dialer{Subprotocols: ws.Subprotocols}
+		conn, _, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws",
+			http.Header{"Origin": {"https://nihil.app"}})
+		if err != nil {
+			t.Fatalf("Failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		timestamp := time.Now().Unix()
+		nonce := uuid.New().String()
+		conn.WriteJSON(ws.WSMessage{Type: ws.TypeAuth, Payload: ws.AuthPayload{
+			DeviceUUID:      deviceUUID,
+			Timestamp:       timestamp,
+			Nonce:           nonce,
+			Signature:       computeSignature(key, deviceUUID, timestamp, nonce),
+			ProtocolVersion: ws.MaxProtocolVersion,
+		}})
+		var msg ws.WSMessage
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != ws.TypeAuthSuccess {
+			t.Fatalf("Expected %s, got %s (%v)", ws.TypeAuthSuccess, msg.Type, err)
+		}
+		return conn
+	}
+	list := func() []redisdb.DeviceSession {
+		w := doSigned(router, http.MethodGet, "/device/sessions", deviceUUID, key, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp struct {
+			Sessions []redisdb.DeviceSession `json:"sessions"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp.Sessions
+	}
+
+	conns := []*websocket.Conn{connect(), connect()}
+
+	sessions := list()
+	if len(sessions) != 2 {
+		t.Fatalf("Expected 2 sessions, got %d", len(sessions))
+	}
+	for _, s := range sessions {
+		if s.ID == "" || s.InstanceID == "" || s.ConnectedAt.IsZero() || s.ProtocolVersion != ws.MaxProtocolVersion {
+			t.Errorf("Expected full session metadata, got %+v", s)
+		}
+	}
+	if sessions[0].ID == sessions[1].ID {
+		t.Error("Expected each connection to have its own session ID")
+	}
+
+	if w := doSigned(router, http.MethodDelete, "/device/sessions", deviceUUID, key, nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg ws.WSMessage
+		if err := conn.ReadJSON(&msg); err != nil || msg.Type != ws.TypeError {
+			t.Fatalf("Connection %d: expected a closing notice, got %s (%v)", i, msg.Type, err)
+		}
+		if payload, _ := msg.Payload.(map[string]interface{}); payload["code"] != string(errcode.SessionsRevoked) {
+			t.Errorf("Connection %d: expected %s, got %v", i, errcode.SessionsRevoked, payload["code"])
+		}
+		if err := conn.ReadJSON(&msg); err == nil {
+			t.Errorf("Connection %d: expected it closed, got %s", i, msg.Type)
+		}
+	}
+
+	if sessions := list(); len(sessions) != 0 {
+		t.Errorf("Expected no sessions after closing them, got %d", len(sessions))
+	}
+
+	t.Logf("✓ Device sessions listed with metadata and closed on request")
+}
+
+// testSignalIdentity returns an Ed25519 key pair and its Curve25519 form as a client serializes it
+func testSignalIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey, string) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// u = (1 + y) / (1 - y), little-endian on the wire
+	p := new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+	le := func(b []byte) []byte {
+		r := make([]byte, len(b))
+		for i := range b {
+			r[i] = b[len(b)-1-i]
+		}
+		return r
+	}
+	yBytes := make([]byte, 32)
+	copy(yBytes, pub)
+	yBytes[31] &= 0x7F
+	y := new(big.Int).SetBytes(le(yBytes))
+	denominator := new(big.Int).Mod(new(big.Int).Sub(big.NewInt(1), y), p)
+	u := new(big.Int).Mul(new(big.Int).Add(big.NewInt(1), y), new(big.Int).ModInverse(denominator, p))
+	u.Mod(u, p)
+	uBytes := make([]byte, 32)
+	u.FillBytes(uBytes)
+
+	return pub, priv, base64.StdEncoding.EncodeToString(append([]byte{0x05}, le(uBytes)...))
+}
+
+// testSignedPreKey makes a signed prekey signed by identity, the way libsignal does
+func testSignedPreKey(pub ed25519.PublicKey, priv ed25519.PrivateKey, id int) SignedPreKeyData {
+	spk := make([]byte, 33)
+	spk[0] = 0x05
+	rand.Read(spk[1:])
+	sig := ed25519.Sign(priv, spk)
+	sig[63] |= pub[31] & 0x80
+	return SignedPreKeyData{
+		ID:        id,
+		PublicKey: base64.StdEncoding.EncodeToString(spk),
+		Signature: base64.StdEncoding.EncodeToString(sig),
+	}
+}
+
+func TestUpdateSignedPreKey(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-spk-" + time.Now().Format("150405.000000")
+	key := "test-spk-key"
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, key, "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	pub, priv, identity := testSignalIdentity(t)
+	first := testSignedPreKey(pub, priv, 1)
+	err := client.StoreKeyBundle(ctx, deviceUUID, 1, identity,
+		redisdb.SignedPreKey{ID: first.ID, PublicKey: first.PublicKey, Signature: first.Signature},
+		[]redisdb.PreKey{{ID: 1, PublicKey: "pk1"}, {ID: 2, PublicKey: "pk2"}, {ID: 3, PublicKey: "pk3"}})
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+
+	// Signed by some other identity
+	otherPub, otherPriv, _ := testSignalIdentity(t)
+	forged := testSignedPreKey(otherPub, otherPriv, 2)
+	w := doSigned(router, http.MethodPost, "/keys/signed-prekey", deviceUUID, key, gin.H{"signed_prekey": forged})
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), string(errcode.InvalidPreKeySignature)) {
+		t.Fatalf("Expected 400 %s for a bad signature, got %d: %s", errcode.InvalidPreKeySignature, w.Code, w.Body.String())
+	}
+
+	rotated := testSignedPreKey(pub, priv, 2)
+	w = doSigned(router, http.MethodPost, "/keys/signed-prekey", deviceUUID, key, gin.H{"signed_prekey": rotated})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	if count, _ := client.GetPreKeyCount(ctx, deviceUUID); count != 3 {
+		t.Errorf("Expected the 3 one-time prekeys kept, got %d", count)
+	}
+	bundle, err := client.GetKeyBundle(ctx, deviceUUID)
+	if err != nil || bundle == nil {
+		t.Fatalf("Failed to get key bundle: %v", err)
+	}
+	if bundle.SignedPreKey.ID != 2 || bundle.SignedPreKey.PublicKey != rotated.PublicKey || bundle.IdentityKey != identity {
+		t.Errorf("Expected only the signed prekey replaced, got %+v", bundle)
+	}
+
+	// No bundle to rotate in
+	otherDevice := deviceUUID + "-nokeys"
+	if _, err := client.RestoreSubscription(ctx, otherDevice, key, "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, otherDevice)
+	if w := doSigned(router, http.MethodPost, "/keys/signed-prekey", otherDevice, key, gin.H{"signed_prekey": rotated}); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 without a bundle, got %d", w.Code)
+	}
+
+	t.Logf("✓ Signed prekey rotated without touching one-time prekeys")
+}
+
+func TestBroadcast_Validation(t *testing.T) {
+	_, router := setupTestRouter(t)
+
+	if w := doJSON(router, http.MethodPost, "/admin/broadcast", "", gin.H{"text": "Deploying"}); w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401 without admin token, got %d", w.Code)
+	}
+	if w := doJSON(router, http.MethodPost, "/admin/broadcast", testAdminToken, gin.H{"text": "Deploying", "severity": "urgent"}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown severity, got %d", w.Code)
+	}
+	if w := doJSON(router, http.MethodPost, "/admin/broadcast", testAdminToken, gin.H{"text": strings.Repeat("x", maxAnnouncementLength+1)}); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an overlong text, got %d", w.Code)
+	}
+
+	w := doJSON(router, http.MethodPost, "/admin/broadcast", testAdminToken, gin.H{"text": "Deploying", "severity": "warning"})
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	t.Logf("✓ Broadcast requires the admin token and a valid announcement")
+}
+
+func TestVersion_ReportsBuildInfo(t *testing.T) {
+	defer func(version, commit, buildTime string) {
+		buildinfo.Version, buildinfo.Commit, buildinfo.BuildTime = version, commit, buildTime
+	}(buildinfo.Version, buildinfo.Commit, buildinfo.BuildTime)
+	buildinfo.Version = "1.2.3"
+	buildinfo.Commit = "abc1234"
+	buildinfo.BuildTime = "2026-10-01T12:00:00Z"
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/version", (&Handlers{}).Version)
+
+	w := doJSON(router, http.MethodGet, "/version", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var resp buildinfo.Info
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	want := buildinfo.Info{Version: "1.2.3", Commit: "abc1234", BuildTime: "2026-10-01T12:00:00Z", GoVersion: runtime.Version()}
+	if resp != want {
+		t.Errorf("Expected %+v, got %+v", want, resp)
+	}
+
+	t.Logf("✓ /version reports the injected build info")
+}
+
+func TestTime_ReportsServerClock(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.GET("/time", (&Handlers{}).Time)
+
+	before := time.Now()
+	w := doJSON(router, http.MethodGet, "/time", "", nil)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+	var resp struct {
+		Unix   int64 `json:"unix"`
+		UnixMs int64 `json:"unix_ms"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("Invalid response: %v", err)
+	}
+	if resp.UnixMs < before.UnixMilli() || resp.UnixMs > time.Now().UnixMilli() {
+		t.Errorf("Expected unix_ms to be the server's clock, got %d", resp.UnixMs)
+	}
+	if resp.Unix != resp.UnixMs/1000 {
+		t.Errorf("Expected unix %d to match unix_ms, got %d", resp.UnixMs/1000, resp.Unix)
+	}
+
+	t.Logf("✓ /time reports the server's clock")
+}
+
+func TestDeviceAuth_TimestampExpiredReportsServerTime(t *testing.T) {
+	_, router := setupTestRouter(t)
+
+	deviceUUID := "test-skew-" + time.Now().Format("150405.000000")
+	w := doSignedAt(router, http.MethodGet, "/device/sessions", deviceUUID, "key", time.Now().Add(-time.Hour).Unix(), nil)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("Expected 401, got %d", w.Code)
+	}
+	var resp struct {
+		Code       string `json:"code"`
+		ServerTime int64  `json:"server_time"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &resp)
+	if resp.Code != string(errcode.TimestampExpired) {
+		t.Fatalf("Expected %s, got %s", errcode.TimestampExpired, resp.Code)
+	}
+	if skew := time.Now().Unix() - resp.ServerTime; skew < 0 || skew > 1 {
+		t.Errorf("Expected server_time to be the server's clock, got %d", resp.ServerTime)
+	}
+
+	t.Logf("✓ An expired timestamp over HTTP tells the device the server's time")
+}
+
+// fakeVerifier accepts the single proof it was given
+type fakeVerifier struct {
+	proof     string
+	expiresAt time.Time
+	err       error
+}
+
+func (f fakeVerifier) Verify(ctx context.Context, proof string) (string, string, time.Time, error) {
+	if f.err != nil {
+		return "", "", time.Time{}, f.err
+	}
+	if proof != f.proof {
+		return "", "", time.Time{}, errInvalidPurchase
+	}
+	return "1_week_solo", "solo", f.expiresAt, nil
+}
+
+func TestRestoreSubscription_DispatchesToVerifier(t *testing.T) {
+	client, _ := setupTestRouter(t)
+	cfg := &config.Config{CORSOrigins: "https://nihil.app", MaxChatParticipants: 8}
+	h := NewHandlers(client, ws.NewHub(client, cfg, logging.Discard()), cfg, logging.Discard())
+	ctx := context.Background()
+
+	router := gin.New()
+	router.POST("/subscription/restore", h.RestoreSubscription)
+
+	deviceUUID := "test-restore-receipt-" + time.Now().Format("150405.000000")
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	h.verifiers[ProviderApple] = fakeVerifier{proof: "receipt-ok", expiresAt: expiresAt}
+	h.verifiers[ProviderGoogle] = fakeVerifier{err: errPaymentNotCompleted}
+
+	// Stripe still reports a refunded session as paid
+	refundedSession := "cs_test_refunded_" + time.Now().Format("150405.000000")
+	h.verifiers[ProviderStripe] = fakeVerifier{proof: refundedSession, expiresAt: expiresAt}
+	if err := client.MarkSessionRevoked(ctx, refundedSession); err != nil {
+		t.Fatalf("Failed to mark session revoked: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		body     gin.H
+		wantCode int
+		wantErr  errcode.Code
+	}{
+		{"unknown_provider", gin.H{"provider": "paypal", "receipt": "x"}, http.StatusBadRequest, errcode.InvalidRequest},
+		{"missing_receipt", gin.H{"provider": ProviderApple, "session_id": "receipt-ok"}, http.StatusBadRequest, errcode.InvalidRequest},
+		{"rejected_receipt", gin.H{"provider": ProviderApple, "receipt": "forged"}, http.StatusBadRequest, errcode.InvalidSession},
+		{"unpaid", gin.H{"provider": ProviderGoogle, "receipt": "pending"}, http.StatusBadRequest, errcode.PaymentNotCompleted},
+		{"refunded_session", gin.H{"session_id": refundedSession}, http.StatusBadRequest, errcode.PaymentRevoked},
+		{"restored", gin.H{"provider": ProviderApple, "receipt": "receipt-ok"}, http.StatusOK, ""},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.body["device_uuid"] = deviceUUID
+			tc.body["public_key"] = "test-key"
+			w := doJSON(router, http.MethodPost, "/subscription/restore", "", tc.body)
+			if w.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tc.wantCode, w.Code, w.Body.String())
+			}
+			if tc.wantErr != "" && !strings.Contains(w.Body.String(), string(tc.wantErr)) {
+				t.Errorf("expected code %s, got %s", tc.wantErr, w.Body.String())
+			}
+		})
+	}
+
+	sub, err := client.GetSubscription(ctx, deviceUUID)
+	if err != nil {
+		t.Fatalf("Expected a restored subscription: %v", err)
+	}
+	if sub.Plan != "1_week_solo" || !sub.ExpiresAt.Equal(expiresAt) {
+		t.Errorf("Expected the verifier's plan and expiry, got %s until %v", sub.Plan, sub.ExpiresAt)
+	}
+
+	t.Logf("✓ Restore dispatches to the provider's verifier and maps its errors")
+}
+
+func TestReplenishKeys_ValidatesPreKeys(t *testing.T) {
+	client, router := setupTestRouter(t)
+	client.SetMaxPreKeys(5)
+	t.Cleanup(func() { client.SetMaxPreKeys(0) })
+	ctx := context.Background()
+
+	deviceUUID := "test-prekeys-" + time.Now().Format("150405.000000")
+	key := "test-prekeys-key"
+	if _, err := client.RestoreSubscription(ctx, deviceUUID, key, "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	err := client.StoreKeyBundle(ctx, deviceUUID, 1, "identity", redisdb.SignedPreKey{ID: 1, PublicKey: "spk", Signature: "sig"},
+		[]redisdb.PreKey{{ID: 1, PublicKey: "pk1"}, {ID: 2, PublicKey: "pk2"}, {ID: 3, PublicKey: "pk3"}})
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+
+	cases := []struct {
+		name     string
+		prekeys  []PreKeyData
+		wantCode int
+		wantErr  errcode.Code
+	}{
+		{"duplicate_id", []PreKeyData{{ID: 4, PublicKey: "pk4"}, {ID: 4, PublicKey: "pk4b"}}, http.StatusBadRequest, errcode.DuplicatePreKeyID},
+		{"zero_id", []PreKeyData{{ID: 0, PublicKey: "pk0"}}, http.StatusBadRequest, errcode.InvalidPreKeyID},
+		{"negative_id", []PreKeyData{{ID: -7, PublicKey: "pk-7"}}, http.StatusBadRequest, errcode.InvalidPreKeyID},
+		{"up_to_cap", []PreKeyData{{ID: 3, PublicKey: "pk3b"}, {ID: 4, PublicKey: "pk4"}, {ID: 5, PublicKey: "pk5"}}, http.StatusOK, ""},
+		{"over_cap", []PreKeyData{{ID: 6, PublicKey: "pk6"}}, http.StatusBadRequest, errcode.TooManyPreKeys},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			w := doSigned(router, http.MethodPost, "/keys/replenish", deviceUUID, key, gin.H{"prekeys": tc.prekeys})
+			if w.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d: %s", tc.wantCode, w.Code, w.Body.String())
+			}
+			if tc.wantErr != "" && !strings.Contains(w.Body.String(), string(tc.wantErr)) {
+				t.Errorf("expected code %s, got %s", tc.wantErr, w.Body.String())
+			}
+		})
+	}
+
+	// Rejected requests stored nothing; replacing ID 3 didn't count toward the cap
+	if count, _ := client.GetPreKeyCount(ctx, deviceUUID); count != 5 {
+		t.Errorf("Expected 5 prekeys stored, got %d", count)
+	}
+
+	t.Logf("✓ Prekey IDs must be positive and unique, and the per-device cap holds")
+}
+
+func TestGetDeviceStanding(t *testing.T) {
+	client, router := setupTestRouter(t)
+	ctx := context.Background()
+
+	newDevice := func(t *testing.T, name string) string {
+		deviceUUID := "test-standing-" + name + "-" + time.Now().Format("150405.000000")
+		if _, err := client.RestoreSubscription(ctx, deviceUUID, "standing-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+			t.Fatalf("Failed to create subscription: %v", err)
+		}
+		t.Cleanup(func() {
+			client.Unban(ctx, deviceUUID)
+			client.PurgeDevice(ctx, deviceUUID)
+		})
+		return deviceUUID
+	}
+
+	standing := func(t *testing.T, deviceUUID string) map[string]interface{} {
+		w := doSigned(router, http.MethodGet, "/device/standing", deviceUUID, "standing-key", nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var resp map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+		return resp
+	}
+
+	t.Run("clean", func(t *testing.T) {
+		resp := standing(t, newDevice(t, "clean"))
+		if resp["status"] != StandingClean {
+			t.Errorf("Expected clean standing, got %v", resp)
+		}
+	})
+
+	t.Run("warned", func(t *testing.T) {
+		deviceUUID := newDevice(t, "warned")
+		client.AddWarning(ctx, deviceUUID, "spam detected")
+
+		resp := standing(t, deviceUUID)
+		if resp["status"] != StandingWarned || resp["warnings"] != float64(1) || resp["reason"] != "spam detected" {
+			t.Errorf("Expected one warning for spam, got %v", resp)
+		}
+		if expiresIn, _ := resp["expires_in"].(float64); expiresIn <= 0 || expiresIn > redisdb.WarningExpiry.Seconds() {
+			t.Errorf("Expected the warning to lapse within %v, got %v", redisdb.WarningExpiry, resp["expires_in"])
+		}
+	})
+
+	t.Run("banned", func(t *testing.T) {
+		deviceUUID := newDevice(t, "banned")
+		if err := client.BanDevice(ctx, deviceUUID, "flooding", time.Hour); err != nil {
+			t.Fatalf("Failed to ban device: %v", err)
+		}
+
+		// Locked out everywhere else
+		if w := doSigned(router, http.MethodGet, "/device/sessions", deviceUUID, "standing-key", nil); w.Code != http.StatusForbidden {
+			t.Fatalf("Expected 403 for a banned device, got %d", w.Code)
+		}
+
+		resp := standing(t, deviceUUID)
+		if resp["status"] != StandingBanned || resp["reason"] != "flooding" || resp["permanent"] != false {
+			t.Errorf("Expected a temporary ban for flooding, got %v", resp)
+		}
+		if expiresIn, _ := resp["expires_in"].(float64); expiresIn <= 0 || expiresIn > time.Hour.Seconds() {
+			t.Errorf("Expected the ban to end within an hour, got %v", resp["expires_in"])
+		}
+	})
+
+	t.Run("bad_signature", func(t *testing.T) {
+		deviceUUID := newDevice(t, "forged")
+		if w := doSigned(router, http.MethodGet, "/device/standing", deviceUUID, "wrong-key", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected 401 for a bad signature, got %d", w.Code)
+		}
+	})
+
+	t.Logf("✓ Devices can read their standing, bans included")
+}
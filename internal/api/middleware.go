@@ -3,7 +3,9 @@ package api
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"net/http"
 	"strconv"
@@ -12,143 +14,241 @@ import (
 
 	"github.com/gin-gonic/gin"
 
+	"nihil/internal/audit"
+	"nihil/internal/errcode"
 	redisdb "nihil/internal/redis"
 )
 
 type Middleware struct {
-	redis *redisdb.Client
+	redis      *redisdb.Client
+	adminToken string
 }
 
-func NewMiddleware(redis *redisdb.Client) *Middleware {
-	return &Middleware{redis: redis}
+func NewMiddleware(redis *redisdb.Client, adminToken string) *Middleware {
+	return &Middleware{redis: redis, adminToken: adminToken}
 }
 
+// DeviceAuth checks a device's signed request, refusing banned devices and lapsed subscriptions
 func (m *Middleware) DeviceAuth() gin.HandlerFunc {
+	return m.deviceAuth(false)
+}
+
+// StandingAuth checks a device's signed request like DeviceAuth but lets banned devices
+// and lapsed subscriptions through, so a locked-out device can still learn why
+func (m *Middleware) StandingAuth() gin.HandlerFunc {
+	return m.deviceAuth(true)
+}
+
+func (m *Middleware) deviceAuth(standing bool) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		deviceUUID := c.GetHeader("X-Device-UUID")
 		timestampStr := c.GetHeader("X-Timestamp")
+		nonce := c.GetHeader("X-Nonce")
 		signature := c.GetHeader("X-Signature")
 
-		if deviceUUID == "" || timestampStr == "" || signature == "" {
+		if deviceUUID == "" || timestampStr == "" || nonce == "" || signature == "" {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "missing_headers")
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "missing authentication headers",
+				"code":  errcode.NotAuthenticated,
 			})
 			return
 		}
 
 		timestamp, err := strconv.ParseInt(timestampStr, 10, 64)
 		if err != nil {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "invalid_timestamp")
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid timestamp",
+				"code":  errcode.InvalidTimestamp,
+			})
+			return
+		}
+
+		if now := time.Now(); !m.redis.TimestampFresh(timestamp, now) {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "timestamp_expired")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error":          "timestamp expired",
+				"code":           errcode.TimestampExpired,
+				"server_time":    now.Unix(),
+				"server_time_ms": now.UnixMilli(),
 			})
 			return
 		}
 
-		now := time.Now().Unix()
-		if abs(now-timestamp) > 300 {
+		if len(nonce) > redisdb.MaxNonceLength {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "invalid_nonce")
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "timestamp expired",
+				"error": "invalid nonce",
+				"code":  errcode.InvalidNonce,
 			})
 			return
 		}
 
 		ctx := c.Request.Context()
 
-		banned, reason, _ := m.redis.IsBanned(ctx, deviceUUID)
-		if banned {
-			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		banned, reason, remaining, _ := m.redis.IsBanned(ctx, deviceUUID)
+		if banned && !standing {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "banned")
+			resp := gin.H{
 				"error":  "device banned",
+				"code":   errcode.DeviceBanned,
 				"reason": reason,
-			})
+			}
+			if remaining > 0 {
+				resp["expires_in"] = int64(remaining.Seconds())
+			}
+			c.AbortWithStatusJSON(http.StatusForbidden, resp)
 			return
 		}
 
-		publicKey, err := m.redis.GetDevicePublicKey(ctx, deviceUUID)
-		if err != nil {
+		publicKey, err := m.redis.LookupDevicePublicKey(ctx, deviceUUID)
+		if errors.Is(err, redisdb.ErrDeviceUnknown) {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "device_unknown")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "device unknown",
+				"code":  errcode.DeviceUnknown,
+			})
+			return
+		}
+		if errors.Is(err, redisdb.ErrKeyExpired) {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "key_expired")
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
-				"error": "device not found",
+				"error": "device key expired",
+				"code":  errcode.KeyExpired,
+			})
+			return
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to verify request",
+				"code":  errcode.Internal,
 			})
 			return
 		}
 
-		expectedSig := computeSignature(publicKey, deviceUUID, timestamp)
+		expectedSig := computeSignature(publicKey, deviceUUID, timestamp, nonce)
 		if signature != expectedSig {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "invalid_signature")
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
 				"error": "invalid signature",
+				"code":  errcode.InvalidSignature,
 			})
 			return
 		}
 
-		active, _ := m.redis.IsSubscriptionActive(ctx, deviceUUID)
-		if !active {
-			c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
-				"error":     "subscription expired",
-				"renew_url": "https://nihil.app",
+		// Only recorded once the signature checks out, so forged requests can't burn nonces
+		fresh, err := m.redis.UseNonce(ctx, deviceUUID, nonce)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{
+				"error": "failed to verify request",
+				"code":  errcode.Internal,
+			})
+			return
+		}
+		if !fresh {
+			audit.Record(audit.EventAuthFailed, deviceUUID, "replayed_nonce")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "replayed request",
+				"code":  errcode.ReplayedRequest,
 			})
 			return
 		}
 
+		if !standing {
+			if active, _ := m.redis.IsSubscriptionActive(ctx, deviceUUID); !active {
+				c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{
+					"error":     "subscription expired",
+					"code":      errcode.SubscriptionExpired,
+					"renew_url": "https://nihil.app",
+				})
+				return
+			}
+		}
+
 		c.Set("device_uuid", deviceUUID)
 		c.Next()
 	}
 }
 
-func (m *Middleware) RateLimit(limit int) gin.HandlerFunc {
+// AdminAuth guards operator endpoints with the configured admin token
+// With no token configured the endpoints don't exist
+func (m *Middleware) AdminAuth() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		deviceUUID := c.GetString("device_uuid")
-		if deviceUUID == "" {
-			c.Next()
+		if m.adminToken == "" {
+			c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "not found", "code": errcode.NotFound})
 			return
 		}
 
-		ctx := c.Request.Context()
-
-		count, allowed, err := m.redis.CheckRateLimit(ctx, deviceUUID, limit)
-		if err != nil {
-			c.Next()
+		token := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(m.adminToken)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "invalid admin token",
+				"code":  errcode.InvalidAdminToken,
+			})
 			return
 		}
 
-		if !allowed {
-			c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
-				"error":   "rate limit exceeded",
-				"current": count,
-				"limit":   limit,
-			})
+		c.Next()
+	}
+}
+
+func (m *Middleware) RateLimit(limit int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		deviceUUID := c.GetString("device_uuid")
+		if deviceUUID == "" {
+			c.Next()
 			return
 		}
 
-		c.Header("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
-		c.Header("X-RateLimit-Remaining", fmt.Sprintf("%d", limit-count))
+		m.rateLimit(c, deviceUUID, limit)
+	}
+}
 
-		c.Next()
+// AdminRateLimit limits operator endpoints - all admin callers share one budget
+func (m *Middleware) AdminRateLimit(limit int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		m.rateLimit(c, "admin", limit)
 	}
 }
 
-func CORS(origins string) gin.HandlerFunc {
-	allowedOrigins := strings.Split(origins, ",")
+func (m *Middleware) rateLimit(c *gin.Context, key string, limit int) {
+	ctx := c.Request.Context()
 
-	return func(c *gin.Context) {
-		origin := c.GetHeader("Origin")
+	count, allowed, retryAfter, err := m.redis.CheckRateLimit(ctx, key, limit)
+	if err != nil {
+		c.Next()
+		return
+	}
 
-		allowed := false
-		for _, o := range allowedOrigins {
-			if strings.TrimSpace(o) == origin {
-				allowed = true
-				break
-			}
-		}
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(redisdb.RetryAfterSeconds(retryAfter)))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+			"error":   "rate limit exceeded",
+			"code":    errcode.RateLimited,
+			"current": count,
+			"limit":   limit,
+		})
+		return
+	}
 
-		if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "http://127.0.0.1:") {
-			allowed = true
-		}
+	c.Header("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
+	c.Header("X-RateLimit-Remaining", fmt.Sprintf("%d", limit-count))
+
+	c.Next()
+}
 
-		if allowed {
+// CORS allows the origins on the allowlist, which may change while running
+// Localhost is only on it in development - in production a page running locally must not reach the API
+func CORS(origins *OriginAllowlist) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origins.Allowed(origin) {
 			c.Header("Access-Control-Allow-Origin", origin)
 		}
 
 		c.Header("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, X-Device-UUID, X-Timestamp, X-Signature")
+		c.Header("Access-Control-Allow-Headers", "Origin, Content-Type, Accept, X-Device-UUID, X-Timestamp, X-Nonce, X-Signature")
 		c.Header("Access-Control-Max-Age", "86400")
 
 		if c.Request.Method == "OPTIONS" {
@@ -167,15 +267,8 @@ func RequestLogger() gin.HandlerFunc {
 	}
 }
 
-func abs(n int64) int64 {
-	if n < 0 {
-		return -n
-	}
-	return n
-}
-
-func computeSignature(key, deviceUUID string, timestamp int64) string {
-	data := fmt.Sprintf("%s:%d", deviceUUID, timestamp)
+func computeSignature(key, deviceUUID string, timestamp int64, nonce string) string {
+	data := fmt.Sprintf("%s:%d:%s", deviceUUID, timestamp, nonce)
 	h := hmac.New(sha256.New, []byte(key))
 	h.Write([]byte(data))
 	return hex.EncodeToString(h.Sum(nil))
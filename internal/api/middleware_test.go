@@ -0,0 +1,148 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"nihil/internal/audit"
+)
+
+func TestCORS_LocalhostOnlyOutsideProduction(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	newRouter := func(allowLocalhost bool) *gin.Engine {
+		router := gin.New()
+		router.Use(CORS(NewOriginAllowlist("https://nihil.app", allowLocalhost)))
+		router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+		return router
+	}
+
+	cases := []struct {
+		name           string
+		allowLocalhost bool
+		origin         string
+		allowed        bool
+	}{
+		{"dev_localhost", true, "http://localhost:3000", true},
+		{"prod_localhost", false, "http://localhost:3000", false},
+		{"prod_loopback", false, "http://127.0.0.1:8080", false},
+		{"prod_configured", false, "https://nihil.app", true},
+		{"dev_other", true, "https://evil.example", false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			router := newRouter(tc.allowLocalhost)
+
+			// The preflight and the request itself must agree
+			for _, method := range []string{http.MethodOptions, http.MethodGet} {
+				req := httptest.NewRequest(method, "/health", nil)
+				req.Header.Set("Origin", tc.origin)
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				got := w.Header().Get("Access-Control-Allow-Origin") == tc.origin
+				if got != tc.allowed {
+					t.Errorf("%s: expected allowed %v, got %v", method, tc.allowed, got)
+				}
+			}
+
+			if NewOriginAllowlist("https://nihil.app", tc.allowLocalhost).Allowed(tc.origin) != tc.allowed {
+				t.Errorf("WebSocket origin check disagrees with CORS for %s", tc.origin)
+			}
+		})
+	}
+
+	t.Logf("✓ Localhost origins allowed in development only")
+}
+
+func TestDeviceAuth_FailuresAudited(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	var buf bytes.Buffer
+	audit.SetSink(audit.NewJSONSink(&buf))
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	// Both failures are caught before Redis is consulted
+	router := gin.New()
+	router.Use(NewMiddleware(nil, "").DeviceAuth())
+	router.GET("/me", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	deviceUUID := "9c3b2a51-7e0d-4c86-b1f4-2d6e8a0f3c17"
+	cases := []struct {
+		reason  string
+		headers map[string]string
+	}{
+		{"missing_headers", map[string]string{"X-Device-UUID": deviceUUID}},
+		{"invalid_timestamp", map[string]string{
+			"X-Device-UUID": deviceUUID,
+			"X-Timestamp":   "yesterday",
+			"X-Nonce":       "nonce",
+			"X-Signature":   "sig",
+		}},
+	}
+	for _, tc := range cases {
+		buf.Reset()
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		for k, v := range tc.headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", tc.reason, w.Code)
+		}
+
+		var e audit.Event
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Fatalf("%s: expected one audit event, got %q", tc.reason, buf.String())
+		}
+		if e.Type != audit.EventAuthFailed || e.Reason != tc.reason {
+			t.Errorf("Expected auth_failed for %s, got %+v", tc.reason, e)
+		}
+		if e.Device != audit.HashDevice(deviceUUID) || strings.Contains(buf.String(), deviceUUID) {
+			t.Errorf("%s: expected only the hashed device ID, got %s", tc.reason, buf.String())
+		}
+	}
+
+	t.Logf("✓ HTTP auth failures audited by reason with a hashed device ID")
+}
+
+func TestRateLimit_RetryAfterHeader(t *testing.T) {
+	client, _ := setupTestRouter(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-retry-after-" + time.Now().Format("150405.000000")
+	defer client.PurgeDevice(ctx, deviceUUID)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) { c.Set("device_uuid", deviceUUID) })
+	router.Use(NewMiddleware(client, "").RateLimit(2))
+	router.GET("/me", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	for i := 0; i < 2; i++ {
+		if w := doJSON(router, http.MethodGet, "/me", "", nil); w.Code != http.StatusOK {
+			t.Fatalf("Expected request %d allowed, got %d", i+1, w.Code)
+		}
+	}
+
+	w := doJSON(router, http.MethodGet, "/me", "", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("Expected 429, got %d", w.Code)
+	}
+	retry, err := strconv.Atoi(w.Header().Get("Retry-After"))
+	if err != nil || retry < 58 || retry > 60 {
+		t.Errorf("Expected Retry-After close to 60 seconds, got %q", w.Header().Get("Retry-After"))
+	}
+
+	t.Logf("✓ 429 responses say when to retry")
+}
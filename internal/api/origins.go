@@ -0,0 +1,61 @@
+package api
+
+import (
+	"net/url"
+	"strings"
+	"sync/atomic"
+)
+
+// OriginAllowlist is the set of origins accepted by CORS and the WebSocket upgrader
+// It's read on every request and upgrade and can be replaced at runtime without locking
+type OriginAllowlist struct {
+	origins        atomic.Pointer[[]string]
+	allowLocalhost bool
+}
+
+// NewOriginAllowlist starts from a comma-separated list such as CORS_ORIGINS
+// allowLocalhost also accepts any localhost port (development only)
+func NewOriginAllowlist(origins string, allowLocalhost bool) *OriginAllowlist {
+	a := &OriginAllowlist{allowLocalhost: allowLocalhost}
+	var list []string
+	for _, o := range strings.Split(origins, ",") {
+		list = append(list, strings.TrimSpace(o))
+	}
+	a.Set(list)
+	return a
+}
+
+// Set replaces the allowed origins; requests already past the check are unaffected
+func (a *OriginAllowlist) Set(origins []string) {
+	list := append([]string(nil), origins...)
+	a.origins.Store(&list)
+}
+
+// Origins returns the origins currently allowed
+func (a *OriginAllowlist) Origins() []string {
+	return append([]string(nil), *a.origins.Load()...)
+}
+
+// Allowed matches an Origin header against the list
+func (a *OriginAllowlist) Allowed(origin string) bool {
+	for _, o := range *a.origins.Load() {
+		if o == origin {
+			return true
+		}
+	}
+
+	// Allow localhost for development
+	return a.allowLocalhost && (strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "http://127.0.0.1:"))
+}
+
+// validOrigin reports whether s is a bare scheme://host[:port] origin with no wildcard
+func validOrigin(s string) bool {
+	if strings.Contains(s, "*") {
+		return false
+	}
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.User != nil {
+		return false
+	}
+	return (u.Scheme == "https" || u.Scheme == "http") && u.Path == "" && u.RawQuery == "" && u.Fragment == ""
+}
@@ -1,50 +1,38 @@
 package api
 
 import (
+	"log/slog"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
 
+	"nihil/internal/config"
+	"nihil/internal/errcode"
 	redisdb "nihil/internal/redis"
 	ws "nihil/internal/websocket"
 )
 
-func SetupRoutes(router *gin.Engine, redis *redisdb.Client, hub *ws.Hub, corsOrigins string, rateLimit int) {
-	handlers := NewHandlers(redis, hub)
-	middleware := NewMiddleware(redis)
+// adminRateLimitPerMinute bounds operator calls, shared across all admin callers
+const adminRateLimitPerMinute = 30
 
-	// Create upgrader with origin check
-	allowedOrigins := strings.Split(corsOrigins, ",")
-	upgrader := websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin: func(r *http.Request) bool {
-			origin := r.Header.Get("Origin")
-			
-			// Allow configured origins
-			for _, o := range allowedOrigins {
-				if strings.TrimSpace(o) == origin {
-					return true
-				}
-			}
-			
-			// Allow localhost for development
-			if strings.HasPrefix(origin, "http://localhost:") || strings.HasPrefix(origin, "http://127.0.0.1:") {
-				return true
-			}
-			
-			return false
-		},
-	}
+func SetupRoutes(router *gin.Engine, redis *redisdb.Client, hub *ws.Hub, cfg *config.Config, logger *slog.Logger) {
+	handlers := NewHandlers(redis, hub, cfg, logger)
+	middleware := NewMiddleware(redis, cfg.AdminToken)
 
-	router.Use(CORS(corsOrigins))
+	// CORS and the upgrader share one allowlist, so both see runtime updates
+	upgrader := newUpgrader(handlers.origins, cfg.WSCompression)
+
+	router.Use(CORS(handlers.origins))
 	router.Use(RequestLogger())
 	router.Use(gin.Recovery())
 
 	// Public endpoints
 	router.GET("/health", handlers.Health)
+	router.GET("/version", handlers.Version)
+	router.GET("/time", handlers.Time)
 	router.POST("/activation/validate", handlers.ValidateActivationCode)
 	router.POST("/activation/claim", handlers.ClaimActivationCode)
 	router.POST("/checkout/create", handlers.CreateCheckout)
@@ -58,28 +46,47 @@ func SetupRoutes(router *gin.Engine, redis *redisdb.Client, hub *ws.Hub, corsOri
 	// Key registration (public - called right after activation, before auth is possible)
 	router.POST("/keys/register", handlers.RegisterKeysPublic)
 
+	// Standing (signed, but open to banned and unsubscribed devices)
+	router.GET("/device/standing", middleware.StandingAuth(), middleware.RateLimit(cfg.RateLimitPerMinute), handlers.GetDeviceStanding)
+
 	// WebSocket
 	router.GET("/ws", func(c *gin.Context) {
-		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
-		if err != nil {
+		// Counted before the upgrade, so a connection flood is turned away
+		// before it costs goroutines and buffers
+		if !hub.AcquireConn() {
+			respondError(c, http.StatusServiceUnavailable, errcode.Unavailable, "server at connection capacity")
+			return
+		}
+		conn, ok := upgradeWS(c, upgrader)
+		if !ok {
+			hub.ReleaseConn()
 			return
 		}
 		client := ws.NewClient(hub, conn)
 		hub.Register(client)
 		go client.WritePump()
-		go client.ReadPump()
+		go func() {
+			// ReadPump returns once the client has been unregistered
+			client.ReadPump()
+			hub.ReleaseConn()
+		}()
 	})
 
 	// Authenticated endpoints
 	auth := router.Group("/")
 	auth.Use(middleware.DeviceAuth())
-	auth.Use(middleware.RateLimit(rateLimit))
+	auth.Use(middleware.RateLimit(cfg.RateLimitPerMinute))
 	{
 		// Chat management
 		auth.POST("/chat/create", handlers.CreateChat)
 		auth.POST("/chat/join", handlers.JoinChat)
 		auth.GET("/chat/list", handlers.ListChats)
+		auth.GET("/chat/:chat_uuid", handlers.GetChatStatus)
 		auth.DELETE("/chat/:chat_uuid", handlers.DeleteChat)
+		auth.POST("/chat/:chat_uuid/leave", handlers.LeaveChat)
+		auth.POST("/chat/:chat_uuid/reopen", handlers.ReopenChat)
+		auth.POST("/chat/:chat_uuid/attachments", handlers.CreateAttachment)
+		auth.GET("/chat/:chat_uuid/attachments/:attachment_id", handlers.GetAttachment)
 
 		// Subscription
 		auth.GET("/subscription/status", handlers.GetSubscriptionStatus)
@@ -87,10 +94,77 @@ func SetupRoutes(router *gin.Engine, redis *redisdb.Client, hub *ws.Hub, corsOri
 		// Key exchange (Signal Protocol)
 		auth.GET("/keys/:device_uuid", handlers.GetKeyBundle)
 		auth.POST("/keys/replenish", handlers.ReplenishKeys)
+		auth.POST("/keys/signed-prekey", handlers.UpdateSignedPreKey)
 		auth.GET("/keys/count", handlers.GetPreKeyCount)
+		auth.GET("/keys/:device_uuid/count", handlers.GetPeerPreKeyCount)
 
 		// Push notifications
 		auth.POST("/device/fcm-token", handlers.RegisterFCMToken)
 		auth.DELETE("/device/purge", handlers.PurgeDevice)
+
+		// Sessions
+		auth.GET("/device/sessions", handlers.ListDeviceSessions)
+		auth.DELETE("/device/sessions", handlers.CloseDeviceSessions)
+
+		// Key rotation
+		auth.POST("/device/rotate-key/challenge", handlers.CreateKeyRotationChallenge)
+		auth.POST("/device/rotate-key", handlers.RotateKey)
+	}
+
+	// Operator endpoints
+	admin := router.Group("/admin")
+	admin.Use(middleware.AdminAuth())
+	admin.Use(middleware.AdminRateLimit(adminRateLimitPerMinute))
+	{
+		admin.POST("/devices/:device_uuid/unban", handlers.UnbanDevice)
+		admin.GET("/devices/:device_uuid/abuse", handlers.GetAbuseState)
+		admin.POST("/codes", handlers.MintActivationCodes)
+		admin.GET("/teams/:session_id", handlers.GetTeamRoster)
+		admin.POST("/cors-origins", handlers.SetCORSOrigins)
+		admin.POST("/broadcast", handlers.Broadcast)
 	}
-}
\ No newline at end of file
+}
+
+// newUpgrader builds the WebSocket upgrader, checking Origin against the same allowlist as CORS
+// With compression on, permessage-deflate is negotiated with clients that offer it
+// The subprotocol the client asked for is echoed back, see upgradeWS
+func newUpgrader(origins *OriginAllowlist, compression bool) *websocket.Upgrader {
+	return &websocket.Upgrader{
+		ReadBufferSize:    1024,
+		WriteBufferSize:   1024,
+		EnableCompression: compression,
+		Subprotocols:      ws.Subprotocols,
+		CheckOrigin: func(r *http.Request) bool {
+			return origins.Allowed(r.Header.Get("Origin"))
+		},
+	}
+}
+
+// upgradeWS upgrades the request once the client has asked for a subprotocol this server speaks
+// Clients that didn't are turned away before the handshake, so they never reach auth
+func upgradeWS(c *gin.Context, upgrader *websocket.Upgrader) (*websocket.Conn, bool) {
+	if !supportsSubprotocol(websocket.Subprotocols(c.Request)) {
+		respondError(c, http.StatusBadRequest, errcode.UnsupportedSubprotocol, "unsupported websocket subprotocol, expected one of: "+strings.Join(ws.Subprotocols, ", "))
+		return nil, false
+	}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		return nil, false
+	}
+	return conn, true
+}
+
+// supportsSubprotocol reports whether any requested subprotocol is one in ws.Subprotocols
+func supportsSubprotocol(requested []string) bool {
+	for _, r := range requested {
+		if slices.Contains(ws.Subprotocols, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowLocalhostOrigins reports whether localhost origins are accepted - development only
+func allowLocalhostOrigins(environment string) bool {
+	return environment != "production"
+}
@@ -0,0 +1,224 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"nihil/internal/config"
+	"nihil/internal/errcode"
+	"nihil/internal/logging"
+	redisdb "nihil/internal/redis"
+	ws "nihil/internal/websocket"
+)
+
+func TestNewUpgrader_CheckOrigin(t *testing.T) {
+	cases := []struct {
+		environment string
+		origin      string
+		allowed     bool
+	}{
+		{"production", "https://nihil.app", true},
+		{"production", "https://app.nihil.app", true},
+		{"production", "https://evil.example", false},
+		{"production", "http://localhost:3000", false},
+		{"production", "", false},
+		{"development", "http://localhost:3000", true},
+		{"development", "http://127.0.0.1:5173", true},
+		{"development", "https://evil.example", false},
+		{"development", "http://localhost.evil.example", false},
+	}
+
+	for _, tc := range cases {
+		upgrader := newUpgrader(NewOriginAllowlist("https://nihil.app, https://app.nihil.app", allowLocalhostOrigins(tc.environment)), true)
+
+		req := httptest.NewRequest("GET", "/ws", nil)
+		if tc.origin != "" {
+			req.Header.Set("Origin", tc.origin)
+		}
+		if got := upgrader.CheckOrigin(req); got != tc.allowed {
+			t.Errorf("%s %q: expected allowed %v, got %v", tc.environment, tc.origin, tc.allowed, got)
+		}
+	}
+
+	t.Logf("✓ WebSocket upgrader only accepts configured origins")
+}
+
+func TestSetCORSOrigins_AppliesAtRuntime(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	handlers := &Handlers{
+		origins: NewOriginAllowlist("https://nihil.app", false),
+		logger:  logging.Discard(),
+	}
+	upgrader := newUpgrader(handlers.origins, true)
+	router := gin.New()
+	router.Use(CORS(handlers.origins))
+	router.GET("/health", func(c *gin.Context) { c.Status(http.StatusOK) })
+	router.POST("/admin/cors-origins", handlers.SetCORSOrigins)
+
+	allowed := func(origin string) (cors, ws bool) {
+		req := httptest.NewRequest(http.MethodGet, "/health", nil)
+		req.Header.Set("Origin", origin)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+
+		upgrade := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		upgrade.Header.Set("Origin", origin)
+		return w.Header().Get("Access-Control-Allow-Origin") == origin, upgrader.CheckOrigin(upgrade)
+	}
+	setOrigins := func(origins ...string) int {
+		w := doJSON(router, http.MethodPost, "/admin/cors-origins", "", gin.H{"origins": origins})
+		return w.Code
+	}
+
+	if cors, ws := allowed("https://web.example"); cors || ws {
+		t.Fatalf("Expected a new origin rejected before the update, got cors=%v ws=%v", cors, ws)
+	}
+
+	// CheckOrigin runs on every upgrade, including while the list is swapped
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				handlers.origins.Allowed("https://nihil.app")
+			}
+		}
+	}()
+
+	if code := setOrigins("https://nihil.app", "https://web.example"); code != http.StatusOK {
+		t.Fatalf("Expected 200 updating origins, got %d", code)
+	}
+	if cors, ws := allowed("https://web.example"); !cors || !ws {
+		t.Errorf("Expected the new origin allowed after the update, got cors=%v ws=%v", cors, ws)
+	}
+
+	for _, bad := range []string{"*", "https://*.example", "https://web.example/path", "ftp://web.example", "web.example"} {
+		if code := setOrigins(bad); code != http.StatusBadRequest {
+			t.Errorf("Expected 400 for origin %q, got %d", bad, code)
+		}
+	}
+	if cors, _ := allowed("https://web.example"); !cors {
+		t.Error("Expected a rejected update to leave the list unchanged")
+	}
+
+	t.Logf("✓ Allowed origins updated at runtime for CORS and WebSocket upgrades")
+}
+
+func TestUpgradeWS_RequiresSubprotocol(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	upgrader := newUpgrader(NewOriginAllowlist("https://nihil.app", false), false)
+	router := gin.New()
+	router.GET("/ws", func(c *gin.Context) {
+		if conn, ok := upgradeWS(c, upgrader); ok {
+			conn.Close()
+		}
+	})
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/ws"
+	header := http.Header{"Origin": {"https://nihil.app"}}
+
+	dialer := websocket.Dialer{Subprotocols: []string{"nihil.v9", "nihil.v1"}}
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		t.Fatalf("Expected the upgrade to succeed with nihil.v1 offered, got %v", err)
+	}
+	if got := conn.Subprotocol(); got != "nihil.v1" {
+		t.Errorf("Expected nihil.v1 echoed back, got %q", got)
+	}
+	conn.Close()
+
+	for _, offered := range [][]string{nil, {"nihil.v0"}} {
+		dialer := websocket.Dialer{Subprotocols: offered}
+		_, resp, err := dialer.Dial(url, header)
+		if err == nil {
+			t.Fatalf("Expected the upgrade refused when offering %v", offered)
+		}
+		if resp == nil || resp.StatusCode != http.StatusBadRequest {
+			t.Fatalf("Expected 400 when offering %v, got %v", offered, resp)
+		}
+		var body struct {
+			Code errcode.Code `json:"code"`
+		}
+		json.NewDecoder(resp.Body).Decode(&body)
+		if body.Code != errcode.UnsupportedSubprotocol {
+			t.Errorf("Expected %s when offering %v, got %s", errcode.UnsupportedSubprotocol, offered, body.Code)
+		}
+	}
+
+	t.Logf("✓ WebSocket upgrade requires and echoes a supported subprotocol")
+}
+
+func TestWS_MaxConnections(t *testing.T) {
+	client, err := redisdb.NewClient("redis://localhost:6379")
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	cfg := &config.Config{
+		CORSOrigins:         "https://nihil.app",
+		RateLimitPerMinute:  120,
+		MaxChatParticipants: 8,
+		MaxConnections:      2,
+	}
+	hub := ws.NewHub(client, cfg, logging.Discard())
+	go hub.Run()
+	SetupRoutes(router, client, hub, cfg, logging.Discard())
+	srv := httptest.NewServer(router)
+	defer srv.Close()
+
+	dial := func() (*websocket.Conn, *http.Response, error) {
+		dialer := websocket.Dialer{Subprotocols: ws.Subprotocols}
+		return dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/ws",
+			http.Header{"Origin": {"https://nihil.app"}})
+	}
+
+	var conns []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		conn, _, err := dial()
+		if err != nil {
+			t.Fatalf("Expected connection %d accepted, got %v", i+1, err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	_, resp, err := dial()
+	if err == nil {
+		t.Fatal("Expected the connection over the limit refused")
+	}
+	if resp == nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 over the limit, got %v", resp)
+	}
+	if n := hub.ConnectionsRefused(); n != 1 {
+		t.Errorf("Expected 1 refused connection, got %d", n)
+	}
+
+	// Closing one frees its slot once the hub has unregistered it
+	conns[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for hub.Connections() > 1 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, _, err := dial()
+	if err != nil {
+		t.Fatalf("Expected a connection accepted after one closed, got %v", err)
+	}
+	conn.Close()
+
+	t.Logf("✓ Connections over the instance limit are refused until a slot frees up")
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	stripeClient "nihil/internal/stripe"
+)
+
+// Payment providers a subscription can be restored from, see RestoreSubscriptionRequest
+const (
+	ProviderStripe = "stripe"
+	ProviderApple  = "apple"
+	ProviderGoogle = "google"
+)
+
+var (
+	errInvalidPurchase     = errors.New("invalid purchase")
+	errPaymentNotCompleted = errors.New("payment not completed")
+	errVerifierUnavailable = errors.New("payment provider not supported")
+)
+
+// PaymentVerifier checks a provider's proof of purchase - a Stripe checkout session ID,
+// an App Store or Play receipt - and normalizes it into the subscription it grants
+// expiresAt may already be in the past; the caller decides what to do with an expired purchase
+type PaymentVerifier interface {
+	Verify(ctx context.Context, proof string) (plan, planType string, expiresAt time.Time, err error)
+}
+
+func defaultVerifiers() map[string]PaymentVerifier {
+	return map[string]PaymentVerifier{
+		ProviderStripe: stripeVerifier{},
+		ProviderApple:  storeVerifier{store: "App Store"},
+		ProviderGoogle: storeVerifier{store: "Google Play"},
+	}
+}
+
+// stripeVerifier restores from a paid Stripe checkout session
+type stripeVerifier struct{}
+
+func (stripeVerifier) Verify(ctx context.Context, sessionID string) (string, string, time.Time, error) {
+	session, err := stripeClient.GetClient().GetCheckoutSession(sessionID)
+	if err != nil {
+		return "", "", time.Time{}, fmt.Errorf("%w: %v", errInvalidPurchase, err)
+	}
+
+	if session.PaymentStatus != "paid" {
+		return "", "", time.Time{}, errPaymentNotCompleted
+	}
+
+	plan, ok := session.Metadata["plan"]
+	if !ok {
+		return "", "", time.Time{}, fmt.Errorf("%w: session has no plan metadata", errInvalidPurchase)
+	}
+
+	planType := "solo"
+	if t, ok := session.Metadata["type"]; ok {
+		planType = t
+	}
+
+	var duration time.Duration
+	if planType == "team" {
+		if d, ok := session.Metadata["duration"]; ok {
+			duration = getTeamDurationFromMeta(d)
+		} else {
+			duration = 24 * time.Hour
+		}
+	} else {
+		duration = getPlanDurationFromMeta(plan)
+	}
+
+	purchaseTime := time.Unix(session.Created, 0)
+	return plan, planType, purchaseTime.Add(duration), nil
+}
+
+// storeVerifier stands in for App Store and Play receipt verification until
+// the apps ship through the stores
+type storeVerifier struct {
+	store string
+}
+
+func (v storeVerifier) Verify(ctx context.Context, receipt string) (string, string, time.Time, error) {
+	return "", "", time.Time{}, fmt.Errorf("%s receipts: %w", v.store, errVerifierUnavailable)
+}
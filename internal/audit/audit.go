@@ -0,0 +1,113 @@
+package audit
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Security events, see Record
+const (
+	EventBan          = "ban"
+	EventAbuseWarning = "abuse_warning"
+	EventAuthFailed   = "auth_failed"
+	EventPurge        = "purge"
+)
+
+// Event is one audit record
+// Device is a salted hash so the trail can link events for a device without naming it
+type Event struct {
+	Type   string    `json:"event"`
+	Time   time.Time `json:"time"`
+	Device string    `json:"device,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+// Sink receives audit events
+type Sink interface {
+	Record(e Event)
+}
+
+// JSONSink writes each event as one line of JSON
+type JSONSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func NewJSONSink(w io.Writer) *JSONSink {
+	return &JSONSink{w: w}
+}
+
+func (s *JSONSink) Record(e Event) {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.Write(append(line, '\n'))
+}
+
+// Open returns a JSON sink for dest: stdout, stderr or a file path appended to
+// An empty dest or "off" returns a nil sink, which disables audit logging
+func Open(dest string) (Sink, error) {
+	switch dest {
+	case "", "off":
+		return nil, nil
+	case "stdout":
+		return NewJSONSink(os.Stdout), nil
+	case "stderr":
+		return NewJSONSink(os.Stderr), nil
+	}
+	f, err := os.OpenFile(dest, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open audit log: %w", err)
+	}
+	return NewJSONSink(f), nil
+}
+
+var (
+	sink Sink
+	salt []byte
+)
+
+// SetSink installs where audit events go - nothing is recorded until it's called
+// Call once at startup, before any traffic is served
+func SetSink(s Sink) {
+	sink = s
+}
+
+// SetSalt sets the key device identifiers are hashed with
+func SetSalt(s string) {
+	salt = []byte(s)
+}
+
+// Record sends an event to the installed sink, hashing deviceUUID first
+// The raw UUID never leaves this function
+func Record(eventType, deviceUUID, reason string) {
+	if sink == nil {
+		return
+	}
+	sink.Record(Event{
+		Type:   eventType,
+		Time:   time.Now().UTC(),
+		Device: HashDevice(deviceUUID),
+		Reason: reason,
+	})
+}
+
+// HashDevice returns the salted hash audit events identify a device by, empty for an empty UUID
+func HashDevice(deviceUUID string) string {
+	if deviceUUID == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(deviceUUID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRecord_HashesDevice(t *testing.T) {
+	var buf bytes.Buffer
+	SetSink(NewJSONSink(&buf))
+	SetSalt("test-salt")
+	t.Cleanup(func() {
+		SetSink(nil)
+		SetSalt("")
+	})
+
+	deviceUUID := "0b9f6c1e-3d0a-4f4e-9d61-5a8f2c7e1b44"
+	for _, eventType := range []string{EventBan, EventAbuseWarning, EventAuthFailed, EventPurge} {
+		Record(eventType, deviceUUID, "spam")
+	}
+
+	if strings.Contains(buf.String(), deviceUUID) {
+		t.Fatalf("Expected no raw UUID in the audit log, got %s", buf.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("Expected 4 events, got %d", len(lines))
+	}
+	for i, eventType := range []string{EventBan, EventAbuseWarning, EventAuthFailed, EventPurge} {
+		var e Event
+		if err := json.Unmarshal([]byte(lines[i]), &e); err != nil {
+			t.Fatalf("Expected a JSON line, got %q: %v", lines[i], err)
+		}
+		if e.Type != eventType || e.Reason != "spam" || e.Time.IsZero() {
+			t.Errorf("Unexpected event %+v", e)
+		}
+		if e.Device != HashDevice(deviceUUID) || len(e.Device) != 64 {
+			t.Errorf("Expected the salted device hash, got %q", e.Device)
+		}
+	}
+
+	t.Logf("✓ Events recorded as JSON with hashed device IDs")
+}
+
+func TestHashDevice_Salted(t *testing.T) {
+	t.Cleanup(func() { SetSalt("") })
+
+	SetSalt("one")
+	first := HashDevice("device")
+	SetSalt("two")
+	if HashDevice("device") == first {
+		t.Error("Expected a different salt to give a different hash")
+	}
+	if HashDevice("") != "" {
+		t.Error("Expected no hash for an empty UUID")
+	}
+
+	t.Logf("✓ Device hashes depend on the salt")
+}
+
+func TestOpen(t *testing.T) {
+	if s, err := Open("off"); s != nil || err != nil {
+		t.Errorf("Expected no sink for off, got %v %v", s, err)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	s, err := Open(path)
+	if err != nil {
+		t.Fatalf("Failed to open audit file: %v", err)
+	}
+	s.Record(Event{Type: EventPurge})
+
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), `"event":"purge"`) {
+		t.Errorf("Expected the event in the file, got %q", data)
+	}
+
+	t.Logf("✓ Audit destinations open")
+}
@@ -0,0 +1,29 @@
+package buildinfo
+
+import "runtime"
+
+// Identify the running build, set at link time with
+// -ldflags "-X nihil/internal/buildinfo.Version=... -X nihil/internal/buildinfo.Commit=... -X nihil/internal/buildinfo.BuildTime=..."
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildTime = "unknown" // RFC 3339, e.g. $(date -u +%Y-%m-%dT%H:%M:%SZ)
+)
+
+// Info describes the running build
+type Info struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildTime string `json:"build_time"`
+	GoVersion string `json:"go_version"`
+}
+
+// Get returns the running build's info
+func Get() Info {
+	return Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildTime: BuildTime,
+		GoVersion: runtime.Version(),
+	}
+}
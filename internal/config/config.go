@@ -1,8 +1,14 @@
 package config
 
 import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Config struct {
@@ -13,24 +19,199 @@ type Config struct {
 	CORSOrigins         string
 	Environment         string
 	RateLimitPerMinute  int
+	WSSendRateLimit     int // per minute, separate from the HTTP RateLimitPerMinute
+	WSChatSendRateLimit int // per minute into any one chat, at most WSSendRateLimit
+	WSTypingRateLimit   int
+	WSReadRateLimit     int
+	WSSendBufferSize    int // outbound messages buffered per connection
+	WSOverflowPolicy    string
+	WSCompression       bool // negotiate permessage-deflate with clients that offer it
+	WSCompressThreshold int  // outbound messages at least this many bytes are compressed
+	WSWriteWait         time.Duration
+	WSPongWait          time.Duration // a connection silent this long, pongs included, is closed
+	WSPingPeriod        time.Duration // must be shorter than WSPongWait so pongs can arrive in time
 	MessageMaxSize      int
 	FirebaseKeyPath     string
 	FirebaseProject     string
+	FirebaseKeyBase64   string // service account JSON, base64; takes priority over FirebaseKeyPath
+	ChatSweepInterval   time.Duration
+	LogLevel            string
+	ShutdownGracePeriod time.Duration
+	MaxChatParticipants int
+	MaxChatsPerDevice   int // active chats one device can be in, 0 for no limit
+	MaxDeviceChatRegs   int // chats one device can register for routing on an instance, 0 for no limit
+	AbuseBanDuration    time.Duration
+	MaxChatLifetime     time.Duration // longest chat.extend can keep a chat alive, counted from its creation
+	AdminToken          string
+	PreKeyLowThreshold  int
+	MaxPreKeys          int // one-time prekeys stored per device, 0 for no limit
+	MaxDeviceConns      int
+	MaxConnections      int // WebSocket connections one instance accepts, 0 for no limit
+	DeviceConnPolicy    string
+	MaxQueuedMessages   int
+	ResumeTokenTTL      time.Duration
+	DeliveryAckTimeout  time.Duration // unacknowledged deliveries are queued again after this, 0 to not track
+	// AuthTimestampWindow is the clock skew allowed on signed HTTP and WebSocket auth
+	// Wider lets devices with drifting clocks in but keeps a captured request replayable
+	// for longer; nonces are remembered for this long to cover it
+	AuthTimestampWindow time.Duration
+	SubscriptionGrace   time.Duration
+	ActivationCodeTTL   time.Duration   // how long an unclaimed activation code stays claimable
+	UsedCodeRetention   time.Duration   // how long a claimed code is kept to answer retries
+	ClaimRetrySecret    string          // keys the hash that lets a device retry its own code claim
+	InvitationTTL       time.Duration   // longest a chat invitation stays open
+	SubExpiryWarnings   []time.Duration // how long before expiry connected devices get subscription.expiring
+	SubExpiryDisconnect bool            // close connections once the grace period is over
+	PromoCodesEnabled   bool
+	TeamDiscountTiers   map[int]int // device count -> discount percent from that count up
+	TeamDiscountMax     int         // hard cap on the team discount percent
+	TeamPriceFloor      int         // lowest team price per device, as a percent of the solo price
+	RedisPoolSize       int
+	RedisMinIdleConns   int
+	RedisDialTimeout    time.Duration
+	RedisMaxRetries     int
+	RedisHealthInterval time.Duration
+	RedisSentinelAddrs  string
+	RedisMasterName     string
+	RedisClusterAddrs   string
+	RedisPassword       string
+	AbuseSpamDuplicates int
+	AbuseBotInterval    time.Duration
+	AbuseBotCount       int
+	AbuseWindow         time.Duration
+	AbuseWarnings       int
+	AbuseQuietPeriod    time.Duration
+	PushDataOnly        bool
+	PushValidateTokens  bool // ask FCM whether a token is valid for our project when it's registered
+	PushTitle           string
+	PushBody            string
+	PushMaxAttempts     int
+	PushRetryDelay      time.Duration
+	PushBreakerFailures int           // transient push failures in a row that open the FCM circuit
+	PushBreakerCooldown time.Duration // how long the circuit stays open before a probe
+	AuditLog            string        // stdout, stderr, a file path, or off
+	AuditSalt           string        // keys the hash audit events identify devices by
+
+	malformed []string // env vars that failed to parse and fell back to defaults, see Validate
 }
 
+// parseFailures collects the env vars that failed to parse while Load runs
+var parseFailures []string
+
 func Load() *Config {
-	return &Config{
+	parseFailures = nil
+	environment := getEnv("ENVIRONMENT", "development")
+
+	// Production defaults to info so debug detail never reaches prod logs unless asked for
+	defaultLogLevel := "debug"
+	if environment == "production" {
+		defaultLogLevel = "info"
+	}
+
+	cfg := &Config{
 		Port:                getEnv("PORT", "8080"),
 		RedisURL:            getEnv("REDIS_URL", "redis://localhost:6379"),
 		StripeSecretKey:     getEnv("STRIPE_SECRET_KEY", ""),
 		StripeWebhookSecret: getEnv("STRIPE_WEBHOOK_SECRET", ""),
 		CORSOrigins:         getEnv("CORS_ORIGINS", "https://nihil.app"),
-		Environment:         getEnv("ENVIRONMENT", "development"),
+		Environment:         environment,
 		RateLimitPerMinute:  getEnvInt("RATE_LIMIT_PER_MINUTE", 120),
+		WSSendRateLimit:     getEnvInt("WS_SEND_RATE_LIMIT", 120),
+		WSChatSendRateLimit: getEnvInt("WS_CHAT_SEND_RATE_LIMIT", 60),
+		WSTypingRateLimit:   getEnvInt("WS_TYPING_RATE_LIMIT", 600), // typing start/stop fire on every pause
+		WSReadRateLimit:     getEnvInt("WS_READ_RATE_LIMIT", 300),
+		WSSendBufferSize:    getEnvInt("WS_SEND_BUFFER_SIZE", 256),
+		WSOverflowPolicy:    getEnv("WS_OVERFLOW_POLICY", "disconnect"),
+		WSCompression:       getEnv("WS_COMPRESSION", "true") == "true",
+		WSCompressThreshold: getEnvInt("WS_COMPRESSION_THRESHOLD", 512), // small frames cost more CPU than they save
+		WSWriteWait:         getEnvDuration("WS_WRITE_WAIT", 10*time.Second),
+		WSPongWait:          getEnvDuration("WS_PONG_WAIT", 60*time.Second),
+		WSPingPeriod:        getEnvDuration("WS_PING_PERIOD", 54*time.Second),
 		MessageMaxSize:      getEnvInt("MESSAGE_MAX_SIZE", 10240),
 		FirebaseKeyPath:     getEnv("FIREBASE_KEY_PATH", "/opt/nihil/firebase-key.json"),
-		FirebaseProject:     getEnv("FIREBASE_PROJECT", "nihil-3176a"),
+		FirebaseProject:     getEnv("FIREBASE_PROJECT_ID", getEnv("FIREBASE_PROJECT", "nihil-3176a")),
+		FirebaseKeyBase64:   getEnv("FIREBASE_KEY_BASE64", ""), // for containers that don't mount the key file
+		ChatSweepInterval:   getEnvDuration("CHAT_SWEEP_INTERVAL", 5*time.Second),
+		LogLevel:            getEnv("LOG_LEVEL", defaultLogLevel),
+		ShutdownGracePeriod: getEnvDuration("SHUTDOWN_GRACE_PERIOD", 10*time.Second),
+		MaxChatParticipants: getEnvInt("MAX_CHAT_PARTICIPANTS", 8),
+		MaxChatsPerDevice:   getEnvInt("MAX_CHATS_PER_DEVICE", 50),
+		MaxDeviceChatRegs:   getEnvInt("MAX_CHAT_REGISTRATIONS", 200),
+		MaxChatLifetime:     getEnvDuration("MAX_CHAT_LIFETIME", time.Hour),
+		AbuseBanDuration:    getEnvDuration("ABUSE_BAN_DURATION", 24*time.Hour),
+		AdminToken:          getEnv("ADMIN_TOKEN", ""),
+		PreKeyLowThreshold:  getEnvInt("PREKEY_LOW_THRESHOLD", 10),
+		MaxPreKeys:          getEnvInt("MAX_PREKEYS", 1000),
+		MaxDeviceConns:      getEnvInt("MAX_DEVICE_CONNECTIONS", 1),
+		MaxConnections:      getEnvInt("MAX_CONNECTIONS", 10000),
+		DeviceConnPolicy:    getEnv("DEVICE_CONNECTION_POLICY", "replace"),
+		MaxQueuedMessages:   getEnvInt("MAX_QUEUED_MESSAGES", 500),
+		ResumeTokenTTL:      getEnvDuration("RESUME_TOKEN_TTL", 60*time.Second),
+		DeliveryAckTimeout:  getEnvDuration("DELIVERY_ACK_TIMEOUT", 30*time.Second),
+		AuthTimestampWindow: time.Duration(getEnvInt("AUTH_TIMESTAMP_WINDOW_SECONDS", 300)) * time.Second,
+		SubscriptionGrace:   getEnvDuration("SUBSCRIPTION_GRACE_PERIOD", 48*time.Hour),
+		ActivationCodeTTL:   getEnvDuration("ACTIVATION_CODE_TTL", 24*time.Hour),
+		UsedCodeRetention:   getEnvDuration("USED_CODE_RETENTION", time.Hour),
+		ClaimRetrySecret:    getEnv("CLAIM_RETRY_SECRET", ""),
+		InvitationTTL:       getEnvDuration("INVITATION_TTL", 24*time.Hour),
+		SubExpiryWarnings:   getEnvDurations("SUBSCRIPTION_EXPIRY_WARNINGS", []time.Duration{24 * time.Hour, time.Hour}),
+		SubExpiryDisconnect: getEnv("SUBSCRIPTION_EXPIRY_DISCONNECT", "true") == "true",
+		PromoCodesEnabled:   getEnv("PROMO_CODES_ENABLED", "false") == "true",
+		TeamDiscountTiers:   getEnvTiers("TEAM_DISCOUNT_TIERS", map[int]int{3: 20, 5: 25, 10: 30, 20: 40, 30: 50}),
+		TeamDiscountMax:     getEnvInt("TEAM_DISCOUNT_MAX_PERCENT", 50),
+		TeamPriceFloor:      getEnvInt("TEAM_PRICE_FLOOR_PERCENT", 25),
+		RedisPoolSize:       getEnvInt("REDIS_POOL_SIZE", 0), // 0 keeps the go-redis default of 10 per CPU
+		RedisMinIdleConns:   getEnvInt("REDIS_MIN_IDLE_CONNS", 0),
+		RedisDialTimeout:    getEnvDuration("REDIS_DIAL_TIMEOUT", 5*time.Second),
+		RedisMaxRetries:     getEnvInt("REDIS_MAX_RETRIES", 3),
+		RedisHealthInterval: getEnvDuration("REDIS_HEALTH_INTERVAL", 5*time.Second),
+		RedisSentinelAddrs:  getEnv("REDIS_SENTINEL_ADDRS", ""), // comma-separated; takes priority over REDIS_URL
+		RedisMasterName:     getEnv("REDIS_MASTER_NAME", ""),
+		RedisClusterAddrs:   getEnv("REDIS_CLUSTER_ADDRS", ""), // comma-separated; rejected by Validate for now
+		RedisPassword:       getEnv("REDIS_PASSWORD", ""),
+		AbuseSpamDuplicates: getEnvInt("ABUSE_SPAM_DUPLICATES", 10),
+		AbuseBotInterval:    getEnvDuration("ABUSE_BOT_INTERVAL", 500*time.Millisecond),
+		AbuseBotCount:       getEnvInt("ABUSE_BOT_COUNT", 20),
+		AbuseWindow:         getEnvDuration("ABUSE_WINDOW", 5*time.Minute),
+		AbuseWarnings:       getEnvInt("ABUSE_WARNINGS_BEFORE_BAN", 1),
+		AbuseQuietPeriod:    getEnvDuration("ABUSE_QUIET_PERIOD", time.Hour),
+		PushDataOnly:        getEnv("PUSH_DATA_ONLY", "false") == "true",
+		PushValidateTokens:  getEnv("PUSH_VALIDATE_TOKENS", "false") == "true",
+		PushTitle:           getEnv("PUSH_NOTIFICATION_TITLE", ""), // generic only, e.g. an org name; empty keeps "nihil"
+		PushBody:            getEnv("PUSH_NOTIFICATION_BODY", ""),
+		PushMaxAttempts:     getEnvInt("PUSH_MAX_ATTEMPTS", 3),
+		PushRetryDelay:      getEnvDuration("PUSH_RETRY_DELAY", 250*time.Millisecond), // doubles after each failed attempt
+		PushBreakerFailures: getEnvInt("PUSH_BREAKER_FAILURES", 5),
+		PushBreakerCooldown: getEnvDuration("PUSH_BREAKER_COOLDOWN", 30*time.Second),
+		AuditLog:            getEnv("AUDIT_LOG", "stdout"),
+		AuditSalt:           getEnv("AUDIT_SALT", ""),
 	}
+	cfg.malformed = parseFailures
+	return cfg
+}
+
+// FirebaseCredentials returns the service account JSON from FIREBASE_KEY_BASE64 or the key file
+// Returns nil without an error when neither is set up, which leaves push disabled
+func (c *Config) FirebaseCredentials() ([]byte, error) {
+	if c.FirebaseKeyBase64 != "" {
+		data, err := base64.StdEncoding.DecodeString(c.FirebaseKeyBase64)
+		if err != nil {
+			return nil, fmt.Errorf("FIREBASE_KEY_BASE64 is not valid base64: %w", err)
+		}
+		return data, nil
+	}
+
+	if c.FirebaseKeyPath == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(c.FirebaseKeyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read firebase key: %w", err)
+	}
+	return data, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -45,6 +226,65 @@ func getEnvInt(key string, fallback int) int {
 		if i, err := strconv.Atoi(value); err == nil {
 			return i
 		}
+		parseFailures = append(parseFailures, key)
+	}
+	return fallback
+}
+
+func getEnvDuration(key string, fallback time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if d, err := time.ParseDuration(value); err == nil {
+			return d
+		}
+		parseFailures = append(parseFailures, key)
 	}
 	return fallback
-}
\ No newline at end of file
+}
+
+// getEnvDurations reads a comma-separated list of durations; an empty value is an empty list
+func getEnvDurations(key string, fallback []time.Duration) []time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+
+	durations := []time.Duration{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		d, err := time.ParseDuration(part)
+		if err != nil {
+			parseFailures = append(parseFailures, key)
+			return fallback
+		}
+		durations = append(durations, d)
+	}
+	return durations
+}
+
+// getEnvTiers reads comma-separated count:percent pairs, e.g. "3:20,10:30"
+func getEnvTiers(key string, fallback map[int]int) map[int]int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return fallback
+	}
+
+	tiers := map[int]int{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		count, percent, ok := strings.Cut(part, ":")
+		c, cerr := strconv.Atoi(strings.TrimSpace(count))
+		p, perr := strconv.Atoi(strings.TrimSpace(percent))
+		if !ok || cerr != nil || perr != nil {
+			parseFailures = append(parseFailures, key)
+			return fallback
+		}
+		tiers[c] = p
+	}
+	return tiers
+}
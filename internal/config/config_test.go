@@ -0,0 +1,192 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		name     string
+		env      map[string]string
+		problems []string // substrings expected among the problems, none for a valid config
+	}{
+		{"defaults", nil, nil},
+		{"production", map[string]string{
+			"ENVIRONMENT":           "production",
+			"STRIPE_SECRET_KEY":     "sk_test",
+			"STRIPE_WEBHOOK_SECRET": "whsec_test",
+			"AUDIT_SALT":            "salt",
+			"CLAIM_RETRY_SECRET":    "secret",
+		}, nil},
+		{"production_missing_secrets", map[string]string{
+			"ENVIRONMENT":  "production",
+			"CORS_ORIGINS": "*",
+		}, []string{"STRIPE_SECRET_KEY", "STRIPE_WEBHOOK_SECRET", "CORS_ORIGINS", "AUDIT_SALT", "CLAIM_RETRY_SECRET"}},
+		{"malformed_values", map[string]string{
+			"RATE_LIMIT_PER_MINUTE": "lots",
+			"CHAT_SWEEP_INTERVAL":   "5",
+		}, []string{"RATE_LIMIT_PER_MINUTE is not a valid value", "CHAT_SWEEP_INTERVAL is not a valid value"}},
+		{"out_of_range", map[string]string{
+			"PORT":                  "99999",
+			"RATE_LIMIT_PER_MINUTE": "0",
+			"MESSAGE_MAX_SIZE":      "104857600",
+		}, []string{"PORT", "RATE_LIMIT_PER_MINUTE must be positive", "MESSAGE_MAX_SIZE"}},
+		{"sentinel_without_master", map[string]string{
+			"REDIS_SENTINEL_ADDRS": "10.0.0.1:26379",
+		}, []string{"REDIS_MASTER_NAME"}},
+		{"cluster_unsupported", map[string]string{
+			"REDIS_CLUSTER_ADDRS": "10.0.0.1:7000,10.0.0.2:7000",
+		}, []string{"REDIS_CLUSTER_ADDRS"}},
+		{"bad_policy", map[string]string{
+			"DEVICE_CONNECTION_POLICY": "oldest",
+		}, []string{"DEVICE_CONNECTION_POLICY"}},
+		{"bad_overflow", map[string]string{
+			"WS_SEND_BUFFER_SIZE": "0",
+			"WS_OVERFLOW_POLICY":  "block",
+		}, []string{"WS_SEND_BUFFER_SIZE", "WS_OVERFLOW_POLICY"}},
+		{"chat_rate_above_device", map[string]string{
+			"WS_SEND_RATE_LIMIT":      "60",
+			"WS_CHAT_SEND_RATE_LIMIT": "120",
+		}, []string{"WS_CHAT_SEND_RATE_LIMIT"}},
+		{"bad_auth_window", map[string]string{
+			"AUTH_TIMESTAMP_WINDOW_SECONDS": "0",
+		}, []string{"AUTH_TIMESTAMP_WINDOW_SECONDS"}},
+		{"ping_not_before_pong", map[string]string{
+			"WS_PONG_WAIT":   "30s",
+			"WS_PING_PERIOD": "30s",
+		}, []string{"WS_PING_PERIOD"}},
+		{"bad_write_wait", map[string]string{
+			"WS_WRITE_WAIT": "0s",
+		}, []string{"WS_WRITE_WAIT"}},
+		{"bad_expiry_warnings", map[string]string{
+			"SUBSCRIPTION_EXPIRY_WARNINGS": "24h,soon",
+		}, []string{"SUBSCRIPTION_EXPIRY_WARNINGS"}},
+		{"negative_chat_registrations", map[string]string{
+			"MAX_CHAT_REGISTRATIONS": "-1",
+		}, []string{"MAX_CHAT_REGISTRATIONS"}},
+		{"negative_max_prekeys", map[string]string{
+			"MAX_PREKEYS": "-1",
+		}, []string{"MAX_PREKEYS"}},
+		{"bad_chat_lifetime", map[string]string{
+			"MAX_CHAT_LIFETIME": "0s",
+		}, []string{"MAX_CHAT_LIFETIME"}},
+		{"negative_max_connections", map[string]string{
+			"MAX_CONNECTIONS": "-1",
+		}, []string{"MAX_CONNECTIONS"}},
+		{"bad_retention", map[string]string{
+			"ACTIVATION_CODE_TTL": "0s",
+			"USED_CODE_RETENTION": "-1h",
+			"INVITATION_TTL":      "0s",
+		}, []string{"ACTIVATION_CODE_TTL", "USED_CODE_RETENTION", "INVITATION_TTL"}},
+		{"custom_retention", map[string]string{
+			"ACTIVATION_CODE_TTL": "72h",
+			"USED_CODE_RETENTION": "10m",
+			"INVITATION_TTL":      "1h",
+		}, nil},
+		{"bad_team_discount", map[string]string{
+			"TEAM_DISCOUNT_TIERS":       "3:20,10:15",
+			"TEAM_DISCOUNT_MAX_PERCENT": "100",
+		}, []string{"TEAM_DISCOUNT_TIERS must not lower", "TEAM_DISCOUNT_MAX_PERCENT"}},
+		{"malformed_team_discount", map[string]string{
+			"TEAM_DISCOUNT_TIERS": "3=20",
+		}, []string{"TEAM_DISCOUNT_TIERS is not a valid value"}},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			err := Load().Validate()
+			if len(tc.problems) == 0 {
+				if err != nil {
+					t.Fatalf("Expected a valid config, got %v", err)
+				}
+				return
+			}
+
+			var verr *ValidationError
+			if !errors.As(err, &verr) {
+				t.Fatalf("Expected a ValidationError, got %v", err)
+			}
+			if len(verr.Problems) != len(tc.problems) {
+				t.Errorf("Expected %d problems, got %v", len(tc.problems), verr.Problems)
+			}
+			for _, want := range tc.problems {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("Expected a problem mentioning %s, got %v", want, err)
+				}
+			}
+		})
+	}
+
+	t.Logf("✓ Config validation reports every problem")
+}
+
+func TestFirebaseCredentials(t *testing.T) {
+	keyJSON := `{"type":"service_account"}`
+	keyFile := filepath.Join(t.TempDir(), "firebase-key.json")
+	if err := os.WriteFile(keyFile, []byte(keyJSON), 0o600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+
+	cases := []struct {
+		name string
+		env  map[string]string
+		want string // empty when push should stay disabled
+	}{
+		{"neither", map[string]string{"FIREBASE_KEY_PATH": ""}, ""},
+		{"missing_file", map[string]string{"FIREBASE_KEY_PATH": filepath.Join(t.TempDir(), "missing.json")}, ""},
+		{"file", map[string]string{"FIREBASE_KEY_PATH": keyFile}, keyJSON},
+		{"base64", map[string]string{
+			"FIREBASE_KEY_PATH":   "",
+			"FIREBASE_KEY_BASE64": base64.StdEncoding.EncodeToString([]byte(keyJSON)),
+		}, keyJSON},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			for key, value := range tc.env {
+				t.Setenv(key, value)
+			}
+
+			data, err := Load().FirebaseCredentials()
+			if err != nil {
+				t.Fatalf("Unexpected error: %v", err)
+			}
+			if string(data) != tc.want {
+				t.Errorf("Expected credentials %q, got %q", tc.want, data)
+			}
+		})
+	}
+
+	t.Run("project_id", func(t *testing.T) {
+		t.Setenv("FIREBASE_PROJECT", "legacy-project")
+		if cfg := Load(); cfg.FirebaseProject != "legacy-project" {
+			t.Errorf("Expected FIREBASE_PROJECT honoured, got %q", cfg.FirebaseProject)
+		}
+		t.Setenv("FIREBASE_PROJECT_ID", "nihil-staging")
+		if cfg := Load(); cfg.FirebaseProject != "nihil-staging" {
+			t.Errorf("Expected FIREBASE_PROJECT_ID to win, got %q", cfg.FirebaseProject)
+		}
+	})
+
+	t.Run("invalid_base64", func(t *testing.T) {
+		t.Setenv("FIREBASE_KEY_BASE64", "not base64!")
+		cfg := Load()
+		if _, err := cfg.FirebaseCredentials(); err == nil {
+			t.Error("Expected an error for invalid base64")
+		}
+		if err := cfg.Validate(); err == nil || !strings.Contains(err.Error(), "FIREBASE_KEY_BASE64") {
+			t.Errorf("Expected Validate to report FIREBASE_KEY_BASE64, got %v", err)
+		}
+	})
+
+	t.Logf("✓ Firebase credentials read from base64, file, or left disabled")
+}
@@ -0,0 +1,107 @@
+package config
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxMessageSize bounds MESSAGE_MAX_SIZE; WebSocket frames are sized from it
+const maxMessageSize = 1 << 20
+
+// ValidationError lists every problem Validate found
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "invalid config: " + strings.Join(e.Problems, "; ")
+}
+
+// Validate checks the config is usable before anything starts
+// All problems are reported at once rather than stopping at the first
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	for _, key := range c.malformed {
+		problems = append(problems, fmt.Sprintf("%s is not a valid value", key))
+	}
+
+	port, err := strconv.Atoi(c.Port)
+	check(err == nil && port > 0 && port <= 65535, "PORT must be a port number, got %q", c.Port)
+	check(c.RateLimitPerMinute > 0, "RATE_LIMIT_PER_MINUTE must be positive")
+	check(c.WSSendRateLimit > 0, "WS_SEND_RATE_LIMIT must be positive")
+	check(c.WSChatSendRateLimit > 0 && c.WSChatSendRateLimit <= c.WSSendRateLimit, "WS_CHAT_SEND_RATE_LIMIT must be between 1 and WS_SEND_RATE_LIMIT")
+	check(c.WSTypingRateLimit > 0, "WS_TYPING_RATE_LIMIT must be positive")
+	check(c.WSReadRateLimit > 0, "WS_READ_RATE_LIMIT must be positive")
+	check(c.WSSendBufferSize > 0, "WS_SEND_BUFFER_SIZE must be positive")
+	check(c.WSOverflowPolicy == "disconnect" || c.WSOverflowPolicy == "drop_oldest", "WS_OVERFLOW_POLICY must be disconnect or drop_oldest, got %q", c.WSOverflowPolicy)
+	check(c.WSCompressThreshold >= 0, "WS_COMPRESSION_THRESHOLD must not be negative")
+	check(c.WSWriteWait > 0, "WS_WRITE_WAIT must be positive")
+	check(c.WSPingPeriod > 0 && c.WSPingPeriod < c.WSPongWait, "WS_PING_PERIOD must be positive and shorter than WS_PONG_WAIT")
+	check(c.MessageMaxSize > 0 && c.MessageMaxSize <= maxMessageSize, "MESSAGE_MAX_SIZE must be between 1 and %d bytes", maxMessageSize)
+	check(c.MaxChatParticipants >= 2, "MAX_CHAT_PARTICIPANTS must be at least 2")
+	check(c.MaxChatsPerDevice >= 0, "MAX_CHATS_PER_DEVICE must not be negative")
+	check(c.MaxPreKeys >= 0, "MAX_PREKEYS must not be negative")
+	check(c.MaxDeviceChatRegs >= 0, "MAX_CHAT_REGISTRATIONS must not be negative")
+	check(c.MaxChatLifetime > 0, "MAX_CHAT_LIFETIME must be positive")
+	check(c.MaxDeviceConns >= 0, "MAX_DEVICE_CONNECTIONS must not be negative")
+	check(c.MaxConnections >= 0, "MAX_CONNECTIONS must not be negative")
+	check(c.DeviceConnPolicy == "replace" || c.DeviceConnPolicy == "reject", "DEVICE_CONNECTION_POLICY must be replace or reject, got %q", c.DeviceConnPolicy)
+	check(c.MaxQueuedMessages > 0, "MAX_QUEUED_MESSAGES must be positive")
+	check(c.ChatSweepInterval > 0, "CHAT_SWEEP_INTERVAL must be positive")
+	check(c.ShutdownGracePeriod >= 0, "SHUTDOWN_GRACE_PERIOD must not be negative")
+	check(c.ResumeTokenTTL > 0, "RESUME_TOKEN_TTL must be positive")
+	check(c.DeliveryAckTimeout >= 0, "DELIVERY_ACK_TIMEOUT must not be negative")
+	check(c.AuthTimestampWindow > 0, "AUTH_TIMESTAMP_WINDOW_SECONDS must be positive")
+	check(c.SubscriptionGrace >= 0, "SUBSCRIPTION_GRACE_PERIOD must not be negative")
+	check(c.ActivationCodeTTL > 0, "ACTIVATION_CODE_TTL must be positive")
+	check(c.UsedCodeRetention > 0, "USED_CODE_RETENTION must be positive")
+	check(c.InvitationTTL > 0, "INVITATION_TTL must be positive")
+	for _, w := range c.SubExpiryWarnings {
+		check(w > 0, "SUBSCRIPTION_EXPIRY_WARNINGS must all be positive, got %v", w)
+	}
+	check(len(c.TeamDiscountTiers) > 0, "TEAM_DISCOUNT_TIERS must list at least one tier")
+	for count, percent := range c.TeamDiscountTiers {
+		check(count > 0 && percent >= 0 && percent < 100, "TEAM_DISCOUNT_TIERS needs a positive device count and a percent below 100, got %d:%d", count, percent)
+		for otherCount, otherPercent := range c.TeamDiscountTiers {
+			check(otherCount <= count || otherPercent >= percent, "TEAM_DISCOUNT_TIERS must not lower the discount as devices grow, got %d:%d after %d:%d", otherCount, otherPercent, count, percent)
+		}
+	}
+	check(c.TeamDiscountMax > 0 && c.TeamDiscountMax < 100, "TEAM_DISCOUNT_MAX_PERCENT must be between 1 and 99")
+	check(c.TeamPriceFloor > 0 && c.TeamPriceFloor <= 100, "TEAM_PRICE_FLOOR_PERCENT must be between 1 and 100")
+	check(c.RedisHealthInterval > 0, "REDIS_HEALTH_INTERVAL must be positive")
+	check(c.RedisSentinelAddrs == "" || c.RedisMasterName != "", "REDIS_SENTINEL_ADDRS requires REDIS_MASTER_NAME")
+	// Scripts and transactions touch several keys per call, which a cluster refuses with
+	// CROSSSLOT unless they share a hash slot - none of the keys are hash-tagged yet
+	check(c.RedisClusterAddrs == "", "REDIS_CLUSTER_ADDRS is not supported until keys are hash-tagged; use REDIS_URL or REDIS_SENTINEL_ADDRS")
+	check(c.AbuseWindow > 0, "ABUSE_WINDOW must be positive")
+	check(c.AbuseWarnings >= 0, "ABUSE_WARNINGS_BEFORE_BAN must not be negative")
+	check(c.PushMaxAttempts > 0, "PUSH_MAX_ATTEMPTS must be positive")
+	check(c.PushBreakerFailures > 0, "PUSH_BREAKER_FAILURES must be positive")
+	check(c.PushBreakerCooldown > 0, "PUSH_BREAKER_COOLDOWN must be positive")
+	_, err = base64.StdEncoding.DecodeString(c.FirebaseKeyBase64)
+	check(err == nil, "FIREBASE_KEY_BASE64 is not valid base64")
+
+	if c.Environment == "production" {
+		check(c.StripeSecretKey != "", "STRIPE_SECRET_KEY is required in production")
+		check(c.StripeWebhookSecret != "", "STRIPE_WEBHOOK_SECRET is required in production")
+		origins := strings.TrimSpace(c.CORSOrigins)
+		check(origins != "" && !strings.Contains(origins, "*"), "CORS_ORIGINS must list explicit origins in production")
+		// Without a secret salt anyone holding a UUID could find its events in the audit log
+		check(c.AuditLog == "off" || c.AuditSalt != "", "AUDIT_SALT is required in production unless AUDIT_LOG is off")
+		// Without a shared secret a claim retried on another instance is refused as already used
+		check(c.ClaimRetrySecret != "", "CLAIM_RETRY_SECRET is required in production")
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package errcode
+
+// Code is a stable, machine-readable error identifier shared by the HTTP API
+// (the "code" field next to "error") and WebSocket error payloads
+// Clients branch on these; the human-readable text may change at any time
+type Code string
+
+// Requests
+const (
+	InvalidRequest         Code = "ERR_INVALID_REQUEST"
+	InvalidPayload         Code = "ERR_INVALID_PAYLOAD"
+	InvalidJSON            Code = "ERR_INVALID_JSON"
+	InvalidTTL             Code = "ERR_INVALID_TTL"
+	InvalidMaxParticipants Code = "ERR_INVALID_MAX_PARTICIPANTS"
+	MessageTooLarge        Code = "ERR_MESSAGE_TOO_LARGE"
+	UnknownType            Code = "ERR_UNKNOWN_TYPE"
+	UnsupportedType        Code = "ERR_UNSUPPORTED_TYPE"
+	UnsupportedSubprotocol Code = "ERR_UNSUPPORTED_SUBPROTOCOL"
+	NotFound               Code = "ERR_NOT_FOUND"
+	RateLimited            Code = "ERR_RATE_LIMITED"
+	Internal               Code = "ERR_INTERNAL"
+	Unavailable            Code = "ERR_UNAVAILABLE"
+)
+
+// Authentication
+const (
+	NotAuthenticated    Code = "ERR_NOT_AUTHENTICATED"
+	InvalidTimestamp    Code = "ERR_INVALID_TIMESTAMP"
+	TimestampExpired    Code = "ERR_TIMESTAMP_EXPIRED"
+	InvalidNonce        Code = "ERR_INVALID_NONCE"
+	ReplayedRequest     Code = "ERR_REPLAYED_REQUEST"
+	InvalidSignature    Code = "ERR_INVALID_SIGNATURE"
+	InvalidAdminToken   Code = "ERR_INVALID_ADMIN_TOKEN"
+	DeviceNotFound      Code = "ERR_DEVICE_NOT_FOUND"
+	DeviceUnknown       Code = "ERR_DEVICE_UNKNOWN" // re-activate
+	KeyExpired          Code = "ERR_KEY_EXPIRED"    // re-register keys
+	DeviceBanned        Code = "ERR_DEVICE_BANNED"
+	DevicePurged        Code = "ERR_DEVICE_PURGED"
+	KeyRotated          Code = "ERR_KEY_ROTATED"
+	SessionsRevoked     Code = "ERR_SESSIONS_REVOKED"
+	KeyUnchanged        Code = "ERR_KEY_UNCHANGED"
+	KeyChanged          Code = "ERR_KEY_CHANGED"
+	ChallengeInvalid    Code = "ERR_CHALLENGE_INVALID"
+	InvalidProof        Code = "ERR_INVALID_PROOF"
+	SubscriptionExpired Code = "ERR_SUBSCRIPTION_EXPIRED"
+	NoSubscription      Code = "ERR_NO_SUBSCRIPTION"
+)
+
+// Chats and messages
+const (
+	ChatNotFound       Code = "ERR_CHAT_NOT_FOUND"
+	ChatFull           Code = "ERR_CHAT_FULL"
+	ChatPending        Code = "ERR_CHAT_PENDING"
+	TooManyChats       Code = "ERR_TOO_MANY_CHATS"
+	NotParticipant     Code = "ERR_NOT_PARTICIPANT"
+	InvalidCredentials Code = "ERR_INVALID_CREDENTIALS"
+	InvitationNotFound Code = "ERR_INVITATION_NOT_FOUND"
+	InvitationExpired  Code = "ERR_INVITATION_EXPIRED"
+	InvitationUsed     Code = "ERR_INVITATION_USED"
+	NotMessageSender   Code = "ERR_NOT_MESSAGE_SENDER"
+	InvalidDeliverAt   Code = "ERR_INVALID_DELIVER_AT"
+	DeliverAfterExpiry Code = "ERR_DELIVER_AFTER_EXPIRY"
+	AttachmentNotFound Code = "ERR_ATTACHMENT_NOT_FOUND"
+	TooManyAttachments Code = "ERR_TOO_MANY_ATTACHMENTS"
+	ChatNotActive      Code = "ERR_CHAT_NOT_ACTIVE"
+	ChatLifetimeMax    Code = "ERR_CHAT_LIFETIME_MAX"
+	PeersRemain        Code = "ERR_PEERS_REMAIN"
+)
+
+// Keys
+const (
+	KeysNotFound           Code = "ERR_KEYS_NOT_FOUND"
+	InvalidPreKeySignature Code = "ERR_INVALID_PREKEY_SIGNATURE"
+	KeyBundleChanged       Code = "ERR_KEY_BUNDLE_CHANGED"
+	InvalidPreKeyID        Code = "ERR_INVALID_PREKEY_ID"
+	DuplicatePreKeyID      Code = "ERR_DUPLICATE_PREKEY_ID"
+	TooManyPreKeys         Code = "ERR_TOO_MANY_PREKEYS"
+)
+
+// Billing and activation codes
+const (
+	CodeNotFound         Code = "ERR_CODE_NOT_FOUND"
+	CodeRevoked          Code = "ERR_CODE_REVOKED"
+	CodeUsed             Code = "ERR_CODE_USED"
+	InvalidPlan          Code = "ERR_INVALID_PLAN"
+	InvalidPromoCode     Code = "ERR_INVALID_PROMO_CODE"
+	PromoCodesDisabled   Code = "ERR_PROMO_CODES_DISABLED"
+	InvalidSession       Code = "ERR_INVALID_SESSION"
+	PaymentNotCompleted  Code = "ERR_PAYMENT_NOT_COMPLETED"
+	PaymentRevoked       Code = "ERR_PAYMENT_REVOKED"
+	SubscriptionNotFound Code = "ERR_SUBSCRIPTION_NOT_FOUND"
+)
+
+// Push
+const (
+	InvalidPushToken Code = "ERR_INVALID_PUSH_TOKEN"
+)
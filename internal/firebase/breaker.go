@@ -0,0 +1,157 @@
+package firebase
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"nihil/internal/logging"
+)
+
+// ErrCircuitOpen means FCM kept failing and sends are refused until the cooldown passes
+var ErrCircuitOpen = errors.New("fcm circuit open")
+
+// Circuit breaker states, see BreakerState
+const (
+	BreakerClosed   = "closed"    // sends go through
+	BreakerOpen     = "open"      // sends fail fast until the cooldown passes
+	BreakerHalfOpen = "half_open" // one send is let through to test whether FCM recovered
+)
+
+// BreakerPolicy opens the circuit after Failures transient failures in a row
+// and keeps it open for Cooldown before letting a probe through
+type BreakerPolicy struct {
+	Failures int
+	Cooldown time.Duration
+}
+
+var DefaultBreakerPolicy = BreakerPolicy{
+	Failures: 5,
+	Cooldown: 30 * time.Second,
+}
+
+// breaker stops every offline message from waiting out FCM timeouts during an outage
+// Only transient failures count - a rejected token means FCM is answering
+type breaker struct {
+	mu       sync.Mutex
+	policy   BreakerPolicy
+	state    string
+	failures int       // transient failures in a row while closed
+	openedAt time.Time // when the circuit last opened
+	probing  bool      // a half-open probe is in flight
+
+	opens atomic.Int64 // times the circuit opened, see BreakerOpens
+	now   func() time.Time
+}
+
+func newBreaker(policy BreakerPolicy) *breaker {
+	return &breaker{policy: policy, state: BreakerClosed, now: time.Now}
+}
+
+var pushBreaker = newBreaker(DefaultBreakerPolicy)
+
+var logger = logging.Discard()
+
+// SetLogger sets where breaker state changes are logged
+func SetLogger(l *slog.Logger) {
+	logger = l
+}
+
+// SetBreakerPolicy changes the push circuit breaker policy - zero fields keep the defaults
+// Call once at startup, before any push is sent
+func SetBreakerPolicy(p BreakerPolicy) {
+	if p.Failures <= 0 {
+		p.Failures = DefaultBreakerPolicy.Failures
+	}
+	if p.Cooldown <= 0 {
+		p.Cooldown = DefaultBreakerPolicy.Cooldown
+	}
+	pushBreaker = newBreaker(p)
+}
+
+// BreakerState reports the push circuit breaker's current state
+func BreakerState() string {
+	return pushBreaker.currentState()
+}
+
+// BreakerOpens is how many times the push circuit breaker has opened
+func BreakerOpens() int64 {
+	return pushBreaker.opens.Load()
+}
+
+// allow reports whether a send may go out
+// Once the cooldown has passed the first caller becomes the half-open probe
+func (b *breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case BreakerOpen:
+		if b.now().Sub(b.openedAt) < b.policy.Cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	default:
+		return true
+	}
+}
+
+// success closes the circuit
+func (b *breaker) success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != BreakerClosed {
+		b.setState(BreakerClosed)
+	}
+}
+
+// failure counts a transient failure, opening the circuit once there are enough in a row
+// A failed probe reopens it for another cooldown
+func (b *breaker) failure() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+	b.failures++
+	if b.state == BreakerHalfOpen || (b.state == BreakerClosed && b.failures >= b.policy.Failures) {
+		b.openedAt = b.now()
+		b.opens.Add(1)
+		b.setState(BreakerOpen)
+	}
+}
+
+// release gives back a probe that ended without telling anything, e.g. a cancelled send
+func (b *breaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) currentState() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state
+}
+
+// setState moves the breaker to state, logging the change - b.mu must be held
+func (b *breaker) setState(state string) {
+	if state == BreakerOpen {
+		logger.Warn("fcm circuit breaker opened", "from", b.state, "failures", b.failures, "cooldown", b.policy.Cooldown)
+	} else {
+		logger.Info("fcm circuit breaker "+state, "from", b.state)
+	}
+	b.state = state
+}
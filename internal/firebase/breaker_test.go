@@ -0,0 +1,112 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSendPush_CircuitBreaker(t *testing.T) {
+	var requests atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	retryPolicy = RetryPolicy{MaxAttempts: 1, BaseDelay: time.Millisecond}
+
+	now := time.Now()
+	pushBreaker = newBreaker(BreakerPolicy{Failures: 3, Cooldown: time.Minute})
+	pushBreaker.now = func() time.Time { return now }
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if err := SendPush(ctx, "token", nil, PushOptions{}); err == nil {
+			t.Fatal("Expected a failure while FCM is down")
+		}
+	}
+	if state := BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected the circuit open after 3 failures, got %s", state)
+	}
+	if n := BreakerOpens(); n != 1 {
+		t.Errorf("Expected 1 open, got %d", n)
+	}
+
+	// Open: sends fail fast without reaching FCM
+	before := requests.Load()
+	if err := SendPush(ctx, "token", nil, PushOptions{}); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected ErrCircuitOpen, got %v", err)
+	}
+	if requests.Load() != before {
+		t.Error("Expected no request while the circuit is open")
+	}
+
+	// After the cooldown a failed probe reopens it
+	now = now.Add(time.Minute)
+	if err := SendPush(ctx, "token", nil, PushOptions{}); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("Expected the probe to reach FCM and fail, got %v", err)
+	}
+	if state := BreakerState(); state != BreakerOpen {
+		t.Fatalf("Expected a failed probe to reopen the circuit, got %s", state)
+	}
+
+	// A successful probe closes it
+	down.Store(false)
+	now = now.Add(time.Minute)
+	if err := SendPush(ctx, "token", nil, PushOptions{}); err != nil {
+		t.Fatalf("Expected the probe to succeed, got %v", err)
+	}
+	if state := BreakerState(); state != BreakerClosed {
+		t.Errorf("Expected the circuit closed after a successful probe, got %s", state)
+	}
+
+	t.Logf("✓ Circuit opens after repeated failures and closes on recovery")
+}
+
+func TestBreaker_TokenErrorsDontOpen(t *testing.T) {
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+	})
+	pushBreaker = newBreaker(BreakerPolicy{Failures: 2, Cooldown: time.Minute})
+
+	for i := 0; i < 5; i++ {
+		if err := SendPush(context.Background(), "token", nil, PushOptions{}); !errors.Is(err, ErrTokenInvalid) {
+			t.Fatalf("Expected ErrTokenInvalid, got %v", err)
+		}
+	}
+	if state := BreakerState(); state != BreakerClosed {
+		t.Errorf("Expected rejected tokens to leave the circuit closed, got %s", state)
+	}
+
+	t.Logf("✓ Rejected tokens don't count as FCM failures")
+}
+
+func TestBreaker_SingleProbe(t *testing.T) {
+	now := time.Now()
+	b := newBreaker(BreakerPolicy{Failures: 1, Cooldown: time.Second})
+	b.now = func() time.Time { return now }
+
+	b.failure()
+	now = now.Add(time.Second)
+	if !b.allow() {
+		t.Fatal("Expected a probe after the cooldown")
+	}
+	if b.allow() {
+		t.Error("Expected only one probe while half open")
+	}
+	b.release()
+	if !b.allow() {
+		t.Error("Expected a released probe to let the next send through")
+	}
+
+	t.Logf("✓ Half-open circuit lets one probe through at a time")
+}
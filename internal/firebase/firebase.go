@@ -4,8 +4,11 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"sync"
 	"time"
 
 	"golang.org/x/oauth2/google"
@@ -14,11 +17,29 @@ import (
 type Client struct {
 	projectID  string
 	httpClient *http.Client
-	token      *google.Credentials
+	tokens     *tokenManager
+	baseURL    string // FCM API root, swapped for a mock server in tests
+}
+
+const fcmBaseURL = "https://fcm.googleapis.com"
+
+// ErrTokenInvalid means FCM no longer accepts the token and the registration should be dropped
+var ErrTokenInvalid = errors.New("fcm token invalid")
+
+// fcmErrorResponse is the error body FCM returns with a non-200 status
+type fcmErrorResponse struct {
+	Error struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
 }
 
 type FCMMessage struct {
-	Message Message `json:"message"`
+	ValidateOnly bool    `json:"validate_only,omitempty"` // check the request without delivering it
+	Message      Message `json:"message"`
 }
 
 type Message struct {
@@ -37,14 +58,50 @@ type AndroidConfig struct {
 	Priority string `json:"priority,omitempty"`
 }
 
+// PushOptions controls the visible part of a push
+// The zero value shows the default generic "nihil / New message" notification
+type PushOptions struct {
+	DataOnly bool   // send no notification block at all, the app wakes silently
+	Title    string // generic title, e.g. an org name; never chat metadata
+	Body     string
+}
+
+const (
+	defaultTitle = "nihil"
+	defaultBody  = "New message"
+)
+
+// RetryPolicy bounds how hard SendPush tries when FCM or the network fails transiently
+// Waits BaseDelay after the first failure, doubling each time
+type RetryPolicy struct {
+	MaxAttempts int
+	BaseDelay   time.Duration
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   250 * time.Millisecond,
+}
+
 var client *Client
 
+var retryPolicy = DefaultRetryPolicy
+
+// SetRetryPolicy changes the push retry policy - zero fields keep the defaults
+func SetRetryPolicy(p RetryPolicy) {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = DefaultRetryPolicy.MaxAttempts
+	}
+	if p.BaseDelay <= 0 {
+		p.BaseDelay = DefaultRetryPolicy.BaseDelay
+	}
+	retryPolicy = p
+}
+
 // Initialize creates the Firebase client
 // serviceAccountJSON is the content of the service account JSON file
 func Initialize(projectID string, serviceAccountJSON []byte) error {
-	ctx := context.Background()
-	
-	creds, err := google.CredentialsFromJSON(ctx, serviceAccountJSON,
+	creds, err := google.JWTConfigFromJSON(serviceAccountJSON,
 		"https://www.googleapis.com/auth/firebase.messaging",
 	)
 	if err != nil {
@@ -54,64 +111,177 @@ func Initialize(projectID string, serviceAccountJSON []byte) error {
 	client = &Client{
 		projectID:  projectID,
 		httpClient: &http.Client{Timeout: 10 * time.Second},
-		token:      creds,
+		tokens:     newTokenManager(jwtSource{cfg: creds}),
+		baseURL:    fcmBaseURL,
 	}
 
 	return nil
 }
 
 // SendPush sends a push notification that shows even when app is closed
-func SendPush(ctx context.Context, fcmToken string, data map[string]string) error {
+// unless opts asks for a data-only push
+// Returns ErrCircuitOpen without trying while FCM is considered down
+func SendPush(ctx context.Context, fcmToken string, data map[string]string, opts PushOptions) error {
 	if client == nil {
 		return fmt.Errorf("firebase client not initialized")
 	}
+	defer Track()()
+
+	b := pushBreaker
+	if !b.allow() {
+		return ErrCircuitOpen
+	}
+
+	transient, err := send(ctx, fcmToken, data, opts)
+	switch {
+	case err != nil && ctx.Err() != nil:
+		b.release()
+	case transient:
+		b.failure()
+	default:
+		b.success()
+	}
+	return err
+}
 
+// send makes the FCM request, retrying transient failures
+// Reports whether the final error was transient, i.e. FCM or the network is at fault
+func send(ctx context.Context, fcmToken string, data map[string]string, opts PushOptions) (bool, error) {
 	// Get OAuth2 token
-	token, err := client.token.TokenSource.Token()
+	token, err := client.tokens.Token()
 	if err != nil {
-		return fmt.Errorf("failed to get token: %w", err)
+		return true, fmt.Errorf("failed to get token: %w", err)
 	}
 
-	msg := FCMMessage{
-		Message: Message{
-			Token: fcmToken,
-			// Notification field is required for background/closed app
-			Notification: &Notification{
-				Title: "nihil",
-				Body:  "New message",
-			},
-			Data: data,
-			Android: &AndroidConfig{
-				Priority: "high",
-			},
-		},
+	body, err := json.Marshal(newMessage(fcmToken, data, opts))
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
-	body, err := json.Marshal(msg)
-	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+	url := fmt.Sprintf("%s/v1/projects/%s/messages:send", client.baseURL, client.projectID)
+
+	// Retries 5xx and network errors; a 4xx won't change on retry
+	delay := retryPolicy.BaseDelay
+	for attempt := 1; ; attempt++ {
+		retry, err := post(ctx, url, token.AccessToken, body)
+		if err == nil || !retry || attempt >= retryPolicy.MaxAttempts {
+			return retry, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return retry, err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// maxBatchConcurrency caps the requests SendPushBatch has in flight
+const maxBatchConcurrency = 10
+
+// PushResult is the outcome of one token in a batch
+type PushResult struct {
+	Token string
+	Err   error
+}
+
+// SendPushBatch sends the same push to several tokens, e.g. every offline member of a group
+// FCM's HTTP v1 API has no multicast endpoint, so the sends run concurrently sharing one
+// OAuth token and the client's connections. Results line up with tokens so each
+// failure, ErrTokenInvalid in particular, can be handled on its own
+func SendPushBatch(ctx context.Context, tokens []string, data map[string]string, opts PushOptions) []PushResult {
+	results := make([]PushResult, len(tokens))
+	sem := make(chan struct{}, maxBatchConcurrency)
+	var wg sync.WaitGroup
+
+	for i, fcmToken := range tokens {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, fcmToken string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = PushResult{Token: fcmToken, Err: SendPush(ctx, fcmToken, data, opts)}
+		}(i, fcmToken)
 	}
+	wg.Wait()
+
+	return results
+}
 
-	url := fmt.Sprintf("https://fcm.googleapis.com/v1/projects/%s/messages:send", client.projectID)
+// post makes a single FCM send request
+// Reports whether a failure is transient and worth retrying
+func post(ctx context.Context, url, accessToken string, body []byte) (bool, error) {
 	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
 	if err != nil {
-		return fmt.Errorf("failed to create request: %w", err)
+		return false, fmt.Errorf("failed to create request: %w", err)
 	}
 
-	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Authorization", "Bearer "+accessToken)
 	req.Header.Set("Content-Type", "application/json")
 
 	resp, err := client.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send request: %w", err)
+		return ctx.Err() == nil, fmt.Errorf("failed to send request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode >= 500, responseError(resp)
+	}
+
+	return false, nil
+}
+
+// responseError turns a failed FCM response into an error
+// Wraps ErrTokenInvalid when FCM says the token is unregistered, malformed or from another project
+func responseError(resp *http.Response) error {
+	var body fcmErrorResponse
+	json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&body)
+
+	code := body.Error.Status
+	for _, detail := range body.Error.Details {
+		if detail.ErrorCode != "" {
+			code = detail.ErrorCode
+			break
+		}
+	}
+
+	switch code {
+	case "UNREGISTERED", "INVALID_ARGUMENT", "SENDER_ID_MISMATCH":
+		return fmt.Errorf("%w: %s", ErrTokenInvalid, code)
+	case "":
 		return fmt.Errorf("FCM returned status %d", resp.StatusCode)
+	default:
+		return fmt.Errorf("FCM returned status %d: %s", resp.StatusCode, code)
 	}
+}
 
-	return nil
+// newMessage builds the FCM request body for a push
+func newMessage(fcmToken string, data map[string]string, opts PushOptions) FCMMessage {
+	msg := FCMMessage{
+		Message: Message{
+			Token: fcmToken,
+			Data:  data,
+			Android: &AndroidConfig{
+				Priority: "high",
+			},
+		},
+	}
+
+	// Notification field is required for background/closed app, except on
+	// clients that handle the data-only wake-up themselves
+	if !opts.DataOnly {
+		msg.Message.Notification = &Notification{Title: opts.Title, Body: opts.Body}
+		if msg.Message.Notification.Title == "" {
+			msg.Message.Notification.Title = defaultTitle
+		}
+		if msg.Message.Notification.Body == "" {
+			msg.Message.Notification.Body = defaultBody
+		}
+	}
+
+	return msg
 }
 
 // IsInitialized returns true if Firebase is ready
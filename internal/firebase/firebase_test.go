@@ -0,0 +1,200 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// setupFakeFCM points the package client at a local server answering with handler
+// Retries back off in milliseconds so failing cases stay fast
+func setupFakeFCM(t *testing.T, handler http.HandlerFunc) {
+	srv := httptest.NewServer(handler)
+	prev, prevRetry, prevBreaker := client, retryPolicy, pushBreaker
+	retryPolicy = RetryPolicy{MaxAttempts: 3, BaseDelay: time.Millisecond}
+	pushBreaker = newBreaker(DefaultBreakerPolicy)
+	client = &Client{
+		projectID:  "test-project",
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+		tokens:     newTokenManager(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test-access-token"})),
+		baseURL:    srv.URL,
+	}
+	t.Cleanup(func() {
+		client, retryPolicy, pushBreaker = prev, prevRetry, prevBreaker
+		srv.Close()
+	})
+}
+
+func TestNewMessage_PushOptions(t *testing.T) {
+	data := map[string]string{"type": "wake"}
+
+	t.Run("default", func(t *testing.T) {
+		msg := newMessage("token", data, PushOptions{})
+		if n := msg.Message.Notification; n == nil || n.Title != "nihil" || n.Body != "New message" {
+			t.Errorf("Expected the default notification, got %+v", n)
+		}
+	})
+
+	t.Run("custom_title", func(t *testing.T) {
+		msg := newMessage("token", data, PushOptions{Title: "Acme Corp"})
+		if n := msg.Message.Notification; n == nil || n.Title != "Acme Corp" || n.Body != "New message" {
+			t.Errorf("Expected the custom title with the default body, got %+v", n)
+		}
+	})
+
+	t.Run("data_only", func(t *testing.T) {
+		body, err := json.Marshal(newMessage("token", data, PushOptions{DataOnly: true, Title: "Acme Corp"}))
+		if err != nil {
+			t.Fatalf("Failed to marshal message: %v", err)
+		}
+		if strings.Contains(string(body), `"notification"`) {
+			t.Errorf("Expected no notification block, got %s", body)
+		}
+		if !strings.Contains(string(body), `"wake"`) {
+			t.Errorf("Expected the wake-up data, got %s", body)
+		}
+	})
+
+	t.Logf("✓ Push notification block follows the push options")
+}
+
+func TestSendPush_TokenInvalid(t *testing.T) {
+	cases := []struct {
+		name    string
+		status  int
+		body    string
+		invalid bool
+	}{
+		{"unregistered", http.StatusNotFound,
+			`{"error":{"code":404,"status":"NOT_FOUND","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNREGISTERED"}]}}`, true},
+		{"invalid_argument", http.StatusBadRequest,
+			`{"error":{"code":400,"status":"INVALID_ARGUMENT","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"INVALID_ARGUMENT"}]}}`, true},
+		{"unavailable", http.StatusServiceUnavailable,
+			`{"error":{"code":503,"status":"UNAVAILABLE","details":[{"@type":"type.googleapis.com/google.firebase.fcm.v1.FcmError","errorCode":"UNAVAILABLE"}]}}`, false},
+		{"no_body", http.StatusInternalServerError, ``, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/v1/projects/test-project/messages:send" {
+					t.Errorf("Unexpected FCM path %s", r.URL.Path)
+				}
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			})
+
+			err := SendPush(context.Background(), "dead-token", map[string]string{"type": "wake"}, PushOptions{})
+			if err == nil {
+				t.Fatal("Expected an error")
+			}
+			if errors.Is(err, ErrTokenInvalid) != tc.invalid {
+				t.Errorf("Expected ErrTokenInvalid %v, got %v", tc.invalid, err)
+			}
+		})
+	}
+
+	t.Logf("✓ Unregistered and invalid tokens reported as ErrTokenInvalid")
+}
+
+func TestSendPush_RetriesTransientFailures(t *testing.T) {
+	serve := func(t *testing.T, statuses ...int) *int {
+		attempts := 0
+		setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+			status := http.StatusOK
+			if attempts < len(statuses) {
+				status = statuses[attempts]
+			}
+			attempts++
+			w.WriteHeader(status)
+		})
+		return &attempts
+	}
+
+	t.Run("recovers_after_503", func(t *testing.T) {
+		attempts := serve(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+		if err := SendPush(context.Background(), "token", nil, PushOptions{}); err != nil {
+			t.Fatalf("Expected eventual success, got %v", err)
+		}
+		if *attempts != 3 {
+			t.Errorf("Expected 3 attempts, got %d", *attempts)
+		}
+	})
+
+	t.Run("gives_up", func(t *testing.T) {
+		attempts := serve(t, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError)
+		if err := SendPush(context.Background(), "token", nil, PushOptions{}); err == nil {
+			t.Fatal("Expected an error once attempts are exhausted")
+		}
+		if *attempts != 3 {
+			t.Errorf("Expected 3 attempts, got %d", *attempts)
+		}
+	})
+
+	t.Run("no_retry_on_4xx", func(t *testing.T) {
+		attempts := serve(t, http.StatusNotFound)
+		if err := SendPush(context.Background(), "token", nil, PushOptions{}); err == nil {
+			t.Fatal("Expected an error for a 404")
+		}
+		if *attempts != 1 {
+			t.Errorf("Expected a single attempt, got %d", *attempts)
+		}
+	})
+
+	t.Logf("✓ Transient FCM failures retried with backoff, client errors not")
+}
+
+func TestSendPushBatch_PartialFailure(t *testing.T) {
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		var msg FCMMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		if msg.Message.Token == "dead-token" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":{"code":404,"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`))
+		}
+	})
+
+	tokens := []string{"token-a", "dead-token", "token-b"}
+	results := SendPushBatch(context.Background(), tokens, map[string]string{"type": "wake"}, PushOptions{})
+	if len(results) != len(tokens) {
+		t.Fatalf("Expected %d results, got %d", len(tokens), len(results))
+	}
+	for i, result := range results {
+		if result.Token != tokens[i] {
+			t.Errorf("Result %d: expected token %s, got %s", i, tokens[i], result.Token)
+		}
+		if invalid := errors.Is(result.Err, ErrTokenInvalid); invalid != (tokens[i] == "dead-token") {
+			t.Errorf("Result %d: unexpected error %v", i, result.Err)
+		}
+		if tokens[i] != "dead-token" && result.Err != nil {
+			t.Errorf("Result %d: expected success, got %v", i, result.Err)
+		}
+	}
+
+	t.Logf("✓ Batch reports per-token results")
+}
+
+func TestInitialize_NoCredentials(t *testing.T) {
+	prev := client
+	client = nil
+	t.Cleanup(func() { client = prev })
+
+	if err := Initialize("test-project", nil); err == nil {
+		t.Error("Expected an error without credentials")
+	}
+	if IsInitialized() {
+		t.Error("Expected push to stay disabled")
+	}
+	if err := SendPush(context.Background(), "token", nil, PushOptions{}); err == nil {
+		t.Error("Expected SendPush to fail while disabled")
+	}
+
+	t.Logf("✓ Push stays disabled without a service account key")
+}
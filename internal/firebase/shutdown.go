@@ -0,0 +1,53 @@
+package firebase
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// inflight counts pushes still being sent so Shutdown can wait for them
+var (
+	inflightMu sync.Mutex
+	inflight   sync.WaitGroup
+	closing    bool
+)
+
+// Track registers a push about to be sent, e.g. before handing it to a goroutine,
+// so Shutdown waits for it. Call the returned func once the push is done
+// Once Shutdown has started nothing more is tracked
+func Track() (done func()) {
+	inflightMu.Lock()
+	defer inflightMu.Unlock()
+	if closing {
+		return func() {}
+	}
+	inflight.Add(1)
+	return inflight.Done
+}
+
+// Shutdown waits for in-flight pushes until ctx is done, then closes the client's idle connections
+// Returns an error if pushes were still being sent when ctx ran out
+func Shutdown(ctx context.Context) error {
+	inflightMu.Lock()
+	closing = true
+	inflightMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		inflight.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		err = fmt.Errorf("pushes still in flight: %w", ctx.Err())
+	}
+
+	if client != nil {
+		client.httpClient.CloseIdleConnections()
+	}
+	return err
+}
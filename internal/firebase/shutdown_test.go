@@ -0,0 +1,81 @@
+package firebase
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// resetShutdown lets later tests track pushes again after one shut the package down
+func resetShutdown(t *testing.T) {
+	t.Cleanup(func() {
+		inflightMu.Lock()
+		closing = false
+		inflightMu.Unlock()
+	})
+}
+
+func TestShutdown_WaitsForInFlightPush(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	resetShutdown(t)
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- SendPush(context.Background(), "token", nil, PushOptions{})
+	}()
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- Shutdown(ctx)
+	}()
+
+	select {
+	case err := <-stopped:
+		t.Fatalf("Expected Shutdown to wait for the push, returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(release)
+	if err := <-stopped; err != nil {
+		t.Fatalf("Expected Shutdown to finish once the push completed, got %v", err)
+	}
+	if err := <-sent; err != nil {
+		t.Errorf("Expected the in-flight push to succeed, got %v", err)
+	}
+
+	t.Logf("✓ Shutdown waits for an in-flight push within the deadline")
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	received := make(chan struct{})
+	release := make(chan struct{})
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-release
+		w.WriteHeader(http.StatusOK)
+	})
+	resetShutdown(t)
+	defer close(release)
+
+	go SendPush(context.Background(), "token", nil, PushOptions{})
+	<-received
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected Shutdown to give up at the deadline, got %v", err)
+	}
+
+	t.Logf("✓ Shutdown gives up on pushes still in flight at the deadline")
+}
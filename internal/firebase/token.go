@@ -0,0 +1,103 @@
+package firebase
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/jwt"
+)
+
+// refreshMargin is how long before expiry a token is replaced
+// Callers keep getting the old token while one of them fetches the new one
+const refreshMargin = 5 * time.Minute
+
+// tokenManager caches the FCM OAuth token for concurrent senders
+// source must fetch a new token on every call; caching happens here
+type tokenManager struct {
+	source    oauth2.TokenSource
+	token     *oauth2.Token
+	mu        sync.RWMutex
+	refreshMu sync.Mutex   // one refresh at a time
+	refreshes atomic.Int64 // successful refreshes, see TokenRefreshes
+}
+
+func newTokenManager(source oauth2.TokenSource) *tokenManager {
+	return &tokenManager{source: source}
+}
+
+// Token returns the cached token, refreshing it when it's close to expiry
+func (m *tokenManager) Token() (*oauth2.Token, error) {
+	m.mu.RLock()
+	tok := m.token
+	m.mu.RUnlock()
+
+	if fresh(tok) {
+		return tok, nil
+	}
+
+	// Still usable: whoever gets the lock refreshes, everyone else carries on
+	if tok.Valid() {
+		if !m.refreshMu.TryLock() {
+			return tok, nil
+		}
+	} else {
+		m.refreshMu.Lock()
+	}
+	defer m.refreshMu.Unlock()
+
+	return m.refresh()
+}
+
+// refresh fetches a new token unless another caller just did; refreshMu must be held
+func (m *tokenManager) refresh() (*oauth2.Token, error) {
+	m.mu.RLock()
+	tok := m.token
+	m.mu.RUnlock()
+	if fresh(tok) {
+		return tok, nil
+	}
+
+	next, err := m.source.Token()
+	if err != nil {
+		// A refresh ahead of expiry can fail without losing the current token
+		if tok.Valid() {
+			return tok, nil
+		}
+		return nil, err
+	}
+
+	m.mu.Lock()
+	m.token = next
+	m.mu.Unlock()
+	m.refreshes.Add(1)
+
+	return next, nil
+}
+
+func fresh(tok *oauth2.Token) bool {
+	if !tok.Valid() {
+		return false
+	}
+	return tok.Expiry.IsZero() || time.Until(tok.Expiry) > refreshMargin
+}
+
+// jwtSource fetches a new service account token on every call
+// jwt.Config.TokenSource caches on its own, so a new one is built each time
+type jwtSource struct {
+	cfg *jwt.Config
+}
+
+func (s jwtSource) Token() (*oauth2.Token, error) {
+	return s.cfg.TokenSource(context.Background()).Token()
+}
+
+// TokenRefreshes reports how many times the FCM OAuth token has been fetched
+func TokenRefreshes() int64 {
+	if client == nil {
+		return 0
+	}
+	return client.tokens.refreshes.Load()
+}
@@ -0,0 +1,86 @@
+package firebase
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// fakeTokenSource hands out a new token per call, slowly enough for callers to pile up
+type fakeTokenSource struct {
+	calls  atomic.Int64
+	expiry time.Duration
+}
+
+func (s *fakeTokenSource) Token() (*oauth2.Token, error) {
+	n := s.calls.Add(1)
+	time.Sleep(20 * time.Millisecond)
+	return &oauth2.Token{
+		AccessToken: "fake-access-token-" + strconv.FormatInt(n, 10),
+		Expiry:      time.Now().Add(s.expiry),
+	}, nil
+}
+
+func TestTokenManager_ConcurrentSendsRefreshOnce(t *testing.T) {
+	source := &fakeTokenSource{expiry: time.Hour}
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {})
+	client.tokens = newTokenManager(source)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := SendPush(context.Background(), "token", nil, PushOptions{}); err != nil {
+				t.Errorf("Send failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := source.calls.Load(); calls != 1 {
+		t.Errorf("Expected one token fetch for the burst, got %d", calls)
+	}
+	if TokenRefreshes() != 1 {
+		t.Errorf("Expected one refresh counted, got %d", TokenRefreshes())
+	}
+
+	t.Logf("✓ Burst of concurrent sends shares one token fetch")
+}
+
+func TestTokenManager_RefreshesBeforeExpiry(t *testing.T) {
+	// Issued tokens are already inside the refresh margin
+	source := &fakeTokenSource{expiry: refreshMargin / 2}
+	m := newTokenManager(source)
+
+	first, err := m.Token()
+	if err != nil {
+		t.Fatalf("Failed to get token: %v", err)
+	}
+
+	// A still-valid token is served while someone else refreshes
+	m.refreshMu.Lock()
+	if tok, _ := m.Token(); tok != first {
+		t.Error("Expected the cached token while a refresh is in flight")
+	}
+	m.refreshMu.Unlock()
+
+	second, err := m.Token()
+	if err != nil {
+		t.Fatalf("Failed to refresh token: %v", err)
+	}
+	if second.AccessToken == first.AccessToken {
+		t.Error("Expected a new token ahead of expiry")
+	}
+	if n := m.refreshes.Load(); n != 2 {
+		t.Errorf("Expected 2 refreshes, got %d", n)
+	}
+
+	t.Logf("✓ Token replaced before it expires")
+}
@@ -0,0 +1,62 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+)
+
+// Registration tokens are around 160 characters today; the bounds leave room for format changes
+const (
+	minTokenLength = 32
+	maxTokenLength = 4096
+)
+
+// WellFormedToken reports whether token could be an FCM registration token:
+// a sensible length, made of URL-safe base64 characters and the ':' separating its parts
+// It says nothing about whether FCM accepts the token, see ValidateToken
+func WellFormedToken(token string) bool {
+	if len(token) < minTokenLength || len(token) > maxTokenLength {
+		return false
+	}
+	for _, r := range token {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidateToken asks FCM whether the token can be sent to from the configured project,
+// without delivering anything. Returns ErrTokenInvalid when FCM rejects the token,
+// a token issued for another Firebase project included
+// Any other error means FCM couldn't be asked and says nothing about the token
+func ValidateToken(ctx context.Context, fcmToken string) error {
+	if client == nil {
+		return fmt.Errorf("firebase client not initialized")
+	}
+	if !pushBreaker.allow() {
+		return ErrCircuitOpen
+	}
+	// A dry run is not a push, so it doesn't count toward the breaker either way
+	defer pushBreaker.release()
+
+	token, err := client.tokens.Token()
+	if err != nil {
+		return fmt.Errorf("failed to get token: %w", err)
+	}
+
+	msg := newMessage(fcmToken, nil, PushOptions{DataOnly: true})
+	msg.ValidateOnly = true
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	url := fmt.Sprintf("%s/v1/projects/%s/messages:send", client.baseURL, client.projectID)
+	_, err = post(ctx, url, token.AccessToken, body)
+	return err
+}
@@ -0,0 +1,74 @@
+package firebase
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testToken is shaped like a real registration token
+var testToken = "dQw4w9WgXcQ:APA91bH" + strings.Repeat("x7_Kq-Z", 20)
+
+func TestWellFormedToken(t *testing.T) {
+	cases := []struct {
+		token string
+		want  bool
+	}{
+		{testToken, true},
+		{"", false},
+		{"short:token", false},
+		{strings.Repeat("a", maxTokenLength+1), false},
+		{testToken + " ", false},
+		{testToken + "<script>", false},
+		{strings.Replace(testToken, "x", "é", 1), false},
+	}
+	for _, tc := range cases {
+		if got := WellFormedToken(tc.token); got != tc.want {
+			t.Errorf("WellFormedToken(%.20q): expected %v, got %v", tc.token, tc.want, got)
+		}
+	}
+
+	t.Logf("✓ Well-formed tokens accepted, garbage refused")
+}
+
+func TestValidateToken(t *testing.T) {
+	var status int
+	var reply string
+	setupFakeFCM(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			ValidateOnly bool `json:"validate_only"`
+		}
+		json.NewDecoder(r.Body).Decode(&req)
+		if !req.ValidateOnly {
+			t.Error("Expected a validate-only request")
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(reply))
+	})
+	ctx := context.Background()
+
+	status, reply = http.StatusOK, `{"name":"projects/test-project/messages/fake"}`
+	if err := ValidateToken(ctx, testToken); err != nil {
+		t.Errorf("Expected a valid token, got %v", err)
+	}
+
+	status, reply = http.StatusForbidden, `{"error":{"status":"PERMISSION_DENIED","details":[{"errorCode":"SENDER_ID_MISMATCH"}]}}`
+	if err := ValidateToken(ctx, testToken); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Expected ErrTokenInvalid for another project's token, got %v", err)
+	}
+
+	status, reply = http.StatusNotFound, `{"error":{"status":"NOT_FOUND","details":[{"errorCode":"UNREGISTERED"}]}}`
+	if err := ValidateToken(ctx, testToken); !errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Expected ErrTokenInvalid for an unregistered token, got %v", err)
+	}
+
+	status, reply = http.StatusServiceUnavailable, ""
+	if err := ValidateToken(ctx, testToken); err == nil || errors.Is(err, ErrTokenInvalid) {
+		t.Errorf("Expected an outage not to condemn the token, got %v", err)
+	}
+
+	t.Logf("✓ FCM dry run tells valid tokens from rejected ones")
+}
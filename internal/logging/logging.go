@@ -0,0 +1,40 @@
+package logging
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// New creates a JSON logger writing to stdout at the given level
+// Never pass participant secrets, push tokens or message content as attributes
+func New(level string) *slog.Logger {
+	return NewWithWriter(os.Stdout, level)
+}
+
+// NewWithWriter creates a JSON logger writing to w at the given level
+func NewWithWriter(w io.Writer, level string) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level: ParseLevel(level),
+	}))
+}
+
+// ParseLevel maps debug|info|warn|error to a slog level, defaulting to info
+func ParseLevel(level string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Discard returns a logger that drops everything, for tests
+func Discard() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(io.Discard, nil))
+}
@@ -0,0 +1,76 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+var ErrAttachmentNotFound = errors.New("attachment not found")
+
+// Attachment is an encrypted blob a participant uploaded out-of-band for a chat
+// Only where it lives is kept here; the key to decrypt it travels inside the message
+type Attachment struct {
+	AttachmentID        string `json:"attachment_id"`
+	ChatUUID            string `json:"chat_uuid"`
+	ObjectKey           string `json:"object_key"`
+	UploaderParticipant string `json:"uploader_participant"`
+	CreatedAt           int64  `json:"created_at"`
+}
+
+func attachmentKey(chatUUID, attachmentID string) string {
+	return fmt.Sprintf("attachment:%s:%s", chatUUID, attachmentID)
+}
+
+// CreateAttachment stores an attachment reference for as long as its chat lives
+func (c *Client) CreateAttachment(ctx context.Context, chat *Chat, att *Attachment) error {
+	ttl := time.Until(chat.ExpiresAt())
+	if ttl <= 0 {
+		return fmt.Errorf("chat has expired")
+	}
+
+	attJSON, err := json.Marshal(att)
+	if err != nil {
+		return fmt.Errorf("failed to marshal attachment: %w", err)
+	}
+	if err := c.rdb.Set(ctx, attachmentKey(chat.ChatUUID, att.AttachmentID), attJSON, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to store attachment: %w", err)
+	}
+	return nil
+}
+
+// GetAttachment returns an attachment reference, ErrAttachmentNotFound unless it belongs to the chat
+func (c *Client) GetAttachment(ctx context.Context, chatUUID, attachmentID string) (*Attachment, error) {
+	attJSON, err := c.rdb.Get(ctx, attachmentKey(chatUUID, attachmentID)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrAttachmentNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get attachment: %w", err)
+	}
+
+	var att Attachment
+	if err := json.Unmarshal(attJSON, &att); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal attachment: %w", err)
+	}
+	return &att, nil
+}
+
+// AttachmentsExist reports whether every attachment ID was issued for the chat
+func (c *Client) AttachmentsExist(ctx context.Context, chatUUID string, attachmentIDs []string) (bool, error) {
+	// One key at a time, so cluster mode doesn't need them in the same slot
+	for _, id := range attachmentIDs {
+		n, err := c.rdb.Exists(ctx, attachmentKey(chatUUID, id)).Result()
+		if err != nil {
+			return false, fmt.Errorf("failed to check attachments: %w", err)
+		}
+		if n == 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
@@ -5,16 +5,20 @@ import (
 "encoding/json"
 "fmt"
 "time"
+
+"nihil/internal/audit"
 )
 
 const (
 WarningExpiry = 24 * time.Hour
 )
 
+// Ban blocks a device until ExpiresAt, or forever if ExpiresAt is zero
 type Ban struct {
 DeviceUUID string    `json:"device_uuid"`
 Reason     string    `json:"reason"`
 BannedAt   time.Time `json:"banned_at"`
+ExpiresAt  time.Time `json:"expires_at"`
 }
 
 type Warning struct {
@@ -24,26 +28,39 @@ Count       int       `json:"count"`
 LastWarning time.Time `json:"last_warning"`
 }
 
-func (c *Client) IsBanned(ctx context.Context, deviceUUID string) (bool, string, error) {
+// IsBanned reports whether a device is banned, why, and how long the ban has left
+// remaining is zero for a permanent ban
+func (c *Client) IsBanned(ctx context.Context, deviceUUID string) (bool, string, time.Duration, error) {
 banKey := fmt.Sprintf("ban:%s", deviceUUID)
 banJSON, err := c.rdb.Get(ctx, banKey).Result()
 if err != nil {
-return false, "", nil
+return false, "", 0, nil
 }
 
 var ban Ban
 if err := json.Unmarshal([]byte(banJSON), &ban); err != nil {
-return false, "", nil
+return false, "", 0, nil
+}
+
+// TTL is -1 for a key without expiry, i.e. a permanent ban
+remaining, err := c.rdb.TTL(ctx, banKey).Result()
+if err != nil || remaining < 0 {
+remaining = 0
 }
 
-return true, ban.Reason, nil
+return true, ban.Reason, remaining, nil
 }
 
-func (c *Client) BanDevice(ctx context.Context, deviceUUID, reason string) error {
+// BanDevice bans a device for the given duration; zero bans it permanently
+func (c *Client) BanDevice(ctx context.Context, deviceUUID, reason string, duration time.Duration) error {
+now := time.Now()
 ban := Ban{
 DeviceUUID: deviceUUID,
 Reason:     reason,
-BannedAt:   time.Now(),
+BannedAt:   now,
+}
+if duration > 0 {
+ban.ExpiresAt = now.Add(duration)
 }
 
 banJSON, err := json.Marshal(ban)
@@ -52,16 +69,43 @@ return fmt.Errorf("failed to marshal ban: %w", err)
 }
 
 banKey := fmt.Sprintf("ban:%s", deviceUUID)
-if err := c.rdb.Set(ctx, banKey, banJSON, 0).Err(); err != nil {
+if err := c.rdb.Set(ctx, banKey, banJSON, duration).Err(); err != nil {
 return fmt.Errorf("failed to ban device: %w", err)
 }
 
 c.rdb.Del(ctx, fmt.Sprintf("warn:%s", deviceUUID))
-c.rdb.Del(ctx, fmt.Sprintf("rate:%s", deviceUUID))
+c.rdb.Del(ctx, rateKeys(deviceUUID)...)
+
+audit.Record(audit.EventBan, deviceUUID, reason)
+return nil
+}
 
+// Unban lifts a ban and clears the device's warnings so it starts fresh
+func (c *Client) Unban(ctx context.Context, deviceUUID string) error {
+err := c.rdb.Del(ctx,
+fmt.Sprintf("ban:%s", deviceUUID),
+fmt.Sprintf("warn:%s", deviceUUID),
+).Err()
+if err != nil {
+return fmt.Errorf("failed to unban device: %w", err)
+}
 return nil
 }
 
+// warningTTL is how long a warning is kept: WarningExpiry, or the quiet period if that's
+// shorter, so a device that behaves for the quiet period starts fresh without a check per message
+func (c *Client) warningTTL() time.Duration {
+if c.abuse.QuietPeriod <= 0 {
+return WarningExpiry
+}
+return min(c.abuse.QuietPeriod, WarningExpiry)
+}
+
+// WarningExpiresAt returns when a warning lapses unless the device offends again
+func (c *Client) WarningExpiresAt(warning *Warning) time.Time {
+return warning.LastWarning.Add(c.warningTTL())
+}
+
 func (c *Client) GetWarning(ctx context.Context, deviceUUID string) (*Warning, error) {
 warnKey := fmt.Sprintf("warn:%s", deviceUUID)
 warnJSON, err := c.rdb.Get(ctx, warnKey).Result()
@@ -80,36 +124,38 @@ return &warning, nil
 func (c *Client) AddWarning(ctx context.Context, deviceUUID, reason string) (bool, error) {
 warning, _ := c.GetWarning(ctx, deviceUUID)
 
-if warning != nil && warning.Count >= 1 {
+// A device never warned has used none of its warnings, so 0 bans on the first offence
+count := 0
+if warning != nil {
+count = warning.Count
+}
+if count >= c.abuse.WarningsBeforeBan {
 return true, nil
 }
 
 newWarning := Warning{
 DeviceUUID:  deviceUUID,
 Reason:      reason,
-Count:       1,
+Count:       count + 1,
 LastWarning: time.Now(),
 }
 
-if warning != nil {
-newWarning.Count = warning.Count + 1
-}
-
 warnJSON, err := json.Marshal(newWarning)
 if err != nil {
 return false, fmt.Errorf("failed to marshal warning: %w", err)
 }
 
 warnKey := fmt.Sprintf("warn:%s", deviceUUID)
-if err := c.rdb.Set(ctx, warnKey, warnJSON, WarningExpiry).Err(); err != nil {
+if err := c.rdb.Set(ctx, warnKey, warnJSON, c.warningTTL()).Err(); err != nil {
 return false, fmt.Errorf("failed to store warning: %w", err)
 }
 
 return false, nil
 }
 
-func (c *Client) HandleAbuse(ctx context.Context, deviceUUID, reason string) (string, error) {
-banned, _, _ := c.IsBanned(ctx, deviceUUID)
+// HandleAbuse warns a device for abuse and bans it for banDuration once it's out of warnings
+func (c *Client) HandleAbuse(ctx context.Context, deviceUUID, reason string, banDuration time.Duration) (string, error) {
+banned, _, _, _ := c.IsBanned(ctx, deviceUUID)
 if banned {
 return "ban", nil
 }
@@ -120,11 +166,12 @@ return "", err
 }
 
 if shouldBan {
-if err := c.BanDevice(ctx, deviceUUID, reason); err != nil {
+if err := c.BanDevice(ctx, deviceUUID, reason, banDuration); err != nil {
 return "", err
 }
 return "ban", nil
 }
 
+audit.Record(audit.EventAbuseWarning, deviceUUID, reason)
 return "warning", nil
 }
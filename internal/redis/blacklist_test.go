@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"nihil/internal/audit"
+)
+
+func TestBanDevice_Expires(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-ban-expiry-" + time.Now().Format("150405.000000")
+	defer client.Unban(ctx, deviceUUID)
+
+	if err := client.BanDevice(ctx, deviceUUID, "rate_limit_exceeded", time.Second); err != nil {
+		t.Fatalf("Failed to ban device: %v", err)
+	}
+
+	banned, reason, remaining, _ := client.IsBanned(ctx, deviceUUID)
+	if !banned || reason != "rate_limit_exceeded" {
+		t.Fatalf("Expected device banned for rate_limit_exceeded, got %v %q", banned, reason)
+	}
+	if remaining <= 0 || remaining > time.Second {
+		t.Errorf("Expected remaining within 1s, got %v", remaining)
+	}
+
+	time.Sleep(2 * time.Second)
+
+	if banned, _, _, _ := client.IsBanned(ctx, deviceUUID); banned {
+		t.Error("Expected ban to have expired")
+	}
+
+	t.Logf("✓ Short ban expired and access restored")
+}
+
+func TestUnban(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-unban-" + time.Now().Format("150405.000000")
+	defer client.Unban(ctx, deviceUUID)
+
+	client.AddWarning(ctx, deviceUUID, "duplicate_message")
+	if err := client.BanDevice(ctx, deviceUUID, "admin", 0); err != nil {
+		t.Fatalf("Failed to ban device: %v", err)
+	}
+
+	banned, _, remaining, _ := client.IsBanned(ctx, deviceUUID)
+	if !banned || remaining != 0 {
+		t.Fatalf("Expected permanent ban, got banned=%v remaining=%v", banned, remaining)
+	}
+
+	if err := client.Unban(ctx, deviceUUID); err != nil {
+		t.Fatalf("Failed to unban: %v", err)
+	}
+	if banned, _, _, _ := client.IsBanned(ctx, deviceUUID); banned {
+		t.Error("Expected device to be unbanned")
+	}
+
+	// Warnings are reset, so the next abuse is a warning rather than a ban
+	action, err := client.HandleAbuse(ctx, deviceUUID, "duplicate_message", time.Minute)
+	if err != nil || action != "warning" {
+		t.Errorf("Expected warning after unban, got %q (%v)", action, err)
+	}
+
+	t.Logf("✓ Permanent ban lifted and warnings reset")
+}
+
+func TestAbuse_Audited(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	audit.SetSink(audit.NewJSONSink(&buf))
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	deviceUUID := "test-audit-abuse-" + time.Now().Format("150405.000000")
+	defer client.Unban(ctx, deviceUUID)
+
+	// The default threshold warns once, then bans
+	for _, want := range []string{"warning", "ban"} {
+		action, err := client.HandleAbuse(ctx, deviceUUID, "duplicate_message", time.Minute)
+		if err != nil || action != want {
+			t.Fatalf("Expected %s, got %q (%v)", want, action, err)
+		}
+	}
+
+	if strings.Contains(buf.String(), deviceUUID) {
+		t.Fatalf("Expected no raw UUID in the audit log, got %s", buf.String())
+	}
+	hashed := audit.HashDevice(deviceUUID)
+	for _, eventType := range []string{audit.EventAbuseWarning, audit.EventBan} {
+		want := fmt.Sprintf(`{"event":%q,`, eventType)
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("Expected a %s event, got %s", eventType, buf.String())
+		}
+	}
+	if strings.Count(buf.String(), hashed) != 2 {
+		t.Errorf("Expected both events to carry the hashed device ID, got %s", buf.String())
+	}
+
+	t.Logf("✓ Abuse warning and ban audited with a hashed device ID")
+}
@@ -5,26 +5,160 @@ import (
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 const (
-	MaxChatTTL       = 5 * time.Minute
+	MaxChatTTL = 5 * time.Minute
+	// InvitationMaxTTL is the longest an invitation stays open until SetInvitationTTL is called
 	InvitationMaxTTL = 24 * time.Hour
 )
 
+// InvitationGrace is how long past the chat's own TTL an invitation stays open,
+// so the link for a chat with a seconds-long TTL can still be shared and opened
+const InvitationGrace = 5 * time.Minute
+
+// SetInvitationTTL caps how long an invitation stays open, however long its chat's TTL
+// Call once at startup, before the client is shared
+func (c *Client) SetInvitationTTL(max time.Duration) {
+	c.inviteMaxTTL = max
+}
+
+// invitationTTL is how long an invitation to a chat with the given TTL can be used
+func (c *Client) invitationTTL(ttlSeconds int) time.Duration {
+	ttl := time.Duration(ttlSeconds)*time.Second + InvitationGrace
+	if ttl > c.inviteMaxTTL {
+		return c.inviteMaxTTL
+	}
+	return ttl
+}
+
+// QueuedMessageGrace is added to a chat's TTL when expiring its queued messages,
+// so a message sent just before the deadline isn't dropped mid-fetch
+const QueuedMessageGrace = 10 * time.Second
+
+// validChatTTLs are the message lifetimes, in seconds, a chat may be created with
+var validChatTTLs = map[int]bool{5: true, 30: true, 60: true, 180: true, 300: true}
+
+// ValidChatTTL reports whether ttlSeconds is one of the allowed chat TTLs
+func ValidChatTTL(ttlSeconds int) bool {
+	return validChatTTLs[ttlSeconds]
+}
+
+// Reasons JoinChat refuses an invitation
+var (
+	ErrInvitationNotFound = errors.New("invitation not found")
+	ErrInvitationExpired  = errors.New("invitation expired")
+	ErrInvitationUsed     = errors.New("invitation already used")
+	ErrSameParticipant    = errors.New("cannot join with same participant ID")
+	ErrChatFull           = errors.New("chat is full")
+	ErrTooManyChats       = errors.New("too many active chats")
+)
+
+// DefaultMaxParticipants is the size of a regular two-party chat
+// Chats stored before group support have no limit recorded and get this one
+const DefaultMaxParticipants = 2
+
+// chatExpiryKey is a ZSET of chat UUIDs scored by the unix time they expire
+const chatExpiryKey = "chat_expiry"
+
+// ChatParticipant is one member of a chat, known only by its per-chat credentials
+type ChatParticipant struct {
+	ID         string `json:"id"`
+	SecretHash string `json:"secret_hash"`
+	DeviceUUID string `json:"device_uuid"`
+}
+
 type Chat struct {
-	ChatUUID           string    `json:"chat_uuid"`
-	ParticipantA       string    `json:"participant_a"`
-	ParticipantASecret string    `json:"participant_a_secret"`
-	ParticipantADevice string    `json:"participant_a_device"`
-	ParticipantB       string    `json:"participant_b"`
-	ParticipantBSecret string    `json:"participant_b_secret"`
-	ParticipantBDevice string    `json:"participant_b_device"`
-	TTLSeconds         int       `json:"ttl_seconds"`
-	CreatedAt          time.Time `json:"created_at"`
-	Status             string    `json:"status"`
+	ChatUUID        string            `json:"chat_uuid"`
+	Participants    []ChatParticipant `json:"participants"`
+	MaxParticipants int               `json:"max_participants"`
+	TTLSeconds      int               `json:"ttl_seconds"`
+	CreatedAt       time.Time         `json:"created_at"`
+	Status          string            `json:"status"`
+
+	// JoinDeadline is the unix time the invitation stops being accepted
+	// Chats stored before it was recorded have none and fall back to InvitationMaxTTL
+	JoinDeadline int64 `json:"join_deadline,omitempty"`
+
+	// InvitationToken is the invitation currently accepted for the chat
+	// Reopening replaces it, so links handed out before stop working
+	InvitationToken string `json:"invitation_token,omitempty"`
+}
+
+// legacyChat is the two-party shape chats were stored in before group support
+type legacyChat struct {
+	Chat
+	ParticipantA       string `json:"participant_a"`
+	ParticipantASecret string `json:"participant_a_secret"`
+	ParticipantADevice string `json:"participant_a_device"`
+	ParticipantB       string `json:"participant_b"`
+	ParticipantBSecret string `json:"participant_b_secret"`
+	ParticipantBDevice string `json:"participant_b_device"`
+}
+
+// decodeChat parses a stored chat in either the current or the legacy two-party shape
+func decodeChat(data []byte) (*Chat, error) {
+	var stored legacyChat
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+
+	chat := stored.Chat
+	if len(chat.Participants) == 0 && stored.ParticipantA != "" {
+		chat.Participants = []ChatParticipant{{
+			ID:         stored.ParticipantA,
+			SecretHash: stored.ParticipantASecret,
+			DeviceUUID: stored.ParticipantADevice,
+		}}
+		if stored.ParticipantB != "" {
+			chat.Participants = append(chat.Participants, ChatParticipant{
+				ID:         stored.ParticipantB,
+				SecretHash: stored.ParticipantBSecret,
+				DeviceUUID: stored.ParticipantBDevice,
+			})
+		}
+	}
+	if chat.MaxParticipants == 0 {
+		chat.MaxParticipants = DefaultMaxParticipants
+	}
+	return &chat, nil
+}
+
+// Participant returns the participant with the given ID, or nil
+func (chat *Chat) Participant(participantID string) *ChatParticipant {
+	for i := range chat.Participants {
+		if chat.Participants[i].ID == participantID {
+			return &chat.Participants[i]
+		}
+	}
+	return nil
+}
+
+// ParticipantByDevice returns the participant that joined from the given device, or nil
+func (chat *Chat) ParticipantByDevice(deviceUUID string) *ChatParticipant {
+	for i := range chat.Participants {
+		if chat.Participants[i].DeviceUUID == deviceUUID {
+			return &chat.Participants[i]
+		}
+	}
+	return nil
+}
+
+// OtherParticipants returns every participant except the given one
+func (chat *Chat) OtherParticipants(participantID string) []ChatParticipant {
+	others := make([]ChatParticipant, 0, len(chat.Participants))
+	for _, p := range chat.Participants {
+		if p.ID != participantID {
+			others = append(others, p)
+		}
+	}
+	return others
 }
 
 type ChatInvitation struct {
@@ -37,9 +171,36 @@ type ChatInvitation struct {
 }
 
 type QueuedMessage struct {
-	SenderParticipant string `json:"sender_participant"`
-	SenderDeviceUUID  string `json:"sender_device_uuid"`
-	EncryptedContent  []byte `json:"encrypted_content"`
+	MessageID         string   `json:"-"` // filled in on read, the queue holds the ID
+	SenderParticipant string   `json:"sender_participant"`
+	SenderDeviceUUID  string   `json:"sender_device_uuid"`
+	EncryptedContent  []byte   `json:"encrypted_content"`
+	QueuedAt          int64    `json:"queued_at,omitempty"` // unix seconds; zero for messages queued before it was recorded
+	AttachmentIDs     []string `json:"attachment_ids,omitempty"`
+
+	// Recipients are the participants it still waits for, filled in on read
+	// Nil for messages queued before recipients were tracked
+	Recipients []string `json:"-"`
+}
+
+// PendingFor reports whether the message still waits for participantID
+// A message queued before recipients were tracked waits for everyone but its sender
+func (m *QueuedMessage) PendingFor(participantID string) bool {
+	if m.Recipients == nil {
+		return m.SenderParticipant != participantID
+	}
+	return slices.Contains(m.Recipients, participantID)
+}
+
+// queuedRecipientsKey is the SET of participants a queued message still waits for
+func queuedRecipientsKey(chatUUID, messageID string) string {
+	return fmt.Sprintf("msg_pending:%s:%s", chatUUID, messageID)
+}
+
+// queuedCountsKey is a HASH of participant ID to how many queued messages of the chat wait for it
+// Kept in step with the recipient sets, so counting needs no walk over the queue
+func queuedCountsKey(chatUUID string) string {
+	return fmt.Sprintf("msg_pending_count:%s", chatUUID)
 }
 
 func HashSecret(secret string) string {
@@ -52,14 +213,78 @@ func (c *Client) ValidateParticipant(ctx context.Context, chatUUID, participantI
 	if err != nil {
 		return false, err
 	}
-	secretHash := HashSecret(secret)
-	if chat.ParticipantA == participantID {
-		return chat.ParticipantASecret == secretHash, nil
+	p := chat.Participant(participantID)
+	if p == nil {
+		return false, fmt.Errorf("participant not found in chat")
 	}
-	if chat.ParticipantB == participantID {
-		return chat.ParticipantBSecret == secretHash, nil
+	return p.SecretHash == HashSecret(secret), nil
+}
+
+// upgradeLegacyChatLua rewrites a decoded `chat` from the two-party shape
+// chats were stored in before group support, for scripts that modify it
+const upgradeLegacyChatLua = `
+		-- Chats stored before group support use the two-party shape
+		if not chat.participants then
+			chat.participants = {{
+				id = chat.participant_a,
+				secret_hash = chat.participant_a_secret,
+				device_uuid = chat.participant_a_device
+			}}
+			if chat.participant_b and chat.participant_b ~= '' then
+				table.insert(chat.participants, {
+					id = chat.participant_b,
+					secret_hash = chat.participant_b_secret,
+					device_uuid = chat.participant_b_device
+				})
+			end
+			chat.participant_a = nil
+			chat.participant_a_secret = nil
+			chat.participant_a_device = nil
+			chat.participant_b = nil
+			chat.participant_b_secret = nil
+			chat.participant_b_device = nil
+		end
+`
+
+// ErrInvalidSecret is returned when a participant's current secret doesn't match
+var ErrInvalidSecret = errors.New("invalid participant credentials")
+
+// RotateParticipantSecret replaces a participant's secret, proven by the current one
+// The chat is rewritten atomically so concurrent rotations and joins never clobber each other
+func (c *Client) RotateParticipantSecret(ctx context.Context, chatUUID, participantID, oldSecret, newSecret string) error {
+	rotateScript := `
+		local chatJSON = redis.call('GET', KEYS[1])
+		if not chatJSON then
+			return -1
+		end
+
+		local chat = cjson.decode(chatJSON)
+` + upgradeLegacyChatLua + `
+		for _, p in ipairs(chat.participants) do
+			if p.id == ARGV[1] then
+				if p.secret_hash ~= ARGV[2] then
+					return -2
+				end
+				p.secret_hash = ARGV[3]
+				redis.call('SET', KEYS[1], cjson.encode(chat), 'KEEPTTL')
+				return 1
+			end
+		end
+		return -2
+	`
+
+	chatKey := fmt.Sprintf("chat:%s", chatUUID)
+	result, err := c.rdb.Eval(ctx, rotateScript, []string{chatKey}, participantID, HashSecret(oldSecret), HashSecret(newSecret)).Int()
+	if err != nil {
+		return fmt.Errorf("failed to execute rotate script: %w", err)
 	}
-	return false, fmt.Errorf("participant not found in chat")
+	switch result {
+	case -1:
+		return fmt.Errorf("chat not found")
+	case -2:
+		return ErrInvalidSecret
+	}
+	return nil
 }
 
 func (c *Client) IsDeviceParticipant(ctx context.Context, chatUUID, deviceUUID string) (bool, string, error) {
@@ -67,81 +292,339 @@ func (c *Client) IsDeviceParticipant(ctx context.Context, chatUUID, deviceUUID s
 	if err != nil {
 		return false, "", err
 	}
-	if chat.ParticipantADevice == deviceUUID {
-		return true, chat.ParticipantA, nil
-	}
-	if chat.ParticipantBDevice == deviceUUID {
-		return true, chat.ParticipantB, nil
+	if p := chat.ParticipantByDevice(deviceUUID); p != nil {
+		return true, p.ID, nil
 	}
 	return false, "", nil
 }
 
-func (c *Client) GetOtherParticipantDevice(ctx context.Context, chatUUID, deviceUUID string) (string, error) {
+func (c *Client) GetOtherParticipantDevices(ctx context.Context, chatUUID, deviceUUID string) ([]string, error) {
 	chat, err := c.GetChat(ctx, chatUUID)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	if chat.ParticipantADevice == deviceUUID {
-		return chat.ParticipantBDevice, nil
+	self := chat.ParticipantByDevice(deviceUUID)
+	if self == nil {
+		return nil, fmt.Errorf("device not in chat")
 	}
-	if chat.ParticipantBDevice == deviceUUID {
-		return chat.ParticipantADevice, nil
+	devices := make([]string, 0, len(chat.Participants)-1)
+	for _, p := range chat.OtherParticipants(self.ID) {
+		devices = append(devices, p.DeviceUUID)
 	}
-	return "", fmt.Errorf("device not in chat")
+	return devices, nil
 }
 
-func (c *Client) CreateChat(ctx context.Context, chatUUID, participantID, participantSecret, creatorDeviceID, invitationToken string, ttlSeconds int) error {
+// CreateChat stores a pending chat seeded with its creator
+// maxParticipants caps how many can join; anything below two means a two-party chat
+func (c *Client) CreateChat(ctx context.Context, chatUUID, participantID, participantSecret, creatorDeviceID, invitationToken string, ttlSeconds, maxParticipants int) error {
+	if maxParticipants < DefaultMaxParticipants {
+		maxParticipants = DefaultMaxParticipants
+	}
+	if err := c.checkChatLimit(ctx, creatorDeviceID); err != nil {
+		return err
+	}
 	secretHash := HashSecret(participantSecret)
+	now := time.Now()
+	inviteTTL := c.invitationTTL(ttlSeconds)
 	chat := Chat{
-		ChatUUID:           chatUUID,
-		ParticipantA:       participantID,
-		ParticipantASecret: secretHash,
-		ParticipantADevice: creatorDeviceID,
-		ParticipantB:       "",
-		ParticipantBSecret: "",
-		ParticipantBDevice: "",
-		TTLSeconds:         ttlSeconds,
-		CreatedAt:          time.Now(),
-		Status:             "pending",
+		ChatUUID: chatUUID,
+		Participants: []ChatParticipant{{
+			ID:         participantID,
+			SecretHash: secretHash,
+			DeviceUUID: creatorDeviceID,
+		}},
+		MaxParticipants: maxParticipants,
+		TTLSeconds:      ttlSeconds,
+		CreatedAt:       now,
+		Status:          "pending",
+		JoinDeadline:    now.Add(inviteTTL).Unix(),
+		InvitationToken: invitationToken,
 	}
 	chatJSON, err := json.Marshal(chat)
 	if err != nil {
 		return fmt.Errorf("failed to marshal chat: %w", err)
 	}
 	chatKey := fmt.Sprintf("chat:%s", chatUUID)
-	if err := c.rdb.Set(ctx, chatKey, chatJSON, InvitationMaxTTL).Err(); err != nil {
+	if err := c.rdb.Set(ctx, chatKey, chatJSON, inviteTTL).Err(); err != nil {
 		return fmt.Errorf("failed to store chat: %w", err)
 	}
+	if err := c.storeInvitation(ctx, invitationToken, chatUUID, creatorDeviceID, ttlSeconds, now); err != nil {
+		return err
+	}
+	if err := c.addUserChat(ctx, creatorDeviceID, chatUUID); err != nil {
+		return err
+	}
+	if err := c.scheduleChatExpiry(ctx, &chat); err != nil {
+		return err
+	}
+	return nil
+}
+
+// storeInvitation stores an unused invitation to chatUUID for the invitation window
+func (c *Client) storeInvitation(ctx context.Context, token, chatUUID, creatorDeviceID string, ttlSeconds int, now time.Time) error {
 	invitation := ChatInvitation{
-		Token:           invitationToken,
+		Token:           token,
 		ChatUUID:        chatUUID,
 		CreatorDeviceID: creatorDeviceID,
 		TTLSeconds:      ttlSeconds,
-		CreatedAt:       time.Now(),
+		CreatedAt:       now,
 		Used:            false,
 	}
 	invJSON, err := json.Marshal(invitation)
 	if err != nil {
 		return fmt.Errorf("failed to marshal invitation: %w", err)
 	}
-	invKey := fmt.Sprintf("invite:%s", invitationToken)
-	if err := c.rdb.Set(ctx, invKey, invJSON, InvitationMaxTTL).Err(); err != nil {
+	invKey := fmt.Sprintf("invite:%s", token)
+	if err := c.rdb.Set(ctx, invKey, invJSON, c.invitationTTL(ttlSeconds)).Err(); err != nil {
 		return fmt.Errorf("failed to store invitation: %w", err)
 	}
 	return nil
 }
 
+// ErrPeersRemain means a chat can't be reopened while others are still in it
+var ErrPeersRemain = errors.New("other participants are still in the chat")
+
+// LeaveChat takes a participant out of a chat, keeping it for everyone else
+// The caller is checked by its device or secret. Returns the chat as the others now see it,
+// or nil if the caller was the last one in it and the chat was deleted
+func (c *Client) LeaveChat(ctx context.Context, chatUUID, participantID, participantSecret, deviceUUID string) (*Chat, error) {
+	leaveScript := `
+		local chatJSON = redis.call('GET', KEYS[1])
+		if not chatJSON then
+			return {-1, ""}
+		end
+
+		local chat = cjson.decode(chatJSON)
+` + upgradeLegacyChatLua + `
+		local leaver
+		local remaining = {}
+		for _, p in ipairs(chat.participants) do
+			if p.id == ARGV[1] then
+				leaver = p
+			else
+				table.insert(remaining, p)
+			end
+		end
+		if not leaver or (leaver.device_uuid ~= ARGV[3] and leaver.secret_hash ~= ARGV[2]) then
+			return {-2, ""}
+		end
+		if #remaining == 0 then
+			return {0, ""}
+		end
+
+		chat.participants = remaining
+		local updated = cjson.encode(chat)
+		redis.call('SET', KEYS[1], updated, 'KEEPTTL')
+		return {1, updated}
+	`
+
+	chatKey := fmt.Sprintf("chat:%s", chatUUID)
+	result, err := c.rdb.Eval(ctx, leaveScript, []string{chatKey}, participantID, HashSecret(participantSecret), deviceUUID).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute leave script: %w", err)
+	}
+
+	arr, ok := result.([]interface{})
+	if !ok || len(arr) < 2 {
+		return nil, fmt.Errorf("invalid script result")
+	}
+	code, _ := arr[0].(int64)
+	switch code {
+	case -1:
+		return nil, fmt.Errorf("chat not found")
+	case -2:
+		return nil, ErrInvalidSecret
+	case 0:
+		return nil, c.DeleteChat(ctx, chatUUID)
+	}
+
+	chatJSON, _ := arr[1].(string)
+	chat, err := decodeChat([]byte(chatJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chat: %w", err)
+	}
+
+	// The leaver loses the chat from its list and stops getting its pushes
+	c.rdb.SRem(ctx, userChatsKey(deviceUUID), chatUUID)
+	c.DeletePushForChat(ctx, chatUUID, participantID)
+	c.DeleteParticipantFCM(ctx, chatUUID, participantID)
+	c.rdb.Del(ctx, muteKey(chatUUID, participantID))
+
+	// Nothing still queued waits for it any more
+	msgIDs, _ := c.rdb.LRange(ctx, fmt.Sprintf("msg_queue:%s", chatUUID), 0, -1).Result()
+	for _, msgID := range msgIDs {
+		if member, _ := c.rdb.SIsMember(ctx, queuedRecipientsKey(chatUUID, msgID), participantID).Result(); member {
+			c.ReleaseQueuedMessage(ctx, chatUUID, msgID, participantID)
+		}
+	}
+	return chat, nil
+}
+
+// ReopenChat turns a chat everyone else has left back into a pending one, with a fresh
+// invitation under invitationToken. The caller is checked by its device or secret.
+// Returns ErrPeersRemain while anyone else is still in the chat and ErrChatNotActive
+// for a chat nobody has joined yet. The chat's TTL starts over once someone joins
+func (c *Client) ReopenChat(ctx context.Context, chatUUID, participantID, participantSecret, deviceUUID, invitationToken string) (*Chat, error) {
+	reopenScript := `
+		local chatJSON = redis.call('GET', KEYS[1])
+		if not chatJSON then
+			return {-1, ""}
+		end
+
+		local chat = cjson.decode(chatJSON)
+` + upgradeLegacyChatLua + `
+		local caller
+		for _, p in ipairs(chat.participants) do
+			if p.id == ARGV[1] then
+				caller = p
+			end
+		end
+		if not caller or (caller.device_uuid ~= ARGV[3] and caller.secret_hash ~= ARGV[2]) then
+			return {-2, ""}
+		end
+		-- Only once the others have left, see LeaveChat
+		if #chat.participants > 1 then
+			return {-3, ""}
+		end
+		if chat.status ~= 'active' then
+			return {-4, ""}
+		end
+
+		if chat.invitation_token and chat.invitation_token ~= '' then
+			redis.call('DEL', 'invite:' .. chat.invitation_token)
+		end
+
+		chat.status = 'pending'
+		chat.created_at = ARGV[4]
+		chat.join_deadline = tonumber(ARGV[5])
+		chat.invitation_token = ARGV[6]
+		local updated = cjson.encode(chat)
+		redis.call('SET', KEYS[1], updated, 'EX', tonumber(ARGV[7]))
+
+		return {1, updated}
+	`
+
+	chat, err := c.GetChat(ctx, chatUUID)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	inviteTTL := c.invitationTTL(chat.TTLSeconds)
+
+	chatKey := fmt.Sprintf("chat:%s", chatUUID)
+	result, err := c.rdb.Eval(ctx, reopenScript, []string{chatKey},
+		participantID, HashSecret(participantSecret), deviceUUID,
+		now.UTC().Format(time.RFC3339Nano), now.Add(inviteTTL).Unix(), invitationToken, int64(inviteTTL.Seconds()),
+	).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute reopen script: %w", err)
+	}
+
+	arr, ok := result.([]interface{})
+	if !ok || len(arr) < 2 {
+		return nil, fmt.Errorf("invalid script result")
+	}
+	code, _ := arr[0].(int64)
+	switch code {
+	case -1:
+		return nil, fmt.Errorf("chat not found")
+	case -2:
+		return nil, ErrInvalidSecret
+	case -3:
+		return nil, ErrPeersRemain
+	case -4:
+		return nil, ErrChatNotActive
+	}
+
+	newJSON, _ := arr[1].(string)
+	reopened, err := decodeChat([]byte(newJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse chat: %w", err)
+	}
+
+	creatorDeviceID := reopened.Participants[0].DeviceUUID
+	if err := c.storeInvitation(ctx, invitationToken, chatUUID, creatorDeviceID, reopened.TTLSeconds, now); err != nil {
+		return nil, err
+	}
+	if err := c.scheduleChatExpiry(ctx, reopened); err != nil {
+		return nil, err
+	}
+	return reopened, nil
+}
+
+// ChatRequestTTL is how long a create-chat request ID is remembered for client retries
+const ChatRequestTTL = 10 * time.Minute
+
+// ChatRequest is the result a create-chat request ID maps to
+type ChatRequest struct {
+	ChatUUID        string `json:"chat_uuid"`
+	InvitationToken string `json:"invitation_token"`
+}
+
+func chatRequestKey(deviceUUID, requestID string) string {
+	return fmt.Sprintf("chat_req:%s:%s", deviceUUID, requestID)
+}
+
+// ReserveChatRequest claims a request ID for the chat about to be created
+// Returns the earlier result instead if the device already used this request ID
+func (c *Client) ReserveChatRequest(ctx context.Context, deviceUUID, requestID string, req ChatRequest) (*ChatRequest, error) {
+	reqJSON, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal chat request: %w", err)
+	}
+
+	key := chatRequestKey(deviceUUID, requestID)
+	stored, err := c.rdb.SetArgs(ctx, key, reqJSON, redis.SetArgs{Mode: "NX", TTL: ChatRequestTTL, Get: true}).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reserve chat request: %w", err)
+	}
+
+	var existing ChatRequest
+	if err := json.Unmarshal([]byte(stored), &existing); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal chat request: %w", err)
+	}
+	return &existing, nil
+}
+
+// ReleaseChatRequest forgets a request ID whose chat couldn't be created, so a retry starts over
+func (c *Client) ReleaseChatRequest(ctx context.Context, deviceUUID, requestID string) error {
+	return c.rdb.Del(ctx, chatRequestKey(deviceUUID, requestID)).Err()
+}
+
+// MessageDedupMinWindow is the shortest time a sent message ID is remembered
+// Chat TTLs can be seconds, shorter than a client waits before retrying a send
+const MessageDedupMinWindow = 5 * time.Minute
+
+func messageDedupKey(chatUUID, messageID string) string {
+	return fmt.Sprintf("msg_dedup:%s:%s", chatUUID, messageID)
+}
+
+// MarkMessageSent claims a message ID in a chat for delivery
+// Returns false if the ID was already sent within the window, the chat's TTL but
+// never less than MessageDedupMinWindow
+func (c *Client) MarkMessageSent(ctx context.Context, chatUUID, messageID string, ttlSeconds int) (bool, error) {
+	window := max(time.Duration(ttlSeconds)*time.Second, MessageDedupMinWindow)
+	first, err := c.rdb.SetNX(ctx, messageDedupKey(chatUUID, messageID), time.Now().Unix(), window).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record message send: %w", err)
+	}
+	return first, nil
+}
+
 func (c *Client) GetChat(ctx context.Context, chatUUID string) (*Chat, error) {
 	chatKey := fmt.Sprintf("chat:%s", chatUUID)
 	chatJSON, err := c.rdb.Get(ctx, chatKey).Result()
 	if err != nil {
 		return nil, fmt.Errorf("chat not found: %w", err)
 	}
-	var chat Chat
-	if err := json.Unmarshal([]byte(chatJSON), &chat); err != nil {
+	chat, err := decodeChat([]byte(chatJSON))
+	if err != nil {
 		return nil, fmt.Errorf("failed to unmarshal chat: %w", err)
 	}
-	return &chat, nil
+	return chat, nil
 }
 
 func (c *Client) GetInvitation(ctx context.Context, token string) (*ChatInvitation, error) {
@@ -158,21 +641,22 @@ func (c *Client) GetInvitation(ctx context.Context, token string) (*ChatInvitati
 }
 
 // JoinChat validates invitation TTL and joins the chat atomically
+// The invitation stays usable until the chat reaches its participant limit
 func (c *Client) JoinChat(ctx context.Context, token, joinerDeviceUUID, participantID, participantSecret string) (*Chat, string, error) {
 	// First check invitation TTL in Go (Lua can't parse ISO timestamps)
 	invitation, err := c.GetInvitation(ctx, token)
 	if err != nil {
-		return nil, "", fmt.Errorf("invitation not found")
+		return nil, "", ErrInvitationNotFound
 	}
 
-	// Check if invitation has expired (24 hours max)
-	if time.Since(invitation.CreatedAt) > InvitationMaxTTL {
-		return nil, "", fmt.Errorf("invitation expired")
+	// Check if invitation has expired (the chat's TTL plus grace, 24 hours max)
+	if time.Since(invitation.CreatedAt) > c.invitationTTL(invitation.TTLSeconds) {
+		return nil, "", ErrInvitationExpired
 	}
 
 	// Check if already used (also checked atomically in Lua, but fail fast here)
 	if invitation.Used {
-		return nil, "", fmt.Errorf("invitation already used")
+		return nil, "", ErrInvitationUsed
 	}
 
 	// Now execute atomic join via Lua script
@@ -184,6 +668,7 @@ func (c *Client) JoinChat(ctx context.Context, token, joinerDeviceUUID, particip
 		local joinerDevice = ARGV[1]
 		local participantID = ARGV[2]
 		local secretHash = ARGV[3]
+		local now = tonumber(ARGV[4])
 
 		local invJSON = redis.call('GET', invKey)
 		if not invJSON then
@@ -203,29 +688,53 @@ func (c *Client) JoinChat(ctx context.Context, token, joinerDeviceUUID, particip
 		end
 
 		local chat = cjson.decode(chatJSON)
+` + upgradeLegacyChatLua + `
+
+		local maxParticipants = tonumber(chat.max_participants) or 2
+		chat.max_participants = maxParticipants
 
-		if chat.status ~= 'pending' then
+		if chat.status ~= 'pending' and chat.status ~= 'active' then
 			return {-4, "", ""}
 		end
 
-		if chat.participant_a == participantID then
-			return {-3, "", ""}
+		-- The chat was reopened under a newer invitation
+		if chat.invitation_token and chat.invitation_token ~= '' and chat.invitation_token ~= inv.token then
+			return {-2, "", ""}
+		end
+
+		-- The chat outlived its invitation; joining now would make a stale chat active
+		if chat.join_deadline and now > tonumber(chat.join_deadline) then
+			return {-5, "", ""}
 		end
 
-		chat.participant_b = participantID
-		chat.participant_b_secret = secretHash
-		chat.participant_b_device = joinerDevice
+		for _, p in ipairs(chat.participants) do
+			if p.id == participantID then
+				return {-3, "", ""}
+			end
+		end
+
+		if #chat.participants >= maxParticipants then
+			return {-4, "", ""}
+		end
+
+		table.insert(chat.participants, {
+			id = participantID,
+			secret_hash = secretHash,
+			device_uuid = joinerDevice
+		})
 		chat.status = 'active'
 
 		redis.call('SET', chatKey, cjson.encode(chat))
 
-		inv.used = true
-		redis.call('SET', invKey, cjson.encode(inv), 'EX', 3600)
+		if #chat.participants >= maxParticipants then
+			inv.used = true
+			redis.call('SET', invKey, cjson.encode(inv), 'EX', 3600)
+		end
 
 		return {1, cjson.encode(chat), inv.creator_device_id}
 	`
 
-	result, err := c.rdb.Eval(ctx, joinScript, []string{invKey}, joinerDeviceUUID, participantID, secretHash).Result()
+	result, err := c.rdb.Eval(ctx, joinScript, []string{invKey}, joinerDeviceUUID, participantID, secretHash, time.Now().Unix()).Result()
 	if err != nil {
 		return nil, "", fmt.Errorf("failed to execute join script: %w", err)
 	}
@@ -238,86 +747,363 @@ func (c *Client) JoinChat(ctx context.Context, token, joinerDeviceUUID, particip
 	code, _ := arr[0].(int64)
 	switch code {
 	case -1:
-		return nil, "", fmt.Errorf("invitation not found")
+		return nil, "", ErrInvitationNotFound
 	case -2:
-		return nil, "", fmt.Errorf("invitation already used")
+		return nil, "", ErrInvitationUsed
 	case -3:
-		return nil, "", fmt.Errorf("cannot join with same participant ID")
+		return nil, "", ErrSameParticipant
 	case -4:
-		return nil, "", fmt.Errorf("chat is not pending")
+		return nil, "", ErrChatFull
+	case -5:
+		return nil, "", ErrInvitationExpired
 	case 1:
 		if len(arr) < 3 {
 			return nil, "", fmt.Errorf("invalid script result")
 		}
 		chatJSON, _ := arr[1].(string)
 		creatorDeviceID, _ := arr[2].(string)
-		var chat Chat
-		if err := json.Unmarshal([]byte(chatJSON), &chat); err != nil {
+		chat, err := decodeChat([]byte(chatJSON))
+		if err != nil {
 			return nil, "", fmt.Errorf("failed to parse chat: %w", err)
 		}
-		return &chat, creatorDeviceID, nil
+		if err := c.addUserChat(ctx, joinerDeviceUUID, chat.ChatUUID); err != nil {
+			return nil, "", err
+		}
+		if err := c.addUserChat(ctx, creatorDeviceID, chat.ChatUUID); err != nil {
+			return nil, "", err
+		}
+		if err := c.scheduleChatExpiry(ctx, chat); err != nil {
+			return nil, "", err
+		}
+		// A mute set while the invitation was open expired at the join deadline
+		if err := c.refreshChatMutes(ctx, chat); err != nil {
+			return nil, "", err
+		}
+		return chat, creatorDeviceID, nil
 	default:
 		return nil, "", fmt.Errorf("unknown error")
 	}
 }
 
+// SetMaxChatsPerDevice caps how many active chats a device can be in when creating another
+// Every chat holds chat: and invite: keys for up to a day, so this bounds what one device can store
+// Call once at startup, before the client is shared
+func (c *Client) SetMaxChatsPerDevice(max int) {
+	c.maxChats = max
+}
+
+// checkChatLimit returns ErrTooManyChats if the device is already in as many chats as allowed
+// Expired and deleted chats are pruned from the device's set first, so they free their slot
+func (c *Client) checkChatLimit(ctx context.Context, deviceUUID string) error {
+	if c.maxChats <= 0 || deviceUUID == "" {
+		return nil
+	}
+	chats, err := c.GetUserChats(ctx, deviceUUID)
+	if err != nil {
+		return err
+	}
+	if len(chats) >= c.maxChats {
+		return ErrTooManyChats
+	}
+	return nil
+}
+
+func userChatsKey(deviceUUID string) string {
+	return fmt.Sprintf("user_chats:%s", deviceUUID)
+}
+
+// addUserChat records chatUUID in the device's chat set
+// The set lives as long as the longest chat it could reference
+func (c *Client) addUserChat(ctx context.Context, deviceUUID, chatUUID string) error {
+	if deviceUUID == "" {
+		return nil
+	}
+	key := userChatsKey(deviceUUID)
+	pipe := c.rdb.Pipeline()
+	pipe.SAdd(ctx, key, chatUUID)
+	pipe.Expire(ctx, key, c.inviteMaxTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to track user chat: %w", err)
+	}
+	return nil
+}
+
+// GetUserChats returns the chats a device participates in
+// Entries whose chat has already expired are dropped from the set
 func (c *Client) GetUserChats(ctx context.Context, deviceUUID string) ([]string, error) {
-	return []string{}, nil
+	key := userChatsKey(deviceUUID)
+	chatUUIDs, err := c.rdb.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get user chats: %w", err)
+	}
+
+	chats := make([]string, 0, len(chatUUIDs))
+	for _, chatUUID := range chatUUIDs {
+		exists, err := c.rdb.Exists(ctx, fmt.Sprintf("chat:%s", chatUUID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check chat: %w", err)
+		}
+		if exists == 0 {
+			c.rdb.SRem(ctx, key, chatUUID)
+			continue
+		}
+		chats = append(chats, chatUUID)
+	}
+	return chats, nil
 }
 
 func (c *Client) DeleteChat(ctx context.Context, chatUUID string) error {
 	chatKey := fmt.Sprintf("chat:%s", chatUUID)
-	if err := c.rdb.Del(ctx, chatKey).Err(); err != nil {
+
+	// Look up participants first so their chat sets can be cleaned up
+	chat, _ := c.GetChat(ctx, chatUUID)
+
+	// The chat and its push registrations go together, so a push registered
+	// concurrently can't outlive the chat (RegisterPushForChat needs the chat key)
+	script := `
+		redis.call('DEL', KEYS[1])
+		redis.call('ZREM', KEYS[3], ARGV[1])
+		local pushKeys = KEYS[2]
+` + deleteChatPushLua + `
+		return 1
+	`
+	keys := []string{chatKey, chatPushKeysKey(chatUUID), chatExpiryKey}
+	if err := c.rdb.Eval(ctx, script, keys, chatUUID).Err(); err != nil {
 		return fmt.Errorf("failed to delete chat: %w", err)
 	}
+
+	if chat != nil {
+		c.removeUserChat(ctx, chat, chatUUID)
+		c.DeleteMessageStates(ctx, chat)
+		c.deleteChatMutes(ctx, chat)
+	}
+	return nil
+}
+
+// ExpiresAt returns when the chat stops being usable
+// Active chats live for their chosen TTL, pending chats for the invitation window
+func (chat *Chat) ExpiresAt() time.Time {
+	if chat.Status == "active" {
+		return chat.CreatedAt.Add(time.Duration(chat.TTLSeconds) * time.Second)
+	}
+	if chat.JoinDeadline != 0 {
+		return time.Unix(chat.JoinDeadline, 0)
+	}
+	return chat.CreatedAt.Add(InvitationMaxTTL)
+}
+
+// scheduleChatExpiry (re)indexes the chat in the expiry ZSET
+func (c *Client) scheduleChatExpiry(ctx context.Context, chat *Chat) error {
+	err := c.rdb.ZAdd(ctx, chatExpiryKey, redis.Z{
+		Score:  float64(chat.ExpiresAt().Unix()),
+		Member: chat.ChatUUID,
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("failed to schedule chat expiry: %w", err)
+	}
 	return nil
 }
 
+// GetExpiredChats returns chats whose scheduled expiry is at or before now
+// Chats that no longer exist are dropped from the index and not returned
+func (c *Client) GetExpiredChats(ctx context.Context, now time.Time) ([]*Chat, error) {
+	chatUUIDs, err := c.rdb.ZRangeByScore(ctx, chatExpiryKey, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("%d", now.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired chats: %w", err)
+	}
+
+	chats := make([]*Chat, 0, len(chatUUIDs))
+	for _, chatUUID := range chatUUIDs {
+		chat, err := c.GetChat(ctx, chatUUID)
+		if err != nil {
+			// Deleted concurrently or already expired from Redis
+			c.rdb.ZRem(ctx, chatExpiryKey, chatUUID)
+			continue
+		}
+		if chat.ExpiresAt().After(now) {
+			// Status changed since it was indexed - reschedule
+			c.scheduleChatExpiry(ctx, chat)
+			continue
+		}
+		chats = append(chats, chat)
+	}
+	return chats, nil
+}
+
+// DeleteQueuedMessages removes a chat's message queue and every queued message body
+func (c *Client) DeleteQueuedMessages(ctx context.Context, chatUUID string) error {
+	queueKey := fmt.Sprintf("msg_queue:%s", chatUUID)
+	msgIDs, err := c.rdb.LRange(ctx, queueKey, 0, -1).Result()
+	if err != nil {
+		return fmt.Errorf("failed to read message queue: %w", err)
+	}
+
+	keys := make([]string, 0, 2*len(msgIDs)+1)
+	for _, msgID := range msgIDs {
+		keys = append(keys, fmt.Sprintf("msg:%s:%s", chatUUID, msgID), queuedRecipientsKey(chatUUID, msgID))
+	}
+	keys = append(keys, queueKey, queuedCountsKey(chatUUID))
+
+	if err := c.rdb.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete queued messages: %w", err)
+	}
+	return nil
+}
+
+// removeUserChat drops chatUUID from every participant's chat set
+func (c *Client) removeUserChat(ctx context.Context, chat *Chat, chatUUID string) {
+	for _, p := range chat.Participants {
+		if p.DeviceUUID != "" {
+			c.rdb.SRem(ctx, userChatsKey(p.DeviceUUID), chatUUID)
+		}
+	}
+}
+
 func (c *Client) QueueMessage(ctx context.Context, chatUUID, messageID, senderParticipant string, encryptedContent []byte) error {
-	return c.QueueMessageWithDevice(ctx, chatUUID, messageID, senderParticipant, "", encryptedContent)
+	_, err := c.QueueMessageWithDevice(ctx, chatUUID, messageID, senderParticipant, "", encryptedContent, 0)
+	return err
+}
+
+// queuedMessageTTL is how long a chat's queued messages live: the chat's own TTL plus grace
+// Falls back to MaxChatTTL when the chat can't be read or predates per-chat TTLs
+func queuedMessageTTL(chat *Chat) time.Duration {
+	if chat == nil || chat.TTLSeconds <= 0 {
+		return MaxChatTTL + QueuedMessageGrace
+	}
+	return time.Duration(chat.TTLSeconds)*time.Second + QueuedMessageGrace
+}
+
+// QueueMessageWithDevice queues a message for offline recipients
+// Once the queue holds more than maxQueued messages the oldest are dropped (0 for no limit)
+// Returns how many were dropped
+func (c *Client) QueueMessageWithDevice(ctx context.Context, chatUUID, messageID, senderParticipant, senderDeviceUUID string, encryptedContent []byte, maxQueued int) (int64, error) {
+	return c.QueueMessageWithAttachments(ctx, chatUUID, messageID, senderParticipant, senderDeviceUUID, encryptedContent, nil, maxQueued)
+}
+
+// QueueMessageWithAttachments is QueueMessageWithDevice for a message referencing attachments
+func (c *Client) QueueMessageWithAttachments(ctx context.Context, chatUUID, messageID, senderParticipant, senderDeviceUUID string, encryptedContent []byte, attachmentIDs []string, maxQueued int) (int64, error) {
+	return c.QueueMessageFor(ctx, chatUUID, messageID, senderParticipant, senderDeviceUUID, encryptedContent, attachmentIDs, nil, maxQueued)
 }
 
-func (c *Client) QueueMessageWithDevice(ctx context.Context, chatUUID, messageID, senderParticipant, senderDeviceUUID string, encryptedContent []byte) error {
-	msg := QueuedMessage{
+// QueueMessageFor queues a message for the given recipients only, every other participant if none
+// Each recipient takes it off the queue for itself; the body goes once none is left waiting
+func (c *Client) QueueMessageFor(ctx context.Context, chatUUID, messageID, senderParticipant, senderDeviceUUID string, encryptedContent []byte, attachmentIDs, recipients []string, maxQueued int) (int64, error) {
+	chat, _ := c.GetChat(ctx, chatUUID)
+	if len(recipients) == 0 && chat != nil {
+		for _, p := range chat.OtherParticipants(senderParticipant) {
+			recipients = append(recipients, p.ID)
+		}
+	}
+
+	msg := &QueuedMessage{
+		MessageID:         messageID,
 		SenderParticipant: senderParticipant,
 		SenderDeviceUUID:  senderDeviceUUID,
 		EncryptedContent:  encryptedContent,
+		QueuedAt:          time.Now().Unix(),
+		AttachmentIDs:     attachmentIDs,
 	}
+	return c.queueMessage(ctx, chat, chatUUID, msg, recipients, maxQueued)
+}
+
+// RequeueMessage puts a message that never reached recipientID back in the queue for it alone
+// It keeps the QueuedAt it was first sent with; a copy still queued for others now waits for it too
+func (c *Client) RequeueMessage(ctx context.Context, chatUUID string, msg *QueuedMessage, recipientID string, maxQueued int) (int64, error) {
+	chat, _ := c.GetChat(ctx, chatUUID)
+	return c.queueMessage(ctx, chat, chatUUID, msg, []string{recipientID}, maxQueued)
+}
+
+// queueMessage stores msg under its MessageID and appends it to the chat's queue
+func (c *Client) queueMessage(ctx context.Context, chat *Chat, chatUUID string, msg *QueuedMessage, recipients []string, maxQueued int) (int64, error) {
+	messageID := msg.MessageID
 	msgJSON, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal message: %w", err)
+		return 0, fmt.Errorf("failed to marshal message: %w", err)
 	}
 
 	msgKey := fmt.Sprintf("msg:%s:%s", chatUUID, messageID)
 	queueKey := fmt.Sprintf("msg_queue:%s", chatUUID)
-	ttlSeconds := int(MaxChatTTL.Seconds())
+	ttlSeconds := int(queuedMessageTTL(chat).Seconds())
 
 	// Atomic queue operation: store message + add to queue + set TTLs
 	queueScript := `
 		local msgKey = KEYS[1]
 		local queueKey = KEYS[2]
+		local pendingKey = KEYS[3]
+		local countsKey = KEYS[4]
 		local msgJSON = ARGV[1]
 		local messageID = ARGV[2]
 		local ttl = tonumber(ARGV[3])
+		local maxQueued = tonumber(ARGV[4])
+		local msgPrefix = ARGV[5]
+		local pendingPrefix = ARGV[6]
+
+		-- Records who it waits for, counting each new recipient once
+		local function addRecipients()
+			for i = 7, #ARGV do
+				if redis.call('SADD', pendingKey, ARGV[i]) == 1 then
+					redis.call('HINCRBY', countsKey, ARGV[i], 1)
+				end
+			end
+			redis.call('EXPIRE', countsKey, ttl)
+		end
+
+		-- Already queued for others (say by another instance): it now waits for these too
+		if redis.call('EXISTS', msgKey) == 1 then
+			if #ARGV > 6 and redis.call('EXISTS', pendingKey) == 1 then
+				addRecipients()
+			end
+			return 0
+		end
 
 		-- Store message with TTL
 		redis.call('SET', msgKey, msgJSON, 'EX', ttl)
+
+		-- Who it waits for; with nobody recorded it waits for everyone but the sender
+		redis.call('DEL', pendingKey)
+		if #ARGV > 6 then
+			addRecipients()
+			redis.call('EXPIRE', pendingKey, ttl)
+		end
 		
 		-- Add to queue
 		redis.call('RPUSH', queueKey, messageID)
 		
 		-- Set queue TTL (refresh on each message)
 		redis.call('EXPIRE', queueKey, ttl)
-		
-		return 1
+
+		-- Drop the oldest messages over the cap, bodies included
+		local len = redis.call('LLEN', queueKey)
+		if maxQueued <= 0 or len <= maxQueued then
+			return 0
+		end
+		local excess = len - maxQueued
+		local dropped = redis.call('LRANGE', queueKey, 0, excess - 1)
+		redis.call('LTRIM', queueKey, excess, -1)
+		for _, id in ipairs(dropped) do
+			for _, p in ipairs(redis.call('SMEMBERS', pendingPrefix .. id)) do
+				redis.call('HINCRBY', countsKey, p, -1)
+			end
+			redis.call('DEL', msgPrefix .. id, pendingPrefix .. id)
+		end
+		return excess
 	`
 
-	_, err = c.rdb.Eval(ctx, queueScript, []string{msgKey, queueKey}, msgJSON, messageID, ttlSeconds).Result()
+	msgPrefix := fmt.Sprintf("msg:%s:", chatUUID)
+	args := []interface{}{msgJSON, messageID, ttlSeconds, maxQueued, msgPrefix, queuedRecipientsKey(chatUUID, "")}
+	for _, id := range recipients {
+		args = append(args, id)
+	}
+	keys := []string{msgKey, queueKey, queuedRecipientsKey(chatUUID, messageID), queuedCountsKey(chatUUID)}
+	dropped, err := c.rdb.Eval(ctx, queueScript, keys, args...).Int64()
 	if err != nil {
-		return fmt.Errorf("failed to queue message: %w", err)
+		return 0, fmt.Errorf("failed to queue message: %w", err)
 	}
 
-	return nil
+	return dropped, nil
 }
 
 func (c *Client) GetQueuedMessages(ctx context.Context, chatUUID string) (map[string]*QueuedMessage, error) {
@@ -340,11 +1126,191 @@ func (c *Client) GetQueuedMessages(ctx context.Context, chatUUID string) (map[st
 	return messages, nil
 }
 
-func (c *Client) DeleteQueuedMessage(ctx context.Context, chatUUID, messageID string) error {
-	msgKey := fmt.Sprintf("msg:%s:%s", chatUUID, messageID)
-	c.rdb.Del(ctx, msgKey)
+// GetQueuedMessagesRange returns up to limit queued messages starting at offset, oldest first
+// Also returns the queue length so callers know when to stop paging
+// Messages whose body already expired are skipped, so a page may be short
+func (c *Client) GetQueuedMessagesRange(ctx context.Context, chatUUID string, offset, limit int) ([]*QueuedMessage, int64, error) {
 	queueKey := fmt.Sprintf("msg_queue:%s", chatUUID)
-	c.rdb.LRem(ctx, queueKey, 1, messageID)
+
+	pipe := c.rdb.Pipeline()
+	idsCmd := pipe.LRange(ctx, queueKey, int64(offset), int64(offset+limit-1))
+	lenCmd := pipe.LLen(ctx, queueKey)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, 0, fmt.Errorf("failed to read message queue: %w", err)
+	}
+
+	messages, err := c.GetQueuedMessagesByID(ctx, chatUUID, idsCmd.Val())
+	if err != nil {
+		return nil, 0, err
+	}
+	return messages, lenCmd.Val(), nil
+}
+
+// GetQueuedMessageIDs returns the IDs of every message queued in a chat, oldest first
+// Paging over this snapshot with GetQueuedMessagesByID can't skip messages the way
+// offsets do when others are taken off the queue meanwhile
+func (c *Client) GetQueuedMessageIDs(ctx context.Context, chatUUID string) ([]string, error) {
+	ids, err := c.rdb.LRange(ctx, fmt.Sprintf("msg_queue:%s", chatUUID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message queue: %w", err)
+	}
+	return ids, nil
+}
+
+// GetQueuedMessagesByID loads queued messages in the order given
+// Messages no longer queued are skipped, so fewer may come back than were asked for
+func (c *Client) GetQueuedMessagesByID(ctx context.Context, chatUUID string, messageIDs []string) ([]*QueuedMessage, error) {
+	if len(messageIDs) == 0 {
+		return nil, nil
+	}
+
+	msgKeys := make([]string, len(messageIDs))
+	for i, msgID := range messageIDs {
+		msgKeys[i] = fmt.Sprintf("msg:%s:%s", chatUUID, msgID)
+	}
+	pipe := c.rdb.Pipeline()
+	bodiesCmd := pipe.MGet(ctx, msgKeys...)
+	recipientCmds := make([]*redis.StringSliceCmd, len(messageIDs))
+	for i, msgID := range messageIDs {
+		recipientCmds[i] = pipe.SMembers(ctx, queuedRecipientsKey(chatUUID, msgID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to read queued messages: %w", err)
+	}
+
+	messages := make([]*QueuedMessage, 0, len(messageIDs))
+	for i, body := range bodiesCmd.Val() {
+		content, ok := body.(string)
+		if !ok {
+			continue
+		}
+		var msg QueuedMessage
+		if json.Unmarshal([]byte(content), &msg) == nil {
+			msg.MessageID = messageIDs[i]
+			if recipients := recipientCmds[i].Val(); len(recipients) > 0 {
+				msg.Recipients = recipients
+			}
+			messages = append(messages, &msg)
+		}
+	}
+	return messages, nil
+}
+
+// GetQueuedMessageCount returns how many messages are queued in a chat, whoever sent them
+func (c *Client) GetQueuedMessageCount(ctx context.Context, chatUUID string) (int64, error) {
+	n, err := c.rdb.LLen(ctx, fmt.Sprintf("msg_queue:%s", chatUUID)).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to count queued messages: %w", err)
+	}
+	return n, nil
+}
+
+// GetPendingMessageCount returns how many queued messages in a chat are waiting for participantID,
+// leaving out the ones it sent itself. A single HGET on counters kept as messages are queued and
+// taken; messages queued before recipients were tracked aren't counted
+func (c *Client) GetPendingMessageCount(ctx context.Context, chatUUID, participantID string) (int64, error) {
+	n, err := c.rdb.HGet(ctx, queuedCountsKey(chatUUID), participantID).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to count pending messages: %w", err)
+	}
+	return max(n, 0), nil
+}
+
+// GetQueuedMessage returns a message still waiting in the queue
+// Returns nil once it has been delivered or expired
+func (c *Client) GetQueuedMessage(ctx context.Context, chatUUID, messageID string) (*QueuedMessage, error) {
+	msgKey := fmt.Sprintf("msg:%s:%s", chatUUID, messageID)
+	content, err := c.rdb.Get(ctx, msgKey).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get queued message: %w", err)
+	}
+
+	var msg QueuedMessage
+	if err := json.Unmarshal(content, &msg); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal message: %w", err)
+	}
+	msg.MessageID = messageID
+	return &msg, nil
+}
+
+// UpdateQueuedMessage replaces the content of a message still waiting in the queue
+// Returns false if it was delivered in the meantime
+func (c *Client) UpdateQueuedMessage(ctx context.Context, msg *QueuedMessage, chatUUID string, encryptedContent []byte) (bool, error) {
+	updated := *msg
+	updated.EncryptedContent = encryptedContent
+	msgJSON, err := json.Marshal(updated)
+	if err != nil {
+		return false, fmt.Errorf("failed to marshal message: %w", err)
+	}
+
+	// XX: never recreate a body the recipient already took off the queue
+	msgKey := fmt.Sprintf("msg:%s:%s", chatUUID, msg.MessageID)
+	err = c.rdb.SetArgs(ctx, msgKey, msgJSON, redis.SetArgs{Mode: "XX", KeepTTL: true}).Err()
+	if err == redis.Nil {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to update queued message: %w", err)
+	}
+	return true, nil
+}
+
+// DeleteQueuedMessage removes a queued message for every recipient still waiting for it
+func (c *Client) DeleteQueuedMessage(ctx context.Context, chatUUID, messageID string) error {
+	deleteScript := `
+		for _, p in ipairs(redis.call('SMEMBERS', KEYS[3])) do
+			redis.call('HINCRBY', KEYS[4], p, -1)
+		end
+		redis.call('DEL', KEYS[1], KEYS[3])
+		redis.call('LREM', KEYS[2], 1, ARGV[1])
+		return 1
+	`
+
+	keys := []string{
+		fmt.Sprintf("msg:%s:%s", chatUUID, messageID),
+		fmt.Sprintf("msg_queue:%s", chatUUID),
+		queuedRecipientsKey(chatUUID, messageID),
+		queuedCountsKey(chatUUID),
+	}
+	if err := c.rdb.Eval(ctx, deleteScript, keys, messageID).Err(); err != nil {
+		return fmt.Errorf("failed to delete queued message: %w", err)
+	}
+	return nil
+}
+
+// ReleaseQueuedMessage takes a queued message off the queue for one recipient
+// The body is deleted once no recipient is left waiting, or at once for a message
+// queued before recipients were tracked
+func (c *Client) ReleaseQueuedMessage(ctx context.Context, chatUUID, messageID, participantID string) error {
+	releaseScript := `
+		if redis.call('EXISTS', KEYS[3]) == 1 then
+			if redis.call('SREM', KEYS[3], ARGV[2]) == 1 then
+				redis.call('HINCRBY', KEYS[4], ARGV[2], -1)
+			end
+			if redis.call('SCARD', KEYS[3]) > 0 then
+				return 0
+			end
+		end
+		redis.call('DEL', KEYS[1], KEYS[3])
+		redis.call('LREM', KEYS[2], 1, ARGV[1])
+		return 1
+	`
+
+	keys := []string{
+		fmt.Sprintf("msg:%s:%s", chatUUID, messageID),
+		fmt.Sprintf("msg_queue:%s", chatUUID),
+		queuedRecipientsKey(chatUUID, messageID),
+		queuedCountsKey(chatUUID),
+	}
+	if err := c.rdb.Eval(ctx, releaseScript, keys, messageID, participantID).Err(); err != nil {
+		return fmt.Errorf("failed to release queued message: %w", err)
+	}
 	return nil
 }
 
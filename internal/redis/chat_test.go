@@ -2,6 +2,9 @@ package redis
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -31,18 +34,20 @@ func TestJoinChat_Success(t *testing.T) {
 	ctx := context.Background()
 
 	// Create a chat
-	chatUUID := "test-chat-" + time.Now().Format("150405")
-	creatorUUID := "creator-device-123"
-	joinerUUID := "joiner-device-456"
-	invitationToken := "test-token-" + time.Now().Format("150405")
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-" + suffix
+	creatorUUID := "creator-device-" + suffix
+	joinerUUID := "joiner-device-" + suffix
+	invitationToken := "test-token-" + suffix
 
-	err := client.CreateChat(ctx, chatUUID, creatorUUID, invitationToken, 60)
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", creatorUUID, invitationToken, 60, 2)
 	if err != nil {
 		t.Fatalf("Failed to create chat: %v", err)
 	}
+	defer client.DeleteChat(ctx, chatUUID)
 
 	// Join the chat
-	chat, err := client.JoinChat(ctx, invitationToken, joinerUUID)
+	chat, creatorDevice, err := client.JoinChat(ctx, invitationToken, joinerUUID, "participant-b", "secret-b")
 	if err != nil {
 		t.Fatalf("Failed to join chat: %v", err)
 	}
@@ -51,14 +56,20 @@ func TestJoinChat_Success(t *testing.T) {
 	if chat.Status != "active" {
 		t.Errorf("Expected status 'active', got '%s'", chat.Status)
 	}
-	if chat.ParticipantB != joinerUUID {
-		t.Errorf("Expected participant_b '%s', got '%s'", joinerUUID, chat.ParticipantB)
+	if creatorDevice != creatorUUID {
+		t.Errorf("Expected creator device '%s', got '%s'", creatorUUID, creatorDevice)
+	}
+	if len(chat.Participants) != 2 {
+		t.Fatalf("Expected 2 participants, got %d", len(chat.Participants))
+	}
+	if joiner := chat.Participants[1]; joiner.ID != "participant-b" || joiner.DeviceUUID != joinerUUID {
+		t.Errorf("Expected participant 'participant-b' on '%s', got '%s' on '%s'", joinerUUID, joiner.ID, joiner.DeviceUUID)
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-b", "secret-b"); !valid {
+		t.Error("Expected joiner credentials to validate")
 	}
 
 	t.Logf("✓ Join successful: chat=%s, status=%s", chat.ChatUUID, chat.Status)
-
-	// Cleanup
-	client.DeleteChat(ctx, chatUUID)
 }
 
 func TestJoinChat_AlreadyUsed(t *testing.T) {
@@ -66,60 +77,88 @@ func TestJoinChat_AlreadyUsed(t *testing.T) {
 	ctx := context.Background()
 
 	// Create a chat
-	chatUUID := "test-chat-used-" + time.Now().Format("150405")
-	creatorUUID := "creator-device-123"
-	joinerUUID1 := "joiner-device-456"
-	joinerUUID2 := "joiner-device-789"
-	invitationToken := "test-token-used-" + time.Now().Format("150405")
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-used-" + suffix
+	invitationToken := "test-token-used-" + suffix
 
-	err := client.CreateChat(ctx, chatUUID, creatorUUID, invitationToken, 60)
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "creator-device-"+suffix, invitationToken, 60, 2)
 	if err != nil {
 		t.Fatalf("Failed to create chat: %v", err)
 	}
+	defer client.DeleteChat(ctx, chatUUID)
 
 	// First join - should succeed
-	_, err = client.JoinChat(ctx, invitationToken, joinerUUID1)
+	_, _, err = client.JoinChat(ctx, invitationToken, "joiner-1-"+suffix, "participant-b", "secret-b")
 	if err != nil {
 		t.Fatalf("First join failed: %v", err)
 	}
 	t.Log("✓ First join successful")
 
-	// Second join - should fail
-	_, err = client.JoinChat(ctx, invitationToken, joinerUUID2)
-	if err == nil {
-		t.Fatal("Second join should have failed but didn't")
+	// Second join - should fail, the two-party chat used up the invitation
+	_, _, err = client.JoinChat(ctx, invitationToken, "joiner-2-"+suffix, "participant-c", "secret-c")
+	if !errors.Is(err, ErrInvitationUsed) {
+		t.Fatalf("Expected %v, got %v", ErrInvitationUsed, err)
 	}
 
 	t.Logf("✓ Second join correctly rejected: %v", err)
-
-	// Cleanup
-	client.DeleteChat(ctx, chatUUID)
 }
 
-func TestJoinChat_SelfJoin(t *testing.T) {
+func TestJoinChat_SameParticipantID(t *testing.T) {
 	client := setupTestClient(t)
 	ctx := context.Background()
 
 	// Create a chat
-	chatUUID := "test-chat-self-" + time.Now().Format("150405")
-	creatorUUID := "creator-device-123"
-	invitationToken := "test-token-self-" + time.Now().Format("150405")
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-self-" + suffix
+	creatorUUID := "creator-device-" + suffix
+	invitationToken := "test-token-self-" + suffix
 
-	err := client.CreateChat(ctx, chatUUID, creatorUUID, invitationToken, 60)
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", creatorUUID, invitationToken, 60, 2)
 	if err != nil {
 		t.Fatalf("Failed to create chat: %v", err)
 	}
+	defer client.DeleteChat(ctx, chatUUID)
 
-	// Try to join own chat - should fail
-	_, err = client.JoinChat(ctx, invitationToken, creatorUUID)
-	if err == nil {
-		t.Fatal("Self-join should have failed but didn't")
+	// Joining under the creator's participant ID - should fail
+	_, _, err = client.JoinChat(ctx, invitationToken, creatorUUID, "participant-a", "secret-x")
+	if !errors.Is(err, ErrSameParticipant) {
+		t.Fatalf("Expected %v, got %v", ErrSameParticipant, err)
+	}
+
+	t.Logf("✓ Same participant ID correctly rejected: %v", err)
+}
+
+func TestJoinChat_NotJoinable(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-closed-" + suffix
+	invitationToken := "test-token-closed-" + suffix
+
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "creator-device-"+suffix, invitationToken, 60, 2)
+	if err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
 	}
+	defer client.DeleteChat(ctx, chatUUID)
 
-	t.Logf("✓ Self-join correctly rejected: %v", err)
+	// A chat that is neither pending nor active, with its invitation still unused
+	chatJSON, err := client.rdb.Get(ctx, "chat:"+chatUUID).Result()
+	if err != nil {
+		t.Fatalf("Failed to read chat: %v", err)
+	}
+	var chat map[string]interface{}
+	json.Unmarshal([]byte(chatJSON), &chat)
+	chat["status"] = "expired"
+	updated, _ := json.Marshal(chat)
+	client.rdb.Set(ctx, "chat:"+chatUUID, updated, time.Minute)
+
+	_, _, err = client.JoinChat(ctx, invitationToken, "joiner-device-"+suffix, "participant-b", "secret-b")
+	if !errors.Is(err, ErrChatFull) {
+		t.Fatalf("Expected %v, got %v", ErrChatFull, err)
+	}
 
-	// Cleanup
-	client.DeleteChat(ctx, chatUUID)
+	t.Logf("✓ Join to a closed chat correctly rejected: %v", err)
 }
 
 func TestJoinChat_InvalidToken(t *testing.T) {
@@ -127,9 +166,9 @@ func TestJoinChat_InvalidToken(t *testing.T) {
 	ctx := context.Background()
 
 	// Try to join with invalid token
-	_, err := client.JoinChat(ctx, "nonexistent-token", "some-device")
-	if err == nil {
-		t.Fatal("Join with invalid token should have failed")
+	_, _, err := client.JoinChat(ctx, "nonexistent-token", "some-device", "participant-b", "secret-b")
+	if !errors.Is(err, ErrInvitationNotFound) {
+		t.Fatalf("Expected %v, got %v", ErrInvitationNotFound, err)
 	}
 
 	t.Logf("✓ Invalid token correctly rejected: %v", err)
@@ -140,22 +179,23 @@ func TestJoinChat_RaceCondition(t *testing.T) {
 	ctx := context.Background()
 
 	// Create a chat
-	chatUUID := "test-chat-race-" + time.Now().Format("150405")
-	creatorUUID := "creator-device-123"
-	invitationToken := "test-token-race-" + time.Now().Format("150405")
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-race-" + suffix
+	invitationToken := "test-token-race-" + suffix
 
-	err := client.CreateChat(ctx, chatUUID, creatorUUID, invitationToken, 60)
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "creator-device-"+suffix, invitationToken, 60, 2)
 	if err != nil {
 		t.Fatalf("Failed to create chat: %v", err)
 	}
+	defer client.DeleteChat(ctx, chatUUID)
 
 	// Simulate race condition - 10 concurrent joins
 	results := make(chan error, 10)
 
 	for i := 0; i < 10; i++ {
 		go func(deviceNum int) {
-			joinerUUID := "joiner-" + string(rune('A'+deviceNum))
-			_, err := client.JoinChat(ctx, invitationToken, joinerUUID)
+			id := string(rune('A' + deviceNum))
+			_, _, err := client.JoinChat(ctx, invitationToken, "joiner-"+id+"-"+suffix, "participant-"+id, "secret-"+id)
 			results <- err
 		}(i)
 	}
@@ -175,7 +215,494 @@ func TestJoinChat_RaceCondition(t *testing.T) {
 	}
 
 	t.Logf("✓ Race condition test passed: %d/10 succeeded (expected 1)", successCount)
+}
+
+func TestGetUserChats_BothParticipants(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-list-" + suffix
+	creatorUUID := "creator-list-" + suffix
+	joinerUUID := "joiner-list-" + suffix
+	invitationToken := "test-token-list-" + suffix
+
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", creatorUUID, invitationToken, 60, 2)
+	if err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	if _, _, err := client.JoinChat(ctx, invitationToken, joinerUUID, "participant-b", "secret-b"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	perspectives := map[string]string{
+		creatorUUID: joinerUUID,
+		joinerUUID:  creatorUUID,
+	}
+	for deviceUUID, expectedOther := range perspectives {
+		chats, err := client.GetUserChats(ctx, deviceUUID)
+		if err != nil {
+			t.Fatalf("GetUserChats(%s) failed: %v", deviceUUID, err)
+		}
+		if len(chats) != 1 || chats[0] != chatUUID {
+			t.Fatalf("Expected [%s] for %s, got %v", chatUUID, deviceUUID, chats)
+		}
+
+		others, err := client.GetOtherParticipantDevices(ctx, chatUUID, deviceUUID)
+		if err != nil {
+			t.Fatalf("GetOtherParticipantDevices failed: %v", err)
+		}
+		if len(others) != 1 || others[0] != expectedOther {
+			t.Errorf("Expected other devices [%s] for %s, got %v", expectedOther, deviceUUID, others)
+		}
+	}
+
+	// Deleting the chat must clear both sets
+	if err := client.DeleteChat(ctx, chatUUID); err != nil {
+		t.Fatalf("Failed to delete chat: %v", err)
+	}
+	for deviceUUID := range perspectives {
+		chats, _ := client.GetUserChats(ctx, deviceUUID)
+		if len(chats) != 0 {
+			t.Errorf("Expected no chats for %s after delete, got %v", deviceUUID, chats)
+		}
+	}
+
+	t.Logf("✓ Chat listed from both perspectives and cleaned up on delete")
+}
+
+func TestJoinChat_Group(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-group-" + suffix
+	invitationToken := "test-token-group-" + suffix
+
+	err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "device-a-"+suffix, invitationToken, 60, 3)
+	if err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	// Same invitation works until the chat is full
+	for _, id := range []string{"b", "c"} {
+		_, _, err := client.JoinChat(ctx, invitationToken, "device-"+id+"-"+suffix, "participant-"+id, "secret-"+id)
+		if err != nil {
+			t.Fatalf("Participant %s failed to join: %v", id, err)
+		}
+	}
+
+	_, _, err = client.JoinChat(ctx, invitationToken, "device-d-"+suffix, "participant-d", "secret-d")
+	if err == nil {
+		t.Fatal("Expected join to fail once the chat is full")
+	}
+
+	chat, err := client.GetChat(ctx, chatUUID)
+	if err != nil {
+		t.Fatalf("Failed to get chat: %v", err)
+	}
+	if len(chat.Participants) != 3 || chat.Status != "active" {
+		t.Fatalf("Expected 3 active participants, got %d (%s)", len(chat.Participants), chat.Status)
+	}
+	if others := chat.OtherParticipants("participant-b"); len(others) != 2 {
+		t.Errorf("Expected 2 other participants, got %d", len(others))
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-c", "secret-c"); !valid {
+		t.Error("Expected participant-c credentials to validate")
+	}
+
+	t.Logf("✓ Group chat filled to its limit and then refused joins")
+}
+
+func TestGetChat_LegacyShape(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-legacy-" + suffix
+	invitationToken := "test-token-legacy-" + suffix
+
+	// A pending chat as it was stored before group support
+	legacy := `{"chat_uuid":"` + chatUUID + `","participant_a":"participant-a",` +
+		`"participant_a_secret":"` + HashSecret("secret-a") + `","participant_a_device":"device-a",` +
+		`"participant_b":"","participant_b_secret":"","participant_b_device":"",` +
+		`"ttl_seconds":60,"created_at":"` + time.Now().Format(time.RFC3339Nano) + `","status":"pending"}`
+	client.rdb.Set(ctx, "chat:"+chatUUID, legacy, time.Minute)
+	client.rdb.Set(ctx, "invite:"+invitationToken, `{"token":"`+invitationToken+`","chat_uuid":"`+chatUUID+
+		`","creator_device_id":"device-a","ttl_seconds":60,"created_at":"`+time.Now().Format(time.RFC3339Nano)+`","used":false}`, time.Minute)
+	defer client.DeleteChat(ctx, chatUUID)
+
+	chat, err := client.GetChat(ctx, chatUUID)
+	if err != nil {
+		t.Fatalf("Failed to get legacy chat: %v", err)
+	}
+	if len(chat.Participants) != 1 || chat.Participants[0].DeviceUUID != "device-a" {
+		t.Fatalf("Expected creator as only participant, got %+v", chat.Participants)
+	}
+	if chat.MaxParticipants != DefaultMaxParticipants {
+		t.Errorf("Expected max participants %d, got %d", DefaultMaxParticipants, chat.MaxParticipants)
+	}
+
+	joined, _, err := client.JoinChat(ctx, invitationToken, "device-b", "participant-b", "secret-b")
+	if err != nil {
+		t.Fatalf("Failed to join legacy chat: %v", err)
+	}
+	if len(joined.Participants) != 2 || joined.Participants[1].ID != "participant-b" {
+		t.Errorf("Expected joiner appended, got %+v", joined.Participants)
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-a", "secret-a"); !valid {
+		t.Error("Expected creator credentials to survive migration")
+	}
+
+	t.Logf("✓ Legacy two-party chat decoded and joined")
+}
+
+func TestRotateParticipantSecret(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-rotate-" + suffix
+	invitationToken := "test-token-rotate-" + suffix
+
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "creator-device-"+suffix, invitationToken, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	if _, _, err := client.JoinChat(ctx, invitationToken, "joiner-device-"+suffix, "participant-b", "secret-b"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	if err := client.RotateParticipantSecret(ctx, chatUUID, "participant-a", "wrong", "secret-a2"); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("Expected ErrInvalidSecret for wrong old secret, got %v", err)
+	}
+	if err := client.RotateParticipantSecret(ctx, chatUUID, "participant-a", "secret-a", "secret-a2"); err != nil {
+		t.Fatalf("Failed to rotate secret: %v", err)
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-a", "secret-a"); valid {
+		t.Error("Expected old secret rejected after rotation")
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-a", "secret-a2"); !valid {
+		t.Error("Expected new secret accepted after rotation")
+	}
+
+	// Concurrent rotations from the same secret: one wins, the chat stays intact
+	results := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		go func(n int) {
+			results <- client.RotateParticipantSecret(ctx, chatUUID, "participant-a", "secret-a2", "secret-x"+string(rune('A'+n)))
+		}(i)
+	}
+	bDone := make(chan error, 1)
+	go func() {
+		bDone <- client.RotateParticipantSecret(ctx, chatUUID, "participant-b", "secret-b", "secret-b2")
+	}()
+
+	successCount := 0
+	for i := 0; i < 10; i++ {
+		if err := <-results; err == nil {
+			successCount++
+		} else if !errors.Is(err, ErrInvalidSecret) {
+			t.Errorf("Unexpected rotation error: %v", err)
+		}
+	}
+	if err := <-bDone; err != nil {
+		t.Errorf("Failed to rotate participant-b: %v", err)
+	}
+	if successCount != 1 {
+		t.Errorf("Expected exactly 1 successful rotation, got %d", successCount)
+	}
+
+	chat, err := client.GetChat(ctx, chatUUID)
+	if err != nil {
+		t.Fatalf("Chat unreadable after concurrent rotations: %v", err)
+	}
+	if len(chat.Participants) != 2 || chat.Status != "active" || chat.TTLSeconds != 60 {
+		t.Errorf("Chat corrupted by rotation: %+v", chat)
+	}
+	winners := 0
+	for i := 0; i < 10; i++ {
+		if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-a", "secret-x"+string(rune('A'+i))); valid {
+			winners++
+		}
+	}
+	if winners != 1 {
+		t.Errorf("Expected exactly one rotated secret valid, got %d", winners)
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-b", "secret-b2"); !valid {
+		t.Error("Expected participant-b rotation kept alongside participant-a's")
+	}
+
+	t.Logf("✓ Secret rotated, old secret rejected, %d/10 concurrent rotations succeeded", successCount)
+}
+
+func TestJoinChat_ExpiredChatInvite(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-stale-" + suffix
+	invitationToken := "test-token-stale-" + suffix
+
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "creator-device-"+suffix, invitationToken, 5, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	// A 5 second chat's invitation lives for its TTL plus grace, not 24 hours
+	ttl, _ := client.rdb.TTL(ctx, "invite:"+invitationToken).Result()
+	if ttl <= 0 || ttl > 5*time.Second+InvitationGrace {
+		t.Errorf("Expected invitation TTL aligned to the chat, got %v", ttl)
+	}
+
+	// The chat's join deadline has passed even though the invitation is still stored
+	chat, err := client.GetChat(ctx, chatUUID)
+	if err != nil {
+		t.Fatalf("Failed to get chat: %v", err)
+	}
+	chat.JoinDeadline = time.Now().Add(-time.Second).Unix()
+	chatJSON, _ := json.Marshal(chat)
+	client.rdb.Set(ctx, "chat:"+chatUUID, chatJSON, time.Minute)
+
+	_, _, err = client.JoinChat(ctx, invitationToken, "joiner-device-"+suffix, "participant-b", "secret-b")
+	if !errors.Is(err, ErrInvitationExpired) {
+		t.Errorf("Expected ErrInvitationExpired past the join deadline, got %v", err)
+	}
+
+	// An invitation older than its aligned TTL is refused before the script runs
+	invitation, err := client.GetInvitation(ctx, invitationToken)
+	if err != nil {
+		t.Fatalf("Failed to get invitation: %v", err)
+	}
+	invitation.CreatedAt = time.Now().Add(-(5*time.Second + InvitationGrace + time.Second))
+	invJSON, _ := json.Marshal(invitation)
+	client.rdb.Set(ctx, "invite:"+invitationToken, invJSON, time.Minute)
+
+	_, _, err = client.JoinChat(ctx, invitationToken, "joiner-device-"+suffix, "participant-b", "secret-b")
+	if !errors.Is(err, ErrInvitationExpired) {
+		t.Errorf("Expected ErrInvitationExpired for a stale invitation, got %v", err)
+	}
+
+	if chat, _ := client.GetChat(ctx, chatUUID); chat == nil || chat.Status != "pending" || len(chat.Participants) != 1 {
+		t.Error("Expected the stale chat left pending and unjoined")
+	}
+
+	t.Logf("✓ Invitation for an expired chat correctly rejected")
+}
+
+func TestCreateChat_MaxChatsPerDevice(t *testing.T) {
+	client := setupTestClient(t)
+	client.SetMaxChatsPerDevice(3)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	deviceUUID := "test-chat-cap-" + suffix
+	defer client.rdb.Del(ctx, userChatsKey(deviceUUID))
+
+	create := func(i int) (string, error) {
+		chatUUID := fmt.Sprintf("test-chat-cap-%s-%d", suffix, i)
+		return chatUUID, client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", deviceUUID, fmt.Sprintf("test-token-cap-%s-%d", suffix, i), 60, 2)
+	}
+
+	var chatUUIDs []string
+	for i := 0; i < 3; i++ {
+		chatUUID, err := create(i)
+		if err != nil {
+			t.Fatalf("Failed to create chat %d: %v", i, err)
+		}
+		chatUUIDs = append(chatUUIDs, chatUUID)
+		defer client.DeleteChat(ctx, chatUUID)
+	}
+
+	if _, err := create(3); !errors.Is(err, ErrTooManyChats) {
+		t.Fatalf("Expected ErrTooManyChats beyond the cap, got %v", err)
+	}
+
+	// Deleting a chat frees its slot
+	client.DeleteChat(ctx, chatUUIDs[0])
+	chatUUID, err := create(4)
+	if err != nil {
+		t.Fatalf("Expected a chat after deleting one, got %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	// So does one that expired without being deleted
+	client.rdb.Del(ctx, "chat:"+chatUUIDs[1])
+	chatUUID, err = create(5)
+	if err != nil {
+		t.Fatalf("Expected a chat after one expired, got %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	t.Logf("✓ Devices are capped at their active chat count")
+}
+
+func TestReopenChat(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-reopen-" + suffix
+	creatorUUID := "creator-device-" + suffix
+	peerUUID := "peer-device-" + suffix
+	invitationToken := "test-token-reopen-" + suffix
+
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", creatorUUID, invitationToken, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+
+	// Nobody to replace before anyone joined
+	if _, err := client.ReopenChat(ctx, chatUUID, "participant-a", "", creatorUUID, "never-"+suffix); !errors.Is(err, ErrChatNotActive) {
+		t.Errorf("Expected ErrChatNotActive for a pending chat, got %v", err)
+	}
+
+	if _, _, err := client.JoinChat(ctx, invitationToken, peerUUID, "participant-b", "secret-b"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	if _, err := client.ReopenChat(ctx, chatUUID, "participant-a", "wrong", "other-device-"+suffix, "never-"+suffix); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("Expected ErrInvalidSecret for a stranger, got %v", err)
+	}
+
+	// The peer is still in the chat, so it can't be pushed out
+	if _, err := client.ReopenChat(ctx, chatUUID, "participant-a", "", creatorUUID, "never-"+suffix); !errors.Is(err, ErrPeersRemain) {
+		t.Fatalf("Expected ErrPeersRemain while the peer is in the chat, got %v", err)
+	}
+	if chat, _ := client.GetChat(ctx, chatUUID); chat == nil || chat.Status != "active" || len(chat.Participants) != 2 {
+		t.Fatalf("Expected the chat left untouched, got %+v", chat)
+	}
+
+	// The peer leaves; the chat stays for the creator
+	left, err := client.LeaveChat(ctx, chatUUID, "participant-b", "", peerUUID)
+	if err != nil {
+		t.Fatalf("Failed to leave chat: %v", err)
+	}
+	if left == nil || len(left.Participants) != 1 || left.Participants[0].ID != "participant-a" {
+		t.Fatalf("Expected the chat kept with only participant-a, got %+v", left)
+	}
+	if chats, _ := client.GetUserChats(ctx, peerUUID); len(chats) != 0 {
+		t.Errorf("Expected the chat dropped from the peer's list, got %v", chats)
+	}
+
+	newToken := "test-token-reopened-" + suffix
+	chat, err := client.ReopenChat(ctx, chatUUID, "participant-a", "", creatorUUID, newToken)
+	if err != nil {
+		t.Fatalf("Failed to reopen chat: %v", err)
+	}
+	if chat.Status != "pending" || len(chat.Participants) != 1 || chat.Participants[0].ID != "participant-a" {
+		t.Errorf("Expected a pending chat holding only participant-a, got %+v", chat)
+	}
+
+	if _, _, err := client.JoinChat(ctx, invitationToken, "late-device-"+suffix, "participant-c", "secret-c"); err == nil {
+		t.Error("Expected the old invitation rejected after reopening")
+	}
+
+	joinerUUID := "joiner-device-" + suffix
+	chat, creatorDevice, err := client.JoinChat(ctx, newToken, joinerUUID, "participant-d", "secret-d")
+	if err != nil {
+		t.Fatalf("Failed to join reopened chat: %v", err)
+	}
+	defer client.PurgeDevice(ctx, joinerUUID)
+	if chat.ChatUUID != chatUUID || chat.Status != "active" || len(chat.Participants) != 2 {
+		t.Errorf("Expected the same chat active with two participants, got %+v", chat)
+	}
+	if creatorDevice != creatorUUID {
+		t.Errorf("Expected creator device %s, got %s", creatorUUID, creatorDevice)
+	}
+	if valid, _ := client.ValidateParticipant(ctx, chatUUID, "participant-b", "secret-b"); valid {
+		t.Error("Expected the old peer's credentials rejected")
+	}
+
+	t.Logf("✓ Chat reopened after the peer left and a new participant joined")
+}
+
+func TestLeaveChat_LastOneDeletes(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-leave-" + suffix
+	creatorUUID := "leave-creator-" + suffix
+	peerUUID := "leave-peer-" + suffix
+	invitationToken := "test-token-leave-" + suffix
+
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", creatorUUID, invitationToken, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	if _, _, err := client.JoinChat(ctx, invitationToken, peerUUID, "participant-b", "secret-b"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
 
-	// Cleanup
-	client.DeleteChat(ctx, chatUUID)
-}
\ No newline at end of file
+	if _, err := client.LeaveChat(ctx, chatUUID, "participant-b", "wrong", "other-device-"+suffix); !errors.Is(err, ErrInvalidSecret) {
+		t.Errorf("Expected ErrInvalidSecret for a stranger, got %v", err)
+	}
+	if err := client.QueueMessage(ctx, chatUUID, "msg-for-b", "participant-a", []byte("ciphertext")); err != nil {
+		t.Fatalf("Failed to queue message: %v", err)
+	}
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+	if _, err := client.LeaveChat(ctx, chatUUID, "participant-b", "secret-b", "other-device-"+suffix); err != nil {
+		t.Fatalf("Expected the peer to leave with its secret, got %v", err)
+	}
+	// Nothing stays queued for the participant that left
+	if queued, _ := client.GetQueuedMessage(ctx, chatUUID, "msg-for-b"); queued != nil {
+		t.Error("Expected the message queued for the leaver released")
+	}
+
+	chat, err := client.LeaveChat(ctx, chatUUID, "participant-a", "", creatorUUID)
+	if err != nil {
+		t.Fatalf("Failed to leave chat: %v", err)
+	}
+	if chat != nil {
+		t.Errorf("Expected no chat left, got %+v", chat)
+	}
+	if _, err := client.GetChat(ctx, chatUUID); err == nil {
+		t.Error("Expected the chat deleted once the last participant left")
+	}
+
+	t.Logf("✓ The last participant to leave deletes the chat")
+}
+
+func TestChatMute_FollowsChatExpiry(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-chat-mute-" + suffix
+	invitationToken := "test-token-mute-" + suffix
+
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", "mute-creator-"+suffix, invitationToken, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	pending, err := client.GetChat(ctx, chatUUID)
+	if err != nil {
+		t.Fatalf("Failed to get chat: %v", err)
+	}
+	if err := client.SetChatMuted(ctx, pending, "participant-a", true); err != nil {
+		t.Fatalf("Failed to mute chat: %v", err)
+	}
+	key := muteKey(chatUUID, "participant-a")
+
+	// Muted while pending, the flag moves to the activated chat's expiry
+	if _, _, err := client.JoinChat(ctx, invitationToken, "mute-peer-"+suffix, "participant-b", "secret-b"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	if ttl := client.rdb.TTL(ctx, key).Val(); ttl <= 0 || ttl > 60*time.Second {
+		t.Errorf("Expected the mute to expire with the activated chat, got TTL %v", ttl)
+	}
+
+	// Extending the chat carries the mute along
+	if _, err := client.ExtendChat(ctx, chatUUID, "participant-a", "secret-a", 600, time.Hour); err != nil {
+		t.Fatalf("Failed to extend chat: %v", err)
+	}
+	if ttl := client.rdb.TTL(ctx, key).Val(); ttl < 590*time.Second {
+		t.Errorf("Expected the mute extended with the chat, got TTL %v", ttl)
+	}
+
+	t.Logf("✓ A chat's mute flag expires when the chat does")
+}
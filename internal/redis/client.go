@@ -2,32 +2,126 @@ package redis
 
 import (
 "context"
+"crypto/rand"
 "fmt"
+"log/slog"
+"sync/atomic"
 "time"
 
 "github.com/redis/go-redis/v9"
 )
 
 type Client struct {
-rdb *redis.Client
+rdb               redis.UniversalClient
+subscriptionGrace time.Duration // how long an expired subscription keeps working
+authWindow        time.Duration // allowed clock skew on signed timestamps, see TimestampFresh
+healthy           atomic.Bool   // last background health check result, see RunHealthCheck
+abuse             AbuseThresholds
+maxChats          int // active chats one device may be in, 0 for no limit, see SetMaxChatsPerDevice
+maxPreKeys        int // one-time prekeys one device may have stored, 0 for no limit, see SetMaxPreKeys
+codeTTL           time.Duration // how long an unclaimed activation code is kept, see SetCodeRetention
+usedCodeRetention time.Duration // how long a claimed code is kept for retries
+inviteMaxTTL      time.Duration // longest an invitation stays open, see SetInvitationTTL
+claimSecret       []byte        // keys claimHash, see SetClaimSecret
+}
+
+// Options tunes the connection - zero fields keep the go-redis defaults
+// SentinelAddrs (with MasterName) or ClusterAddrs replace the single node in the URL
+// Cluster mode needs hash-tagged keys first, so config.Validate refuses it for now
+type Options struct {
+PoolSize     int
+MinIdleConns int
+DialTimeout  time.Duration
+MaxRetries   int
+
+SentinelAddrs []string
+MasterName    string
+ClusterAddrs  []string
+Password      string // for sentinel and cluster mode; single-node takes it from the URL
 }
 
 func NewClient(redisURL string) (*Client, error) {
-opt, err := redis.ParseURL(redisURL)
-if err != nil {
-return nil, fmt.Errorf("failed to parse redis URL: %w", err)
+return NewClientWithOptions(redisURL, Options{})
 }
 
-rdb := redis.NewClient(opt)
+func NewClientWithOptions(redisURL string, opts Options) (*Client, error) {
+rdb, err := newUniversalClient(redisURL, opts)
+if err != nil {
+return nil, err
+}
 
 ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 defer cancel()
 
 if err := rdb.Ping(ctx).Err(); err != nil {
+rdb.Close()
 return nil, fmt.Errorf("failed to connect to redis: %w", err)
 }
 
-return &Client{rdb: rdb}, nil
+c := &Client{
+rdb:               rdb,
+abuse:             DefaultAbuseThresholds,
+authWindow:        DefaultAuthWindow,
+codeTTL:           DefaultActivationCodeTTL,
+usedCodeRetention: DefaultUsedCodeRetention,
+inviteMaxTTL:      InvitationMaxTTL,
+claimSecret:       make([]byte, 32),
+}
+// Random until SetClaimSecret, so retries only match on the instance that claimed
+rand.Read(c.claimSecret)
+c.healthy.Store(true)
+return c, nil
+}
+
+// newUniversalClient builds a sentinel, cluster or single-node client without connecting
+// NOTE: in cluster mode the multi-key Lua scripts need their keys on one slot;
+// keys aren't hash-tagged yet, so those commands fail with CROSSSLOT until they are
+func newUniversalClient(redisURL string, opts Options) (redis.UniversalClient, error) {
+if len(opts.SentinelAddrs) > 0 {
+if opts.MasterName == "" {
+return nil, fmt.Errorf("redis sentinel requires a master name")
+}
+return redis.NewFailoverClient(&redis.FailoverOptions{
+MasterName:    opts.MasterName,
+SentinelAddrs: opts.SentinelAddrs,
+Password:      opts.Password,
+PoolSize:      opts.PoolSize,
+MinIdleConns:  opts.MinIdleConns,
+DialTimeout:   opts.DialTimeout,
+MaxRetries:    opts.MaxRetries,
+}), nil
+}
+
+if len(opts.ClusterAddrs) > 0 {
+return redis.NewClusterClient(&redis.ClusterOptions{
+Addrs:        opts.ClusterAddrs,
+Password:     opts.Password,
+PoolSize:     opts.PoolSize,
+MinIdleConns: opts.MinIdleConns,
+DialTimeout:  opts.DialTimeout,
+MaxRetries:   opts.MaxRetries,
+}), nil
+}
+
+opt, err := redis.ParseURL(redisURL)
+if err != nil {
+return nil, fmt.Errorf("failed to parse redis URL: %w", err)
+}
+
+if opts.PoolSize > 0 {
+opt.PoolSize = opts.PoolSize
+}
+if opts.MinIdleConns > 0 {
+opt.MinIdleConns = opts.MinIdleConns
+}
+if opts.DialTimeout > 0 {
+opt.DialTimeout = opts.DialTimeout
+}
+if opts.MaxRetries != 0 {
+opt.MaxRetries = opts.MaxRetries
+}
+
+return redis.NewClient(opt), nil
 }
 
 func (c *Client) Close() error {
@@ -38,6 +132,47 @@ func (c *Client) Ping(ctx context.Context) error {
 return c.rdb.Ping(ctx).Err()
 }
 
-func (c *Client) GetRedis() *redis.Client {
+// Healthy reports whether the last background health check reached Redis
+func (c *Client) Healthy() bool {
+return c.healthy.Load()
+}
+
+// RunHealthCheck pings Redis every interval until ctx is done
+// Logs when Redis becomes unreachable and again when it recovers; go-redis
+// reconnects on its own, this only tracks the state for Healthy
+func (c *Client) RunHealthCheck(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+ticker := time.NewTicker(interval)
+defer ticker.Stop()
+
+var downSince time.Time
+for {
+select {
+case <-ctx.Done():
+return
+case <-ticker.C:
+}
+
+pingCtx, cancel := context.WithTimeout(ctx, interval)
+err := c.rdb.Ping(pingCtx).Err()
+cancel()
+
+if err != nil {
+if c.healthy.Swap(false) {
+downSince = time.Now()
+logger.Error("redis unreachable", "error", err)
+}
+continue
+}
+if !c.healthy.Swap(true) {
+logger.Info("redis reachable again", "down_for", time.Since(downSince).Round(time.Second))
+}
+}
+}
+
+func (c *Client) PoolStats() *redis.PoolStats {
+return c.rdb.PoolStats()
+}
+
+func (c *Client) GetRedis() redis.UniversalClient {
 return c.rdb
 }
@@ -0,0 +1,113 @@
+package redis
+
+import (
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"nihil/internal/config"
+)
+
+func TestNewClientWithOptions_PoolFromEnv(t *testing.T) {
+	t.Setenv("REDIS_POOL_SIZE", "7")
+	t.Setenv("REDIS_MIN_IDLE_CONNS", "2")
+	t.Setenv("REDIS_DIAL_TIMEOUT", "3s")
+	t.Setenv("REDIS_MAX_RETRIES", "5")
+	cfg := config.Load()
+
+	client, err := NewClientWithOptions("redis://localhost:6379", Options{
+		PoolSize:     cfg.RedisPoolSize,
+		MinIdleConns: cfg.RedisMinIdleConns,
+		DialTimeout:  cfg.RedisDialTimeout,
+		MaxRetries:   cfg.RedisMaxRetries,
+	})
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	defer client.Close()
+
+	opt := client.rdb.(*redis.Client).Options()
+	if opt.PoolSize != 7 {
+		t.Errorf("Expected pool size 7, got %d", opt.PoolSize)
+	}
+	if opt.MinIdleConns != 2 {
+		t.Errorf("Expected 2 min idle conns, got %d", opt.MinIdleConns)
+	}
+	if opt.DialTimeout != 3*time.Second {
+		t.Errorf("Expected 3s dial timeout, got %v", opt.DialTimeout)
+	}
+	if opt.MaxRetries != 5 {
+		t.Errorf("Expected 5 retries, got %d", opt.MaxRetries)
+	}
+	if !client.Healthy() {
+		t.Error("Expected a freshly connected client to report healthy")
+	}
+
+	t.Logf("✓ Redis pool options taken from the environment")
+}
+
+func TestNewUniversalClient_Modes(t *testing.T) {
+	t.Run("single", func(t *testing.T) {
+		rdb, err := newUniversalClient("redis://localhost:6379/2", Options{PoolSize: 4})
+		if err != nil {
+			t.Fatalf("Failed to build client: %v", err)
+		}
+		defer rdb.Close()
+
+		c, ok := rdb.(*redis.Client)
+		if !ok {
+			t.Fatalf("Expected a single-node client, got %T", rdb)
+		}
+		if opt := c.Options(); opt.Addr != "localhost:6379" || opt.DB != 2 || opt.PoolSize != 4 {
+			t.Errorf("Unexpected options addr=%s db=%d pool=%d", opt.Addr, opt.DB, opt.PoolSize)
+		}
+	})
+
+	t.Run("sentinel", func(t *testing.T) {
+		rdb, err := newUniversalClient("redis://ignored:6379", Options{
+			SentinelAddrs: []string{"sentinel-1:26379", "sentinel-2:26379"},
+			MasterName:    "nihil-master",
+			Password:      "secret",
+		})
+		if err != nil {
+			t.Fatalf("Failed to build client: %v", err)
+		}
+		defer rdb.Close()
+
+		c, ok := rdb.(*redis.Client)
+		if !ok {
+			t.Fatalf("Expected a failover client, got %T", rdb)
+		}
+		if opt := c.Options(); opt.Addr != "FailoverClient" || opt.Password != "secret" {
+			t.Errorf("Expected sentinel-backed options, got addr=%s", opt.Addr)
+		}
+	})
+
+	t.Run("sentinel_needs_master", func(t *testing.T) {
+		if _, err := newUniversalClient("", Options{SentinelAddrs: []string{"sentinel-1:26379"}}); err == nil {
+			t.Fatal("Expected an error without a master name")
+		}
+	})
+
+	t.Run("cluster", func(t *testing.T) {
+		rdb, err := newUniversalClient("redis://ignored:6379", Options{
+			ClusterAddrs: []string{"node-1:6379", "node-2:6379", "node-3:6379"},
+			PoolSize:     6,
+		})
+		if err != nil {
+			t.Fatalf("Failed to build client: %v", err)
+		}
+		defer rdb.Close()
+
+		c, ok := rdb.(*redis.ClusterClient)
+		if !ok {
+			t.Fatalf("Expected a cluster client, got %T", rdb)
+		}
+		if opt := c.Options(); len(opt.Addrs) != 3 || opt.PoolSize != 6 {
+			t.Errorf("Unexpected cluster options addrs=%v pool=%d", opt.Addrs, opt.PoolSize)
+		}
+	})
+
+	t.Logf("✓ Single-node, sentinel and cluster clients built from options")
+}
@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// expiringIndexKey is a ZSET of "chatUUID:messageID:readerID" scored by the unix time
+// the reader's copy expires. Chat and participant IDs have no ':', message IDs may
+const expiringIndexKey = "expiring_messages"
+
+// ExpiringMessage is a read message whose disappearing timer has run out for ReaderID
+type ExpiringMessage struct {
+	ChatUUID  string
+	MessageID string
+	ReaderID  string
+}
+
+func readTTLKey(chatUUID, messageID string) string {
+	return fmt.Sprintf("read_ttl:%s:%s", chatUUID, messageID)
+}
+
+// SetReadTTL makes a message disappear ttl after it is first read
+// Nothing outlives the chat, so neither does the setting
+func (c *Client) SetReadTTL(ctx context.Context, chat *Chat, messageID string, ttl time.Duration) error {
+	key := readTTLKey(chat.ChatUUID, messageID)
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, key, int64(ttl.Seconds()), 0)
+		pipe.ExpireAt(ctx, key, chat.ExpiresAt())
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set read ttl: %w", err)
+	}
+	return nil
+}
+
+// GetReadTTL returns how long a message lives once read, 0 if it doesn't disappear
+func (c *Client) GetReadTTL(ctx context.Context, chatUUID, messageID string) (time.Duration, error) {
+	seconds, err := c.rdb.Get(ctx, readTTLKey(chatUUID, messageID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to get read ttl: %w", err)
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// StartReadTTL starts readerID's timer for a disappearing message from readAt
+// Each reader's copy runs out on its own, so a group member reading late still gets the full TTL.
+// Only a reader's first read counts; returns false for a message with no timer or one already started
+func (c *Client) StartReadTTL(ctx context.Context, chatUUID, messageID, readerID string, readAt time.Time) (time.Time, bool, error) {
+	seconds, err := c.rdb.Get(ctx, readTTLKey(chatUUID, messageID)).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to get read ttl: %w", err)
+	}
+	ttl, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid read ttl: %w", err)
+	}
+
+	deadline := readAt.Add(time.Duration(ttl) * time.Second)
+	added, err := c.rdb.ZAddNX(ctx, expiringIndexKey, redis.Z{
+		Score:  float64(deadline.Unix()),
+		Member: scheduledMember(chatUUID, messageID) + ":" + readerID,
+	}).Result()
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("failed to start read ttl: %w", err)
+	}
+	return deadline, added == 1, nil
+}
+
+// PopExpiredMessages removes and returns up to limit messages whose timer ran out at or before now
+// Each is claimed with ZREM, so with several instances sweeping only one expires it
+func (c *Client) PopExpiredMessages(ctx context.Context, now time.Time, limit int) ([]ExpiringMessage, error) {
+	members, err := c.rdb.ZRangeByScore(ctx, expiringIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", now.Unix()),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get expired messages: %w", err)
+	}
+
+	expired := make([]ExpiringMessage, 0, len(members))
+	for _, member := range members {
+		claimed, err := c.rdb.ZRem(ctx, expiringIndexKey, member).Result()
+		if err != nil || claimed == 0 {
+			continue
+		}
+		chatUUID, rest, ok := strings.Cut(member, ":")
+		i := strings.LastIndex(rest, ":")
+		if !ok || i < 0 {
+			continue
+		}
+		messageID, readerID := rest[:i], rest[i+1:]
+		expired = append(expired, ExpiringMessage{ChatUUID: chatUUID, MessageID: messageID, ReaderID: readerID})
+	}
+	return expired, nil
+}
@@ -0,0 +1,116 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Reasons ExtendChat refuses an extension
+var (
+	ErrChatNotActive        = errors.New("chat is not active")
+	ErrChatNotExtended      = errors.New("new ttl would not extend the chat")
+	ErrChatLifetimeExceeded = errors.New("chat would outlive its maximum lifetime")
+)
+
+// ExtendChat keeps an active chat alive for ttlSeconds from now, as long as its whole
+// lifetime stays within maxLifetime. The caller is checked by its secret
+// TTLSeconds keeps counting from CreatedAt, so it grows by however long the chat has run
+func (c *Client) ExtendChat(ctx context.Context, chatUUID, participantID, secret string, ttlSeconds int, maxLifetime time.Duration) (*Chat, error) {
+	chat, err := c.GetChat(ctx, chatUUID)
+	if err != nil {
+		return nil, fmt.Errorf("chat not found: %w", err)
+	}
+
+	// Worked out here because Lua can't parse created_at
+	lifetime := time.Since(chat.CreatedAt).Truncate(time.Second) + time.Duration(ttlSeconds)*time.Second
+	newTTL := int(lifetime / time.Second)
+
+	// Only ever lengthens the chat, so concurrent extensions settle on the longest
+	extendScript := `
+		local chatJSON = redis.call('GET', KEYS[1])
+		if not chatJSON then
+			return -1
+		end
+
+		local chat = cjson.decode(chatJSON)
+` + upgradeLegacyChatLua + `
+		local valid = false
+		for _, p in ipairs(chat.participants) do
+			if p.id == ARGV[1] and p.secret_hash == ARGV[2] then
+				valid = true
+			end
+		end
+		if not valid then
+			return -2
+		end
+		if chat.status ~= 'active' then
+			return -3
+		end
+
+		local newTTL = tonumber(ARGV[3])
+		if newTTL > tonumber(ARGV[4]) then
+			return -5
+		end
+		if newTTL <= (tonumber(chat.ttl_seconds) or 0) then
+			return -4
+		end
+		chat.ttl_seconds = newTTL
+		redis.call('SET', KEYS[1], cjson.encode(chat), 'KEEPTTL')
+		return 1
+	`
+
+	chatKey := fmt.Sprintf("chat:%s", chatUUID)
+	result, err := c.rdb.Eval(ctx, extendScript, []string{chatKey}, participantID, HashSecret(secret), newTTL, int(maxLifetime.Seconds())).Int()
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute extend script: %w", err)
+	}
+	switch result {
+	case -1:
+		return nil, fmt.Errorf("chat not found")
+	case -2:
+		return nil, ErrInvalidSecret
+	case -3:
+		return nil, ErrChatNotActive
+	case -4:
+		return nil, ErrChatNotExtended
+	case -5:
+		return nil, ErrChatLifetimeExceeded
+	}
+
+	chat.TTLSeconds = newTTL
+	if err := c.scheduleChatExpiry(ctx, chat); err != nil {
+		return nil, err
+	}
+	if err := c.extendChatKeys(ctx, chat); err != nil {
+		return nil, err
+	}
+	if err := c.refreshChatMutes(ctx, chat); err != nil {
+		return nil, err
+	}
+	return chat, nil
+}
+
+// extendChatKeys moves the keys that expire with the chat to its new expiry
+// Mute flags are moved by refreshChatMutes. Per-message keys nothing indexes - attachments, read timers - keep the expiry they were given
+func (c *Client) extendChatKeys(ctx context.Context, chat *Chat) error {
+	expiresAt := chat.ExpiresAt()
+	pipe := c.rdb.Pipeline()
+	pipe.ExpireAt(ctx, messageSendersKey(chat.ChatUUID), expiresAt)
+	for _, p := range chat.Participants {
+		sentKey := sentMessagesKey(chat.ChatUUID, p.ID)
+		messageIDs, err := c.rdb.SMembers(ctx, sentKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get sent messages: %w", err)
+		}
+		for _, messageID := range messageIDs {
+			pipe.ExpireAt(ctx, messageStateKey(chat.ChatUUID, messageID), expiresAt)
+		}
+		pipe.ExpireAt(ctx, sentKey, expiresAt)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to extend chat keys: %w", err)
+	}
+	return nil
+}
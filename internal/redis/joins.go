@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// JoinEvent records that someone joined a chat while another participant was offline
+type JoinEvent struct {
+	ChatUUID         string `json:"chat_uuid"`
+	ParticipantID    string `json:"participant_id"`
+	JoinerDeviceUUID string `json:"joiner_device_uuid"`
+}
+
+func pendingJoinsKey(deviceUUID string) string {
+	return fmt.Sprintf("pending_joins:%s", deviceUUID)
+}
+
+// QueueJoinEvent holds a join event for a device to pick up when it next connects
+// Kept as long as an invitation can be open, since that's when joins happen
+func (c *Client) QueueJoinEvent(ctx context.Context, deviceUUID string, event JoinEvent) error {
+	eventJSON, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to marshal join event: %w", err)
+	}
+
+	key := pendingJoinsKey(deviceUUID)
+	_, err = c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, eventJSON)
+		pipe.Expire(ctx, key, c.inviteMaxTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue join event: %w", err)
+	}
+	return nil
+}
+
+// PopJoinEvents removes and returns a device's pending join events, oldest first
+func (c *Client) PopJoinEvents(ctx context.Context, deviceUUID string) ([]JoinEvent, error) {
+	key := pendingJoinsKey(deviceUUID)
+	var lrange *redis.StringSliceCmd
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get join events: %w", err)
+	}
+
+	events := make([]JoinEvent, 0, len(lrange.Val()))
+	for _, eventJSON := range lrange.Val() {
+		var event JoinEvent
+		if err := json.Unmarshal([]byte(eventJSON), &event); err != nil {
+			continue
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -3,15 +3,48 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"nihil/internal/signal"
 )
 
 // Key bundle TTL - how long keys stay in Redis
 const KeyBundleTTL = 30 * 24 * time.Hour // 30 days
 
+var (
+	ErrKeyBundleNotFound = errors.New("key bundle not found")
+	ErrKeyBundleChanged  = errors.New("identity key changed during update")
+	ErrInvalidPreKeyID   = errors.New("prekey ids must be positive")
+	ErrDuplicatePreKeyID = errors.New("duplicate prekey id")
+	ErrTooManyPreKeys    = errors.New("too many prekeys")
+)
+
+// SetMaxPreKeys caps how many one-time prekeys a device can have stored, 0 for no limit
+// Call once at startup, before the client is shared
+func (c *Client) SetMaxPreKeys(max int) {
+	c.maxPreKeys = max
+}
+
+// validatePreKeys rejects IDs that would silently shrink the pool: a duplicate
+// overwrites its twin in the HASH and nothing hands out a non-positive ID
+func validatePreKeys(preKeys []PreKey) error {
+	seen := make(map[int]bool, len(preKeys))
+	for _, pk := range preKeys {
+		if pk.ID <= 0 {
+			return fmt.Errorf("%w: %d", ErrInvalidPreKeyID, pk.ID)
+		}
+		if seen[pk.ID] {
+			return fmt.Errorf("%w: %d", ErrDuplicatePreKeyID, pk.ID)
+		}
+		seen[pk.ID] = true
+	}
+	return nil
+}
+
 // PreKey represents a one-time prekey
 type PreKey struct {
 	ID        int    `json:"id"`
@@ -49,9 +82,21 @@ func preKeysKey(deviceUUID string) string {
 	return fmt.Sprintf("prekeys:%s", deviceUUID)
 }
 
+// preKeysLowKey flags that a device has been asked to replenish its prekeys
+func preKeysLowKey(deviceUUID string) string {
+	return fmt.Sprintf("prekeys_low:%s", deviceUUID)
+}
+
 // StoreKeyBundle stores a device's key bundle and prekeys
 // This REPLACES all existing prekeys - use for initial registration only
 func (c *Client) StoreKeyBundle(ctx context.Context, deviceUUID string, registrationID int, identityKey string, signedPreKey SignedPreKey, preKeys []PreKey) error {
+	if err := validatePreKeys(preKeys); err != nil {
+		return err
+	}
+	if c.maxPreKeys > 0 && len(preKeys) > c.maxPreKeys {
+		return ErrTooManyPreKeys
+	}
+
 	// Store the main bundle (identity + signed prekey)
 	bundle := StoredKeyBundle{
 		RegistrationID: registrationID,
@@ -111,42 +156,125 @@ func (c *Client) StoreKeyBundle(ctx context.Context, deviceUUID string, registra
 		if err != nil {
 			return fmt.Errorf("store prekeys: %w", err)
 		}
+		c.rdb.Del(ctx, preKeysLowKey(deviceUUID))
 	}
 
 	return nil
 }
 
 // AddPreKeys adds prekeys to existing HASH without deleting existing ones
-// Use this for prekey replenishment
+// Use this for prekey replenishment; ErrTooManyPreKeys once the device would hold more than the cap
 func (c *Client) AddPreKeys(ctx context.Context, deviceUUID string, preKeys []PreKey) error {
 	if len(preKeys) == 0 {
 		return nil
 	}
+	if err := validatePreKeys(preKeys); err != nil {
+		return err
+	}
 
-	preKeysHashKey := preKeysKey(deviceUUID)
-
-	// Use pipeline for efficiency
-	pipe := c.rdb.Pipeline()
-
+	args := make([]interface{}, 0, 2+len(preKeys)*2)
+	args = append(args, c.maxPreKeys, int(KeyBundleTTL.Seconds()))
 	for _, pk := range preKeys {
 		pkJSON, err := json.Marshal(pk)
 		if err != nil {
 			return fmt.Errorf("marshal prekey %d: %w", pk.ID, err)
 		}
-		pipe.HSet(ctx, preKeysHashKey, fmt.Sprintf("%d", pk.ID), string(pkJSON))
+		args = append(args, pk.ID, string(pkJSON))
 	}
 
-	// Refresh TTL
-	pipe.Expire(ctx, preKeysHashKey, KeyBundleTTL)
+	// Checked and stored in one step, so concurrent replenishments can't
+	// together push a device past the cap. IDs already stored are replaced, not added
+	script := `
+		local key = KEYS[1]
+		local max = tonumber(ARGV[1])
+
+		if max > 0 then
+			local total = redis.call('HLEN', key)
+			for i = 3, #ARGV, 2 do
+				if redis.call('HEXISTS', key, ARGV[i]) == 0 then
+					total = total + 1
+				end
+			end
+			if total > max then
+				return -1
+			end
+		end
 
-	_, err := pipe.Exec(ctx)
+		for i = 3, #ARGV, 2 do
+			redis.call('HSET', key, ARGV[i], ARGV[i + 1])
+		end
+		redis.call('EXPIRE', key, ARGV[2])
+		return 1
+	`
+
+	result, err := c.rdb.Eval(ctx, script, []string{preKeysKey(deviceUUID)}, args...).Int()
 	if err != nil {
 		return fmt.Errorf("add prekeys: %w", err)
 	}
+	if result == -1 {
+		return ErrTooManyPreKeys
+	}
+
+	// Supply is topped up - the next shortage should be reported again
+	c.rdb.Del(ctx, preKeysLowKey(deviceUUID))
 
 	return nil
 }
 
+// UpdateSignedPreKey replaces just the signed prekey in a device's stored bundle
+// The signature must verify against the identity key already stored; one-time prekeys
+// are left alone. A re-registration racing the update fails it with ErrKeyBundleChanged
+func (c *Client) UpdateSignedPreKey(ctx context.Context, deviceUUID string, signedPreKey SignedPreKey) error {
+	bundleKey := keyBundleKey(deviceUUID)
+
+	bundleJSON, err := c.rdb.Get(ctx, bundleKey).Result()
+	if err == redis.Nil {
+		return ErrKeyBundleNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("get bundle: %w", err)
+	}
+
+	var stored StoredKeyBundle
+	if err := json.Unmarshal([]byte(bundleJSON), &stored); err != nil {
+		return fmt.Errorf("unmarshal bundle: %w", err)
+	}
+	if err := signal.VerifySignedPreKey(stored.IdentityKey, signedPreKey.PublicKey, signedPreKey.Signature); err != nil {
+		return err
+	}
+
+	spkJSON, err := json.Marshal(signedPreKey)
+	if err != nil {
+		return fmt.Errorf("marshal signed prekey: %w", err)
+	}
+
+	// Swapped in only if the identity it was verified against is still the stored one
+	script := `
+		local bundleJSON = redis.call('GET', KEYS[1])
+		if not bundleJSON then
+			return -1
+		end
+		local bundle = cjson.decode(bundleJSON)
+		if bundle.identity_key ~= ARGV[1] then
+			return -2
+		end
+		bundle.signed_prekey = cjson.decode(ARGV[2])
+		redis.call('SET', KEYS[1], cjson.encode(bundle), 'KEEPTTL')
+		return 1
+	`
+	result, err := c.rdb.Eval(ctx, script, []string{bundleKey}, stored.IdentityKey, string(spkJSON)).Int()
+	if err != nil {
+		return fmt.Errorf("update signed prekey: %w", err)
+	}
+	switch result {
+	case -1:
+		return ErrKeyBundleNotFound
+	case -2:
+		return ErrKeyBundleChanged
+	}
+	return nil
+}
+
 // GetKeyBundle retrieves a device's key bundle with ONE prekey (consumed atomically)
 func (c *Client) GetKeyBundle(ctx context.Context, deviceUUID string) (*KeyBundle, error) {
 	bundleKey := keyBundleKey(deviceUUID)
@@ -239,6 +367,21 @@ func (c *Client) GetPreKeyCount(ctx context.Context, deviceUUID string) (int64,
 	return count, nil
 }
 
+// MarkPreKeysLow records that a device has been asked to replenish its prekeys
+// Returns false if it was already asked, so each shortage is reported only once
+func (c *Client) MarkPreKeysLow(ctx context.Context, deviceUUID string) (bool, error) {
+	set, err := c.rdb.SetNX(ctx, preKeysLowKey(deviceUUID), 1, KeyBundleTTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("mark prekeys low: %w", err)
+	}
+	return set, nil
+}
+
+// ClearPreKeysLow forgets that a device was asked to replenish
+func (c *Client) ClearPreKeysLow(ctx context.Context, deviceUUID string) error {
+	return c.rdb.Del(ctx, preKeysLowKey(deviceUUID)).Err()
+}
+
 // HasPreKey checks if a specific prekey ID exists
 func (c *Client) HasPreKey(ctx context.Context, deviceUUID string, preKeyID int) (bool, error) {
 	preKeysHashKey := preKeysKey(deviceUUID)
@@ -257,6 +400,7 @@ func (c *Client) DeleteKeyBundle(ctx context.Context, deviceUUID string) error {
 	pipe := c.rdb.Pipeline()
 	pipe.Del(ctx, bundleKey)
 	pipe.Del(ctx, preKeysHashKey)
+	pipe.Del(ctx, preKeysLowKey(deviceUUID))
 	_, err := pipe.Exec(ctx)
 
 	if err != nil {
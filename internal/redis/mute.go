@@ -0,0 +1,64 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+)
+
+// muteKey flags a chat a participant muted - messages still queue, pushes are skipped
+func muteKey(chatUUID, participantID string) string {
+	return fmt.Sprintf("mute:%s:%s", chatUUID, participantID)
+}
+
+// SetChatMuted mutes or unmutes push notifications for a participant's chat
+// The flag expires with the chat
+func (c *Client) SetChatMuted(ctx context.Context, chat *Chat, participantID string, muted bool) error {
+	key := muteKey(chat.ChatUUID, participantID)
+	if !muted {
+		if err := c.rdb.Del(ctx, key).Err(); err != nil {
+			return fmt.Errorf("failed to unmute chat: %w", err)
+		}
+		return nil
+	}
+
+	pipe := c.rdb.TxPipeline()
+	pipe.Set(ctx, key, "1", 0)
+	pipe.ExpireAt(ctx, key, chat.ExpiresAt())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to mute chat: %w", err)
+	}
+	return nil
+}
+
+func (c *Client) IsChatMuted(ctx context.Context, chatUUID, participantID string) (bool, error) {
+	n, err := c.rdb.Exists(ctx, muteKey(chatUUID, participantID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check chat mute: %w", err)
+	}
+	return n > 0, nil
+}
+
+// refreshChatMutes moves every participant's mute flag to the chat's current expiry
+// Missing flags are left missing - EXPIREAT never creates a key
+func (c *Client) refreshChatMutes(ctx context.Context, chat *Chat) error {
+	expiresAt := chat.ExpiresAt()
+	pipe := c.rdb.Pipeline()
+	for _, p := range chat.Participants {
+		pipe.ExpireAt(ctx, muteKey(chat.ChatUUID, p.ID), expiresAt)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to refresh chat mutes: %w", err)
+	}
+	return nil
+}
+
+// deleteChatMutes drops every participant's mute flag for a chat
+func (c *Client) deleteChatMutes(ctx context.Context, chat *Chat) {
+	keys := make([]string, 0, len(chat.Participants))
+	for _, p := range chat.Participants {
+		keys = append(keys, muteKey(chat.ChatUUID, p.ID))
+	}
+	if len(keys) > 0 {
+		c.rdb.Del(ctx, keys...)
+	}
+}
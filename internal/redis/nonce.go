@@ -0,0 +1,42 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// DefaultAuthWindow is how far a signed request's timestamp may drift from server time
+// until SetAuthWindow is called
+const DefaultAuthWindow = 300 * time.Second
+
+// MaxNonceLength bounds client-chosen nonces so they can't bloat Redis keys
+const MaxNonceLength = 64
+
+// SetAuthWindow sets how far a signed timestamp may drift from server time
+// Call once at startup, before the client is shared
+func (c *Client) SetAuthWindow(window time.Duration) {
+	c.authWindow = window
+}
+
+// TimestampFresh reports whether a signed unix timestamp is within the auth window of now
+// HTTP and WebSocket auth both check through here so their windows can't drift apart
+func (c *Client) TimestampFresh(timestamp int64, now time.Time) bool {
+	skew := now.Unix() - timestamp
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew <= int64(c.authWindow.Seconds())
+}
+
+// UseNonce records a nonce for a device, rejecting any nonce already seen in the window
+// Returns false if the nonce was replayed
+func (c *Client) UseNonce(ctx context.Context, deviceUUID, nonce string) (bool, error) {
+	key := fmt.Sprintf("nonce:%s:%s", deviceUUID, nonce)
+	// Nonces only need to be remembered for the window - older requests fail the timestamp check
+	fresh, err := c.rdb.SetNX(ctx, key, 1, c.authWindow).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record nonce: %w", err)
+	}
+	return fresh, nil
+}
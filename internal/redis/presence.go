@@ -0,0 +1,109 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PresenceTTL is how long a presence key survives without being refreshed
+// Instances refresh well inside this window, so an expired key means the device is gone
+const PresenceTTL = 30 * time.Second
+
+func presenceKey(deviceUUID string) string {
+	return fmt.Sprintf("presence:%s", deviceUUID)
+}
+
+func deviceChannel(deviceUUID string) string {
+	return fmt.Sprintf("deliver:%s", deviceUUID)
+}
+
+// broadcastChannel carries events for every connected device, on every instance
+const broadcastChannel = "broadcast"
+
+// SetPresence marks a device as connected to the given server instance
+func (c *Client) SetPresence(ctx context.Context, deviceUUID, instanceID string) error {
+	if err := c.rdb.Set(ctx, presenceKey(deviceUUID), instanceID, PresenceTTL).Err(); err != nil {
+		return fmt.Errorf("failed to set presence: %w", err)
+	}
+	return nil
+}
+
+// ClearPresence removes a device's presence, but only if this instance still owns it
+// A device that already reconnected to another instance keeps its presence
+func (c *Client) ClearPresence(ctx context.Context, deviceUUID, instanceID string) error {
+	script := `
+		if redis.call('GET', KEYS[1]) == ARGV[1] then
+			return redis.call('DEL', KEYS[1])
+		end
+		return 0
+	`
+	if err := c.rdb.Eval(ctx, script, []string{presenceKey(deviceUUID)}, instanceID).Err(); err != nil {
+		return fmt.Errorf("failed to clear presence: %w", err)
+	}
+	return nil
+}
+
+// IsPresent reports whether any instance currently holds a connection for the device
+func (c *Client) IsPresent(ctx context.Context, deviceUUID string) (bool, error) {
+	n, err := c.rdb.Exists(ctx, presenceKey(deviceUUID)).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check presence: %w", err)
+	}
+	return n > 0, nil
+}
+
+// PublishToDevice relays an event to whichever instance is subscribed for the device
+// Returns the number of instances that received it
+func (c *Client) PublishToDevice(ctx context.Context, deviceUUID string, data []byte) (int64, error) {
+	n, err := c.rdb.Publish(ctx, deviceChannel(deviceUUID), data).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish to device: %w", err)
+	}
+	return n, nil
+}
+
+// PublishBroadcast relays an event to every instance
+// Returns the number of instances that received it
+func (c *Client) PublishBroadcast(ctx context.Context, data []byte) (int64, error) {
+	n, err := c.rdb.Publish(ctx, broadcastChannel, data).Result()
+	if err != nil {
+		return 0, fmt.Errorf("failed to publish broadcast: %w", err)
+	}
+	return n, nil
+}
+
+// DeviceSubscription receives events published for locally-connected devices
+type DeviceSubscription struct {
+	pubsub *redis.PubSub
+}
+
+// NewDeviceSubscription opens a subscription with no channels yet
+// Devices are added as they authenticate and removed as they disconnect
+func (c *Client) NewDeviceSubscription(ctx context.Context) *DeviceSubscription {
+	return &DeviceSubscription{pubsub: c.rdb.Subscribe(ctx)}
+}
+
+func (s *DeviceSubscription) Add(ctx context.Context, deviceUUID string) error {
+	return s.pubsub.Subscribe(ctx, deviceChannel(deviceUUID))
+}
+
+// AddBroadcast also receives events published with PublishBroadcast
+func (s *DeviceSubscription) AddBroadcast(ctx context.Context) error {
+	return s.pubsub.Subscribe(ctx, broadcastChannel)
+}
+
+func (s *DeviceSubscription) Remove(ctx context.Context, deviceUUID string) error {
+	return s.pubsub.Unsubscribe(ctx, deviceChannel(deviceUUID))
+}
+
+// Channel delivers the raw payload of every event for subscribed devices and broadcasts
+func (s *DeviceSubscription) Channel() <-chan *redis.Message {
+	return s.pubsub.Channel()
+}
+
+func (s *DeviceSubscription) Close() error {
+	return s.pubsub.Close()
+}
@@ -3,37 +3,59 @@ package redis
 import (
 "context"
 "fmt"
+
+"nihil/internal/audit"
 )
 
+// PurgeDevice removes everything stored for a device: its subscription, key bundle and
+// prekeys, the push registrations of each of its participant IDs, and every chat it's in
 func (c *Client) PurgeDevice(ctx context.Context, deviceUUID string) error {
 keysToDelete := []string{
 fmt.Sprintf("sub:%s", deviceUUID),
 fmt.Sprintf("pubkey:%s", deviceUUID),
-fmt.Sprintf("keys:%s", deviceUUID),
-fmt.Sprintf("fcm:%s", deviceUUID),
-fmt.Sprintf("prekeys:%s", deviceUUID),
-fmt.Sprintf("rate:%s", deviceUUID),
 fmt.Sprintf("warn:%s", deviceUUID),
+pendingJoinsKey(deviceUUID),
+subNoticesKey(deviceUUID),
+deviceSessionsKey(deviceUUID),
+}
+keysToDelete = append(keysToDelete, rateKeys(deviceUUID)...)
+
+if err := c.DeleteKeyBundle(ctx, deviceUUID); err != nil {
+return err
 }
 
-userChatsKey := fmt.Sprintf("user_chats:%s", deviceUUID)
-chatUUIDs, _ := c.rdb.SMembers(ctx, userChatsKey).Result()
+chatsKey := userChatsKey(deviceUUID)
+chatUUIDs, _ := c.rdb.SMembers(ctx, chatsKey).Result()
 
 for _, chatUUID := range chatUUIDs {
+// Remove the chat from the other participant's set as well
+if chat, err := c.GetChat(ctx, chatUUID); err == nil {
+c.removeUserChat(ctx, chat, chatUUID)
+
+// Push registrations are keyed by participant ID, not device
+for _, p := range chat.Participants {
+if p.DeviceUUID == deviceUUID {
+c.DeletePushForChat(ctx, chatUUID, p.ID)
+c.DeleteParticipantFCM(ctx, chatUUID, p.ID)
+}
+}
+}
 c.rdb.Del(ctx, fmt.Sprintf("chat:%s", chatUUID))
 c.rdb.Del(ctx, fmt.Sprintf("invitation:%s", chatUUID))
+c.rdb.Del(ctx, fmt.Sprintf("rate:%s", chatRateSubject(deviceUUID, chatUUID)))
 msgQueueKey := fmt.Sprintf("msg_queue:%s", chatUUID)
 msgIDs, _ := c.rdb.LRange(ctx, msgQueueKey, 0, -1).Result()
 for _, msgID := range msgIDs {
-c.rdb.Del(ctx, fmt.Sprintf("msg:%s:%s", chatUUID, msgID))
+c.rdb.Del(ctx, fmt.Sprintf("msg:%s:%s", chatUUID, msgID), queuedRecipientsKey(chatUUID, msgID))
 }
-c.rdb.Del(ctx, msgQueueKey)
+c.rdb.Del(ctx, msgQueueKey, queuedCountsKey(chatUUID))
 }
 
-keysToDelete = append(keysToDelete, userChatsKey)
+keysToDelete = append(keysToDelete, chatsKey)
 for _, key := range keysToDelete {
 c.rdb.Del(ctx, key)
 }
 
+audit.Record(audit.EventPurge, deviceUUID, "")
 return nil
 }
@@ -0,0 +1,108 @@
+package redis
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"nihil/internal/audit"
+)
+
+func TestPurgeDevice_RemovesFullFootprint(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	device := "test-purge-a-" + suffix
+	peer := "test-purge-b-" + suffix
+	chatUUID := "test-purge-chat-" + suffix
+	token := "test-purge-token-" + suffix
+	defer client.PurgeDevice(ctx, peer)
+
+	// Everything a registered, chatting device leaves behind
+	if _, err := client.RestoreSubscription(ctx, device, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	err := client.StoreKeyBundle(ctx, device, 1, "identity", SignedPreKey{ID: 1, PublicKey: "spk", Signature: "sig"},
+		[]PreKey{{ID: 1, PublicKey: "pk1"}, {ID: 2, PublicKey: "pk2"}})
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+	if err := client.CreateChat(ctx, chatUUID, "pa", "sa", device, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	if _, _, err := client.JoinChat(ctx, token, peer, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	client.RegisterPushForChat(ctx, chatUUID, "pa", "fcm-token")
+	client.StoreParticipantFCM(ctx, chatUUID, "pa", "fcm-token")
+	client.QueueMessage(ctx, chatUUID, "msg-1", "pb", []byte("ciphertext"))
+	client.QueueJoinEvent(ctx, device, JoinEvent{ChatUUID: chatUUID, ParticipantID: "pb"})
+	client.CheckRateLimit(ctx, device, 10)
+	client.CheckChatRateLimit(ctx, device, chatUUID, 10)
+	client.MarkSubscriptionNotice(ctx, device, "expiring_1h", time.Now().Add(time.Hour))
+	client.AddWarning(ctx, device, "spam detected")
+
+	keys := []string{
+		"sub:" + device,
+		"pubkey:" + device,
+		keyBundleKey(device),
+		preKeysKey(device),
+		"push:" + chatUUID + ":pa",
+		"fcm:" + chatUUID + ":pa",
+		"chat:" + chatUUID,
+		"msg_queue:" + chatUUID,
+		"msg:" + chatUUID + ":msg-1",
+		userChatsKey(device),
+		pendingJoinsKey(device),
+		subNoticesKey(device),
+		"rate:" + device,
+		"rate:" + chatRateSubject(device, chatUUID),
+		"warn:" + device,
+	}
+	for _, key := range keys {
+		if n, _ := client.rdb.Exists(ctx, key).Result(); n == 0 {
+			t.Fatalf("Seeding failed, %s missing", key)
+		}
+	}
+
+	if err := client.PurgeDevice(ctx, device); err != nil {
+		t.Fatalf("Failed to purge device: %v", err)
+	}
+
+	for _, key := range keys {
+		if n, _ := client.rdb.Exists(ctx, key).Result(); n != 0 {
+			t.Errorf("Expected %s removed by purge", key)
+		}
+	}
+	if isMember, _ := client.rdb.SIsMember(ctx, userChatsKey(peer), chatUUID).Result(); isMember {
+		t.Error("Expected the chat removed from the peer's chat set")
+	}
+
+	t.Logf("✓ Purge removes the device's keys, push registrations and chats")
+}
+
+func TestPurgeDevice_Audited(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	audit.SetSink(audit.NewJSONSink(&buf))
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	device := "test-audit-purge-" + time.Now().Format("150405.000000")
+	if err := client.PurgeDevice(ctx, device); err != nil {
+		t.Fatalf("Failed to purge device: %v", err)
+	}
+
+	if strings.Contains(buf.String(), device) {
+		t.Fatalf("Expected no raw UUID in the audit log, got %s", buf.String())
+	}
+	if !strings.Contains(buf.String(), `"event":"purge"`) || !strings.Contains(buf.String(), audit.HashDevice(device)) {
+		t.Errorf("Expected a purge event with the hashed device ID, got %s", buf.String())
+	}
+
+	t.Logf("✓ Purge audited with a hashed device ID")
+}
@@ -5,6 +5,8 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 // PushRegistration represents a chat-scoped push token
@@ -15,6 +17,24 @@ type PushRegistration struct {
 	CreatedAt time.Time `json:"created_at"`
 }
 
+func pushKey(chatUUID, participantID string) string {
+	return fmt.Sprintf("push:%s:%s", chatUUID, participantID)
+}
+
+// chatPushKeysKey indexes a chat's push registrations so they can be
+// deleted together with the chat without scanning the keyspace
+func chatPushKeysKey(chatUUID string) string {
+	return fmt.Sprintf("chat_push_keys:%s", chatUUID)
+}
+
+// deleteChatPushLua deletes every push registration indexed in `pushKeys` and the index itself
+const deleteChatPushLua = `
+		for _, key in ipairs(redis.call('SMEMBERS', pushKeys)) do
+			redis.call('DEL', key)
+		end
+		redis.call('DEL', pushKeys)
+`
+
 // RegisterPushForChat stores a push token for a specific chat participant
 // participantID is the user's participant ID for this chat (not device UUID)
 func (c *Client) RegisterPushForChat(ctx context.Context, chatUUID, participantID, fcmToken string) error {
@@ -25,7 +45,7 @@ func (c *Client) RegisterPushForChat(ctx context.Context, chatUUID, participantI
 	}
 
 	// Verify participant is in this chat
-	if chat.ParticipantA != participantID && chat.ParticipantB != participantID {
+	if chat.Participant(participantID) == nil {
 		return fmt.Errorf("participant not in chat")
 	}
 
@@ -42,10 +62,26 @@ func (c *Client) RegisterPushForChat(ctx context.Context, chatUUID, participantI
 	// Use 24h TTL (same as chat expiry)
 	ttl := 24 * time.Hour
 
-	key := fmt.Sprintf("push:%s:%s", chatUUID, participantID)
-	if err := c.rdb.Set(ctx, key, regJSON, ttl).Err(); err != nil {
+	// Stored and indexed only while the chat still exists, so a registration
+	// racing DeleteChat either lands before it and is cleaned up, or fails
+	script := `
+		if redis.call('EXISTS', KEYS[1]) == 0 then
+			return -1
+		end
+		redis.call('SET', KEYS[2], ARGV[1], 'EX', ARGV[2])
+		redis.call('SADD', KEYS[3], KEYS[2])
+		redis.call('EXPIRE', KEYS[3], ARGV[2])
+		return 1
+	`
+
+	keys := []string{fmt.Sprintf("chat:%s", chatUUID), pushKey(chatUUID, participantID), chatPushKeysKey(chatUUID)}
+	result, err := c.rdb.Eval(ctx, script, keys, regJSON, int(ttl.Seconds())).Int()
+	if err != nil {
 		return fmt.Errorf("failed to store push registration: %w", err)
 	}
+	if result == -1 {
+		return fmt.Errorf("chat not found")
+	}
 
 	return nil
 }
@@ -53,7 +89,7 @@ func (c *Client) RegisterPushForChat(ctx context.Context, chatUUID, participantI
 // GetPushTokenForChat retrieves a push token for a specific chat participant
 // participantID is the participant ID (not device UUID)
 func (c *Client) GetPushTokenForChat(ctx context.Context, chatUUID, participantID string) (string, error) {
-	key := fmt.Sprintf("push:%s:%s", chatUUID, participantID)
+	key := pushKey(chatUUID, participantID)
 
 	regJSON, err := c.rdb.Get(ctx, key).Result()
 	if err != nil {
@@ -70,8 +106,13 @@ func (c *Client) GetPushTokenForChat(ctx context.Context, chatUUID, participantI
 
 // DeletePushForChat removes push registration for a specific chat participant
 func (c *Client) DeletePushForChat(ctx context.Context, chatUUID, participantID string) error {
-	key := fmt.Sprintf("push:%s:%s", chatUUID, participantID)
-	return c.rdb.Del(ctx, key).Err()
+	key := pushKey(chatUUID, participantID)
+
+	pipe := c.rdb.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.SRem(ctx, chatPushKeysKey(chatUUID), key)
+	_, err := pipe.Exec(ctx)
+	return err
 }
 
 // DeleteAllPushForParticipant removes push registrations matching a participant pattern
@@ -80,22 +121,7 @@ func (c *Client) DeleteAllPushForParticipant(ctx context.Context, participantID
 	// Find all push registrations for this participant
 	pattern := fmt.Sprintf("push:*:%s", participantID)
 
-	keys, err := c.rdb.Keys(ctx, pattern).Result()
-	if err != nil {
-		return 0, fmt.Errorf("failed to find push registrations: %w", err)
-	}
-
-	if len(keys) == 0 {
-		return 0, nil
-	}
-
-	// Delete all found keys
-	deleted, err := c.rdb.Del(ctx, keys...).Result()
-	if err != nil {
-		return 0, fmt.Errorf("failed to delete push registrations: %w", err)
-	}
-
-	return deleted, nil
+	return c.deleteMatching(ctx, pattern)
 }
 
 // DeleteAllPushForDevice removes ALL push registrations for all chats a device has registered
@@ -110,32 +136,62 @@ func (c *Client) DeleteAllPushForDevice(ctx context.Context, participantIDs []st
 	var totalDeleted int64
 	for _, participantID := range participantIDs {
 		pattern := fmt.Sprintf("push:*:%s", participantID)
-		keys, err := c.rdb.Keys(ctx, pattern).Result()
-		if err != nil {
-			continue
-		}
-		if len(keys) > 0 {
-			deleted, _ := c.rdb.Del(ctx, keys...).Result()
-			totalDeleted += deleted
-		}
+		deleted, _ := c.deleteMatching(ctx, pattern)
+		totalDeleted += deleted
 	}
 
 	return totalDeleted, nil
 }
 
 // DeleteAllPushForChat removes ALL push registrations for a chat
-// Called when chat expires or is deleted
+// DeleteChat already does this atomically with removing the chat itself
 func (c *Client) DeleteAllPushForChat(ctx context.Context, chatUUID string) error {
-	pattern := fmt.Sprintf("push:%s:*", chatUUID)
-
-	keys, err := c.rdb.Keys(ctx, pattern).Result()
-	if err != nil {
-		return fmt.Errorf("failed to find push registrations: %w", err)
+	script := `
+		local pushKeys = KEYS[1]
+` + deleteChatPushLua + `
+		return 1
+	`
+
+	if err := c.rdb.Eval(ctx, script, []string{chatPushKeysKey(chatUUID)}).Err(); err != nil {
+		return fmt.Errorf("failed to delete push registrations: %w", err)
 	}
+	return nil
+}
 
-	if len(keys) == 0 {
-		return nil
-	}
+// scanBatchSize is the COUNT hint for each SCAN call
+// Keeps every step short so Redis is never blocked walking the whole keyspace
+const scanBatchSize = 500
+
+// deleteMatching deletes every key matching pattern, one SCAN batch at a time
+// Returns the number of keys actually deleted
+func (c *Client) deleteMatching(ctx context.Context, pattern string) (int64, error) {
+	var totalDeleted int64
+	var cursor uint64
 
-	return c.rdb.Del(ctx, keys...).Err()
+	for {
+		keys, next, err := c.rdb.Scan(ctx, cursor, pattern, scanBatchSize).Result()
+		if err != nil {
+			return totalDeleted, fmt.Errorf("failed to find push registrations: %w", err)
+		}
+
+		if len(keys) > 0 {
+			// SCAN may return a key more than once, so count DEL results rather than keys
+			pipe := c.rdb.Pipeline()
+			dels := make([]*redis.IntCmd, len(keys))
+			for i, key := range keys {
+				dels[i] = pipe.Del(ctx, key)
+			}
+			if _, err := pipe.Exec(ctx); err != nil {
+				return totalDeleted, fmt.Errorf("failed to delete push registrations: %w", err)
+			}
+			for _, del := range dels {
+				totalDeleted += del.Val()
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return totalDeleted, nil
+		}
+	}
 }
\ No newline at end of file
@@ -0,0 +1,135 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDeleteAllPushForChat_OnlyMatching(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-push-chat-" + suffix
+	otherChat := "test-push-other-" + suffix
+
+	// Registrations are found through the chat's index, not the key pattern
+	for i := 0; i < 300; i++ {
+		key := pushKey(chatUUID, fmt.Sprintf("p%d", i))
+		client.rdb.Set(ctx, key, "{}", time.Minute)
+		client.rdb.SAdd(ctx, chatPushKeysKey(chatUUID), key)
+	}
+	for i := 0; i < 50; i++ {
+		key := pushKey(otherChat, fmt.Sprintf("p%d", i))
+		client.rdb.Set(ctx, key, "{}", time.Minute)
+		client.rdb.SAdd(ctx, chatPushKeysKey(otherChat), key)
+	}
+	client.rdb.Set(ctx, "chat:"+chatUUID, "{}", time.Minute)
+	defer client.DeleteAllPushForChat(ctx, otherChat)
+	defer client.rdb.Del(ctx, "chat:"+chatUUID)
+
+	if err := client.DeleteAllPushForChat(ctx, chatUUID); err != nil {
+		t.Fatalf("DeleteAllPushForChat failed: %v", err)
+	}
+
+	if n, _ := client.deleteMatching(ctx, fmt.Sprintf("push:%s:*", chatUUID)); n != 0 {
+		t.Errorf("Expected no keys left for chat, found %d", n)
+	}
+	if n, _ := client.rdb.Exists(ctx, chatPushKeysKey(chatUUID)).Result(); n != 0 {
+		t.Error("Expected the chat's push index deleted")
+	}
+	if n, _ := client.rdb.Exists(ctx, "chat:"+chatUUID).Result(); n != 1 {
+		t.Error("Unrelated chat key was deleted")
+	}
+	if n, _ := client.rdb.Exists(ctx, fmt.Sprintf("push:%s:p0", otherChat)).Result(); n != 1 {
+		t.Error("Other chat's push key was deleted")
+	}
+
+	t.Logf("✓ Only the chat's push registrations were deleted")
+}
+
+func TestDeleteAllPushForDevice_Count(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	participants := []string{"pa-" + suffix, "pb-" + suffix}
+	bystander := "pc-" + suffix
+
+	// 200 chats per participant, plus a bystander in the same chats
+	for i := 0; i < 200; i++ {
+		chatUUID := fmt.Sprintf("test-push-dev-%s-%d", suffix, i)
+		for _, p := range participants {
+			client.rdb.Set(ctx, fmt.Sprintf("push:%s:%s", chatUUID, p), "{}", time.Minute)
+		}
+		client.rdb.Set(ctx, fmt.Sprintf("push:%s:%s", chatUUID, bystander), "{}", time.Minute)
+	}
+	defer client.DeleteAllPushForParticipant(ctx, bystander)
+
+	deleted, err := client.DeleteAllPushForDevice(ctx, participants)
+	if err != nil {
+		t.Fatalf("DeleteAllPushForDevice failed: %v", err)
+	}
+	if deleted != 400 {
+		t.Errorf("Expected 400 deleted, got %d", deleted)
+	}
+
+	// Nothing left to delete for the device, bystander untouched
+	if deleted, _ := client.DeleteAllPushForDevice(ctx, participants); deleted != 0 {
+		t.Errorf("Expected 0 on second delete, got %d", deleted)
+	}
+	if deleted, _ := client.DeleteAllPushForParticipant(ctx, bystander); deleted != 200 {
+		t.Errorf("Expected 200 bystander keys, got %d", deleted)
+	}
+
+	t.Logf("✓ Deleted %d registrations across SCAN batches", 400)
+}
+
+func TestDeleteChat_ConcurrentPushDoesNotLeak(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	device := "test-push-race-" + suffix
+
+	for i := 0; i < 20; i++ {
+		chatUUID := fmt.Sprintf("test-push-race-%s-%d", suffix, i)
+		if err := client.CreateChat(ctx, chatUUID, "pa", "sa", device, fmt.Sprintf("test-push-race-token-%s-%d", suffix, i), 3600, 2); err != nil {
+			t.Fatalf("Failed to create chat: %v", err)
+		}
+
+		// Keep re-registering while the chat is deleted
+		var wg sync.WaitGroup
+		stop := make(chan struct{})
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					client.RegisterPushForChat(ctx, chatUUID, "pa", "fcm-token")
+				}
+			}
+		}()
+		time.Sleep(time.Millisecond)
+		if err := client.DeleteChat(ctx, chatUUID); err != nil {
+			t.Fatalf("Failed to delete chat: %v", err)
+		}
+		close(stop)
+		wg.Wait()
+
+		if n, _ := client.rdb.Exists(ctx, pushKey(chatUUID, "pa"), chatPushKeysKey(chatUUID)).Result(); n != 0 {
+			t.Fatalf("Push registration outlived chat %d", i)
+		}
+		if err := client.RegisterPushForChat(ctx, chatUUID, "pa", "fcm-token"); err == nil {
+			t.Fatal("Expected registering for a deleted chat to fail")
+		}
+	}
+
+	t.Logf("✓ Push registrations never outlive their chat")
+}
@@ -0,0 +1,199 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestQueueMessage_TrimsOldest(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	chatUUID := "test-queue-trim-" + time.Now().Format("150405.000000")
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+
+	var dropped int64
+	for i := 1; i <= 5; i++ {
+		n, err := client.QueueMessageWithDevice(ctx, chatUUID, fmt.Sprintf("msg-%d", i), "pa", "device-a", []byte("ciphertext"), 3)
+		if err != nil {
+			t.Fatalf("Failed to queue message: %v", err)
+		}
+		dropped += n
+	}
+	if dropped != 2 {
+		t.Errorf("Expected 2 dropped, got %d", dropped)
+	}
+
+	messages, total, err := client.GetQueuedMessagesRange(ctx, chatUUID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to read queue: %v", err)
+	}
+	if total != 3 || len(messages) != 3 || messages[0].MessageID != "msg-3" {
+		t.Fatalf("Expected msg-3..msg-5 left, got total %d, %d messages", total, len(messages))
+	}
+
+	// Trimmed bodies are gone too
+	for _, msgID := range []string{"msg-1", "msg-2"} {
+		if n, _ := client.rdb.Exists(ctx, fmt.Sprintf("msg:%s:%s", chatUUID, msgID)).Result(); n != 0 {
+			t.Errorf("Expected body of %s to be deleted", msgID)
+		}
+	}
+
+	t.Logf("✓ Queue capped with oldest messages dropped")
+}
+
+func TestGetQueuedMessagesRange_Ordered(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	chatUUID := "test-queue-page-" + time.Now().Format("150405.000000")
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+
+	for i := 0; i < 7; i++ {
+		if err := client.QueueMessage(ctx, chatUUID, fmt.Sprintf("msg-%d", i), "pa", []byte("ciphertext")); err != nil {
+			t.Fatalf("Failed to queue message: %v", err)
+		}
+	}
+
+	var got []string
+	for offset := 0; ; offset += 3 {
+		page, total, err := client.GetQueuedMessagesRange(ctx, chatUUID, offset, 3)
+		if err != nil {
+			t.Fatalf("Failed to read page at %d: %v", offset, err)
+		}
+		if total != 7 {
+			t.Fatalf("Expected total 7, got %d", total)
+		}
+		for _, msg := range page {
+			got = append(got, msg.MessageID)
+		}
+		if int64(offset+3) >= total {
+			break
+		}
+	}
+
+	if len(got) != 7 {
+		t.Fatalf("Expected 7 messages, got %d", len(got))
+	}
+	for i, msgID := range got {
+		if msgID != fmt.Sprintf("msg-%d", i) {
+			t.Errorf("Position %d: expected msg-%d, got %s", i, i, msgID)
+		}
+	}
+
+	t.Logf("✓ Queue paged in order")
+}
+
+func TestGetQueuedMessagesByID_SurvivesRemovals(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	chatUUID := "test-queue-snapshot-" + time.Now().Format("150405.000000")
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+
+	for i := 0; i < 7; i++ {
+		if err := client.QueueMessage(ctx, chatUUID, fmt.Sprintf("msg-%d", i), "pa", []byte("ciphertext")); err != nil {
+			t.Fatalf("Failed to queue message: %v", err)
+		}
+	}
+
+	ids, err := client.GetQueuedMessageIDs(ctx, chatUUID)
+	if err != nil || len(ids) != 7 {
+		t.Fatalf("Expected 7 queued IDs, got %v (%v)", ids, err)
+	}
+
+	var got []string
+	for start := 0; start < len(ids); start += 3 {
+		page, err := client.GetQueuedMessagesByID(ctx, chatUUID, ids[start:min(start+3, len(ids))])
+		if err != nil {
+			t.Fatalf("Failed to read page at %d: %v", start, err)
+		}
+		for _, msg := range page {
+			got = append(got, msg.MessageID)
+		}
+		// Messages ahead of the next page are taken off the queue, e.g. read elsewhere
+		if start == 0 {
+			client.DeleteQueuedMessage(ctx, chatUUID, "msg-0")
+			client.DeleteQueuedMessage(ctx, chatUUID, "msg-1")
+		}
+	}
+
+	want := []string{"msg-0", "msg-1", "msg-2", "msg-3", "msg-4", "msg-5", "msg-6"}
+	if !slices.Equal(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	t.Logf("✓ Paging over an ID snapshot skips nothing when messages are removed")
+}
+
+func TestQueueMessage_ExpiresWithChatTTL(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-queue-ttl-" + suffix
+	invitation := "test-queue-ttl-inv-" + suffix
+	defer client.DeleteChat(ctx, chatUUID)
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+
+	if err := client.CreateChat(ctx, chatUUID, "pa", "secret-a", "device-a", invitation, 30, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	if _, err := client.QueueMessageWithDevice(ctx, chatUUID, "msg-1", "pa", "device-a", []byte("ciphertext"), 0); err != nil {
+		t.Fatalf("Failed to queue message: %v", err)
+	}
+
+	want := 30*time.Second + QueuedMessageGrace
+	for _, key := range []string{"msg:" + chatUUID + ":msg-1", "msg_queue:" + chatUUID} {
+		ttl := client.rdb.TTL(ctx, key).Val()
+		if ttl > want || ttl < want-2*time.Second {
+			t.Errorf("Expected %s TTL around %v, got %v", key, want, ttl)
+		}
+	}
+
+	t.Logf("✓ Queued message expires with the chat's TTL")
+}
+
+func TestGetPendingMessageCount_FollowsQueue(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	chatUUID := "test-queue-count-" + time.Now().Format("150405.000000")
+	defer client.DeleteQueuedMessages(ctx, chatUUID)
+
+	count := func(participantID string) int64 {
+		t.Helper()
+		n, err := client.GetPendingMessageCount(ctx, chatUUID, participantID)
+		if err != nil {
+			t.Fatalf("Failed to count pending messages: %v", err)
+		}
+		return n
+	}
+
+	for i := 1; i <= 4; i++ {
+		_, err := client.QueueMessageFor(ctx, chatUUID, fmt.Sprintf("msg-%d", i), "pa", "device-a", []byte("ciphertext"), nil, []string{"pb", "pc"}, 3)
+		if err != nil {
+			t.Fatalf("Failed to queue message: %v", err)
+		}
+	}
+	// One was trimmed
+	if count("pb") != 3 || count("pc") != 3 || count("pa") != 0 {
+		t.Fatalf("Expected 3 pending for pb and pc and none for pa, got %d, %d, %d", count("pb"), count("pc"), count("pa"))
+	}
+
+	client.ReleaseQueuedMessage(ctx, chatUUID, "msg-2", "pb")
+	client.ReleaseQueuedMessage(ctx, chatUUID, "msg-2", "pb")
+	if count("pb") != 2 || count("pc") != 3 {
+		t.Errorf("Expected pb's release counted once, got pb %d, pc %d", count("pb"), count("pc"))
+	}
+
+	client.DeleteQueuedMessage(ctx, chatUUID, "msg-3")
+	if count("pb") != 1 || count("pc") != 2 {
+		t.Errorf("Expected a deleted message gone for both, got pb %d, pc %d", count("pb"), count("pc"))
+	}
+
+	t.Logf("✓ Pending counts follow queueing, trimming, release and delete")
+}
@@ -2,50 +2,140 @@ package redis
 
 import (
 "context"
+"crypto/rand"
+"encoding/hex"
 "fmt"
 "time"
-
-goredis "github.com/redis/go-redis/v9"
 )
 
 const (
 RateLimitWindow = 60 * time.Second
 )
 
-func (c *Client) CheckRateLimit(ctx context.Context, deviceUUID string, limit int) (int, bool, error) {
-rateKey := fmt.Sprintf("rate:%s", deviceUUID)
-now := time.Now().UnixMilli()
-windowStart := now - int64(RateLimitWindow.Milliseconds())
+// RetryAfterSeconds rounds a rate limit's retry-after up to whole seconds, at least one
+func RetryAfterSeconds(retryAfter time.Duration) int {
+return max(int((retryAfter+time.Second-1)/time.Second), 1)
+}
+
+// WebSocket event categories, each counted on its own budget apart from HTTP requests
+const (
+RateCategorySend   = "send"
+RateCategoryTyping = "typing"
+RateCategoryRead   = "read"
+)
+
+var rateCategories = []string{RateCategorySend, RateCategoryTyping, RateCategoryRead}
 
-c.rdb.ZRemRangeByScore(ctx, rateKey, "0", fmt.Sprintf("%d", windowStart))
+// AbuseThresholds tunes spam/bot detection and how quickly abusers are banned
+type AbuseThresholds struct {
+SpamDuplicates    int           // identical messages within Window that count as spam
+BotInterval       time.Duration // a gap between messages shorter than this looks automated
+BotCount          int           // automated-looking gaps within Window that count as a bot
+Window            time.Duration // how long duplicate and bot counts are kept
+WarningsBeforeBan int           // warnings a device gets; the next abuse is a ban
+QuietPeriod       time.Duration // abuse-free time after a warning before it lapses and the device starts fresh
+}
+
+// DefaultAbuseThresholds are used until SetAbuseThresholds is called
+var DefaultAbuseThresholds = AbuseThresholds{
+SpamDuplicates:    10,
+BotInterval:       500 * time.Millisecond,
+BotCount:          20,
+Window:            5 * time.Minute,
+WarningsBeforeBan: 1,
+QuietPeriod:       time.Hour,
+}
+
+// SetAbuseThresholds replaces the abuse detection thresholds
+// Call once at startup, before the client is shared
+func (c *Client) SetAbuseThresholds(t AbuseThresholds) {
+c.abuse = t
+}
 
-count, err := c.rdb.ZCard(ctx, rateKey).Result()
+// CheckRateLimit counts one event in the subject's sliding window and reports whether it fits under limit
+// Pruning, counting and adding run as one script, so the window is trimmed on every call and
+// concurrent events can't both slip in under the limit
+// A rejected event also gets how long until enough of the window ages out to let the next one in
+func (c *Client) CheckRateLimit(ctx context.Context, deviceUUID string, limit int) (int, bool, time.Duration, error) {
+rateKey := fmt.Sprintf("rate:%s", deviceUUID)
+now := time.Now()
+windowStart := now.UnixMilli() - RateLimitWindow.Milliseconds()
+
+script := `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[1])
+local count = redis.call('ZCARD', KEYS[1])
+if count >= tonumber(ARGV[4]) then
+local oldest = redis.call('ZRANGE', KEYS[1], count - tonumber(ARGV[4]), count - tonumber(ARGV[4]), 'WITHSCORES')
+local retry = tonumber(ARGV[5])
+if oldest[2] then
+retry = tonumber(oldest[2]) + tonumber(ARGV[5]) - tonumber(ARGV[2])
+end
+return {count, 0, retry}
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[3])
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return {count + 1, 1, 0}
+`
+
+result, err := c.rdb.Eval(ctx, script, []string{rateKey},
+windowStart, now.UnixMilli(), rateMember(now), limit, RateLimitWindow.Milliseconds()).Int64Slice()
 if err != nil {
-return 0, false, fmt.Errorf("failed to check rate limit: %w", err)
+return 0, false, 0, fmt.Errorf("failed to check rate limit: %w", err)
+}
+return int(result[0]), result[1] == 1, time.Duration(max(result[2], 0)) * time.Millisecond, nil
+}
+
+// rateMember makes each event its own ZSET member - events in the same
+// millisecond, or even nanosecond on another instance, would otherwise count once
+func rateMember(now time.Time) string {
+b := make([]byte, 4)
+rand.Read(b)
+return fmt.Sprintf("%d-%s", now.UnixNano(), hex.EncodeToString(b))
+}
+
+// CheckEventRateLimit counts one WebSocket event of the given category against the device's budget
+func (c *Client) CheckEventRateLimit(ctx context.Context, deviceUUID, category string, limit int) (int, bool, time.Duration, error) {
+return c.CheckRateLimit(ctx, deviceUUID+":"+category, limit)
+}
+
+// CheckChatRateLimit counts one message from the device into a single chat
+// It runs alongside the device's send budget so no one conversation can take all of it
+func (c *Client) CheckChatRateLimit(ctx context.Context, deviceUUID, chatUUID string, limit int) (int, bool, time.Duration, error) {
+return c.CheckRateLimit(ctx, chatRateSubject(deviceUUID, chatUUID), limit)
 }
 
-if int(count) >= limit {
-return int(count), false, nil
+func chatRateSubject(deviceUUID, chatUUID string) string {
+return deviceUUID + ":chat:" + chatUUID
 }
 
-c.rdb.ZAdd(ctx, rateKey, goredis.Z{
-Score:  float64(now),
-Member: fmt.Sprintf("%d", now),
-})
-c.rdb.Expire(ctx, rateKey, RateLimitWindow)
+// rateKeys lists every rate limit window kept for a device, HTTP and WebSocket
+func rateKeys(deviceUUID string) []string {
+keys := []string{fmt.Sprintf("rate:%s", deviceUUID)}
+for _, category := range rateCategories {
+keys = append(keys, fmt.Sprintf("rate:%s:%s", deviceUUID, category))
+}
+return keys
+}
 
-return int(count) + 1, true, nil
+// messageHashesKey indexes a device's duplicate counters so they can be reset without a SCAN
+func messageHashesKey(deviceUUID string) string {
+return fmt.Sprintf("msghashes:%s", deviceUUID)
 }
 
 func (c *Client) RecordMessage(ctx context.Context, deviceUUID, messageHash string) error {
 hashKey := fmt.Sprintf("msghash:%s:%s", deviceUUID, messageHash)
-count, err := c.rdb.Incr(ctx, hashKey).Result()
-if err != nil {
+indexKey := messageHashesKey(deviceUUID)
+pipe := c.rdb.TxPipeline()
+incr := pipe.Incr(ctx, hashKey)
+pipe.Expire(ctx, hashKey, c.abuse.Window)
+pipe.SAdd(ctx, indexKey, hashKey)
+pipe.Expire(ctx, indexKey, c.abuse.Window)
+if _, err := pipe.Exec(ctx); err != nil {
 return err
 }
-c.rdb.Expire(ctx, hashKey, 5*time.Minute)
+count := incr.Val()
 
-if count >= 10 {
+if count >= int64(c.abuse.SpamDuplicates) {
 return fmt.Errorf("spam detected")
 }
 
@@ -54,12 +144,12 @@ now := time.Now().UnixMilli()
 
 lastTime, err := c.rdb.Get(ctx, timingKey).Int64()
 if err == nil {
-if now-lastTime < 500 {
+if now-lastTime < c.abuse.BotInterval.Milliseconds() {
 botKey := fmt.Sprintf("botcount:%s", deviceUUID)
 botCount, _ := c.rdb.Incr(ctx, botKey).Result()
-c.rdb.Expire(ctx, botKey, 5*time.Minute)
+c.rdb.Expire(ctx, botKey, c.abuse.Window)
 
-if botCount >= 20 {
+if botCount >= int64(c.abuse.BotCount) {
 return fmt.Errorf("bot-like behavior detected")
 }
 }
@@ -69,3 +159,24 @@ c.rdb.Set(ctx, timingKey, now, time.Minute)
 
 return nil
 }
+
+// ResetAbuseState clears a device's warning and its spam and bot counters
+// Bans are left alone - use Unban for those
+func (c *Client) ResetAbuseState(ctx context.Context, deviceUUID string) error {
+indexKey := messageHashesKey(deviceUUID)
+hashKeys, err := c.rdb.SMembers(ctx, indexKey).Result()
+if err != nil {
+return fmt.Errorf("failed to get message hashes: %w", err)
+}
+
+keys := append([]string{
+fmt.Sprintf("warn:%s", deviceUUID),
+fmt.Sprintf("botcount:%s", deviceUUID),
+indexKey,
+}, hashKeys...)
+
+if err := c.rdb.Del(ctx, keys...).Err(); err != nil {
+return fmt.Errorf("failed to reset abuse state: %w", err)
+}
+return nil
+}
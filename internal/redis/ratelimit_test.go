@@ -0,0 +1,205 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+func TestAbuseThresholds_Configurable(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	client.SetAbuseThresholds(AbuseThresholds{
+		SpamDuplicates:    2,
+		BotInterval:       time.Millisecond,
+		BotCount:          100,
+		Window:            time.Minute,
+		WarningsBeforeBan: 2,
+		QuietPeriod:       time.Hour,
+	})
+
+	deviceUUID := "test-abuse-thresholds-" + time.Now().Format("150405.000000")
+	defer client.ResetAbuseState(ctx, deviceUUID)
+	defer client.Unban(ctx, deviceUUID)
+
+	if err := client.RecordMessage(ctx, deviceUUID, "hash-a"); err != nil {
+		t.Fatalf("Expected first message accepted, got %v", err)
+	}
+	if err := client.RecordMessage(ctx, deviceUUID, "hash-a"); err == nil {
+		t.Fatal("Expected spam detected on the second duplicate")
+	}
+
+	// Two warnings before the ban
+	for i, want := range []string{"warning", "warning", "ban"} {
+		action, err := client.HandleAbuse(ctx, deviceUUID, "spam detected", time.Minute)
+		if err != nil || action != want {
+			t.Fatalf("Abuse %d: expected %s, got %q (%v)", i+1, want, action, err)
+		}
+	}
+
+	t.Logf("✓ Spam and ban thresholds follow configuration")
+}
+
+func TestAbuseThresholds_NoWarnings(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	thresholds := DefaultAbuseThresholds
+	thresholds.WarningsBeforeBan = 0
+	client.SetAbuseThresholds(thresholds)
+
+	deviceUUID := "test-abuse-no-warnings-" + time.Now().Format("150405.000000")
+	defer client.ResetAbuseState(ctx, deviceUUID)
+	defer client.Unban(ctx, deviceUUID)
+
+	action, err := client.HandleAbuse(ctx, deviceUUID, "spam detected", time.Minute)
+	if err != nil || action != "ban" {
+		t.Fatalf("Expected the first offence banned, got %q (%v)", action, err)
+	}
+	if banned, _, _, _ := client.IsBanned(ctx, deviceUUID); !banned {
+		t.Error("Expected the device banned")
+	}
+
+	t.Logf("✓ No warnings before a ban bans on the first offence")
+}
+
+func TestResetAbuseState(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	thresholds := DefaultAbuseThresholds
+	thresholds.SpamDuplicates = 3
+	client.SetAbuseThresholds(thresholds)
+
+	deviceUUID := "test-abuse-reset-" + time.Now().Format("150405.000000")
+	defer client.ResetAbuseState(ctx, deviceUUID)
+
+	client.RecordMessage(ctx, deviceUUID, "hash-a")
+	client.RecordMessage(ctx, deviceUUID, "hash-a")
+	client.AddWarning(ctx, deviceUUID, "spam detected")
+
+	if err := client.ResetAbuseState(ctx, deviceUUID); err != nil {
+		t.Fatalf("Failed to reset abuse state: %v", err)
+	}
+	if warning, _ := client.GetWarning(ctx, deviceUUID); warning != nil {
+		t.Error("Expected warning cleared")
+	}
+	// The duplicate count started over, so two more copies are still fine
+	client.RecordMessage(ctx, deviceUUID, "hash-a")
+	if err := client.RecordMessage(ctx, deviceUUID, "hash-a"); err != nil {
+		t.Errorf("Expected duplicate count reset, got %v", err)
+	}
+
+	// A warning lapses once the quiet period has passed
+	thresholds.QuietPeriod = time.Millisecond
+	client.SetAbuseThresholds(thresholds)
+	client.AddWarning(ctx, deviceUUID, "spam detected")
+	time.Sleep(5 * time.Millisecond)
+	client.RecordMessage(ctx, deviceUUID, "hash-b")
+	if warning, _ := client.GetWarning(ctx, deviceUUID); warning != nil {
+		t.Error("Expected warning cleared after the quiet period")
+	}
+
+	t.Logf("✓ Abuse state resets on demand and after a quiet period")
+}
+
+func TestCheckRateLimit_CountsBurstsExactly(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-rate-burst-" + time.Now().Format("150405.000000")
+	rateKey := "rate:" + deviceUUID
+	defer client.rdb.Del(ctx, rateKey)
+
+	// Far more events than fit in one millisecond, fired at once
+	const events, limit = 200, 150
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < events; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok, _, err := client.CheckRateLimit(ctx, deviceUUID, limit); err == nil && ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := allowed.Load(); got != limit {
+		t.Errorf("Expected exactly %d events allowed, got %d", limit, got)
+	}
+	if n, _ := client.rdb.ZCard(ctx, rateKey).Result(); n != limit {
+		t.Errorf("Expected %d distinct members, got %d", limit, n)
+	}
+
+	// Entries older than the window are pruned on the next check
+	client.rdb.ZAdd(ctx, rateKey, redis.Z{Score: float64(time.Now().Add(-2 * RateLimitWindow).UnixMilli()), Member: "stale"})
+	client.CheckRateLimit(ctx, deviceUUID, limit)
+	if _, err := client.rdb.ZScore(ctx, rateKey, "stale").Result(); err != redis.Nil {
+		t.Error("Expected stale entry pruned")
+	}
+	if ttl, _ := client.rdb.PTTL(ctx, rateKey).Result(); ttl <= 0 || ttl > RateLimitWindow {
+		t.Errorf("Expected the window to expire within %v, got %v", RateLimitWindow, ttl)
+	}
+
+	t.Logf("✓ Every event in a burst is counted and old entries are pruned")
+}
+
+func TestCheckRateLimit_RetryAfter(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	cases := []struct {
+		name    string
+		ages    []time.Duration // how long ago each event in the window happened
+		limit   int
+		allowed bool
+		retry   time.Duration // until the window has room again
+	}{
+		{"room_left", []time.Duration{50 * time.Second, 10 * time.Second}, 3, true, 0},
+		{"full", []time.Duration{50 * time.Second, 30 * time.Second, 10 * time.Second}, 3, false, 10 * time.Second},
+		{"full_recent", []time.Duration{5 * time.Second, 2 * time.Second}, 2, false, 55 * time.Second},
+		// The limit dropped below what's already in the window: two have to age out
+		{"over_full", []time.Duration{50 * time.Second, 30 * time.Second, 10 * time.Second}, 2, false, 30 * time.Second},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			subject := "test-rate-retry-" + tc.name + "-" + time.Now().Format("150405.000000")
+			rateKey := "rate:" + subject
+			defer client.rdb.Del(ctx, rateKey)
+
+			now := time.Now()
+			for i, age := range tc.ages {
+				client.rdb.ZAdd(ctx, rateKey, redis.Z{Score: float64(now.Add(-age).UnixMilli()), Member: fmt.Sprintf("seed-%d", i)})
+			}
+
+			_, allowed, retry, err := client.CheckRateLimit(ctx, subject, tc.limit)
+			if err != nil {
+				t.Fatalf("Failed to check rate limit: %v", err)
+			}
+			if allowed != tc.allowed {
+				t.Fatalf("Expected allowed=%v, got %v", tc.allowed, allowed)
+			}
+			if retry > tc.retry || retry < tc.retry-time.Second {
+				t.Errorf("Expected retry after about %v, got %v", tc.retry, retry)
+			}
+		})
+	}
+
+	if s := RetryAfterSeconds(10*time.Second + time.Millisecond); s != 11 {
+		t.Errorf("Expected retry-after rounded up to 11s, got %d", s)
+	}
+	if s := RetryAfterSeconds(0); s != 1 {
+		t.Errorf("Expected at least 1s, got %d", s)
+	}
+
+	t.Logf("✓ Retry-after follows the oldest entry still blocking the window")
+}
@@ -0,0 +1,179 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Message states, in the order a message moves through them for each recipient
+const (
+	MessageQueued    = "queued"
+	MessageDelivered = "delivered"
+	MessageRead      = "read"
+)
+
+// MessageState is where one recipient is with one message
+type MessageState struct {
+	MessageID   string `json:"message_id"`
+	RecipientID string `json:"recipient_id"`
+	State       string `json:"state"`
+}
+
+// messageStateKey holds a message's sender plus one "r:{participantID}" field per recipient
+func messageStateKey(chatUUID, messageID string) string {
+	return fmt.Sprintf("msg_state:%s:%s", chatUUID, messageID)
+}
+
+// sentMessagesKey indexes the tracked messages a participant sent in a chat
+func sentMessagesKey(chatUUID, participantID string) string {
+	return fmt.Sprintf("msg_sent:%s:%s", chatUUID, participantID)
+}
+
+// messageSendersKey maps each message sent in a chat to its sender for as long as the chat lives
+// Kept apart from the receipt record, which is forgotten once the sender has seen the final state
+func messageSendersKey(chatUUID string) string {
+	return fmt.Sprintf("msg_senders:%s", chatUUID)
+}
+
+// SetMessageState advances a recipient's state for a message
+// States never move backwards; with no senderID the sender recorded earlier is used
+// and an untracked message is ignored. Keys expire with the chat
+func (c *Client) SetMessageState(ctx context.Context, chat *Chat, messageID, senderID, recipientID, state string) error {
+	script := `
+		local rank = {queued = 1, delivered = 2, read = 3}
+		local stateKey = KEYS[1]
+		local messageID = ARGV[1]
+		local sender = ARGV[2]
+		local field = 'r:' .. ARGV[3]
+		local state = ARGV[4]
+		local expireAt = ARGV[5]
+
+		if sender == '' then
+			sender = redis.call('HGET', stateKey, 'sender')
+			if not sender then
+				return 0
+			end
+		end
+
+		local current = redis.call('HGET', stateKey, field)
+		if current and rank[current] >= rank[state] then
+			return 0
+		end
+
+		redis.call('HSET', stateKey, 'sender', sender, field, state)
+		redis.call('EXPIREAT', stateKey, expireAt)
+
+		local sentKey = ARGV[6] .. sender
+		redis.call('SADD', sentKey, messageID)
+		redis.call('EXPIREAT', sentKey, expireAt)
+		return 1
+	`
+	keys := []string{messageStateKey(chat.ChatUUID, messageID)}
+	sentPrefix := sentMessagesKey(chat.ChatUUID, "")
+	err := c.rdb.Eval(ctx, script, keys, messageID, senderID, recipientID, state, chat.ExpiresAt().Unix(), sentPrefix).Err()
+	if err != nil {
+		return fmt.Errorf("failed to set message state: %w", err)
+	}
+	return nil
+}
+
+// GetMessageStates returns every recipient state for the participant's tracked outbound messages
+func (c *Client) GetMessageStates(ctx context.Context, chatUUID, participantID string) ([]MessageState, error) {
+	sentKey := sentMessagesKey(chatUUID, participantID)
+	messageIDs, err := c.rdb.SMembers(ctx, sentKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sent messages: %w", err)
+	}
+
+	states := make([]MessageState, 0, len(messageIDs))
+	for _, messageID := range messageIDs {
+		fields, err := c.rdb.HGetAll(ctx, messageStateKey(chatUUID, messageID)).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get message state: %w", err)
+		}
+		if len(fields) == 0 {
+			c.rdb.SRem(ctx, sentKey, messageID)
+			continue
+		}
+		for field, state := range fields {
+			recipientID, ok := strings.CutPrefix(field, "r:")
+			if !ok {
+				continue
+			}
+			states = append(states, MessageState{
+				MessageID:   messageID,
+				RecipientID: recipientID,
+				State:       state,
+			})
+		}
+	}
+	return states, nil
+}
+
+// RecordMessageSender remembers who sent a message so only they can change it later
+// The first sender recorded for a message ID wins; the record expires with the chat
+func (c *Client) RecordMessageSender(ctx context.Context, chat *Chat, messageID, senderID string) error {
+	key := messageSendersKey(chat.ChatUUID)
+	pipe := c.rdb.TxPipeline()
+	pipe.HSetNX(ctx, key, messageID, senderID)
+	pipe.ExpireAt(ctx, key, chat.ExpiresAt())
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to record message sender: %w", err)
+	}
+	return nil
+}
+
+// ForgetMessageSender drops a deleted message's sender record
+func (c *Client) ForgetMessageSender(ctx context.Context, chatUUID, messageID string) error {
+	if err := c.rdb.HDel(ctx, messageSendersKey(chatUUID), messageID).Err(); err != nil {
+		return fmt.Errorf("failed to forget message sender: %w", err)
+	}
+	return nil
+}
+
+// GetMessageSender returns the participant that sent a message
+// Returns an empty string for a message never recorded or already deleted
+func (c *Client) GetMessageSender(ctx context.Context, chatUUID, messageID string) (string, error) {
+	sender, err := c.rdb.HGet(ctx, messageSendersKey(chatUUID), messageID).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get message sender: %w", err)
+	}
+	return sender, nil
+}
+
+// ForgetMessageState stops tracking a message once its sender has seen its final state
+func (c *Client) ForgetMessageState(ctx context.Context, chatUUID, participantID, messageID string) error {
+	pipe := c.rdb.TxPipeline()
+	pipe.Del(ctx, messageStateKey(chatUUID, messageID))
+	pipe.SRem(ctx, sentMessagesKey(chatUUID, participantID), messageID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to forget message state: %w", err)
+	}
+	return nil
+}
+
+// DeleteMessageStates drops all delivery/read tracking and sender records for a chat
+func (c *Client) DeleteMessageStates(ctx context.Context, chat *Chat) error {
+	keys := []string{messageSendersKey(chat.ChatUUID)}
+	for _, p := range chat.Participants {
+		sentKey := sentMessagesKey(chat.ChatUUID, p.ID)
+		messageIDs, err := c.rdb.SMembers(ctx, sentKey).Result()
+		if err != nil {
+			return fmt.Errorf("failed to get sent messages: %w", err)
+		}
+		for _, messageID := range messageIDs {
+			keys = append(keys, messageStateKey(chat.ChatUUID, messageID))
+		}
+		keys = append(keys, sentKey)
+	}
+	if err := c.rdb.Del(ctx, keys...).Err(); err != nil {
+		return fmt.Errorf("failed to delete message states: %w", err)
+	}
+	return nil
+}
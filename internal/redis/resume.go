@@ -0,0 +1,100 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+var ErrResumeInvalid = errors.New("resume token invalid or expired")
+
+// ResumeSession is what a resume token restores: the device and its registered chat participants
+type ResumeSession struct {
+	DeviceUUID   string
+	Participants map[string]string // chatUUID -> participantID
+}
+
+// resumeKey is a hash with "device" and "key" (public key fingerprint) fields plus
+// one "p:{chatUUID}" field per registered chat
+func resumeKey(token string) string {
+	return fmt.Sprintf("resume:%s", token)
+}
+
+// CreateResumeSession stores a new resume token for an authenticated device
+// The token is tied to the device's current public key
+func (c *Client) CreateResumeSession(ctx context.Context, token, deviceUUID string, ttl time.Duration) error {
+	publicKey, err := c.GetDevicePublicKey(ctx, deviceUUID)
+	if err != nil {
+		return fmt.Errorf("failed to create resume session: %w", err)
+	}
+
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, resumeKey(token), "device", deviceUUID, "key", keyFingerprint(publicKey))
+	pipe.Expire(ctx, resumeKey(token), ttl)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to create resume session: %w", err)
+	}
+	return nil
+}
+
+// AddResumeParticipant records a chat registration so a resume restores it
+// A token that has already expired or been used is left alone
+func (c *Client) AddResumeParticipant(ctx context.Context, token, chatUUID, participantID string) error {
+	script := `
+		if redis.call('EXISTS', KEYS[1]) == 0 then
+			return 0
+		end
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[2])
+		return 1
+	`
+	if err := c.rdb.Eval(ctx, script, []string{resumeKey(token)}, "p:"+chatUUID, participantID).Err(); err != nil {
+		return fmt.Errorf("failed to update resume session: %w", err)
+	}
+	return nil
+}
+
+// RefreshResumeSession keeps a connected device's token alive
+// Once the device disconnects it stops being refreshed and expires after ttl
+func (c *Client) RefreshResumeSession(ctx context.Context, token string, ttl time.Duration) error {
+	if err := c.rdb.Expire(ctx, resumeKey(token), ttl).Err(); err != nil {
+		return fmt.Errorf("failed to refresh resume session: %w", err)
+	}
+	return nil
+}
+
+// ConsumeResumeSession returns and deletes a resume session - tokens are single-use
+// A token issued before the device's key was rotated is rejected
+func (c *Client) ConsumeResumeSession(ctx context.Context, token string) (*ResumeSession, error) {
+	script := `
+		local fields = redis.call('HGETALL', KEYS[1])
+		redis.call('DEL', KEYS[1])
+		return fields
+	`
+	fields, err := c.rdb.Eval(ctx, script, []string{resumeKey(token)}).StringSlice()
+	if err != nil {
+		return nil, fmt.Errorf("failed to consume resume session: %w", err)
+	}
+
+	session := &ResumeSession{Participants: make(map[string]string)}
+	var fingerprint string
+	for i := 0; i+1 < len(fields); i += 2 {
+		if fields[i] == "device" {
+			session.DeviceUUID = fields[i+1]
+		} else if fields[i] == "key" {
+			fingerprint = fields[i+1]
+		} else if chatUUID, ok := strings.CutPrefix(fields[i], "p:"); ok {
+			session.Participants[chatUUID] = fields[i+1]
+		}
+	}
+	if session.DeviceUUID == "" {
+		return nil, ErrResumeInvalid
+	}
+
+	publicKey, err := c.GetDevicePublicKey(ctx, session.DeviceUUID)
+	if err != nil || keyFingerprint(publicKey) != fingerprint {
+		return nil, ErrResumeInvalid
+	}
+	return session, nil
+}
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// KeyRotationChallengeTTL is how long a device has to answer a key rotation challenge
+const KeyRotationChallengeTTL = 5 * time.Minute
+
+var (
+	ErrChallengeInvalid = errors.New("key rotation challenge invalid or expired")
+	ErrKeyChanged       = errors.New("public key changed during rotation")
+)
+
+func rotationChallengeKey(deviceUUID string) string {
+	return fmt.Sprintf("rotate_challenge:%s", deviceUUID)
+}
+
+// CreateKeyRotationChallenge issues a fresh challenge for a device to sign with its new key
+// A new challenge replaces any outstanding one
+func (c *Client) CreateKeyRotationChallenge(ctx context.Context, deviceUUID string) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate challenge: %w", err)
+	}
+	challenge := hex.EncodeToString(b)
+
+	if err := c.rdb.Set(ctx, rotationChallengeKey(deviceUUID), challenge, KeyRotationChallengeTTL).Err(); err != nil {
+		return "", fmt.Errorf("failed to store challenge: %w", err)
+	}
+	return challenge, nil
+}
+
+// ConsumeKeyRotationChallenge checks and deletes a device's challenge - each is good for one attempt
+func (c *Client) ConsumeKeyRotationChallenge(ctx context.Context, deviceUUID, challenge string) error {
+	stored, err := c.rdb.GetDel(ctx, rotationChallengeKey(deviceUUID)).Result()
+	if err == redis.Nil {
+		return ErrChallengeInvalid
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read challenge: %w", err)
+	}
+	if stored != challenge {
+		return ErrChallengeInvalid
+	}
+	return nil
+}
+
+// RotatePublicKey replaces a device's public key, provided it's still oldKey
+// Resume tokens issued under the old key stop working, see ConsumeResumeSession
+func (c *Client) RotatePublicKey(ctx context.Context, deviceUUID, oldKey, newKey string) error {
+	script := `
+		if redis.call('GET', KEYS[1]) ~= ARGV[1] then
+			return 0
+		end
+		redis.call('SET', KEYS[1], ARGV[2], 'KEEPTTL')
+		return 1
+	`
+	swapped, err := c.rdb.Eval(ctx, script, []string{fmt.Sprintf("pubkey:%s", deviceUUID)}, oldKey, newKey).Int()
+	if err != nil {
+		return fmt.Errorf("failed to rotate public key: %w", err)
+	}
+	if swapped == 0 {
+		return ErrKeyChanged
+	}
+	return nil
+}
+
+// keyFingerprint identifies a public key without storing it again
+func keyFingerprint(publicKey string) string {
+	sum := sha256.Sum256([]byte(publicKey))
+	return hex.EncodeToString(sum[:8])
+}
@@ -0,0 +1,49 @@
+package redis
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRotatePublicKey(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	deviceUUID := "test-rotation-" + time.Now().Format("150405.000000")
+	client.rdb.Set(ctx, "pubkey:"+deviceUUID, "old-key", 0)
+	defer client.rdb.Del(ctx, "pubkey:"+deviceUUID, "rotate_challenge:"+deviceUUID)
+
+	challenge, err := client.CreateKeyRotationChallenge(ctx, deviceUUID)
+	if err != nil {
+		t.Fatalf("Failed to create challenge: %v", err)
+	}
+	if err := client.ConsumeKeyRotationChallenge(ctx, deviceUUID, challenge); err != nil {
+		t.Fatalf("Expected challenge accepted, got %v", err)
+	}
+	if err := client.ConsumeKeyRotationChallenge(ctx, deviceUUID, challenge); err != ErrChallengeInvalid {
+		t.Errorf("Expected a spent challenge rejected, got %v", err)
+	}
+
+	token := "test-rotation-token-" + deviceUUID
+	if err := client.CreateResumeSession(ctx, token, deviceUUID, time.Minute); err != nil {
+		t.Fatalf("Failed to create resume session: %v", err)
+	}
+
+	if err := client.RotatePublicKey(ctx, deviceUUID, "wrong-old-key", "new-key"); err != ErrKeyChanged {
+		t.Errorf("Expected ErrKeyChanged for a stale old key, got %v", err)
+	}
+	if err := client.RotatePublicKey(ctx, deviceUUID, "old-key", "new-key"); err != nil {
+		t.Fatalf("Failed to rotate key: %v", err)
+	}
+	if key, _ := client.GetDevicePublicKey(ctx, deviceUUID); key != "new-key" {
+		t.Errorf("Expected new key stored, got %q", key)
+	}
+
+	// Resume tokens from before the rotation can't skip re-authentication
+	if _, err := client.ConsumeResumeSession(ctx, token); err != ErrResumeInvalid {
+		t.Errorf("Expected resume token from the old key rejected, got %v", err)
+	}
+
+	t.Logf("✓ Public key rotated atomically and old resume tokens revoked")
+}
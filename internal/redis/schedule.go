@@ -0,0 +1,94 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// scheduledIndexKey is a ZSET of "chatUUID:messageID" scored by the unix time to deliver
+const scheduledIndexKey = "scheduled_messages"
+
+// scheduledMessageGrace keeps a body around past its delivery time in case no
+// instance was polling right then; the chat has usually expired by the time it lapses
+const scheduledMessageGrace = 10 * time.Minute
+
+// ScheduledMessage is a message.send held back until DeliverAt
+type ScheduledMessage struct {
+	ChatUUID          string    `json:"chat_uuid"`
+	MessageID         string    `json:"message_id"`
+	SenderParticipant string    `json:"sender_participant"`
+	SenderDeviceUUID  string    `json:"sender_device_uuid"`
+	EncryptedContent  []byte    `json:"encrypted_content"`
+	AttachmentIDs     []string  `json:"attachment_ids,omitempty"`
+	DeliverAt         time.Time `json:"deliver_at"`
+}
+
+func scheduledMember(chatUUID, messageID string) string {
+	return chatUUID + ":" + messageID
+}
+
+func scheduledMessageKey(member string) string {
+	return "scheduled:" + member
+}
+
+// ScheduleMessage stores a message to be delivered at msg.DeliverAt
+// Scheduling the same message ID again replaces the earlier one
+func (c *Client) ScheduleMessage(ctx context.Context, msg *ScheduledMessage) error {
+	msgJSON, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal scheduled message: %w", err)
+	}
+
+	member := scheduledMember(msg.ChatUUID, msg.MessageID)
+	ttl := time.Until(msg.DeliverAt) + scheduledMessageGrace
+
+	_, err = c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(ctx, scheduledMessageKey(member), msgJSON, ttl)
+		pipe.ZAdd(ctx, scheduledIndexKey, redis.Z{
+			Score:  float64(msg.DeliverAt.Unix()),
+			Member: member,
+		})
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to schedule message: %w", err)
+	}
+	return nil
+}
+
+// PopDueScheduledMessages removes and returns up to limit messages due at or before now
+// Each message is claimed with ZREM, so with several instances polling only one delivers it
+func (c *Client) PopDueScheduledMessages(ctx context.Context, now time.Time, limit int) ([]*ScheduledMessage, error) {
+	members, err := c.rdb.ZRangeByScore(ctx, scheduledIndexKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   fmt.Sprintf("%d", now.Unix()),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get due scheduled messages: %w", err)
+	}
+
+	due := make([]*ScheduledMessage, 0, len(members))
+	for _, member := range members {
+		claimed, err := c.rdb.ZRem(ctx, scheduledIndexKey, member).Result()
+		if err != nil || claimed == 0 {
+			continue
+		}
+
+		msgJSON, err := c.rdb.GetDel(ctx, scheduledMessageKey(member)).Bytes()
+		if err != nil {
+			// Body lapsed before anyone got to it
+			continue
+		}
+		var msg ScheduledMessage
+		if err := json.Unmarshal(msgJSON, &msg); err != nil {
+			continue
+		}
+		due = append(due, &msg)
+	}
+	return due, nil
+}
@@ -0,0 +1,81 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DeviceSession describes one authenticated connection of a device, on whichever instance holds it
+type DeviceSession struct {
+	ID              string    `json:"session_id"`
+	InstanceID      string    `json:"instance_id"`
+	ConnectedAt     time.Time `json:"connected_at"`
+	ProtocolVersion int       `json:"protocol_version"`
+	LastSeenAt      time.Time `json:"last_seen_at"` // refreshed with presence, see SaveDeviceSession
+}
+
+// deviceSessionsKey is a hash of session ID -> DeviceSession JSON
+func deviceSessionsKey(deviceUUID string) string {
+	return fmt.Sprintf("device_sessions:%s", deviceUUID)
+}
+
+// SaveDeviceSession records or refreshes a connection in the device's session registry
+// Instances re-save their sessions as often as presence, so one not seen for PresenceTTL
+// belongs to an instance that died without cleaning up
+func (c *Client) SaveDeviceSession(ctx context.Context, deviceUUID string, session DeviceSession) error {
+	session.LastSeenAt = time.Now()
+	data, err := json.Marshal(session)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %w", err)
+	}
+
+	key := deviceSessionsKey(deviceUUID)
+	pipe := c.rdb.TxPipeline()
+	pipe.HSet(ctx, key, session.ID, data)
+	pipe.Expire(ctx, key, PresenceTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to save session: %w", err)
+	}
+	return nil
+}
+
+// RemoveDeviceSession drops a closed connection from the registry
+func (c *Client) RemoveDeviceSession(ctx context.Context, deviceUUID, sessionID string) error {
+	if err := c.rdb.HDel(ctx, deviceSessionsKey(deviceUUID), sessionID).Err(); err != nil {
+		return fmt.Errorf("failed to remove session: %w", err)
+	}
+	return nil
+}
+
+// GetDeviceSessions lists a device's live connections, oldest first
+// Sessions left behind by a dead instance are pruned on the way
+func (c *Client) GetDeviceSessions(ctx context.Context, deviceUUID string) ([]DeviceSession, error) {
+	key := deviceSessionsKey(deviceUUID)
+	fields, err := c.rdb.HGetAll(ctx, key).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sessions: %w", err)
+	}
+
+	sessions := make([]DeviceSession, 0, len(fields))
+	var stale []string
+	cutoff := time.Now().Add(-PresenceTTL)
+	for id, data := range fields {
+		var session DeviceSession
+		if err := json.Unmarshal([]byte(data), &session); err != nil || session.LastSeenAt.Before(cutoff) {
+			stale = append(stale, id)
+			continue
+		}
+		sessions = append(sessions, session)
+	}
+	if len(stale) > 0 {
+		c.rdb.HDel(ctx, key, stale...)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].ConnectedAt.Before(sessions[j].ConnectedAt)
+	})
+	return sessions, nil
+}
@@ -2,9 +2,35 @@ package redis
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"slices"
+	"sort"
+	"strings"
 	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Reasons an activation code can't be claimed
+var (
+	ErrCodeNotFound = errors.New("activation code not found")
+	ErrCodeRevoked  = errors.New("activation code revoked")
+	ErrCodeUsed     = errors.New("activation code already used")
+)
+
+// ErrDuoLink is a duo claim whose subscription was written but whose partner wasn't pointed back at it
+// Retrying the claim from the same device finishes the link
+var ErrDuoLink = errors.New("failed to link duo partner")
+
+// Reasons a device has no public key to authenticate with
+var (
+	ErrDeviceUnknown = errors.New("device unknown")     // no subscription either: never activated, purged or lapsed
+	ErrKeyExpired    = errors.New("device key expired") // still subscribed, only the key is gone
 )
 
 type Subscription struct {
@@ -17,6 +43,15 @@ type Subscription struct {
 	CreatedAt    time.Time `json:"created_at"`
 	IsDuoGuest   bool      `json:"is_duo_guest"`
 	DuoOwnerUUID string    `json:"duo_owner_uuid,omitempty"`
+	DuoGuestUUID string    `json:"duo_guest_uuid,omitempty"`
+}
+
+// DuoPartner returns the device linked to this duo subscription, if any
+func (s *Subscription) DuoPartner() string {
+	if s.IsDuoGuest {
+		return s.DuoOwnerUUID
+	}
+	return s.DuoGuestUUID
 }
 
 type ActivationCode struct {
@@ -27,6 +62,7 @@ type ActivationCode struct {
 	Status          string    `json:"status"`
 	CreatedAt       time.Time `json:"created_at"`
 	DuoOwnerCode    string    `json:"duo_owner_code,omitempty"`
+	Origin          string    `json:"origin,omitempty"` // "admin" for codes minted without a Stripe payment
 	// TEAM fields
 	TeamIndex int    `json:"team_index,omitempty"` // 1, 2, 3... which code in the team
 	TeamTotal int    `json:"team_total,omitempty"` // total devices in this team purchase
@@ -35,13 +71,63 @@ type ActivationCode struct {
 	// This breaks the link between payment and device for privacy
 }
 
+// CodeOriginAdmin marks activation codes minted by an operator rather than a checkout
+const CodeOriginAdmin = "admin"
+
+// Effective subscription states, see SubscriptionState
+const (
+	SubscriptionActive  = "active"
+	SubscriptionGrace   = "grace"
+	SubscriptionExpired = "expired"
+)
+
+// Activation code lifetimes until SetCodeRetention is called
+const (
+	DefaultActivationCodeTTL = 24 * time.Hour // an unclaimed code stays claimable
+	DefaultUsedCodeRetention = time.Hour      // a claimed code is kept to answer retries and reject reuse
+)
+
+// SetCodeRetention sets how long unclaimed activation codes stay claimable and how long
+// claimed ones are kept afterwards. Call once at startup, before the client is shared
+func (c *Client) SetCodeRetention(codeTTL, usedRetention time.Duration) {
+	c.codeTTL = codeTTL
+	c.usedCodeRetention = usedRetention
+}
+
+// SetSubscriptionGrace sets how long a subscription keeps working after it expires
+// Call once at startup, before the client is shared
+func (c *Client) SetSubscriptionGrace(grace time.Duration) {
+	c.subscriptionGrace = grace
+}
+
+// SubscriptionGraceEnds returns when an expired subscription stops working
+func (c *Client) SubscriptionGraceEnds(sub *Subscription) time.Time {
+	return sub.ExpiresAt.Add(c.subscriptionGrace)
+}
+
+// SubscriptionState resolves the effective state of a subscription at now
+// A subscription past ExpiresAt is in grace until the grace period runs out
+func (c *Client) SubscriptionState(sub *Subscription, now time.Time) string {
+	if sub.Status != SubscriptionActive {
+		return sub.Status
+	}
+	if !now.After(sub.ExpiresAt) {
+		return SubscriptionActive
+	}
+	if now.Before(c.SubscriptionGraceEnds(sub)) {
+		return SubscriptionGrace
+	}
+	return SubscriptionExpired
+}
+
 func (c *Client) SetSubscription(ctx context.Context, sub *Subscription) error {
 	subJSON, err := json.Marshal(sub)
 	if err != nil {
 		return fmt.Errorf("failed to marshal subscription: %w", err)
 	}
 
-	ttl := time.Until(sub.ExpiresAt)
+	// Kept through the grace period so the device can still authenticate
+	ttl := time.Until(c.SubscriptionGraceEnds(sub))
 	if ttl <= 0 {
 		ttl = time.Hour
 	}
@@ -75,15 +161,30 @@ func (c *Client) IsSubscriptionActive(ctx context.Context, deviceUUID string) (b
 		return false, nil
 	}
 
-	if sub.Status != "active" {
-		return false, nil
+	switch c.SubscriptionState(sub, time.Now()) {
+	case SubscriptionActive, SubscriptionGrace:
+		return true, nil
 	}
+	return false, nil
+}
 
-	if time.Now().After(sub.ExpiresAt) {
-		return false, nil
+func subNoticesKey(deviceUUID string) string {
+	return fmt.Sprintf("sub_notices:%s", deviceUUID)
+}
+
+// MarkSubscriptionNotice records that a device was sent an expiry notice for the subscription
+// expiring at expiresAt. Returns false if it already had it
+// Notices are tied to the expiry, so a subscription that gets extended is warned afresh
+func (c *Client) MarkSubscriptionNotice(ctx context.Context, deviceUUID, notice string, expiresAt time.Time) (bool, error) {
+	key := subNoticesKey(deviceUUID)
+	first, err := c.rdb.HSetNX(ctx, key, fmt.Sprintf("%s:%d", notice, expiresAt.Unix()), time.Now().Unix()).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record subscription notice: %w", err)
 	}
 
-	return true, nil
+	// Outlives the subscription key, so the expired notice isn't repeated either
+	c.rdb.Expire(ctx, key, time.Until(c.SubscriptionGraceEnds(&Subscription{ExpiresAt: expiresAt}))+time.Hour)
+	return first, nil
 }
 
 func (c *Client) CreateActivationCode(ctx context.Context, code *ActivationCode) error {
@@ -93,7 +194,7 @@ func (c *Client) CreateActivationCode(ctx context.Context, code *ActivationCode)
 	}
 
 	codeKey := fmt.Sprintf("code:%s", code.Code)
-	if err := c.rdb.Set(ctx, codeKey, codeJSON, 24*time.Hour).Err(); err != nil {
+	if err := c.rdb.Set(ctx, codeKey, codeJSON, c.codeTTL).Err(); err != nil {
 		return fmt.Errorf("failed to store activation code: %w", err)
 	}
 
@@ -104,7 +205,7 @@ func (c *Client) GetActivationCode(ctx context.Context, code string) (*Activatio
 	codeKey := fmt.Sprintf("code:%s", code)
 	codeJSON, err := c.rdb.Get(ctx, codeKey).Result()
 	if err != nil {
-		return nil, fmt.Errorf("activation code not found: %w", err)
+		return nil, fmt.Errorf("%w: %w", ErrCodeNotFound, err)
 	}
 
 	var ac ActivationCode
@@ -115,14 +216,91 @@ func (c *Client) GetActivationCode(ctx context.Context, code string) (*Activatio
 	return &ac, nil
 }
 
+// SetClaimSecret sets the key claimHash is computed with
+// Every instance needs the same secret for a retry to be recognised wherever it lands
+// Call once at startup, before the client is shared
+func (c *Client) SetClaimSecret(secret string) {
+	if secret != "" {
+		c.claimSecret = []byte(secret)
+	}
+}
+
+// claimHash lets the device that claimed a code retry the claim without storing the device
+// Keyed with a secret kept out of Redis, so the stored hash can't be checked against known devices
+func (c *Client) claimHash(code, deviceUUID string) string {
+	mac := hmac.New(sha256.New, c.claimSecret)
+	mac.Write([]byte(code + ":" + deviceUUID))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// claimCode marks a pending code used, so no two devices can claim the same code
+// Returns the code as it was before the claim, and whether deviceUUID had already claimed it
+func (c *Client) claimCode(ctx context.Context, code, deviceUUID string) (*ActivationCode, string, bool, error) {
+	script := `
+		local codeJSON = redis.call('GET', KEYS[1])
+		if not codeJSON then
+			return {'missing'}
+		end
+		local ac = cjson.decode(codeJSON)
+		if ac.status == 'used' and ac.claim_hash == ARGV[1] then
+			return {'claimed', codeJSON}
+		end
+		if ac.status ~= 'pending' then
+			return {ac.status}
+		end
+		ac.status = 'used'
+		ac.claim_hash = ARGV[1]
+		redis.call('SET', KEYS[1], cjson.encode(ac), 'KEEPTTL')
+		return {'ok', codeJSON}
+	`
+
+	res, err := c.rdb.Eval(ctx, script, []string{fmt.Sprintf("code:%s", code)}, c.claimHash(code, deviceUUID)).StringSlice()
+	if err != nil {
+		return nil, "", false, fmt.Errorf("failed to claim activation code: %w", err)
+	}
+	claimed := false
+	switch res[0] {
+	case "ok":
+	case "claimed":
+		claimed = true
+	case "missing":
+		return nil, "", false, ErrCodeNotFound
+	case "revoked":
+		return nil, "", false, ErrCodeRevoked
+	default:
+		return nil, "", false, ErrCodeUsed
+	}
+
+	var ac ActivationCode
+	if err := json.Unmarshal([]byte(res[1]), &ac); err != nil {
+		return nil, "", false, fmt.Errorf("failed to unmarshal activation code: %w", err)
+	}
+	return &ac, res[1], claimed, nil
+}
+
+// releaseCode puts back a code whose claim failed part way, so it can be claimed again
+func (c *Client) releaseCode(ctx context.Context, code, codeJSON string) {
+	c.rdb.SetArgs(ctx, fmt.Sprintf("code:%s", code), codeJSON, redis.SetArgs{Mode: "XX", KeepTTL: true})
+}
+
 func (c *Client) ClaimActivationCode(ctx context.Context, code, deviceUUID, publicKey string) (*Subscription, string, error) {
-	ac, err := c.GetActivationCode(ctx, code)
+	ac, pendingJSON, claimed, err := c.claimCode(ctx, code, deviceUUID)
 	if err != nil {
 		return nil, "", err
 	}
-
-	if ac.Status != "pending" {
-		return nil, "", fmt.Errorf("activation code already used")
+	if claimed {
+		// A retry from the device that claimed it gets the same answer, not more time
+		// Until the first claim has written the subscription there is nothing to return
+		sub, err := c.GetSubscription(ctx, deviceUUID)
+		if err != nil {
+			return nil, "", ErrCodeUsed
+		}
+		if partner := sub.DuoPartner(); partner != "" {
+			if err := c.setDuoPartner(ctx, partner, deviceUUID); err != nil {
+				return nil, "", fmt.Errorf("%w: %v", ErrDuoLink, err)
+			}
+		}
+		return sub, ac.StripeSessionID, nil
 	}
 
 	// Get duration based on plan type
@@ -154,22 +332,45 @@ func (c *Client) ClaimActivationCode(ctx context.Context, code, deviceUUID, publ
 		IsDuoGuest: ac.Type == "duo_guest",
 	}
 
+	partnerUUID := ""
+	if ac.Type == "duo_owner" || ac.Type == "duo_guest" {
+		partnerUUID, err = c.linkDuoClaim(ctx, ac, deviceUUID)
+		if err != nil {
+			c.releaseCode(ctx, code, pendingJSON)
+			return nil, "", err
+		}
+		if sub.IsDuoGuest {
+			sub.DuoOwnerUUID = partnerUUID
+		} else {
+			sub.DuoGuestUUID = partnerUUID
+		}
+	}
+
 	if err := c.SetSubscription(ctx, sub); err != nil {
+		c.releaseCode(ctx, code, pendingJSON)
 		return nil, "", err
 	}
 
+	if partnerUUID != "" {
+		if err := c.setDuoPartner(ctx, partnerUUID, deviceUUID); err != nil {
+			return nil, "", fmt.Errorf("%w: %v", ErrDuoLink, err)
+		}
+	}
+	if ac.Type == "team" {
+		c.addToTeamRoster(ctx, ac, c.SubscriptionGraceEnds(sub))
+	}
+
 	keyKey := fmt.Sprintf("pubkey:%s", deviceUUID)
 	c.rdb.Set(ctx, keyKey, publicKey, 0)
 
-	// PRIVACY: Mark code as used but do NOT store which device claimed it
-	// This breaks the Stripe payment -> device link
-	ac.Status = "used"
+	// PRIVACY: The code is already marked used and does NOT store which device claimed it
+	// This breaks the Stripe payment -> device link. Its claim hash only answers
+	// "was it this device?" for retries, and goes with the code
 	// REMOVED: ac.ClaimedByDevice = deviceUUID
 	// REMOVED: ac.ClaimedAt = time.Now()
-	codeJSON, _ := json.Marshal(ac)
 	codeKey := fmt.Sprintf("code:%s", code)
-	// Delete used code after short period (just for duplicate prevention)
-	c.rdb.Set(ctx, codeKey, codeJSON, 1*time.Hour)
+	// Delete used code after short period (just for duplicate prevention and retries)
+	c.rdb.Expire(ctx, codeKey, c.usedCodeRetention)
 
 	// Remove from code pool
 	c.RemoveFromCodePool(ctx, code)
@@ -213,6 +414,25 @@ func (c *Client) GetDevicePublicKey(ctx context.Context, deviceUUID string) (str
 	return c.rdb.Get(ctx, keyKey).Result()
 }
 
+// LookupDevicePublicKey returns the key a device authenticates with
+// A missing key is ErrKeyExpired while the device still has a subscription, so it only
+// needs to register keys again, and ErrDeviceUnknown otherwise, so it must re-activate
+func (c *Client) LookupDevicePublicKey(ctx context.Context, deviceUUID string) (string, error) {
+	publicKey, err := c.GetDevicePublicKey(ctx, deviceUUID)
+	if err != redis.Nil {
+		return publicKey, err
+	}
+
+	subscribed, err := c.rdb.Exists(ctx, fmt.Sprintf("sub:%s", deviceUUID)).Result()
+	if err != nil {
+		return "", fmt.Errorf("failed to check subscription: %w", err)
+	}
+	if subscribed == 0 {
+		return "", ErrDeviceUnknown
+	}
+	return "", ErrKeyExpired
+}
+
 func getPlanDuration(plan string) time.Duration {
 	switch plan {
 	case "1_day_solo", "1_day_duo":
@@ -258,48 +478,109 @@ func getPlanType(codeType string) string {
 	}
 }
 
+// GetActivationCodesBySession returns every code bought in a checkout session
+// Ordered by team index, then code, so pages taken from it are stable
 func (c *Client) GetActivationCodesBySession(ctx context.Context, sessionID string) ([]ActivationCode, error) {
-	// Use the code pool for faster lookup
+	// The code pool is the fast path; scanning is only for codes that predate it
 	codes, err := c.GetCodesFromPool(ctx, sessionID)
-	if err == nil && len(codes) > 0 {
-		var result []ActivationCode
-		for _, code := range codes {
-			ac, err := c.GetActivationCode(ctx, code)
-			if err == nil {
-				result = append(result, *ac)
-			}
-		}
-		if len(result) > 0 {
-			return result, nil
-		}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read code pool: %w", err)
 	}
 
-	// Fallback to scanning (for existing codes)
-	keys, err := c.rdb.Keys(ctx, "code:*").Result()
+	var result []ActivationCode
+	if len(codes) > 0 {
+		result, err = c.getActivationCodes(ctx, codes)
+	} else {
+		result, err = c.scanSessionCodes(ctx, sessionID)
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	var result []ActivationCode
-	for _, key := range keys {
-		codeJSON, err := c.rdb.Get(ctx, key).Result()
-		if err != nil {
-			continue
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].TeamIndex != result[j].TeamIndex {
+			return result[i].TeamIndex < result[j].TeamIndex
 		}
+		return result[i].Code < result[j].Code
+	})
+	return result, nil
+}
 
-		var ac ActivationCode
-		if err := json.Unmarshal([]byte(codeJSON), &ac); err != nil {
+// GetActivationCodesPage returns up to limit of a session's codes starting at offset
+// Also returns how many codes the session has, so callers know when to stop paging
+func (c *Client) GetActivationCodesPage(ctx context.Context, sessionID string, offset, limit int) ([]ActivationCode, int, error) {
+	codes, err := c.GetActivationCodesBySession(ctx, sessionID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total := len(codes)
+	if offset >= total {
+		return []ActivationCode{}, total, nil
+	}
+	return codes[offset:min(offset+limit, total)], total, nil
+}
+
+// getActivationCodes loads the given codes in one round trip, skipping any that expired
+func (c *Client) getActivationCodes(ctx context.Context, codes []string) ([]ActivationCode, error) {
+	codeKeys := make([]string, len(codes))
+	for i, code := range codes {
+		codeKeys[i] = fmt.Sprintf("code:%s", code)
+	}
+	bodies, err := c.rdb.MGet(ctx, codeKeys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read activation codes: %w", err)
+	}
+
+	result := make([]ActivationCode, 0, len(codes))
+	for _, body := range bodies {
+		codeJSON, ok := body.(string)
+		if !ok {
 			continue
 		}
-
-		if ac.StripeSessionID == sessionID {
+		var ac ActivationCode
+		if json.Unmarshal([]byte(codeJSON), &ac) == nil {
 			result = append(result, ac)
 		}
 	}
-
 	return result, nil
 }
 
+// scanSessionCodes walks every code looking for the session's, one SCAN batch at a time
+func (c *Client) scanSessionCodes(ctx context.Context, sessionID string) ([]ActivationCode, error) {
+	var result []ActivationCode
+	var cursor uint64
+
+	for {
+		keys, next, err := c.rdb.Scan(ctx, cursor, "code:*", scanBatchSize).Result()
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan activation codes: %w", err)
+		}
+
+		if len(keys) > 0 {
+			codes := make([]string, len(keys))
+			for i, key := range keys {
+				codes[i] = strings.TrimPrefix(key, "code:")
+			}
+			batch, err := c.getActivationCodes(ctx, codes)
+			if err != nil {
+				return nil, err
+			}
+			for _, ac := range batch {
+				// SCAN may return a key more than once
+				if ac.StripeSessionID == sessionID && !slices.ContainsFunc(result, func(seen ActivationCode) bool { return seen.Code == ac.Code }) {
+					result = append(result, ac)
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return result, nil
+		}
+	}
+}
+
 // ============================================
 // ANONYMOUS CODE POOL
 // Maps session_id -> codes for activation page lookup
@@ -308,8 +589,14 @@ func (c *Client) GetActivationCodesBySession(ctx context.Context, sessionID stri
 
 func (c *Client) AddToCodePool(ctx context.Context, code, sessionID string) error {
 	poolKey := fmt.Sprintf("pool:%s", sessionID)
-	c.rdb.SAdd(ctx, poolKey, code)
-	c.rdb.Expire(ctx, poolKey, 24*time.Hour)
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, poolKey, code)
+		pipe.Expire(ctx, poolKey, c.codeTTL)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to add code to pool: %w", err)
+	}
 	return nil
 }
 
@@ -320,6 +607,248 @@ func (c *Client) GetCodesFromPool(ctx context.Context, sessionID string) ([]stri
 
 func (c *Client) RemoveFromCodePool(ctx context.Context, code string) error {
 	// We don't know which session this code belongs to (by design)
-	// The pool entry will expire naturally after 24h
+	// The pool entry expires naturally along with its codes
+	return nil
+}
+
+// ============================================
+// DUO LINKAGE
+// Links the two devices of a duo purchase without keeping code -> device
+// The first claim parks its device under the owner code until the other half
+// is claimed, then the entry is deleted - it never outlives the pending codes
+// ============================================
+
+// linkDuoClaim records a duo code claim and returns the partner device if the
+// other half was already claimed
+func (c *Client) linkDuoClaim(ctx context.Context, ac *ActivationCode, deviceUUID string) (string, error) {
+	ownerCode := ac.Code
+	role, partnerRole := "owner", "guest"
+	if ac.Type == "duo_guest" {
+		ownerCode = ac.DuoOwnerCode
+		role, partnerRole = "guest", "owner"
+	}
+	if ownerCode == "" {
+		return "", nil
+	}
+
+	// Atomic so two halves claimed at once still find each other
+	script := `
+		local partner = redis.call('HGET', KEYS[1], ARGV[2])
+		if partner then
+			redis.call('DEL', KEYS[1])
+			return partner
+		end
+		redis.call('HSET', KEYS[1], ARGV[1], ARGV[3])
+		redis.call('EXPIRE', KEYS[1], ARGV[4])
+		return false
+	`
+
+	key := fmt.Sprintf("duo_link:%s", ownerCode)
+	partner, err := c.rdb.Eval(ctx, script, []string{key}, role, partnerRole, deviceUUID, int(c.codeTTL.Seconds())).Text()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to link duo claim: %w", err)
+	}
+	return partner, nil
+}
+
+// setDuoPartner links the first-claimed half of a duo to the device that just claimed the other
+// A partner whose subscription has since gone is left alone
+func (c *Client) setDuoPartner(ctx context.Context, deviceUUID, partnerUUID string) error {
+	sub, err := c.GetSubscription(ctx, deviceUUID)
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if sub.IsDuoGuest {
+		sub.DuoOwnerUUID = partnerUUID
+	} else {
+		sub.DuoGuestUUID = partnerUUID
+	}
+	return c.SetSubscription(ctx, sub)
+}
+
+// ============================================
+// TEAM ROSTER
+// Counts how many of a team purchase's devices were provisioned
+// Only the count is kept - never which devices, or which code went to which
+// ============================================
+
+// TeamRoster is how far a team purchase has been provisioned
+type TeamRoster struct {
+	Purchased int `json:"purchased" redis:"purchased"`
+	Active    int `json:"active" redis:"active"` // codes claimed, each by exactly one device
+}
+
+func teamRosterKey(sessionID string) string {
+	return fmt.Sprintf("team_roster:%s", sessionID)
+}
+
+// addToTeamRoster counts a claimed team code against its purchase
+// The roster lives until the last subscription claimed from it stops working
+func (c *Client) addToTeamRoster(ctx context.Context, ac *ActivationCode, until time.Time) error {
+	script := `
+		redis.call('HSET', KEYS[1], 'purchased', ARGV[1])
+		local active = redis.call('HINCRBY', KEYS[1], 'active', 1)
+		if redis.call('PTTL', KEYS[1]) < tonumber(ARGV[2]) then
+			redis.call('PEXPIRE', KEYS[1], ARGV[2])
+		end
+		return active
+	`
+
+	ttl := time.Until(until)
+	if ttl <= 0 {
+		ttl = time.Hour
+	}
+	err := c.rdb.Eval(ctx, script, []string{teamRosterKey(ac.StripeSessionID)}, ac.TeamTotal, ttl.Milliseconds()).Err()
+	if err != nil {
+		return fmt.Errorf("failed to update team roster: %w", err)
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// GetTeamRoster returns how many of a team purchase's devices were provisioned
+// Returns nil if no code from the purchase has been claimed
+func (c *Client) GetTeamRoster(ctx context.Context, sessionID string) (*TeamRoster, error) {
+	var roster TeamRoster
+	cmd := c.rdb.HGetAll(ctx, teamRosterKey(sessionID))
+	if err := cmd.Err(); err != nil {
+		return nil, fmt.Errorf("failed to get team roster: %w", err)
+	}
+	if len(cmd.Val()) == 0 {
+		return nil, nil
+	}
+	if err := cmd.Scan(&roster); err != nil {
+		return nil, fmt.Errorf("failed to parse team roster: %w", err)
+	}
+	return &roster, nil
+}
+
+// ============================================
+// REFUNDS AND DISPUTES
+// Refunded or disputed payments lose their unclaimed codes
+// ============================================
+
+// LinkPaymentToSession remembers which checkout session a payment intent paid for
+// Refund and dispute events only carry the payment intent
+// Kept as long as the session's codes can still be claimed
+func (c *Client) LinkPaymentToSession(ctx context.Context, paymentIntentID, sessionID string) error {
+	key := fmt.Sprintf("payment_session:%s", paymentIntentID)
+	if err := c.rdb.Set(ctx, key, sessionID, c.codeTTL).Err(); err != nil {
+		return fmt.Errorf("failed to link payment to session: %w", err)
+	}
+	return nil
+}
+
+// GetSessionForPayment returns the checkout session a payment intent paid for
+// Returns an empty string for a payment never seen or whose link has expired
+func (c *Client) GetSessionForPayment(ctx context.Context, paymentIntentID string) (string, error) {
+	key := fmt.Sprintf("payment_session:%s", paymentIntentID)
+	sessionID, err := c.rdb.Get(ctx, key).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get session for payment: %w", err)
+	}
+	return sessionID, nil
+}
+
+// RevokedSessionTTL outlasts the longest plan, so a refunded purchase can't be
+// restored for as long as it would otherwise have been running
+const RevokedSessionTTL = 366 * 24 * time.Hour
+
+// MarkSessionRevoked records that a checkout session's payment was refunded or disputed
+// Stripe keeps such a session's payment_status at "paid", so restores check this instead
+func (c *Client) MarkSessionRevoked(ctx context.Context, sessionID string) error {
+	key := fmt.Sprintf("revoked_session:%s", sessionID)
+	if err := c.rdb.Set(ctx, key, "1", RevokedSessionTTL).Err(); err != nil {
+		return fmt.Errorf("failed to mark session revoked: %w", err)
+	}
+	return nil
+}
+
+// IsSessionRevoked reports whether a checkout session's payment was refunded or disputed
+func (c *Client) IsSessionRevoked(ctx context.Context, sessionID string) (bool, error) {
+	key := fmt.Sprintf("revoked_session:%s", sessionID)
+	n, err := c.rdb.Exists(ctx, key).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check revoked session: %w", err)
+	}
+	return n > 0, nil
+}
+
+// RevokeSessionCodes marks a session's still-pending codes as revoked so they can't be claimed
+// LIMITATION: codes already claimed can't be traced to a device - that link is never
+// stored - so a refund after claiming leaves that subscription running to its expiry
+// Returns how many codes were revoked
+func (c *Client) RevokeSessionCodes(ctx context.Context, sessionID string) (int, error) {
+	codes, err := c.GetActivationCodesBySession(ctx, sessionID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get session codes: %w", err)
+	}
+
+	// Atomic against a concurrent claim: only a code still pending is revoked
+	script := `
+		local codeJSON = redis.call('GET', KEYS[1])
+		if not codeJSON then
+			return 0
+		end
+		local ac = cjson.decode(codeJSON)
+		if ac.status ~= 'pending' then
+			return 0
+		end
+		ac.status = 'revoked'
+		local ttl = redis.call('PTTL', KEYS[1])
+		if ttl > 0 then
+			redis.call('SET', KEYS[1], cjson.encode(ac), 'PX', ttl)
+		else
+			redis.call('SET', KEYS[1], cjson.encode(ac))
+		end
+		return 1
+	`
+
+	revoked := 0
+	for _, ac := range codes {
+		if ac.Status != "pending" {
+			continue
+		}
+		n, err := c.rdb.Eval(ctx, script, []string{fmt.Sprintf("code:%s", ac.Code)}).Int()
+		if err != nil {
+			return revoked, fmt.Errorf("failed to revoke code: %w", err)
+		}
+		revoked += n
+	}
+	return revoked, nil
+}
+
+// ============================================
+// STRIPE WEBHOOK IDEMPOTENCY
+// Stripe retries deliveries, so each event ID is processed once
+// ============================================
+
+// StripeEventTTL outlasts Stripe's retry window for a single event
+const StripeEventTTL = 3 * 24 * time.Hour
+
+// MarkStripeEventProcessed claims an event ID for processing
+// Returns false if the event was already claimed by an earlier delivery
+func (c *Client) MarkStripeEventProcessed(ctx context.Context, eventID string) (bool, error) {
+	key := fmt.Sprintf("stripe_event:%s", eventID)
+	first, err := c.rdb.SetNX(ctx, key, time.Now().Unix(), StripeEventTTL).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to record stripe event: %w", err)
+	}
+	return first, nil
+}
+
+// ReleaseStripeEvent gives back the claim on an event that failed, so a retry processes it
+func (c *Client) ReleaseStripeEvent(ctx context.Context, eventID string) error {
+	if err := c.rdb.Del(ctx, fmt.Sprintf("stripe_event:%s", eventID)).Err(); err != nil {
+		return fmt.Errorf("failed to release stripe event: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,465 @@
+package redis
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSubscriptionState_GracePeriod(t *testing.T) {
+	client := setupTestClient(t)
+	client.SetSubscriptionGrace(48 * time.Hour)
+	ctx := context.Background()
+
+	deviceUUID := "test-grace-" + time.Now().Format("150405.000000")
+	defer client.rdb.Del(ctx, "sub:"+deviceUUID)
+
+	now := time.Now()
+	cases := []struct {
+		name      string
+		expiresAt time.Time
+		state     string
+		active    bool
+	}{
+		{"active", now.Add(time.Hour), SubscriptionActive, true},
+		{"grace", now.Add(-time.Hour), SubscriptionGrace, true},
+		{"expired", now.Add(-49 * time.Hour), SubscriptionExpired, false},
+	}
+
+	for _, tc := range cases {
+		sub := &Subscription{DeviceUUID: deviceUUID, Plan: "1_week_solo", Status: "active", ExpiresAt: tc.expiresAt}
+		if err := client.SetSubscription(ctx, sub); err != nil {
+			t.Fatalf("%s: failed to set subscription: %v", tc.name, err)
+		}
+
+		if state := client.SubscriptionState(sub, now); state != tc.state {
+			t.Errorf("%s: expected state %s, got %s", tc.name, tc.state, state)
+		}
+		if active, _ := client.IsSubscriptionActive(ctx, deviceUUID); active != tc.active {
+			t.Errorf("%s: expected IsSubscriptionActive %v, got %v", tc.name, tc.active, active)
+		}
+	}
+
+	// An expired subscription is kept around for its grace period
+	sub := &Subscription{DeviceUUID: deviceUUID, Status: "active", ExpiresAt: now.Add(-time.Hour)}
+	client.SetSubscription(ctx, sub)
+	if ttl := client.rdb.TTL(ctx, "sub:"+deviceUUID).Val(); ttl < 46*time.Hour {
+		t.Errorf("Expected subscription kept through grace, TTL %v", ttl)
+	}
+
+	t.Logf("✓ Subscription moves active → grace → expired")
+}
+
+func TestClaimActivationCode_LinksDuo(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	claimPair := func(t *testing.T, suffix string, ownerFirst bool) {
+		ownerCode := "DUO-OWNER-" + suffix
+		guestCode := "DUO-GUEST-" + suffix
+		ownerDevice := "test-duo-owner-" + suffix
+		guestDevice := "test-duo-guest-" + suffix
+		t.Cleanup(func() {
+			client.rdb.Del(ctx, "code:"+ownerCode, "code:"+guestCode, "duo_link:"+ownerCode,
+				"sub:"+ownerDevice, "sub:"+guestDevice, "pubkey:"+ownerDevice, "pubkey:"+guestDevice)
+		})
+
+		client.CreateActivationCode(ctx, &ActivationCode{Code: ownerCode, Plan: "1_week_duo", Type: "duo_owner", Status: "pending"})
+		client.CreateActivationCode(ctx, &ActivationCode{Code: guestCode, Plan: "1_week_duo", Type: "duo_guest", Status: "pending", DuoOwnerCode: ownerCode})
+
+		claims := []struct{ code, device string }{{ownerCode, ownerDevice}, {guestCode, guestDevice}}
+		if !ownerFirst {
+			claims[0], claims[1] = claims[1], claims[0]
+		}
+		for _, cl := range claims {
+			if _, _, err := client.ClaimActivationCode(ctx, cl.code, cl.device, "test-public-key"); err != nil {
+				t.Fatalf("Failed to claim %s: %v", cl.code, err)
+			}
+		}
+
+		owner, err := client.GetSubscription(ctx, ownerDevice)
+		if err != nil {
+			t.Fatalf("Owner subscription missing: %v", err)
+		}
+		guest, err := client.GetSubscription(ctx, guestDevice)
+		if err != nil {
+			t.Fatalf("Guest subscription missing: %v", err)
+		}
+		if owner.DuoPartner() != guestDevice {
+			t.Errorf("Expected owner linked to %s, got %q", guestDevice, owner.DuoPartner())
+		}
+		if guest.DuoOwnerUUID != ownerDevice || guest.DuoPartner() != ownerDevice {
+			t.Errorf("Expected guest linked to %s, got %q", ownerDevice, guest.DuoOwnerUUID)
+		}
+
+		// The transient link is gone once both halves are claimed
+		if n := client.rdb.Exists(ctx, "duo_link:"+ownerCode).Val(); n != 0 {
+			t.Error("Expected duo link entry deleted after both claims")
+		}
+	}
+
+	suffix := time.Now().Format("150405.000000")
+
+	t.Run("owner_first", func(t *testing.T) {
+		claimPair(t, "a-"+suffix, true)
+	})
+
+	t.Run("guest_first", func(t *testing.T) {
+		claimPair(t, "b-"+suffix, false)
+	})
+
+	t.Logf("✓ Duo owner and guest linked in either claim order")
+}
+
+func TestClaimActivationCode_DuoLinkFailure(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	ownerCode := "DUO-OWNER-f-" + suffix
+	guestCode := "DUO-GUEST-f-" + suffix
+	ownerDevice := "test-duo-owner-f-" + suffix
+	guestDevice := "test-duo-guest-f-" + suffix
+	t.Cleanup(func() {
+		client.rdb.Del(ctx, "code:"+ownerCode, "code:"+guestCode, "duo_link:"+ownerCode,
+			"sub:"+ownerDevice, "sub:"+guestDevice, "pubkey:"+ownerDevice, "pubkey:"+guestDevice)
+	})
+
+	client.CreateActivationCode(ctx, &ActivationCode{Code: ownerCode, Plan: "1_week_duo", Type: "duo_owner", Status: "pending"})
+	client.CreateActivationCode(ctx, &ActivationCode{Code: guestCode, Plan: "1_week_duo", Type: "duo_guest", Status: "pending", DuoOwnerCode: ownerCode})
+
+	if _, _, err := client.ClaimActivationCode(ctx, ownerCode, ownerDevice, "test-public-key"); err != nil {
+		t.Fatalf("Failed to claim owner code: %v", err)
+	}
+
+	// An unreadable owner subscription can't be pointed at the guest
+	ownerJSON := client.rdb.Get(ctx, "sub:"+ownerDevice).Val()
+	client.rdb.Set(ctx, "sub:"+ownerDevice, "not json", 0)
+	if _, _, err := client.ClaimActivationCode(ctx, guestCode, guestDevice, "test-public-key"); !errors.Is(err, ErrDuoLink) {
+		t.Fatalf("Expected ErrDuoLink, got %v", err)
+	}
+
+	// Retrying once the owner is readable again finishes the link
+	client.rdb.Set(ctx, "sub:"+ownerDevice, ownerJSON, 0)
+	if _, _, err := client.ClaimActivationCode(ctx, guestCode, guestDevice, "test-public-key"); err != nil {
+		t.Fatalf("Retry failed: %v", err)
+	}
+	owner, err := client.GetSubscription(ctx, ownerDevice)
+	if err != nil {
+		t.Fatalf("Owner subscription missing: %v", err)
+	}
+	if owner.DuoPartner() != guestDevice {
+		t.Errorf("Expected owner linked to %s, got %q", guestDevice, owner.DuoPartner())
+	}
+
+	t.Logf("✓ Partial duo link reported and finished on retry")
+}
+
+func TestGetActivationCodesPage_TeamSession(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "test-team-session-" + suffix
+	defer client.rdb.Del(ctx, "pool:"+sessionID)
+
+	const teamSize = 50
+	for i := 1; i <= teamSize; i++ {
+		code := fmt.Sprintf("TEAM-%s-%02d", suffix, i)
+		ac := &ActivationCode{
+			Code:            code,
+			StripeSessionID: sessionID,
+			Plan:            "team",
+			Type:            "team",
+			Status:          "pending",
+			TeamIndex:       i,
+			TeamTotal:       teamSize,
+			Duration:        "1_week",
+		}
+		if err := client.CreateActivationCode(ctx, ac); err != nil {
+			t.Fatalf("Failed to create code: %v", err)
+		}
+		client.AddToCodePool(ctx, code, sessionID)
+		defer client.rdb.Del(ctx, "code:"+code)
+	}
+
+	seen := 0
+	for offset := 0; offset < teamSize; offset += 20 {
+		page, total, err := client.GetActivationCodesPage(ctx, sessionID, offset, 20)
+		if err != nil {
+			t.Fatalf("Failed to get page at %d: %v", offset, err)
+		}
+		if total != teamSize {
+			t.Fatalf("Expected total %d, got %d", teamSize, total)
+		}
+		if want := min(20, teamSize-offset); len(page) != want {
+			t.Fatalf("Expected %d codes at offset %d, got %d", want, offset, len(page))
+		}
+		for i, ac := range page {
+			if ac.TeamIndex != offset+i+1 {
+				t.Errorf("Expected team index %d at position %d, got %d", offset+i+1, offset+i, ac.TeamIndex)
+			}
+		}
+		seen += len(page)
+	}
+	if seen != teamSize {
+		t.Errorf("Expected %d codes across pages, got %d", teamSize, seen)
+	}
+
+	page, total, err := client.GetActivationCodesPage(ctx, sessionID, teamSize, 20)
+	if err != nil || total != teamSize || len(page) != 0 {
+		t.Errorf("Expected an empty page past the end, got %d codes, total %d, err %v", len(page), total, err)
+	}
+
+	t.Logf("✓ 50-code team session pages in team order")
+}
+
+func TestGetActivationCodesBySession_ScanFallback(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "test-legacy-session-" + suffix
+
+	// Codes from before the pool existed have no pool entry
+	for i := 1; i <= 3; i++ {
+		code := fmt.Sprintf("LEGACY-%s-%d", suffix, i)
+		ac := &ActivationCode{Code: code, StripeSessionID: sessionID, Plan: "1_week_solo", Type: "solo", Status: "pending"}
+		if err := client.CreateActivationCode(ctx, ac); err != nil {
+			t.Fatalf("Failed to create code: %v", err)
+		}
+		defer client.rdb.Del(ctx, "code:"+code)
+	}
+
+	codes, err := client.GetActivationCodesBySession(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("Failed to get codes: %v", err)
+	}
+	if len(codes) != 3 {
+		t.Fatalf("Expected 3 codes found by scanning, got %d", len(codes))
+	}
+
+	t.Logf("✓ Codes without a pool entry are found by SCAN")
+}
+
+func TestClaimActivationCode_TeamRoster(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "test-roster-session-" + suffix
+	defer client.rdb.Del(ctx, teamRosterKey(sessionID), "pool:"+sessionID)
+
+	var codes []string
+	for i := 1; i <= 3; i++ {
+		code := fmt.Sprintf("ROSTER-%s-%d", suffix, i)
+		ac := &ActivationCode{
+			Code:            code,
+			StripeSessionID: sessionID,
+			Plan:            "team",
+			Type:            "team",
+			Status:          "pending",
+			TeamIndex:       i,
+			TeamTotal:       3,
+			Duration:        "1_week",
+		}
+		if err := client.CreateActivationCode(ctx, ac); err != nil {
+			t.Fatalf("Failed to create code: %v", err)
+		}
+		codes = append(codes, code)
+		defer client.rdb.Del(ctx, "code:"+code)
+	}
+
+	if roster, err := client.GetTeamRoster(ctx, sessionID); err != nil || roster != nil {
+		t.Fatalf("Expected no roster before any claim, got %+v, %v", roster, err)
+	}
+
+	// Two devices racing for the same code: exactly one gets it
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		deviceUUID := fmt.Sprintf("test-roster-race-%s-%d", suffix, i)
+		defer client.rdb.Del(ctx, "sub:"+deviceUUID, "pubkey:"+deviceUUID)
+		go func() {
+			_, _, err := client.ClaimActivationCode(ctx, codes[0], deviceUUID, "test-public-key")
+			results <- err
+		}()
+	}
+	var claimed, refused int
+	for i := 0; i < 2; i++ {
+		switch err := <-results; {
+		case err == nil:
+			claimed++
+		case errors.Is(err, ErrCodeUsed):
+			refused++
+		default:
+			t.Fatalf("Unexpected claim error: %v", err)
+		}
+	}
+	if claimed != 1 || refused != 1 {
+		t.Fatalf("Expected one claim and one refusal, got %d and %d", claimed, refused)
+	}
+
+	deviceUUID := "test-roster-device-" + suffix
+	defer client.rdb.Del(ctx, "sub:"+deviceUUID, "pubkey:"+deviceUUID)
+	if _, _, err := client.ClaimActivationCode(ctx, codes[1], deviceUUID, "test-public-key"); err != nil {
+		t.Fatalf("Failed to claim second team code: %v", err)
+	}
+
+	roster, err := client.GetTeamRoster(ctx, sessionID)
+	if err != nil || roster == nil {
+		t.Fatalf("Failed to get roster: %v", err)
+	}
+	if roster.Purchased != 3 || roster.Active != 2 {
+		t.Errorf("Expected 2 of 3 devices active, got %+v", roster)
+	}
+
+	// The roster holds counts only
+	fields, _ := client.rdb.HKeys(ctx, teamRosterKey(sessionID)).Result()
+	for _, field := range fields {
+		if field != "purchased" && field != "active" {
+			t.Errorf("Unexpected roster field %q", field)
+		}
+	}
+
+	t.Logf("✓ Team codes claimed once each and counted on the roster")
+}
+
+func TestClaimActivationCode_RaceCondition(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	code := "RACE-" + suffix
+	client.CreateActivationCode(ctx, &ActivationCode{Code: code, Plan: "1_week_solo", Type: "solo", Status: "pending"})
+	defer client.rdb.Del(ctx, "code:"+code)
+
+	// Simulate race condition - 10 concurrent claims of the same code
+	results := make(chan error, 10)
+
+	for i := 0; i < 10; i++ {
+		device := fmt.Sprintf("test-claim-race-%d-%s", i, suffix)
+		defer client.rdb.Del(ctx, "sub:"+device, "pubkey:"+device)
+		go func() {
+			_, _, err := client.ClaimActivationCode(ctx, code, device, "test-public-key")
+			results <- err
+		}()
+	}
+
+	successCount := 0
+	for i := 0; i < 10; i++ {
+		err := <-results
+		if err == nil {
+			successCount++
+		} else if !errors.Is(err, ErrCodeUsed) {
+			t.Errorf("Expected %v for a losing claim, got %v", ErrCodeUsed, err)
+		}
+	}
+
+	// Only 1 should succeed
+	if successCount != 1 {
+		t.Errorf("Expected exactly 1 successful claim, got %d", successCount)
+	}
+
+	t.Logf("✓ Race condition test passed: %d/10 succeeded (expected 1)", successCount)
+}
+
+func TestClaimActivationCode_RetryIsIdempotent(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	code := "RETRY-" + suffix
+	device := "test-claim-retry-" + suffix
+	other := "test-claim-other-" + suffix
+	client.CreateActivationCode(ctx, &ActivationCode{Code: code, StripeSessionID: "cs_retry", Plan: "1_week_solo", Type: "solo", Status: "pending"})
+	defer client.rdb.Del(ctx, "code:"+code, "sub:"+device, "pubkey:"+device)
+
+	first, sessionID, err := client.ClaimActivationCode(ctx, code, device, "test-public-key")
+	if err != nil {
+		t.Fatalf("Failed to claim: %v", err)
+	}
+
+	// The device retries, e.g. after the response was lost
+	retried, retriedSession, err := client.ClaimActivationCode(ctx, code, device, "test-public-key")
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	if !retried.ExpiresAt.Equal(first.ExpiresAt) {
+		t.Errorf("Expected the retry not to extend the subscription, %v became %v", first.ExpiresAt, retried.ExpiresAt)
+	}
+	if retriedSession != sessionID {
+		t.Errorf("Expected session %s on retry, got %s", sessionID, retriedSession)
+	}
+
+	// Another device still can't claim it
+	if _, _, err := client.ClaimActivationCode(ctx, code, other, "test-public-key"); !errors.Is(err, ErrCodeUsed) {
+		t.Errorf("Expected %v for another device, got %v", ErrCodeUsed, err)
+	}
+
+	// The stored code never names the device
+	raw := client.rdb.Get(ctx, "code:"+code).Val()
+	if strings.Contains(raw, device) {
+		t.Error("Expected the used code not to store the claiming device")
+	}
+	unkeyed := sha256.Sum256([]byte(code + ":" + device))
+	if strings.Contains(raw, hex.EncodeToString(unkeyed[:])) {
+		t.Error("Expected the claim hash to be keyed, not checkable against a known device")
+	}
+
+	t.Logf("✓ Retried claim returns the same subscription without extending it")
+}
+
+func TestRetentionSettings_AppliedAsTTLs(t *testing.T) {
+	client := setupTestClient(t)
+	ctx := context.Background()
+	client.SetCodeRetention(72*time.Hour, 10*time.Minute)
+	client.SetInvitationTTL(7 * time.Minute)
+
+	suffix := time.Now().Format("150405.000000")
+	code := "RETAIN-" + suffix
+	device := "test-retention-" + suffix
+	client.CreateActivationCode(ctx, &ActivationCode{Code: code, StripeSessionID: "cs_retain", Plan: "1_week_solo", Type: "solo", Status: "pending"})
+	defer client.rdb.Del(ctx, "code:"+code, "sub:"+device, "pubkey:"+device)
+
+	if ttl := client.rdb.TTL(ctx, "code:"+code).Val(); ttl <= 71*time.Hour || ttl > 72*time.Hour {
+		t.Errorf("Expected the unclaimed code kept for 72h, got %v", ttl)
+	}
+
+	// The session's pool and payment link live as long as its codes
+	session := "cs_retain_" + suffix
+	payment := "pi_retain_" + suffix
+	client.AddToCodePool(ctx, code, session)
+	client.LinkPaymentToSession(ctx, payment, session)
+	defer client.rdb.Del(ctx, "pool:"+session, "payment_session:"+payment)
+	for _, key := range []string{"pool:" + session, "payment_session:" + payment} {
+		if ttl := client.rdb.TTL(ctx, key).Val(); ttl <= 71*time.Hour || ttl > 72*time.Hour {
+			t.Errorf("Expected %s kept for 72h, got %v", key, ttl)
+		}
+	}
+	if _, _, err := client.ClaimActivationCode(ctx, code, device, "test-public-key"); err != nil {
+		t.Fatalf("Failed to claim: %v", err)
+	}
+	if ttl := client.rdb.TTL(ctx, "code:"+code).Val(); ttl <= 9*time.Minute || ttl > 10*time.Minute {
+		t.Errorf("Expected the claimed code kept for 10m, got %v", ttl)
+	}
+
+	// A 5 minute chat would get 10 minutes to join, capped at the configured 7
+	chatUUID := "test-chat-retain-" + suffix
+	token := "test-token-retain-" + suffix
+	if err := client.CreateChat(ctx, chatUUID, "participant-a", "secret-a", device, token, 300, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer client.DeleteChat(ctx, chatUUID)
+	for _, key := range []string{"invite:" + token, "chat:" + chatUUID, "user_chats:" + device} {
+		if ttl := client.rdb.TTL(ctx, key).Val(); ttl <= 6*time.Minute || ttl > 7*time.Minute {
+			t.Errorf("Expected %s to live 7m, got %v", key, ttl)
+		}
+	}
+
+	t.Logf("✓ Configured code and invitation lifetimes are applied as Redis TTLs")
+}
@@ -0,0 +1,111 @@
+// Package signal verifies Signal Protocol key material uploaded by clients
+package signal
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"math/big"
+)
+
+// djbType prefixes serialized Curve25519 public keys in the Signal Protocol
+const djbType = 0x05
+
+var (
+	ErrInvalidKey       = errors.New("invalid public key")
+	ErrInvalidSignature = errors.New("invalid signature")
+)
+
+// p is the field prime 2^255 - 19
+var p = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 255), big.NewInt(19))
+
+// VerifySignedPreKey checks that signature is the identity key's XEd25519 signature
+// over the signed prekey, exactly as the client serialized it
+// All arguments are base64 as sent by clients
+func VerifySignedPreKey(identityKey, signedPreKey, signature string) error {
+	identity, err := decodePublicKey(identityKey)
+	if err != nil {
+		return err
+	}
+	message, err := base64.StdEncoding.DecodeString(signedPreKey)
+	if err != nil {
+		return ErrInvalidKey
+	}
+	if _, err := decodePublicKey(signedPreKey); err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return ErrInvalidSignature
+	}
+	if !verifyXEd25519(identity, message, sig) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+// decodePublicKey returns the 32-byte Montgomery u-coordinate of a serialized key
+// Accepts both the 33-byte type-prefixed form and the bare 32-byte form
+func decodePublicKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, ErrInvalidKey
+	}
+	switch {
+	case len(key) == 33 && key[0] == djbType:
+		return key[1:], nil
+	case len(key) == 32:
+		return key, nil
+	}
+	return nil, ErrInvalidKey
+}
+
+// verifyXEd25519 verifies an XEd25519 signature made with a Curve25519 key
+// The Edwards sign bit travels in the top bit of the signature, as libsignal does it
+func verifyXEd25519(montgomery, message, signature []byte) bool {
+	edPublic, ok := montgomeryToEdwards(montgomery, signature[63]&0x80)
+	if !ok {
+		return false
+	}
+
+	sig := make([]byte, len(signature))
+	copy(sig, signature)
+	sig[63] &= 0x7F
+
+	return ed25519.Verify(edPublic, message, sig)
+}
+
+// montgomeryToEdwards maps u to the Edwards point with y = (u - 1) / (u + 1)
+func montgomeryToEdwards(montgomery []byte, signBit byte) (ed25519.PublicKey, bool) {
+	u := new(big.Int).SetBytes(reverse(montgomery))
+	if u.Cmp(p) >= 0 {
+		return nil, false
+	}
+
+	denominator := new(big.Int).Add(u, big.NewInt(1))
+	denominator.Mod(denominator, p)
+	if denominator.Sign() == 0 {
+		return nil, false
+	}
+
+	y := new(big.Int).Sub(u, big.NewInt(1))
+	y.Mul(y, new(big.Int).ModInverse(denominator, p))
+	y.Mod(y, p)
+
+	// Little-endian y with the x sign bit in the top bit
+	encoded := make([]byte, 32)
+	yBytes := y.Bytes()
+	copy(encoded[32-len(yBytes):], yBytes)
+	encoded = reverse(encoded)
+	encoded[31] |= signBit
+
+	return ed25519.PublicKey(encoded), true
+}
+
+func reverse(b []byte) []byte {
+	out := make([]byte, len(b))
+	for i := range b {
+		out[len(b)-1-i] = b[i]
+	}
+	return out
+}
@@ -0,0 +1,95 @@
+package signal
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"math/big"
+	"testing"
+)
+
+// testIdentity returns an Ed25519 key and its Curve25519 form as a client would serialize it
+func testIdentity(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey, []byte) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+
+	// u = (1 + y) / (1 - y)
+	yBytes := make([]byte, 32)
+	copy(yBytes, pub)
+	yBytes[31] &= 0x7F
+	y := new(big.Int).SetBytes(reverse(yBytes))
+
+	numerator := new(big.Int).Add(big.NewInt(1), y)
+	denominator := new(big.Int).Sub(big.NewInt(1), y)
+	denominator.Mod(denominator, p)
+	u := numerator.Mul(numerator, new(big.Int).ModInverse(denominator, p))
+	u.Mod(u, p)
+
+	uBytes := make([]byte, 32)
+	b := u.Bytes()
+	copy(uBytes[32-len(b):], b)
+
+	return pub, priv, append([]byte{djbType}, reverse(uBytes)...)
+}
+
+// signXEd25519 signs like libsignal, carrying the Edwards sign bit in the signature
+func signXEd25519(pub ed25519.PublicKey, priv ed25519.PrivateKey, message []byte) []byte {
+	sig := ed25519.Sign(priv, message)
+	sig[63] |= pub[31] & 0x80
+	return sig
+}
+
+func TestVerifySignedPreKey(t *testing.T) {
+	pub, priv, identity := testIdentity(t)
+
+	signedPreKey := make([]byte, 33)
+	signedPreKey[0] = djbType
+	rand.Read(signedPreKey[1:])
+	signature := signXEd25519(pub, priv, signedPreKey)
+
+	enc := base64.StdEncoding.EncodeToString
+	if err := VerifySignedPreKey(enc(identity), enc(signedPreKey), enc(signature)); err != nil {
+		t.Fatalf("Expected good bundle to verify, got %v", err)
+	}
+
+	// Bare 32-byte identity key works too
+	if err := VerifySignedPreKey(enc(identity[1:]), enc(signedPreKey), enc(signature)); err != nil {
+		t.Errorf("Expected bare identity key to verify, got %v", err)
+	}
+
+	t.Logf("✓ Known-good bundle verified")
+}
+
+func TestVerifySignedPreKey_Rejects(t *testing.T) {
+	pub, priv, identity := testIdentity(t)
+	_, _, otherIdentity := testIdentity(t)
+
+	signedPreKey := make([]byte, 33)
+	signedPreKey[0] = djbType
+	rand.Read(signedPreKey[1:])
+	signature := signXEd25519(pub, priv, signedPreKey)
+
+	tamperedKey := append([]byte{}, signedPreKey...)
+	tamperedKey[5] ^= 0x01
+	tamperedSig := append([]byte{}, signature...)
+	tamperedSig[10] ^= 0x01
+
+	enc := base64.StdEncoding.EncodeToString
+	cases := map[string][3]string{
+		"wrong identity":   {enc(otherIdentity), enc(signedPreKey), enc(signature)},
+		"tampered prekey":  {enc(identity), enc(tamperedKey), enc(signature)},
+		"tampered sig":     {enc(identity), enc(signedPreKey), enc(tamperedSig)},
+		"short signature":  {enc(identity), enc(signedPreKey), enc(signature[:32])},
+		"bad identity len": {enc(identity[:20]), enc(signedPreKey), enc(signature)},
+		"not base64":       {enc(identity), enc(signedPreKey), "!!!"},
+	}
+	for name, c := range cases {
+		if err := VerifySignedPreKey(c[0], c[1], c[2]); err == nil {
+			t.Errorf("%s: expected verification to fail", name)
+		}
+	}
+
+	t.Logf("✓ Known-bad bundles rejected")
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Memory is a Backend for tests and local development
+// Its URLs are not served by anything; they only name the object and expiry
+type Memory struct{}
+
+func NewMemory() *Memory {
+	return &Memory{}
+}
+
+func (m *Memory) UploadURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return fmt.Sprintf("memory://upload/%s?expires=%d", key, time.Now().Add(ttl).Unix()), nil
+}
+
+func (m *Memory) DownloadURL(ctx context.Context, key string, ttl time.Duration) (string, error) {
+	return fmt.Sprintf("memory://download/%s?expires=%d", key, time.Now().Add(ttl).Unix()), nil
+}
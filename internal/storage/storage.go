@@ -0,0 +1,27 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// Backend issues short-lived URLs for attachment blobs in object storage
+// Clients encrypt a blob before uploading it, so the server never handles its contents
+type Backend interface {
+	// UploadURL returns a URL the client can PUT the blob at key to until ttl runs out
+	UploadURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+	// DownloadURL returns a URL the blob at key can be fetched from until ttl runs out
+	DownloadURL(ctx context.Context, key string, ttl time.Duration) (string, error)
+}
+
+var backend Backend
+
+// SetBackend installs the object storage backend - attachments are disabled until it's called
+func SetBackend(b Backend) {
+	backend = b
+}
+
+// GetBackend returns the installed backend, nil when attachments are disabled
+func GetBackend() Backend {
+	return backend
+}
@@ -1,11 +1,19 @@
 package stripe
 
 import (
+	"errors"
 	"fmt"
+	"time"
 
 	"github.com/stripe/stripe-go/v82"
 	"github.com/stripe/stripe-go/v82/checkout/session"
 	"github.com/stripe/stripe-go/v82/price"
+	"github.com/stripe/stripe-go/v82/promotioncode"
+)
+
+var (
+	ErrInvalidPromoCode   = errors.New("invalid or expired promo code")
+	ErrPromoCodesDisabled = errors.New("promo codes are disabled")
 )
 
 var Plans = map[string]string{
@@ -53,12 +61,13 @@ var DurationLabels = map[string]string{
 var globalClient *Client
 
 type Client struct {
-	secretKey string
+	secretKey  string
+	promoCodes bool // customers may apply promotion codes at checkout
 }
 
-func NewClient(secretKey string) *Client {
+func NewClient(secretKey string, promoCodes bool) *Client {
 	stripe.Key = secretKey
-	globalClient = &Client{secretKey: secretKey}
+	globalClient = &Client{secretKey: secretKey, promoCodes: promoCodes}
 	return globalClient
 }
 
@@ -88,7 +97,56 @@ func (c *Client) ValidatePriceIDs(validatePrices bool) error {
 	return nil
 }
 
-func (c *Client) CreateCheckoutSession(plan string, successURL, cancelURL string) (*stripe.CheckoutSession, error) {
+// applyPromoCode adds a customer's promo code to a checkout session
+// With no code, the Stripe checkout page offers its own promo code field when promos are enabled
+func (c *Client) applyPromoCode(params *stripe.CheckoutSessionParams, promoCode string) error {
+	if promoCode == "" {
+		if c.promoCodes {
+			params.AllowPromotionCodes = stripe.Bool(true)
+		}
+		return nil
+	}
+
+	if !c.promoCodes {
+		return ErrPromoCodesDisabled
+	}
+
+	promotionCodeID, err := c.resolvePromoCode(promoCode)
+	if err != nil {
+		return err
+	}
+	params.Discounts = []*stripe.CheckoutSessionDiscountParams{
+		{PromotionCode: stripe.String(promotionCodeID)},
+	}
+	return nil
+}
+
+// resolvePromoCode finds the active Stripe promotion code for a customer-facing code
+func (c *Client) resolvePromoCode(promoCode string) (string, error) {
+	params := &stripe.PromotionCodeListParams{
+		Code:   stripe.String(promoCode),
+		Active: stripe.Bool(true),
+	}
+	params.Limit = stripe.Int64(1)
+
+	iter := promotioncode.List(params)
+	for iter.Next() {
+		pc := iter.PromotionCode()
+		if pc.ExpiresAt != 0 && time.Now().Unix() >= pc.ExpiresAt {
+			return "", ErrInvalidPromoCode
+		}
+		if pc.MaxRedemptions != 0 && pc.TimesRedeemed >= pc.MaxRedemptions {
+			return "", ErrInvalidPromoCode
+		}
+		return pc.ID, nil
+	}
+	if err := iter.Err(); err != nil {
+		return "", fmt.Errorf("failed to look up promo code: %w", err)
+	}
+	return "", ErrInvalidPromoCode
+}
+
+func (c *Client) CreateCheckoutSession(plan, promoCode string, successURL, cancelURL string) (*stripe.CheckoutSession, error) {
 	priceID, ok := Plans[plan]
 	if !ok || priceID == "" {
 		return nil, fmt.Errorf("invalid plan: %s", plan)
@@ -113,27 +171,23 @@ func (c *Client) CreateCheckoutSession(plan string, successURL, cancelURL string
 		params.Metadata["type"] = "duo"
 	}
 
-	return session.New(params)
-}
-
-func (c *Client) CreateTeamCheckoutSession(duration string, deviceCount int, successURL, cancelURL string) (*stripe.CheckoutSession, error) {
-	basePrice, ok := SoloBasePrices[duration]
-	if !ok {
-		return nil, fmt.Errorf("invalid duration: %s", duration)
+	if err := c.applyPromoCode(params, promoCode); err != nil {
+		return nil, err
 	}
 
-	if deviceCount < 3 || deviceCount > 50 {
-		return nil, fmt.Errorf("device count must be between 3 and 50")
-	}
+	return session.New(params)
+}
 
+func (c *Client) CreateTeamCheckoutSession(duration string, deviceCount int, promoCode string, successURL, cancelURL string) (*stripe.CheckoutSession, error) {
 	durationLabel, ok := DurationLabels[duration]
 	if !ok {
 		return nil, fmt.Errorf("invalid duration: %s", duration)
 	}
 
-	discountPercent := deviceCount + 18
-	pricePerDevice := basePrice * int64(100-discountPercent) / 100
-	totalPrice := pricePerDevice * int64(deviceCount)
+	_, totalPrice, discountPercent, err := CalculateTeamPrice(duration, deviceCount)
+	if err != nil {
+		return nil, err
+	}
 
 	params := &stripe.CheckoutSessionParams{
 		Mode: stripe.String(string(stripe.CheckoutSessionModePayment)),
@@ -160,6 +214,10 @@ func (c *Client) CreateTeamCheckoutSession(duration string, deviceCount int, suc
 		},
 	}
 
+	if err := c.applyPromoCode(params, promoCode); err != nil {
+		return nil, err
+	}
+
 	return session.New(params)
 }
 
@@ -192,8 +250,9 @@ func CalculateTeamPrice(duration string, deviceCount int) (pricePerDevice int64,
 		return 0, 0, 0, fmt.Errorf("device count must be between 3 and 50")
 	}
 
-	discountPercent = deviceCount + 18
-	pricePerDevice = basePrice * int64(100-discountPercent) / 100
+	policy := teamDiscountPolicy
+	discountPercent = policy.discountPercent(deviceCount)
+	pricePerDevice = policy.pricePerDevice(basePrice, discountPercent)
 	totalPrice = pricePerDevice * int64(deviceCount)
 
 	return pricePerDevice, totalPrice, discountPercent, nil
@@ -0,0 +1,156 @@
+package stripe
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stripe/stripe-go/v82"
+)
+
+// setupFakeStripe points the Stripe SDK at a local server that knows no promotion codes
+// Returns the paths of every request the server saw
+func setupFakeStripe(t *testing.T) func() []string {
+	var mu sync.Mutex
+	var seen []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		seen = append(seen, r.Method+" "+r.URL.Path)
+		mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/v1/promotion_codes" {
+			w.Write([]byte(`{"object":"list","url":"/v1/promotion_codes","has_more":false,"data":[]}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":{"type":"invalid_request_error","message":"not found"}}`))
+	}))
+
+	backend := stripe.GetBackendWithConfig(stripe.APIBackend, &stripe.BackendConfig{
+		URL:               stripe.String(server.URL),
+		MaxNetworkRetries: stripe.Int64(0),
+	})
+	stripe.SetBackend(stripe.APIBackend, backend)
+
+	t.Cleanup(func() {
+		server.Close()
+		stripe.SetBackend(stripe.APIBackend, nil)
+	})
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), seen...)
+	}
+}
+
+func TestCreateCheckoutSession_RejectsInvalidPromoCode(t *testing.T) {
+	requests := setupFakeStripe(t)
+	client := NewClient("sk_test_fake", true)
+
+	_, err := client.CreateCheckoutSession("1_week_solo", "NOTACODE", "https://nihil.app/ok", "https://nihil.app/cancel")
+	if !errors.Is(err, ErrInvalidPromoCode) {
+		t.Fatalf("Expected ErrInvalidPromoCode, got %v", err)
+	}
+
+	_, err = client.CreateTeamCheckoutSession("1_month", 5, "NOTACODE", "https://nihil.app/ok", "https://nihil.app/cancel")
+	if !errors.Is(err, ErrInvalidPromoCode) {
+		t.Fatalf("Expected ErrInvalidPromoCode for team checkout, got %v", err)
+	}
+
+	for _, req := range requests() {
+		if req == "POST /v1/checkout/sessions" {
+			t.Fatal("Checkout session created despite an invalid promo code")
+		}
+	}
+
+	t.Logf("✓ Invalid promo code rejected before creating a checkout session")
+}
+
+func TestCreateCheckoutSession_PromoCodesDisabled(t *testing.T) {
+	requests := setupFakeStripe(t)
+	client := NewClient("sk_test_fake", false)
+
+	_, err := client.CreateCheckoutSession("1_week_solo", "SPRING", "https://nihil.app/ok", "https://nihil.app/cancel")
+	if !errors.Is(err, ErrPromoCodesDisabled) {
+		t.Fatalf("Expected ErrPromoCodesDisabled, got %v", err)
+	}
+	if seen := requests(); len(seen) != 0 {
+		t.Fatalf("Expected no Stripe calls, got %v", seen)
+	}
+
+	t.Logf("✓ Promo code refused while promo codes are disabled")
+}
+
+func TestCalculateTeamPrice_Boundaries(t *testing.T) {
+	cases := []struct {
+		devices  int
+		discount int
+		perUnit  int64
+	}{
+		{3, 20, 3920},
+		{4, 20, 3920},
+		{5, 25, 3675},
+		{29, 40, 2940},
+		{30, 50, 2450},
+		{50, 50, 2450},
+	}
+
+	for _, tc := range cases {
+		perUnit, total, discount, err := CalculateTeamPrice("1_month", tc.devices)
+		if err != nil {
+			t.Fatalf("%d devices: unexpected error %v", tc.devices, err)
+		}
+		if discount != tc.discount || perUnit != tc.perUnit {
+			t.Errorf("%d devices: expected %d%% at %d, got %d%% at %d", tc.devices, tc.discount, tc.perUnit, discount, perUnit)
+		}
+		if total != perUnit*int64(tc.devices) {
+			t.Errorf("%d devices: expected total %d, got %d", tc.devices, perUnit*int64(tc.devices), total)
+		}
+	}
+
+	for _, devices := range []int{2, 51} {
+		if _, _, _, err := CalculateTeamPrice("1_month", devices); err == nil {
+			t.Errorf("Expected %d devices to be rejected", devices)
+		}
+	}
+
+	t.Logf("✓ Team discount follows the tiers and stops at the cap")
+}
+
+func TestCalculateTeamPrice_NeverNonPositive(t *testing.T) {
+	defer SetTeamDiscountPolicy(DefaultTeamDiscountPolicy)
+
+	// A policy that would give everything away still leaves the floor
+	SetTeamDiscountPolicy(TeamDiscountPolicy{
+		Tiers:        map[int]int{3: 90, 10: 150},
+		MaxPercent:   200,
+		FloorPercent: 10,
+	})
+
+	for duration, basePrice := range SoloBasePrices {
+		previous := 0
+		for devices := 3; devices <= 50; devices++ {
+			perUnit, total, discount, err := CalculateTeamPrice(duration, devices)
+			if err != nil {
+				t.Fatalf("%s, %d devices: unexpected error %v", duration, devices, err)
+			}
+			if perUnit <= 0 || total <= 0 {
+				t.Fatalf("%s, %d devices: expected a positive price, got %d per device", duration, devices, perUnit)
+			}
+			if perUnit < basePrice/10 {
+				t.Errorf("%s, %d devices: expected at least the floor %d, got %d", duration, devices, basePrice/10, perUnit)
+			}
+			if discount < previous || discount > 90 {
+				t.Errorf("%s, %d devices: expected a monotonic discount up to 90%%, got %d%% after %d%%", duration, devices, discount, previous)
+			}
+			previous = discount
+		}
+	}
+
+	t.Logf("✓ Team price never drops below the floor")
+}
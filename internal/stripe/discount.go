@@ -0,0 +1,54 @@
+package stripe
+
+// TeamDiscountPolicy prices team plans off the solo price
+// Tiers maps a device count to the discount percent from that count up; the best
+// tier reached applies. The discount never goes above MaxPercent, and the price per
+// device never goes below FloorPercent of the solo price
+type TeamDiscountPolicy struct {
+	Tiers        map[int]int
+	MaxPercent   int
+	FloorPercent int
+}
+
+var DefaultTeamDiscountPolicy = TeamDiscountPolicy{
+	Tiers:        map[int]int{3: 20, 5: 25, 10: 30, 20: 40, 30: 50},
+	MaxPercent:   50,
+	FloorPercent: 25,
+}
+
+var teamDiscountPolicy = DefaultTeamDiscountPolicy
+
+// SetTeamDiscountPolicy changes how team plans are discounted - zero fields keep the defaults
+// Call once at startup, before any price is calculated
+func SetTeamDiscountPolicy(p TeamDiscountPolicy) {
+	if len(p.Tiers) == 0 {
+		p.Tiers = DefaultTeamDiscountPolicy.Tiers
+	}
+	if p.MaxPercent <= 0 {
+		p.MaxPercent = DefaultTeamDiscountPolicy.MaxPercent
+	}
+	if p.FloorPercent <= 0 {
+		p.FloorPercent = DefaultTeamDiscountPolicy.FloorPercent
+	}
+	teamDiscountPolicy = p
+}
+
+// discountPercent is the discount for deviceCount devices
+// Taking the best tier reached keeps it from dropping as the count grows, however the tiers are set
+func (p TeamDiscountPolicy) discountPercent(deviceCount int) int {
+	discount := 0
+	for minDevices, percent := range p.Tiers {
+		if deviceCount >= minDevices && percent > discount {
+			discount = percent
+		}
+	}
+	discount = min(discount, p.MaxPercent, 100-p.FloorPercent)
+	return max(discount, 0)
+}
+
+// pricePerDevice discounts basePrice, never going below the floor or a single cent
+func (p TeamDiscountPolicy) pricePerDevice(basePrice int64, discountPercent int) int64 {
+	price := basePrice * int64(100-discountPercent) / 100
+	floor := max(basePrice*int64(p.FloorPercent)/100, 1)
+	return max(price, floor)
+}
@@ -47,37 +47,77 @@ func (h *WebhookHandler) HandleWebhook(c *gin.Context) {
 
 	ctx := context.Background()
 
+	// Stripe retries deliveries - only the first one for an event is processed
+	first, err := h.redis.MarkStripeEventProcessed(ctx, event.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to record event"})
+		return
+	}
+	if !first {
+		c.JSON(http.StatusOK, gin.H{"received": true, "duplicate": true})
+		return
+	}
+
+	// A failed event gives its claim back, so Stripe's retry is processed rather than skipped
+	if err := h.dispatch(ctx, event); err != nil {
+		h.redis.ReleaseStripeEvent(ctx, event.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to process event"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"received": true})
+}
+
+func (h *WebhookHandler) dispatch(ctx context.Context, event stripe.Event) error {
 	switch event.Type {
 	case "checkout.session.completed":
-		h.handleCheckoutCompleted(ctx, event)
+		return h.handleCheckoutCompleted(ctx, event)
 	case "customer.subscription.deleted":
-		h.handleSubscriptionDeleted(ctx, event)
+		return h.handleSubscriptionDeleted(ctx, event)
+	case "charge.refunded":
+		return h.handleChargeRefunded(ctx, event)
+	case "charge.dispute.created":
+		return h.handleDisputeCreated(ctx, event)
 	}
-
-	c.JSON(http.StatusOK, gin.H{"received": true})
+	return nil
 }
 
-func (h *WebhookHandler) handleCheckoutCompleted(ctx context.Context, event stripe.Event) {
+func (h *WebhookHandler) handleCheckoutCompleted(ctx context.Context, event stripe.Event) error {
 	var session stripe.CheckoutSession
 	if err := json.Unmarshal(event.Data.Raw, &session); err != nil {
-		return
+		return fmt.Errorf("failed to parse checkout session: %w", err)
 	}
 
 	plan := session.Metadata["plan"]
 	planType := session.Metadata["type"]
 
+	// Refunds and disputes reference the payment, not the session
+	if session.PaymentIntent != nil && session.PaymentIntent.ID != "" {
+		if err := h.redis.LinkPaymentToSession(ctx, session.PaymentIntent.ID, session.ID); err != nil {
+			return err
+		}
+	}
+
 	switch planType {
 	case "team":
-		h.handleTeamCheckout(ctx, session)
+		return h.handleTeamCheckout(ctx, session)
 	case "duo":
-		h.handleDuoCheckout(ctx, session, plan)
+		return h.handleDuoCheckout(ctx, session, plan)
 	default:
-		h.handleSoloCheckout(ctx, session, plan)
+		return h.handleSoloCheckout(ctx, session, plan)
+	}
+}
+
+// issueCode stores a new activation code and adds it to its session's pool
+func (h *WebhookHandler) issueCode(ctx context.Context, ac *redisdb.ActivationCode, sessionID string) error {
+	if err := h.redis.CreateActivationCode(ctx, ac); err != nil {
+		return err
 	}
+	return h.redis.AddToCodePool(ctx, ac.Code, sessionID)
 }
 
-func (h *WebhookHandler) handleSoloCheckout(ctx context.Context, session stripe.CheckoutSession, plan string) {
-	code := generateActivationCode()
+func (h *WebhookHandler) handleSoloCheckout(ctx context.Context, session stripe.CheckoutSession, plan string) error {
+	code := GenerateActivationCode()
 
 	// ANONYMOUS CODE POOL: We store the code but NOT which Stripe session it came from
 	// This breaks the link between payment identity and device identity
@@ -89,15 +129,14 @@ func (h *WebhookHandler) handleSoloCheckout(ctx context.Context, session stripe.
 		Status:          "pending",
 		CreatedAt:       time.Now(),
 	}
-	h.redis.CreateActivationCode(ctx, ac)
 
 	// Also store in anonymous pool (for future: pre-generate codes)
-	h.redis.AddToCodePool(ctx, code, session.ID)
+	return h.issueCode(ctx, ac, session.ID)
 }
 
-func (h *WebhookHandler) handleDuoCheckout(ctx context.Context, session stripe.CheckoutSession, plan string) {
-	ownerCode := generateActivationCode()
-	guestCode := generateActivationCode()
+func (h *WebhookHandler) handleDuoCheckout(ctx context.Context, session stripe.CheckoutSession, plan string) error {
+	ownerCode := GenerateActivationCode()
+	guestCode := GenerateActivationCode()
 
 	ownerAC := &redisdb.ActivationCode{
 		Code:            ownerCode,
@@ -107,7 +146,6 @@ func (h *WebhookHandler) handleDuoCheckout(ctx context.Context, session stripe.C
 		Status:          "pending",
 		CreatedAt:       time.Now(),
 	}
-	h.redis.CreateActivationCode(ctx, ownerAC)
 
 	guestAC := &redisdb.ActivationCode{
 		Code:            guestCode,
@@ -118,29 +156,31 @@ func (h *WebhookHandler) handleDuoCheckout(ctx context.Context, session stripe.C
 		CreatedAt:       time.Now(),
 		DuoOwnerCode:    ownerCode,
 	}
-	h.redis.CreateActivationCode(ctx, guestAC)
 
-	// Add to pool
-	h.redis.AddToCodePool(ctx, ownerCode, session.ID)
-	h.redis.AddToCodePool(ctx, guestCode, session.ID)
+	// Store and add to pool
+	if err := h.issueCode(ctx, ownerAC, session.ID); err != nil {
+		return err
+	}
+	return h.issueCode(ctx, guestAC, session.ID)
 }
 
-func (h *WebhookHandler) handleTeamCheckout(ctx context.Context, session stripe.CheckoutSession) {
+func (h *WebhookHandler) handleTeamCheckout(ctx context.Context, session stripe.CheckoutSession) error {
 	deviceCountStr := session.Metadata["device_count"]
 	duration := session.Metadata["duration"]
 	plan := session.Metadata["plan"]
 
+	// A session we didn't create can't be fixed by a retry, so it's acknowledged and ignored
 	deviceCount, err := strconv.Atoi(deviceCountStr)
 	if err != nil {
-		return
+		return nil
 	}
 
 	if deviceCount < 3 || deviceCount > 50 {
-		return
+		return nil
 	}
 
 	for i := 0; i < deviceCount; i++ {
-		code := generateActivationCode()
+		code := GenerateActivationCode()
 
 		ac := &redisdb.ActivationCode{
 			Code:            code,
@@ -153,16 +193,66 @@ func (h *WebhookHandler) handleTeamCheckout(ctx context.Context, session stripe.
 			TeamTotal:       deviceCount,
 			Duration:        duration,
 		}
-		h.redis.CreateActivationCode(ctx, ac)
-		h.redis.AddToCodePool(ctx, code, session.ID)
+		if err := h.issueCode(ctx, ac, session.ID); err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func (h *WebhookHandler) handleSubscriptionDeleted(ctx context.Context, event stripe.Event) {
+func (h *WebhookHandler) handleSubscriptionDeleted(ctx context.Context, event stripe.Event) error {
 	// No action needed - subscriptions are time-based
+	return nil
+}
+
+func (h *WebhookHandler) handleChargeRefunded(ctx context.Context, event stripe.Event) error {
+	var charge stripe.Charge
+	if err := json.Unmarshal(event.Data.Raw, &charge); err != nil {
+		return fmt.Errorf("failed to parse charge: %w", err)
+	}
+
+	// Partial refunds keep the codes
+	if !charge.Refunded || charge.PaymentIntent == nil {
+		return nil
+	}
+	return h.revokeCodesForPayment(ctx, charge.PaymentIntent.ID)
+}
+
+func (h *WebhookHandler) handleDisputeCreated(ctx context.Context, event stripe.Event) error {
+	var dispute stripe.Dispute
+	if err := json.Unmarshal(event.Data.Raw, &dispute); err != nil {
+		return fmt.Errorf("failed to parse dispute: %w", err)
+	}
+
+	if dispute.PaymentIntent == nil {
+		return nil
+	}
+	return h.revokeCodesForPayment(ctx, dispute.PaymentIntent.ID)
+}
+
+// revokeCodesForPayment revokes the unclaimed codes bought with a payment and
+// marks its session so it can't be used to restore a subscription
+// Devices that already claimed a code can't be found (by design) and keep their time
+// LIMITATION: the payment is only traced to its session while the link is kept,
+// which is as long as the session's codes stay claimable
+func (h *WebhookHandler) revokeCodesForPayment(ctx context.Context, paymentIntentID string) error {
+	sessionID, err := h.redis.GetSessionForPayment(ctx, paymentIntentID)
+	if err != nil {
+		return err
+	}
+	if sessionID == "" {
+		// Unknown payment or its codes have already expired
+		return nil
+	}
+	if err := h.redis.MarkSessionRevoked(ctx, sessionID); err != nil {
+		return err
+	}
+	_, err = h.redis.RevokeSessionCodes(ctx, sessionID)
+	return err
 }
 
-func generateActivationCode() string {
+// GenerateActivationCode returns a random code in the xxxx-xxxx-xxxx-xxxx format
+func GenerateActivationCode() string {
 	bytes := make([]byte, 8)
 	rand.Read(bytes)
 	h := hex.EncodeToString(bytes)
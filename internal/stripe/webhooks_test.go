@@ -0,0 +1,187 @@
+package stripe
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v82/webhook"
+
+	redisdb "nihil/internal/redis"
+)
+
+// To run these tests, you need Redis running locally:
+// docker run -d -p 6379:6379 redis:7-alpine
+
+const testWebhookSecret = "whsec_test"
+
+func setupTestWebhook(t *testing.T) (*WebhookHandler, *gin.Engine) {
+	client, err := redisdb.NewClient("redis://localhost:6379")
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	h := NewWebhookHandler(client, testWebhookSecret)
+	h.RegisterRoutes(router)
+	return h, router
+}
+
+func postEvent(router *gin.Engine, payload []byte) *httptest.ResponseRecorder {
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  testWebhookSecret,
+	})
+
+	req := httptest.NewRequest(http.MethodPost, "/webhook/stripe", bytes.NewReader(payload))
+	req.Header.Set("Stripe-Signature", signed.Header)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestHandleWebhook_Idempotent(t *testing.T) {
+	h, router := setupTestWebhook(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "cs_test_" + suffix
+	payload := []byte(fmt.Sprintf(`{
+		"id": "evt_test_%s",
+		"object": "event",
+		"type": "checkout.session.completed",
+		"data": {"object": {
+			"id": "%s",
+			"object": "checkout.session",
+			"metadata": {"plan": "1_week_duo", "type": "duo"}
+		}}
+	}`, suffix, sessionID))
+
+	// Same event delivered twice, as a Stripe retry would
+	for i := 0; i < 2; i++ {
+		if w := postEvent(router, payload); w.Code != http.StatusOK {
+			t.Fatalf("Delivery %d: expected 200, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	codes, err := h.redis.GetCodesFromPool(ctx, sessionID)
+	if err != nil {
+		t.Fatalf("Failed to get codes: %v", err)
+	}
+	if len(codes) != 2 {
+		t.Errorf("Expected one duo code set (2 codes), got %d", len(codes))
+	}
+
+	t.Logf("✓ Duplicate webhook delivery did not create extra codes")
+}
+
+func TestHandleWebhook_RefundRevokesPendingCodes(t *testing.T) {
+	h, router := setupTestWebhook(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	sessionID := "cs_test_refund_" + suffix
+	paymentIntentID := "pi_test_refund_" + suffix
+	checkout := []byte(fmt.Sprintf(`{
+		"id": "evt_checkout_%s",
+		"object": "event",
+		"type": "checkout.session.completed",
+		"data": {"object": {
+			"id": "%s",
+			"object": "checkout.session",
+			"payment_intent": "%s",
+			"metadata": {"plan": "1_week_duo", "type": "duo"}
+		}}
+	}`, suffix, sessionID, paymentIntentID))
+	if w := postEvent(router, checkout); w.Code != http.StatusOK {
+		t.Fatalf("Checkout: expected 200, got %d", w.Code)
+	}
+
+	codes, _ := h.redis.GetCodesFromPool(ctx, sessionID)
+	if len(codes) != 2 {
+		t.Fatalf("Expected 2 codes, got %d", len(codes))
+	}
+
+	// One code is claimed before the refund
+	deviceUUID := "refund-device-" + suffix
+	if _, _, err := h.redis.ClaimActivationCode(ctx, codes[0], deviceUUID, "pk"); err != nil {
+		t.Fatalf("Failed to claim code: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+	refund := []byte(fmt.Sprintf(`{
+		"id": "evt_refund_%s",
+		"object": "event",
+		"type": "charge.refunded",
+		"data": {"object": {
+			"id": "ch_test_%s",
+			"object": "charge",
+			"payment_intent": "%s",
+			"refunded": true
+		}}
+	}`, suffix, suffix, paymentIntentID))
+	if w := postEvent(router, refund); w.Code != http.StatusOK {
+		t.Fatalf("Refund: expected 200, got %d", w.Code)
+	}
+
+	claimed, _ := h.redis.GetActivationCode(ctx, codes[0])
+	if claimed.Status != "used" {
+		t.Errorf("Expected claimed code to stay used, got %s", claimed.Status)
+	}
+	pending, _ := h.redis.GetActivationCode(ctx, codes[1])
+	if pending.Status != "revoked" {
+		t.Errorf("Expected pending code revoked, got %s", pending.Status)
+	}
+	if _, _, err := h.redis.ClaimActivationCode(ctx, codes[1], deviceUUID, "pk"); err == nil {
+		t.Error("Expected revoked code to be rejected on claim")
+	}
+	if revoked, _ := h.redis.IsSessionRevoked(ctx, sessionID); !revoked {
+		t.Error("Expected the refunded session to be marked so it can't be restored")
+	}
+
+	t.Logf("✓ Refund revoked the unclaimed code and the session")
+}
+
+func TestHandleWebhook_FailureReleasesEvent(t *testing.T) {
+	h, router := setupTestWebhook(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	eventID := "evt_test_failed_" + suffix
+	// Metadata that isn't an object can't be parsed into a session
+	payload := []byte(fmt.Sprintf(`{
+		"id": "%s",
+		"object": "event",
+		"type": "checkout.session.completed",
+		"data": {"object": {
+			"id": "cs_test_failed_%s",
+			"object": "checkout.session",
+			"metadata": "broken"
+		}}
+	}`, eventID, suffix))
+
+	// Each delivery is processed again rather than skipped as a duplicate
+	for i := 0; i < 2; i++ {
+		if w := postEvent(router, payload); w.Code != http.StatusInternalServerError {
+			t.Fatalf("Delivery %d: expected 500, got %d: %s", i+1, w.Code, w.Body.String())
+		}
+	}
+
+	first, err := h.redis.MarkStripeEventProcessed(ctx, eventID)
+	if err != nil {
+		t.Fatalf("Failed to claim event: %v", err)
+	}
+	if !first {
+		t.Error("Expected a failed event to be left unclaimed")
+	}
+	h.redis.ReleaseStripeEvent(ctx, eventID)
+
+	t.Logf("✓ A failed event is answered with 500 and left for Stripe to retry")
+}
@@ -0,0 +1,135 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// deliveryKey identifies a message within a client's pending deliveries
+func deliveryKey(chatUUID, messageID string) string {
+	return chatUUID + ":" + messageID
+}
+
+// pendingDelivery is a message.received written to a client that hasn't acknowledged it yet
+type pendingDelivery struct {
+	payload     MessageReceivedPayload
+	deliveredAt time.Time
+}
+
+// trackDelivery remembers a message handed to a client until it sends message.received.ack
+// or message.read. Messages delivered live aren't queued, so without this a client that
+// drops before processing one loses it. Clients too old to ack aren't tracked
+func (h *Hub) trackDelivery(client *Client, p MessageReceivedPayload) {
+	if h.ackTimeout <= 0 || !supportsType(client.ProtocolVersion(), TypeMessageReceivedAck) {
+		return
+	}
+
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+	if h.unacked == nil {
+		h.unacked = make(map[*Client]map[string]pendingDelivery)
+	}
+	pending := h.unacked[client]
+	if pending == nil {
+		pending = make(map[string]pendingDelivery)
+		h.unacked[client] = pending
+	}
+	pending[deliveryKey(p.ChatUUID, p.MessageID)] = pendingDelivery{payload: p, deliveredAt: time.Now()}
+}
+
+// ackDelivery forgets a message the client has confirmed
+func (h *Hub) ackDelivery(client *Client, chatUUID, messageID string) {
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+	pending := h.unacked[client]
+	delete(pending, deliveryKey(chatUUID, messageID))
+	if len(pending) == 0 {
+		delete(h.unacked, client)
+	}
+}
+
+// takeUnacked removes and returns a client's unacknowledged messages
+func (h *Hub) takeUnacked(client *Client) []MessageReceivedPayload {
+	h.ackMu.Lock()
+	defer h.ackMu.Unlock()
+	pending := h.unacked[client]
+	delete(h.unacked, client)
+
+	payloads := make([]MessageReceivedPayload, 0, len(pending))
+	for _, d := range pending {
+		payloads = append(payloads, d.payload)
+	}
+	return payloads
+}
+
+// requeueUnacked puts everything a departing client never acknowledged back in the queue
+// so it is delivered again when the device reconnects and registers its chats
+func (h *Hub) requeueUnacked(client *Client) {
+	payloads := h.takeUnacked(client)
+	if len(payloads) == 0 {
+		return
+	}
+	ctx := context.Background()
+	for _, p := range payloads {
+		h.requeueMessage(ctx, p, client.GetDeviceUUID())
+	}
+	h.logger.Debug("unacked messages requeued", "device_uuid", client.GetDeviceUUID(), "count", len(payloads))
+}
+
+func (h *Hub) handleMessageReceivedAck(client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageReceivedAckPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return
+	}
+	h.ackDelivery(client, payload.ChatUUID, payload.MessageID)
+}
+
+// runAckSweeper requeues messages that have gone unacknowledged for longer than ackTimeout
+func (h *Hub) runAckSweeper() {
+	if h.ackTimeout <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.ackTimeout / 2)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.sweepUnacked(context.Background(), time.Now())
+	}
+}
+
+// sweepUnacked requeues every delivery older than ackTimeout, for its recipient alone
+// The client may still be connected; it gets the message again from the queue on its next register
+func (h *Hub) sweepUnacked(ctx context.Context, now time.Time) {
+	type unackedDelivery struct {
+		payload    MessageReceivedPayload
+		deviceUUID string
+	}
+	var expired []unackedDelivery
+	h.ackMu.Lock()
+	for client, pending := range h.unacked {
+		for key, d := range pending {
+			if now.Sub(d.deliveredAt) >= h.ackTimeout {
+				expired = append(expired, unackedDelivery{payload: d.payload, deviceUUID: client.GetDeviceUUID()})
+				delete(pending, key)
+			}
+		}
+		if len(pending) == 0 {
+			delete(h.unacked, client)
+		}
+	}
+	h.ackMu.Unlock()
+
+	for _, d := range expired {
+		h.requeueMessage(ctx, d.payload, d.deviceUUID)
+	}
+	if len(expired) > 0 {
+		h.logger.Info("unacked messages requeued", "count", len(expired))
+	}
+}
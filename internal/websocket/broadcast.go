@@ -0,0 +1,51 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+)
+
+// Broadcast sends msg to every authenticated client on every instance
+// Returns how many local clients it was handed to; other instances send it to theirs
+func (h *Hub) Broadcast(ctx context.Context, msg *WSMessage) int {
+	sent := h.broadcastLocal(msg)
+
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return sent
+	}
+	data, err := json.Marshal(relayEnvelope{
+		Origin:    h.instanceID,
+		Message:   msgBytes,
+		Broadcast: true,
+	})
+	if err != nil {
+		return sent
+	}
+	if _, err := h.redis.PublishBroadcast(ctx, data); err != nil {
+		h.logger.Warn("failed to relay broadcast", "type", msg.Type, "error", err)
+	}
+	return sent
+}
+
+// broadcastLocal sends msg to every authenticated client on this instance
+// Never blocks - a client with a full buffer just misses it
+func (h *Hub) broadcastLocal(msg *WSMessage) int {
+	h.mu.RLock()
+	clients := make([]*Client, 0, len(h.connections))
+	for client := range h.connections {
+		if client.IsAuthed() {
+			clients = append(clients, client)
+		}
+	}
+	h.mu.RUnlock()
+
+	sent := 0
+	for _, client := range clients {
+		if supportsType(client.ProtocolVersion(), msg.Type) && client.SendMessage(msg) == nil {
+			sent++
+		}
+	}
+	h.logger.Info("broadcast sent", "type", msg.Type, "clients", sent)
+	return sent
+}
@@ -7,31 +7,95 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+
+	"nihil/internal/errcode"
+)
+
+// Keepalive timings used when the hub has none configured
+const (
+	defaultWriteWait  = 10 * time.Second
+	defaultPongWait   = 60 * time.Second
+	defaultPingPeriod = (defaultPongWait * 9) / 10
+)
+
+const (
+
+	// envelopeOverhead covers the JSON envelope around a message.send payload
+	envelopeOverhead = 1024
+
+	// maxBufferFullSends is how many sends in a row may find the buffer full before
+	// the client is treated as dead and evicted
+	maxBufferFullSends = 3
+
+	// defaultSendBufferSize is used when the hub has no buffer size configured
+	defaultSendBufferSize = 256
 )
 
+// Policies for a send that finds the client's buffer full
+// message.received is never dropped under either: it goes back to the chat's queue instead
 const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 10240
+	OverflowDisconnect = "disconnect"  // refuse the send, evicting the client if it keeps happening
+	OverflowDropOldest = "drop_oldest" // discard the oldest buffered message to make room
 )
 
+// requeuedTypes are the message types put back in Redis rather than lost on overflow
+var requeuedTypes = map[string]bool{
+	TypeMessageReceived: true,
+}
+
 type Client struct {
-	hub        *Hub
-	conn       *websocket.Conn
-	send       chan []byte
-	deviceUUID string
-	authed     bool
-	mu         sync.RWMutex
+	hub         *Hub
+	conn        *websocket.Conn
+	send        chan []byte
+	done        chan struct{} // closed once WritePump has exited
+	deviceUUID  string
+	authed      bool
+	authedAt    time.Time // orders a device's connections when the oldest must go
+	pendingAuth string    // device this connection was admitted for while its auth completes
+	sessionID   string    // this connection's entry in the device's session registry
+	resumeToken string    // restores this connection's chat registrations after a drop
+	mu          sync.RWMutex
+
+	protocolVersion int // negotiated at auth, 0 until then
+
+	writeWait  time.Duration // bound on each write, including pings
+	pongWait   time.Duration // silence after which the peer is considered dead
+	pingPeriod time.Duration // how often the peer is pinged, shorter than pongWait
+
+	lastActivity time.Time // last frame or pong read from the client
+	bufferFull   int       // sends in a row that found the buffer full
+	evicted      bool      // set once the hub has been asked to drop this client
+	loggedOut    bool      // ReadPump stops reading once set, see handleLogout
+
+	closeOnce sync.Once
+	closed    bool // send has been closed; guarded by mu so no send races the close
 }
 
 func NewClient(hub *Hub, conn *websocket.Conn) *Client {
-	return &Client{
+	bufferSize := hub.sendBufferSize
+	if bufferSize <= 0 {
+		bufferSize = defaultSendBufferSize
+	}
+	c := &Client{
 		hub:    hub,
 		conn:   conn,
-		send:   make(chan []byte, 256),
+		send:   make(chan []byte, bufferSize),
+		done:   make(chan struct{}),
 		authed: false,
+
+		writeWait:  hub.writeWait,
+		pongWait:   hub.pongWait,
+		pingPeriod: hub.pingPeriod,
+
+		lastActivity: time.Now(),
+	}
+	if c.writeWait <= 0 {
+		c.writeWait = defaultWriteWait
+	}
+	if c.pongWait <= 0 || c.pingPeriod <= 0 {
+		c.pongWait, c.pingPeriod = defaultPongWait, defaultPingPeriod
 	}
+	return c
 }
 
 func (c *Client) GetDeviceUUID() string {
@@ -45,6 +109,76 @@ func (c *Client) SetDeviceUUID(uuid string) {
 	defer c.mu.Unlock()
 	c.deviceUUID = uuid
 	c.authed = true
+	c.authedAt = time.Now()
+	c.sessionID = newSessionID()
+	c.pendingAuth = ""
+}
+
+// reserveDevice holds a slot in the device's connection limit from admission until
+// SetDeviceUUID, so concurrent auths for one device can't both fit under the limit
+func (c *Client) reserveDevice(deviceUUID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.pendingAuth = deviceUUID
+	c.authedAt = time.Now()
+}
+
+// holdsDeviceSlot reports whether the client counts against the device's connection limit
+func (c *Client) holdsDeviceSlot(deviceUUID string) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return (c.authed && c.deviceUUID == deviceUUID) || c.pendingAuth == deviceUUID
+}
+
+func (c *Client) AuthedAt() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.authedAt
+}
+
+// SessionID identifies the connection in the device's session registry, empty until auth
+func (c *Client) SessionID() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.sessionID
+}
+
+func (c *Client) ResumeToken() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.resumeToken
+}
+
+func (c *Client) SetResumeToken(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.resumeToken = token
+}
+
+// ProtocolVersion returns the protocol version negotiated at auth
+func (c *Client) ProtocolVersion() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.protocolVersion
+}
+
+func (c *Client) SetProtocolVersion(version int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.protocolVersion = version
+}
+
+// LastActivity is when the client was last heard from
+func (c *Client) LastActivity() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.lastActivity
+}
+
+func (c *Client) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastActivity = time.Now()
 }
 
 func (c *Client) IsAuthed() bool {
@@ -53,45 +187,126 @@ func (c *Client) IsAuthed() bool {
 	return c.authed
 }
 
+// SendMessage queues a message for the client
+// Message types newer than the client's protocol version are silently dropped
+// A full buffer is handled by the hub's overflow policy; ErrClientBufferFull means
+// the message wasn't taken and a message.received should be queued by the caller
 func (c *Client) SendMessage(msg *WSMessage) error {
+	if !supportsType(c.ProtocolVersion(), msg.Type) {
+		return nil
+	}
+
 	data, err := json.Marshal(msg)
 	if err != nil {
 		return err
 	}
 
+	if c.IsClosed() {
+		return ErrClientClosed
+	}
+	if c.trySend(data) {
+		return nil
+	}
+	if c.hub.overflowPolicy == OverflowDropOldest && !requeuedTypes[msg.Type] {
+		c.dropOldest()
+		if c.trySend(data) {
+			return nil
+		}
+	}
+	c.noteBufferFull()
+	return ErrClientBufferFull
+}
+
+// trySend buffers data without blocking, reporting false if the buffer is full or closed
+func (c *Client) trySend(data []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return false
+	}
 	select {
 	case c.send <- data:
-		return nil
+		c.bufferFull = 0
+		return true
+	default:
+		return false
+	}
+}
+
+// dropOldest discards the oldest buffered message to make room
+// A message.received can't just vanish, so it goes back to its chat's queue and the
+// client is evicted; it's delivered again once the client reconnects and registers
+func (c *Client) dropOldest() {
+	select {
+	case data := <-c.send:
+		var frame struct {
+			Type string `json:"type"`
+		}
+		if json.Unmarshal(data, &frame) == nil && requeuedTypes[frame.Type] {
+			c.hub.requeueDropped(c, data)
+			c.evict()
+		}
 	default:
-		return ErrClientBufferFull
+	}
+}
+
+// noteBufferFull counts a send that found the buffer full and evicts the client
+// once that has happened maxBufferFullSends times in a row
+func (c *Client) noteBufferFull() {
+	c.mu.Lock()
+	c.bufferFull++
+	full := c.bufferFull >= maxBufferFullSends
+	c.mu.Unlock()
+
+	if full {
+		c.evict()
+	}
+}
+
+// evict asks the hub to drop this client, once
+func (c *Client) evict() {
+	c.mu.Lock()
+	first := !c.evicted
+	c.evicted = true
+	c.mu.Unlock()
+
+	if first {
+		c.hub.evictStuck(c)
 	}
 }
 
 func (c *Client) ReadPump() {
+	var readErr error
 	defer func() {
 		c.hub.unregister <- c
-		c.conn.Close()
+		// After a logout the conn is left to WritePump, which closes it once the ack is flushed
+		if readErr != nil {
+			c.conn.Close()
+		}
 	}()
 
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
+	c.conn.SetReadLimit(c.hub.readLimit())
+	c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
 	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
+		c.conn.SetReadDeadline(time.Now().Add(c.pongWait))
+		c.touch()
 		return nil
 	})
 
 	for {
 		_, message, err := c.conn.ReadMessage()
 		if err != nil {
+			readErr = err
 			break
 		}
+		c.touch()
 
 		var msg WSMessage
 		if err := json.Unmarshal(message, &msg); err != nil {
 			c.SendMessage(&WSMessage{
 				Type: TypeError,
 				Payload: ErrorPayload{
-					Code:    "invalid_json",
+					Code:    errcode.InvalidJSON,
 					Message: "Invalid JSON message",
 				},
 			})
@@ -99,31 +314,37 @@ func (c *Client) ReadPump() {
 		}
 
 		c.hub.HandleMessage(c, &msg)
+		if c.isLoggedOut() {
+			return
+		}
 	}
 }
 
 func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingPeriod)
 	defer func() {
 		ticker.Stop()
 		c.conn.Close()
+		close(c.done)
 	}()
 
 	for {
 		select {
 		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
 			if !ok {
 				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
 				return
 			}
 
+			// Only applies when the client negotiated permessage-deflate
+			c.conn.EnableWriteCompression(len(message) >= c.hub.compressThreshold)
 			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 
 		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.conn.SetWriteDeadline(time.Now().Add(c.writeWait))
 			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
@@ -131,8 +352,35 @@ func (c *Client) WritePump() {
 	}
 }
 
+// Close closes the send buffer, after which WritePump flushes it and closes the conn
+// Safe to call more than once and while other goroutines are still sending
 func (c *Client) Close() {
-	close(c.send)
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.closed = true
+		close(c.send)
+	})
+}
+
+// IsClosed reports whether the client's send buffer has been closed
+func (c *Client) IsClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// logOut makes ReadPump stop reading after the current frame
+func (c *Client) logOut() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loggedOut = true
+}
+
+func (c *Client) isLoggedOut() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.loggedOut
 }
 
 func (c *Client) Context() context.Context {
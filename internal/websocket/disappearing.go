@@ -0,0 +1,57 @@
+package websocket
+
+import (
+	"context"
+	"time"
+)
+
+// expireBatchSize caps the disappearing messages expired per sweep
+const expireBatchSize = 100
+
+// startReadTTL starts a disappearing message's timer when a participant first reads it
+func (h *Hub) startReadTTL(ctx context.Context, chatUUID, messageID, readerID string) {
+	deadline, started, err := h.redis.StartReadTTL(ctx, chatUUID, messageID, readerID, time.Now())
+	if err != nil {
+		h.logger.Warn("failed to start read ttl", "chat_uuid", chatUUID, "error", err)
+		return
+	}
+	if started {
+		h.logger.Debug("disappearing message read", "chat_uuid", chatUUID, "expires_at", deadline.Unix())
+	}
+}
+
+// sweepExpiredMessages drops every disappearing message whose timer ran out by now
+// A reader's copy expires on its own: the reader and the sender are sent message.expired,
+// and the copies still queued for participants yet to read it are left alone
+func (h *Hub) sweepExpiredMessages(ctx context.Context, now time.Time) {
+	for {
+		expired, err := h.redis.PopExpiredMessages(ctx, now, expireBatchSize)
+		if err != nil {
+			h.logger.Error("failed to get expired messages", "error", err)
+			return
+		}
+
+		for _, m := range expired {
+			notice := &WSMessage{
+				Type:    TypeMessageExpired,
+				Payload: MessageExpiredPayload{ChatUUID: m.ChatUUID, MessageID: m.MessageID},
+			}
+			sender, _ := h.redis.GetMessageSender(ctx, m.ChatUUID, m.MessageID)
+
+			h.redis.ReleaseQueuedMessage(ctx, m.ChatUUID, m.MessageID, m.ReaderID)
+			chat, err := h.redis.GetChat(ctx, m.ChatUUID)
+			if err != nil {
+				continue
+			}
+			h.routeToParticipant(ctx, chat, m.ReaderID, notice)
+			if sender != "" && sender != m.ReaderID {
+				h.routeToParticipant(ctx, chat, sender, notice)
+			}
+			h.logger.Debug("disappearing message expired", "chat_uuid", m.ChatUUID)
+		}
+
+		if len(expired) < expireBatchSize {
+			return
+		}
+	}
+}
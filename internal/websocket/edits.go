@@ -0,0 +1,162 @@
+package websocket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"nihil/internal/errcode"
+	redisdb "nihil/internal/redis"
+)
+
+// handleMessageEdit replaces a message's content for the other participants
+// A copy still in the queue is rewritten; the edit is forwarded either way
+func (h *Hub) handleMessageEdit(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageEditPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		sendError(client, errcode.InvalidPayload, "Invalid message payload")
+		return
+	}
+
+	content, err := base64.StdEncoding.DecodeString(payload.EncryptedContent)
+	if err != nil || len(content) > h.messageMaxSize {
+		sendError(client, errcode.MessageTooLarge, fmt.Sprintf("Message exceeds %d byte limit", h.messageMaxSize))
+		return
+	}
+
+	chat, queued, ok := h.authorizeMessageChange(ctx, client, payload.ChatUUID, payload.MessageID, payload.ParticipantID, payload.ParticipantSecret)
+	if !ok {
+		return
+	}
+
+	if queued != nil {
+		if _, err := h.redis.UpdateQueuedMessage(ctx, queued, payload.ChatUUID, content); err != nil {
+			h.logger.Error("failed to update queued message", "chat_uuid", payload.ChatUUID, "error", err)
+		}
+	}
+
+	edited := &WSMessage{
+		Type: TypeMessageEdited,
+		Payload: MessageEditedPayload{
+			ChatUUID:         payload.ChatUUID,
+			MessageID:        payload.MessageID,
+			SenderUUID:       payload.ParticipantID,
+			SenderDeviceUUID: client.GetDeviceUUID(),
+			EncryptedContent: payload.EncryptedContent,
+			Timestamp:        time.Now().Unix(),
+		},
+	}
+	for _, other := range chat.OtherParticipants(payload.ParticipantID) {
+		h.routeToParticipant(ctx, chat, other.ID, edited)
+	}
+}
+
+// handleMessageDelete unsends a message
+// A copy still in the queue is dropped so it's never delivered; the delete is forwarded either way
+func (h *Hub) handleMessageDelete(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageDeletePayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		sendError(client, errcode.InvalidPayload, "Invalid message payload")
+		return
+	}
+
+	chat, queued, ok := h.authorizeMessageChange(ctx, client, payload.ChatUUID, payload.MessageID, payload.ParticipantID, payload.ParticipantSecret)
+	if !ok {
+		return
+	}
+
+	if queued != nil {
+		h.redis.DeleteQueuedMessage(ctx, payload.ChatUUID, payload.MessageID)
+	}
+	h.redis.ForgetMessageState(ctx, payload.ChatUUID, payload.ParticipantID, payload.MessageID)
+	h.redis.ForgetMessageSender(ctx, payload.ChatUUID, payload.MessageID)
+
+	deleted := &WSMessage{
+		Type: TypeMessageDeleted,
+		Payload: MessageDeletedPayload{
+			ChatUUID:   payload.ChatUUID,
+			MessageID:  payload.MessageID,
+			SenderUUID: payload.ParticipantID,
+		},
+	}
+	for _, other := range chat.OtherParticipants(payload.ParticipantID) {
+		h.routeToParticipant(ctx, chat, other.ID, deleted)
+	}
+}
+
+// authorizeMessageChange checks the participant may edit or delete a message
+// Ownership is checked against the sender recorded when the message was sent; a message
+// with no record - never sent, deleted, or sent without a message ID - can't be changed
+// Returns the queued copy if the message hasn't been delivered yet
+func (h *Hub) authorizeMessageChange(ctx context.Context, client *Client, chatUUID, messageID, participantID, secret string) (*redisdb.Chat, *redisdb.QueuedMessage, bool) {
+	warning, allowed := h.allowEvent(ctx, client, redisdb.RateCategorySend)
+	if !allowed {
+		client.SendMessage(&WSMessage{
+			Type:    TypeRateLimitWarning,
+			Payload: warning,
+		})
+		return nil, nil, false
+	}
+
+	valid, err := h.redis.ValidateParticipant(ctx, chatUUID, participantID, secret)
+	if err != nil || !valid {
+		sendError(client, errcode.InvalidCredentials, "Invalid participant credentials")
+		return nil, nil, false
+	}
+
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil {
+		sendError(client, errcode.ChatNotFound, "Chat not found")
+		return nil, nil, false
+	}
+
+	queued, err := h.redis.GetQueuedMessage(ctx, chatUUID, messageID)
+	if err != nil {
+		h.logger.Error("failed to look up queued message", "chat_uuid", chatUUID, "error", err)
+		sendError(client, errcode.Internal, "Failed to look up message")
+		return nil, nil, false
+	}
+
+	sender, err := h.redis.GetMessageSender(ctx, chatUUID, messageID)
+	if err != nil {
+		h.logger.Error("failed to look up message sender", "chat_uuid", chatUUID, "error", err)
+		sendError(client, errcode.Internal, "Failed to look up message")
+		return nil, nil, false
+	}
+	if sender == "" && queued != nil {
+		sender = queued.SenderParticipant
+	}
+
+	if sender == "" {
+		h.logger.Debug("message change rejected", "reason", "unknown_message", "chat_uuid", chatUUID)
+		sendError(client, errcode.NotFound, "Message not found")
+		return nil, nil, false
+	}
+	if sender != participantID {
+		h.logger.Debug("message change rejected", "reason", "not_sender", "chat_uuid", chatUUID)
+		sendError(client, errcode.NotMessageSender, "Only the sender can change a message")
+		return nil, nil, false
+	}
+
+	return chat, queued, true
+}
+
+// sendError reports a failed request to the client
+func sendError(client *Client, code errcode.Code, message string) {
+	client.SendMessage(&WSMessage{
+		Type:    TypeError,
+		Payload: ErrorPayload{Code: code, Message: message},
+	})
+}
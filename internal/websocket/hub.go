@@ -9,15 +9,23 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/google/uuid"
+
+	"nihil/internal/audit"
+	"nihil/internal/config"
+	"nihil/internal/errcode"
 	"nihil/internal/firebase"
 	redisdb "nihil/internal/redis"
 )
 
 var (
 	ErrClientBufferFull = errors.New("client send buffer full")
+	ErrClientClosed     = errors.New("client closed")
 	ErrNotAuthed        = errors.New("client not authenticated")
 	ErrChatNotFound     = errors.New("chat not found")
 )
@@ -31,54 +39,197 @@ type Hub struct {
 	clients            map[string]*Client          // deviceUUID -> Client
 	connections        map[*Client]bool            // all connections
 	chatParticipants   map[string]string           // chatUUID:participantID -> deviceUUID
+	presenceSubs       map[*Client]map[string]bool // client -> chat UUIDs it wants presence.update for
 	register           chan *Client
 	unregister         chan *Client
 	redis              *redisdb.Client
-	rateLimitPerMinute int
+	messageMaxSize     int           // decoded content limit in bytes
+	abuseBanDuration   time.Duration // how long repeat abusers are banned
+	preKeyLowThreshold int           // prekey count that triggers keys.replenish_needed
+	maxDeviceConns     int           // concurrent connections per device, 0 for no limit
+	maxConns           int           // connections this instance accepts, 0 for no limit
+	maxChatRegs        int           // chats one device may register, 0 for no limit
+	maxChatLifetime    time.Duration // longest chat.extend can keep a chat alive
+	deviceConnPolicy   string        // ConnPolicyReplace or ConnPolicyReject once the limit is hit
+	sendBufferSize     int           // per-client outbound buffer, defaultSendBufferSize when unset
+	overflowPolicy     string        // OverflowDisconnect or OverflowDropOldest once that buffer is full
+	compressThreshold  int           // outbound messages at least this size are deflated, if negotiated
+	writeWait          time.Duration // keepalive timings for each connection, see NewClient
+	pongWait           time.Duration
+	pingPeriod         time.Duration
+	maxQueuedMessages  int           // per-chat offline queue cap, oldest dropped first
+	resumeTTL          time.Duration // how long a resume token outlives its connection
+	sweepInterval      time.Duration
+	logger             *slog.Logger
+	instanceID         string                      // identifies this server for presence
+	subscription       *redisdb.DeviceSubscription // events relayed from other instances
+	closing            bool                        // set by Shutdown, refuses new connections
 	mu                 sync.RWMutex
+
+	pushOptions       firebase.PushOptions // data-only or a custom generic title
+	rateLimits        map[string]int       // per-minute budget for each redisdb.RateCategory
+	chatSendRateLimit int                  // per-minute sends from one device into one chat
+
+	expiryWarnings   []time.Duration // subscription.expiring thresholds before ExpiresAt
+	expiryDisconnect bool            // close connections once a subscription's grace is over
+
+	bufferFullEvictions atomic.Int64 // clients dropped for a stuck send buffer, see BufferFullEvictions
+	staleMappingsReaped atomic.Int64 // chat mappings found pointing at gone devices, see reapStaleMappings
+	conns               atomic.Int64 // connection slots held, see AcquireConn
+	connsRefused        atomic.Int64 // upgrades turned away at capacity
+
+	ackTimeout time.Duration                          // how long a delivered message may go unacknowledged, 0 to not track
+	unacked    map[*Client]map[string]pendingDelivery // see trackDelivery
+	ackMu      sync.Mutex
+
+	// Push delivery, replaced in tests
+	pushReady     func() bool
+	validateToken func(ctx context.Context, fcmToken string) error // nil when registered tokens aren't checked with FCM
+	sendPushBatch func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult
 }
 
-func NewHub(redis *redisdb.Client, rateLimitPerMinute int) *Hub {
+func NewHub(redis *redisdb.Client, cfg *config.Config, logger *slog.Logger) *Hub {
 	return &Hub{
 		clients:            make(map[string]*Client),
 		connections:        make(map[*Client]bool),
 		chatParticipants:   make(map[string]string),
+		presenceSubs:       make(map[*Client]map[string]bool),
 		register:           make(chan *Client),
 		unregister:         make(chan *Client),
 		redis:              redis,
-		rateLimitPerMinute: rateLimitPerMinute,
+		rateLimits:         wsRateLimits(cfg),
+		chatSendRateLimit:  cfg.WSChatSendRateLimit,
+		messageMaxSize:     cfg.MessageMaxSize,
+		abuseBanDuration:   cfg.AbuseBanDuration,
+		preKeyLowThreshold: cfg.PreKeyLowThreshold,
+		maxDeviceConns:     cfg.MaxDeviceConns,
+		maxConns:           cfg.MaxConnections,
+		maxChatRegs:        cfg.MaxDeviceChatRegs,
+		maxChatLifetime:    cfg.MaxChatLifetime,
+		deviceConnPolicy:   cfg.DeviceConnPolicy,
+		sendBufferSize:     cfg.WSSendBufferSize,
+		overflowPolicy:     cfg.WSOverflowPolicy,
+		compressThreshold:  cfg.WSCompressThreshold,
+		writeWait:          cfg.WSWriteWait,
+		pongWait:           cfg.WSPongWait,
+		pingPeriod:         cfg.WSPingPeriod,
+		maxQueuedMessages:  cfg.MaxQueuedMessages,
+		resumeTTL:          cfg.ResumeTokenTTL,
+		ackTimeout:         cfg.DeliveryAckTimeout,
+		unacked:            make(map[*Client]map[string]pendingDelivery),
+		expiryWarnings:     cfg.SubExpiryWarnings,
+		expiryDisconnect:   cfg.SubExpiryDisconnect,
+		sweepInterval:      cfg.ChatSweepInterval,
+		logger:             logger,
+		instanceID:         uuid.New().String(),
+		subscription:       redis.NewDeviceSubscription(context.Background()),
+		pushOptions: firebase.PushOptions{
+			DataOnly: cfg.PushDataOnly,
+			Title:    cfg.PushTitle,
+			Body:     cfg.PushBody,
+		},
+		pushReady:     firebase.IsInitialized,
+		sendPushBatch: firebase.SendPushBatch,
+		validateToken: pushTokenValidator(cfg.PushValidateTokens),
+	}
+}
+
+// wsRateLimits maps each WebSocket rate category to its configured per-minute budget
+func wsRateLimits(cfg *config.Config) map[string]int {
+	return map[string]int{
+		redisdb.RateCategorySend:   cfg.WSSendRateLimit,
+		redisdb.RateCategoryTyping: cfg.WSTypingRateLimit,
+		redisdb.RateCategoryRead:   cfg.WSReadRateLimit,
 	}
 }
 
 func (h *Hub) Run() {
+	if err := h.subscription.AddBroadcast(context.Background()); err != nil {
+		h.logger.Warn("failed to subscribe to broadcasts", "error", err)
+	}
+	go h.runChatSweeper()
+	go h.runRelay()
+	go h.runPresenceRefresher()
+	go h.runScheduler()
+	go h.runExpiryNotifier()
+	go h.runAckSweeper()
+
 	for {
 		select {
 		case client := <-h.register:
 			h.mu.Lock()
+			if h.closing {
+				h.mu.Unlock()
+				client.Close()
+				continue
+			}
 			h.connections[client] = true
+			count := len(h.connections)
 			h.mu.Unlock()
-			fmt.Printf("[DEBUG] Client connected (total connections: %d)\n", len(h.connections))
+			h.logger.Debug("client connected", "connections", count)
 
 		case client := <-h.unregister:
-			h.mu.Lock()
-			if _, ok := h.connections[client]; ok {
-				delete(h.connections, client)
-				if client.deviceUUID != "" {
-					fmt.Printf("[DEBUG] Client disconnected: %s\n", client.deviceUUID)
-					delete(h.clients, client.deviceUUID)
-					// Clean up chat participant mappings for this device
-					for key, deviceUUID := range h.chatParticipants {
-						if deviceUUID == client.deviceUUID {
-							fmt.Printf("[DEBUG] Removing mapping: %s\n", key)
-							delete(h.chatParticipants, key)
-						}
-					}
+			h.dropClient(client, nil)
+		}
+	}
+}
+
+// dropClient forgets a connection and closes it, sending farewell first if set
+// Its chat mappings go with it, so later messages for the device are queued and pushed
+func (h *Hub) dropClient(client *Client, farewell *WSMessage) {
+	h.forgetClient(client, farewell)
+	client.Close()
+}
+
+// forgetClient is dropClient without closing the connection, for a client whose
+// ReadPump is still running and will unregister it. A client already forgotten is left alone
+func (h *Hub) forgetClient(client *Client, farewell *WSMessage) {
+	var removed string
+	var offline []string
+	h.mu.Lock()
+	if _, ok := h.connections[client]; ok {
+		delete(h.connections, client)
+		delete(h.presenceSubs, client)
+		if client.deviceUUID != "" {
+			h.logger.Debug("client disconnected", "device_uuid", client.deviceUUID)
+			// A reconnect may already have replaced this client
+			if h.clients[client.deviceUUID] == client {
+				delete(h.clients, client.deviceUUID)
+				removed = client.deviceUUID
+			}
+			// Clean up chat participant mappings for this device
+			for key, deviceUUID := range h.chatParticipants {
+				if deviceUUID == client.deviceUUID {
+					delete(h.chatParticipants, key)
+					offline = append(offline, key)
 				}
-				client.Close()
 			}
-			h.mu.Unlock()
 		}
+		if farewell != nil {
+			client.SendMessage(farewell)
+		}
+	}
+	h.mu.Unlock()
+
+	h.releaseClient(client)
+	if removed != "" {
+		h.removeClient(context.Background(), removed)
 	}
+	// Off the caller's goroutine - notifying reads Redis for every chat
+	if len(offline) > 0 {
+		done := firebase.Track()
+		go func() {
+			defer done()
+			h.notifyOffline(context.Background(), offline)
+		}()
+	}
+}
+
+// readLimit is the largest WebSocket frame accepted from a client
+// Content arrives base64 encoded inside a JSON envelope, so it is larger than messageMaxSize
+func (h *Hub) readLimit() int64 {
+	encoded := base64.StdEncoding.EncodedLen(h.messageMaxSize)
+	return int64(encoded + envelopeOverhead)
 }
 
 func (h *Hub) Register(client *Client) {
@@ -88,60 +239,234 @@ func (h *Hub) Register(client *Client) {
 // DisconnectDevice forcefully disconnects a device and clears all in-memory state
 // Called when device is purged via HTTP API
 func (h *Hub) DisconnectDevice(deviceUUID string) {
-	h.mu.Lock()
-	defer h.mu.Unlock()
+	h.disconnectEverywhere(deviceUUID, ErrorPayload{
+		Code:    errcode.DevicePurged,
+		Message: "Device has been purged",
+	})
+}
+
+// RevokeDeviceSessions closes every connection the device has
+// Called after a key rotation so the device has to authenticate with its new key
+func (h *Hub) RevokeDeviceSessions(deviceUUID string) {
+	h.disconnectEverywhere(deviceUUID, ErrorPayload{
+		Code:    errcode.KeyRotated,
+		Message: "Device key was rotated, authenticate again",
+	})
+}
+
+// CloseDeviceSessions closes every connection the device has at its own request
+// Nothing is purged; the device can authenticate again straight away
+func (h *Hub) CloseDeviceSessions(deviceUUID string) {
+	h.disconnectEverywhere(deviceUUID, ErrorPayload{
+		Code:    errcode.SessionsRevoked,
+		Message: "Session was closed from another connection",
+	})
+}
+
+// AcquireConn reserves a connection slot ahead of a WebSocket upgrade
+// Returns false once maxConns slots are held; a reserved slot is given back with ReleaseConn
+func (h *Hub) AcquireConn() bool {
+	if n := h.conns.Add(1); h.maxConns > 0 && n > int64(h.maxConns) {
+		h.conns.Add(-1)
+		h.connsRefused.Add(1)
+		return false
+	}
+	return true
+}
 
-	client, exists := h.clients[deviceUUID]
-	if !exists {
-		fmt.Printf("[DEBUG] DisconnectDevice: device %s not connected\n", deviceUUID)
+// ReleaseConn gives back a slot taken by AcquireConn
+func (h *Hub) ReleaseConn() {
+	h.conns.Add(-1)
+}
+
+// Connections is how many connection slots are held, upgrades in progress included
+func (h *Hub) Connections() int64 {
+	return h.conns.Load()
+}
+
+// ConnectionsRefused is how many upgrades were turned away because the instance was at capacity
+func (h *Hub) ConnectionsRefused() int64 {
+	return h.connsRefused.Load()
+}
+
+// ChatMappings is how many chat participants this instance currently routes to a device
+func (h *Hub) ChatMappings() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.chatParticipants)
+}
+
+// StaleMappingsReaped is how many chat mappings were found pointing at devices no longer connected
+// Anything above zero means a disconnect path missed its cleanup
+func (h *Hub) StaleMappingsReaped() int64 {
+	return h.staleMappingsReaped.Load()
+}
+
+// countDeviceChats is how many chat mappings point at deviceUUID - h.mu must be held
+func (h *Hub) countDeviceChats(deviceUUID string) int {
+	n := 0
+	for _, d := range h.chatParticipants {
+		if d == deviceUUID {
+			n++
+		}
+	}
+	return n
+}
+
+// BufferFullEvictions is how many clients were dropped because their send buffer stayed full
+func (h *Hub) BufferFullEvictions() int64 {
+	return h.bufferFullEvictions.Load()
+}
+
+// evictStuck drops a client whose writer has stopped draining its buffer
+// Closing the socket ends its pumps; the unregister runs off the caller's goroutine
+// because SendMessage may be called with h.mu held
+func (h *Hub) evictStuck(c *Client) {
+	h.bufferFullEvictions.Add(1)
+	h.logger.Warn("evicting stuck client", "device_uuid", c.GetDeviceUUID(),
+		"idle_for", time.Since(c.LastActivity()).Round(time.Second))
+
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	go func() { h.unregister <- c }()
+}
+
+// requeueDropped puts a message.received dropped from a client's buffer back in its chat's queue
+func (h *Hub) requeueDropped(client *Client, data []byte) {
+	var frame struct {
+		Payload MessageReceivedPayload `json:"payload"`
+	}
+	if err := json.Unmarshal(data, &frame); err != nil {
 		return
 	}
+	if h.requeueMessage(context.Background(), frame.Payload, client.GetDeviceUUID()) {
+		h.logger.Info("dropped message requeued", "chat_uuid", frame.Payload.ChatUUID)
+	}
+}
+
+// requeueMessage puts a message.received that never reached the participant on deviceUUID
+// back in its chat's queue, for that participant only and stamped with when it was sent
+// Nothing is queued once the chat or the participant is gone. Reports whether it was queued
+func (h *Hub) requeueMessage(ctx context.Context, p MessageReceivedPayload, deviceUUID string) bool {
+	content, err := base64.StdEncoding.DecodeString(p.EncryptedContent)
+	if err != nil {
+		return false
+	}
+
+	chat, err := h.redis.GetChat(ctx, p.ChatUUID)
+	if err != nil {
+		return false
+	}
+	recipient := chat.ParticipantByDevice(deviceUUID)
+	if recipient == nil {
+		return false
+	}
+	msg := &redisdb.QueuedMessage{
+		MessageID:         p.MessageID,
+		SenderParticipant: p.SenderUUID,
+		SenderDeviceUUID:  p.SenderDeviceUUID,
+		EncryptedContent:  content,
+		QueuedAt:          p.Timestamp,
+		AttachmentIDs:     p.AttachmentIDs,
+	}
+	if _, err := h.redis.RequeueMessage(ctx, p.ChatUUID, msg, recipient.ID, h.maxQueuedMessages); err != nil {
+		h.logger.Error("failed to requeue message", "chat_uuid", p.ChatUUID, "error", err)
+		return false
+	}
+	return true
+}
 
-	fmt.Printf("[DEBUG] DisconnectDevice: forcefully disconnecting %s\n", deviceUUID)
+// disconnectDevice closes all of a device's connections, telling each why first
+func (h *Hub) disconnectDevice(deviceUUID string, notice ErrorPayload) {
+	h.mu.Lock()
+	var closing []*Client
+	for c := range h.connections {
+		if c.IsAuthed() && c.GetDeviceUUID() == deviceUUID {
+			closing = append(closing, c)
+		}
+	}
+	if len(closing) == 0 {
+		h.mu.Unlock()
+		h.logger.Debug("disconnect device: not connected", "device_uuid", deviceUUID)
+		return
+	}
 
 	// Remove from clients map
 	delete(h.clients, deviceUUID)
 
 	// Remove from connections
-	delete(h.connections, client)
+	for _, c := range closing {
+		delete(h.connections, c)
+		delete(h.presenceSubs, c)
+	}
 
 	// Clean up all chat participant mappings for this device
+	var offline []string
 	for key, devUUID := range h.chatParticipants {
 		if devUUID == deviceUUID {
-			fmt.Printf("[DEBUG] DisconnectDevice: removing mapping %s\n", key)
 			delete(h.chatParticipants, key)
+			offline = append(offline, key)
 		}
 	}
 
-	// Send a message to client before closing (optional - they're being purged anyway)
-	client.SendMessage(&WSMessage{
-		Type: TypeError,
-		Payload: ErrorPayload{
-			Code:    "device_purged",
-			Message: "Device has been purged",
-		},
-	})
+	// Tell the client why before closing the connection
+	for _, c := range closing {
+		c.SendMessage(&WSMessage{Type: TypeError, Payload: notice})
+		c.Close()
+	}
+	h.mu.Unlock()
 
-	// Close the connection
-	client.Close()
+	for _, c := range closing {
+		h.releaseClient(c)
+	}
+	h.removeClient(context.Background(), deviceUUID)
+	h.notifyOffline(context.Background(), offline)
 
-	fmt.Printf("[DEBUG] DisconnectDevice: %s fully disconnected and cleaned up\n", deviceUUID)
+	h.logger.Info("device disconnected", "device_uuid", deviceUUID, "reason", notice.Code)
 }
 
 func (h *Hub) HandleMessage(client *Client, msg *WSMessage) {
 	ctx := context.Background()
 
-	fmt.Printf("[DEBUG] Received message type: %s\n", msg.Type)
+	h.logger.Debug("message received", "type", msg.Type)
+
+	// Frames still arriving from a client the hub has closed, e.g. evicted by a newer
+	// connection, are ignored rather than answered on a closed buffer
+	if client.IsClosed() {
+		return
+	}
+
+	if !supportsType(client.ProtocolVersion(), msg.Type) {
+		sendError(client, errcode.UnsupportedType, "Message type needs a newer protocol version")
+		return
+	}
 
 	switch msg.Type {
 	case TypeAuth:
 		h.handleAuth(ctx, client, msg)
+	case TypeAuthResume:
+		h.handleAuthResume(ctx, client, msg)
 	case TypeChatRegister:
 		h.handleChatRegister(ctx, client, msg)
 	case TypeMessageSend:
 		h.handleMessageSend(ctx, client, msg)
+	case TypeMessageEdit:
+		h.handleMessageEdit(ctx, client, msg)
+	case TypeMessageDelete:
+		h.handleMessageDelete(ctx, client, msg)
+	case TypeMessageSchedule:
+		h.handleMessageSchedule(ctx, client, msg)
+	case TypeChatMute, TypeChatUnmute:
+		h.handleChatMute(ctx, client, msg)
+	case TypeChatExtend:
+		h.handleChatExtend(ctx, client, msg)
+	case TypeChatRotateSecret:
+		h.handleChatRotateSecret(ctx, client, msg)
 	case TypeMessageRead:
 		h.handleMessageRead(ctx, client, msg)
+	case TypeMessageReceivedAck:
+		h.handleMessageReceivedAck(client, msg)
 	case TypeTypingStart, TypeTypingStop:
 		h.handleTyping(ctx, client, msg)
 	case TypePushRegister:
@@ -150,13 +475,19 @@ func (h *Hub) HandleMessage(client *Client, msg *WSMessage) {
 		h.handlePushUnregister(ctx, client, msg)
 	case TypePushBurnAll:
 		h.handlePushBurnAll(ctx, client, msg)
-	case "ping":
-		return
+	case TypePresenceQuery, TypePresenceSubscribe, TypePresenceUnsubscribe:
+		h.handlePresence(ctx, client, msg)
+	case TypeSubQuery:
+		h.handleSubscriptionQuery(ctx, client)
+	case TypeLogout:
+		h.handleLogout(client)
+	case TypePing:
+		h.handlePing(client, msg)
 	default:
 		client.SendMessage(&WSMessage{
 			Type: TypeError,
 			Payload: ErrorPayload{
-				Code:    "unknown_type",
+				Code:    errcode.UnknownType,
 				Message: "Unknown message type",
 			},
 		})
@@ -167,97 +498,101 @@ func (h *Hub) handleAuth(ctx context.Context, client *Client, msg *WSMessage) {
 	payloadBytes, _ := json.Marshal(msg.Payload)
 	var payload AuthPayload
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		h.rejectAuth(client, "", "invalid_payload")
+		return
+	}
+
+	h.logger.Debug("auth attempt", "device_uuid", payload.DeviceUUID)
+
+	version, ok := negotiateProtocol(payload.ProtocolVersion)
+	if !ok {
+		h.logger.Info("auth failed", "reason", "unsupported_protocol", "protocol_version", payload.ProtocolVersion)
+		audit.Record(audit.EventAuthFailed, payload.DeviceUUID, "unsupported_protocol")
 		client.SendMessage(&WSMessage{
 			Type:    TypeAuthFailed,
-			Payload: AuthFailedPayload{Reason: "invalid_payload"},
+			Payload: AuthFailedPayload{Reason: "unsupported_protocol"},
 		})
 		return
 	}
 
-	fmt.Printf("[DEBUG] Auth attempt from device: %s\n", payload.DeviceUUID)
-
-	banned, reason, _ := h.redis.IsBanned(ctx, payload.DeviceUUID)
+	banned, reason, remaining, _ := h.redis.IsBanned(ctx, payload.DeviceUUID)
 	if banned {
-		fmt.Printf("[DEBUG] Device %s is banned: %s\n", payload.DeviceUUID, reason)
+		h.logger.Info("auth rejected: device banned", "device_uuid", payload.DeviceUUID, "reason", reason)
+		audit.Record(audit.EventAuthFailed, payload.DeviceUUID, "banned")
 		client.SendMessage(&WSMessage{
 			Type:    TypeBanned,
-			Payload: BannedPayload{Reason: reason},
+			Payload: BannedPayload{Reason: reason, ExpiresIn: int64(remaining.Seconds())},
 		})
 		return
 	}
 
-	now := time.Now().Unix()
-	if abs(now-payload.Timestamp) > 300 {
-		fmt.Printf("[DEBUG] Auth failed: timestamp expired\n")
-		client.SendMessage(&WSMessage{
-			Type:    TypeAuthFailed,
-			Payload: AuthFailedPayload{Reason: "timestamp_expired"},
-		})
+	if !h.redis.TimestampFresh(payload.Timestamp, time.Now()) {
+		h.rejectAuth(client, payload.DeviceUUID, "timestamp_expired")
 		return
 	}
 
-	publicKey, err := h.redis.GetDevicePublicKey(ctx, payload.DeviceUUID)
+	if payload.Nonce == "" || len(payload.Nonce) > redisdb.MaxNonceLength {
+		h.rejectAuth(client, payload.DeviceUUID, "invalid_nonce")
+		return
+	}
+
+	// device_unknown means activate again, key_expired only register keys again
+	publicKey, err := h.redis.LookupDevicePublicKey(ctx, payload.DeviceUUID)
 	if err != nil {
-		fmt.Printf("[DEBUG] Auth failed: device not found - %v\n", err)
-		client.SendMessage(&WSMessage{
-			Type:    TypeAuthFailed,
-			Payload: AuthFailedPayload{Reason: "device_not_found"},
-		})
+		reason := "internal_error"
+		switch {
+		case errors.Is(err, redisdb.ErrDeviceUnknown):
+			reason = "device_unknown"
+		case errors.Is(err, redisdb.ErrKeyExpired):
+			reason = "key_expired"
+		default:
+			h.logger.Error("failed to look up device key", "error", err)
+		}
+		h.rejectAuth(client, payload.DeviceUUID, reason)
 		return
 	}
 
-	expectedSig := computeSignature(publicKey, payload.DeviceUUID, payload.Timestamp)
+	expectedSig := computeSignature(publicKey, payload.DeviceUUID, payload.Timestamp, payload.Nonce)
 	if payload.Signature != expectedSig {
-		fmt.Printf("[DEBUG] Auth failed: invalid signature\n")
-		client.SendMessage(&WSMessage{
-			Type:    TypeAuthFailed,
-			Payload: AuthFailedPayload{Reason: "invalid_signature"},
-		})
+		h.rejectAuth(client, payload.DeviceUUID, "invalid_signature")
 		return
 	}
 
-	sub, err := h.redis.GetSubscription(ctx, payload.DeviceUUID)
-	if err != nil || sub.Status != "active" || time.Now().After(sub.ExpiresAt) {
-		fmt.Printf("[DEBUG] Auth failed: subscription expired or invalid\n")
-		client.SendMessage(&WSMessage{
-			Type:    TypeSubExpired,
-			Payload: SubExpiredPayload{RenewURL: "https://nihil.app"},
-		})
+	// Only recorded once the signature checks out, so forged auths can't burn nonces
+	fresh, err := h.redis.UseNonce(ctx, payload.DeviceUUID, payload.Nonce)
+	if err != nil || !fresh {
+		h.rejectAuth(client, payload.DeviceUUID, "replayed_nonce")
 		return
 	}
 
-	client.SetDeviceUUID(payload.DeviceUUID)
-
-	h.mu.Lock()
-	h.clients[payload.DeviceUUID] = client
-	h.mu.Unlock()
-
-	fmt.Printf("[DEBUG] Auth SUCCESS for device: %s (total clients: %d)\n", payload.DeviceUUID, len(h.clients))
+	h.completeAuth(ctx, client, payload.DeviceUUID, version)
+}
 
-	// Note: Chats are stored client-side, so we return empty list
-	// Client will send chat.register with their local chats
-	chats := make([]ChatInfo, 0)
+// rejectAuth logs and audits a failed auth and tells the client why
+func (h *Hub) rejectAuth(client *Client, deviceUUID, reason string) {
+	h.logger.Info("auth failed", "reason", reason)
+	audit.Record(audit.EventAuthFailed, deviceUUID, reason)
 
+	payload := AuthFailedPayload{Reason: reason}
+	if reason == "timestamp_expired" {
+		now := time.Now()
+		payload.ServerTime = now.Unix()
+		payload.ServerTimeMs = now.UnixMilli()
+	}
 	client.SendMessage(&WSMessage{
-		Type: TypeAuthSuccess,
-		Payload: AuthSuccessPayload{
-			Chats: chats,
-			Subscription: SubscriptionInfo{
-				Plan:      sub.Plan,
-				ExpiresAt: sub.ExpiresAt,
-			},
-		},
+		Type:    TypeAuthFailed,
+		Payload: payload,
 	})
 }
 
 // handleChatRegister validates and registers participant credentials for routing
 func (h *Hub) handleChatRegister(ctx context.Context, client *Client, msg *WSMessage) {
 	if !client.IsAuthed() {
-		fmt.Printf("[DEBUG] chat.register rejected: not authenticated\n")
+		h.logger.Debug("chat.register rejected", "reason", "not_authenticated")
 		client.SendMessage(&WSMessage{
 			Type: TypeError,
 			Payload: ErrorPayload{
-				Code:    "not_authenticated",
+				Code:    errcode.NotAuthenticated,
 				Message: "Must authenticate first",
 			},
 		})
@@ -267,11 +602,11 @@ func (h *Hub) handleChatRegister(ctx context.Context, client *Client, msg *WSMes
 	payloadBytes, _ := json.Marshal(msg.Payload)
 	var payload ChatRegisterPayload
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		fmt.Printf("[DEBUG] chat.register rejected: invalid payload - %v\n", err)
+		h.logger.Debug("chat.register rejected", "reason", "invalid_payload", "error", err)
 		client.SendMessage(&WSMessage{
 			Type: TypeError,
 			Payload: ErrorPayload{
-				Code:    "invalid_payload",
+				Code:    errcode.InvalidPayload,
 				Message: "Invalid chat.register payload",
 			},
 		})
@@ -281,246 +616,424 @@ func (h *Hub) handleChatRegister(ctx context.Context, client *Client, msg *WSMes
 	deviceUUID := client.GetDeviceUUID()
 	registered := 0
 	failed := 0
+	limited := 0
+
+	h.logger.Debug("chat.register", "device_uuid", deviceUUID, "chats", len(payload.Chats))
 
-	fmt.Printf("[DEBUG] ========================================\n")
-	fmt.Printf("[DEBUG] chat.register from device: %s\n", deviceUUID)
-	fmt.Printf("[DEBUG] Number of chats to register: %d\n", len(payload.Chats))
+	validChats := make([]ChatRegistration, 0, len(payload.Chats))
 
 	h.mu.Lock()
+	deviceChats := h.countDeviceChats(deviceUUID)
 	for _, chatReg := range payload.Chats {
-		fmt.Printf("[DEBUG] ----------------------------------------\n")
-		fmt.Printf("[DEBUG] Registering chat: %s\n", chatReg.ChatUUID)
-		fmt.Printf("[DEBUG] Participant ID: %s\n", chatReg.ParticipantID)
-		fmt.Printf("[DEBUG] Secret (first 8 chars): %.8s...\n", chatReg.ParticipantSecret)
+		// Re-registering a chat the device already holds doesn't count against the cap
+		key := chatParticipantKey(chatReg.ChatUUID, chatReg.ParticipantID)
+		if h.maxChatRegs > 0 && deviceChats >= h.maxChatRegs && h.chatParticipants[key] != deviceUUID {
+			limited++
+			failed++
+			continue
+		}
 
 		// Validate credentials against Redis
 		valid, err := h.redis.ValidateParticipant(ctx, chatReg.ChatUUID, chatReg.ParticipantID, chatReg.ParticipantSecret)
 
-		fmt.Printf("[DEBUG] Validation result: valid=%v, err=%v\n", valid, err)
-
 		if err != nil || !valid {
-			fmt.Printf("[DEBUG] FAILED to register chat %s\n", chatReg.ChatUUID)
+			h.logger.Debug("chat.register: invalid credentials", "chat_uuid", chatReg.ChatUUID)
 			failed++
 			continue
 		}
 
 		// Register mapping: chatUUID:participantID -> deviceUUID
-		key := chatParticipantKey(chatReg.ChatUUID, chatReg.ParticipantID)
+		if h.chatParticipants[key] != deviceUUID {
+			deviceChats++
+		}
 		h.chatParticipants[key] = deviceUUID
+		validChats = append(validChats, chatReg)
 		registered++
-
-		fmt.Printf("[DEBUG] SUCCESS: Mapped %s -> %s\n", key, deviceUUID)
 	}
 	h.mu.Unlock()
 
-	fmt.Printf("[DEBUG] ========================================\n")
-	fmt.Printf("[DEBUG] Registration complete: %d registered, %d failed\n", registered, failed)
-	fmt.Printf("[DEBUG] Current chatParticipants map:\n")
-	h.mu.RLock()
-	for k, v := range h.chatParticipants {
-		fmt.Printf("[DEBUG]   %s -> %s\n", k, v)
+	if token := client.ResumeToken(); token != "" {
+		for _, chatReg := range validChats {
+			h.redis.AddResumeParticipant(ctx, token, chatReg.ChatUUID, chatReg.ParticipantID)
+		}
+	}
+
+	if limited > 0 {
+		h.logger.Warn("chat.register over the per-device cap", "device_uuid", deviceUUID, "limited", limited, "cap", h.maxChatRegs)
 	}
-	h.mu.RUnlock()
-	fmt.Printf("[DEBUG] ========================================\n")
+	h.logger.Debug("chat.register complete", "device_uuid", deviceUUID, "registered", registered, "failed", failed)
+
+	// Counted before delivery, which takes messages off the queue
+	pending := h.pendingCounts(ctx, validChats)
+
+	// Joins that happened while the device was offline come before the messages
+	h.replayJoinEvents(ctx, client)
 
 	// Deliver any queued messages for registered chats
-	fmt.Printf("[DEBUG] Checking for queued messages...\n")
-	for _, chatReg := range payload.Chats {
-		fmt.Printf("[DEBUG] Checking queue for chat: %s\n", chatReg.ChatUUID)
-		messages, err := h.redis.GetQueuedMessages(ctx, chatReg.ChatUUID)
+	for _, chatReg := range validChats {
+		h.deliverQueuedMessages(ctx, client, chatReg)
+	}
+
+	for _, chatReg := range validChats {
+		// Catch up on receipts for our own messages that arrived while we were offline
+		h.replayMessageStates(ctx, client, chatReg.ChatUUID, chatReg.ParticipantID)
+		// Let subscribed peers know we're reachable in this chat
+		h.notifyPresence(ctx, chatReg.ChatUUID, chatReg.ParticipantID, true)
+	}
+
+	client.SendMessage(&WSMessage{
+		Type: TypeChatRegisterAck,
+		Payload: ChatRegisterAckPayload{
+			Registered: registered,
+			Failed:     failed,
+			Limited:    limited,
+			Pending:    pending,
+		},
+	})
+}
+
+// pendingCounts returns how many queued messages wait for each registered participant
+func (h *Hub) pendingCounts(ctx context.Context, chats []ChatRegistration) map[string]int64 {
+	var pending map[string]int64
+	for _, chatReg := range chats {
+		n, err := h.redis.GetPendingMessageCount(ctx, chatReg.ChatUUID, chatReg.ParticipantID)
 		if err != nil {
-			fmt.Printf("[DEBUG] Error getting queued messages: %v\n", err)
+			h.logger.Warn("failed to count pending messages", "chat_uuid", chatReg.ChatUUID, "error", err)
+			continue
+		}
+		if n > 0 {
+			if pending == nil {
+				pending = make(map[string]int64)
+			}
+			pending[chatReg.ChatUUID] = n
 		}
-		fmt.Printf("[DEBUG] Found %d queued messages for chat %s\n", len(messages), chatReg.ChatUUID)
+	}
+	return pending
+}
+
+// queuePageSize is how many queued messages are loaded at a time on chat.register
+const queuePageSize = 50
+
+// deliverQueuedMessages sends a registering participant what was queued while it was offline
+// The queue is read a page at a time, oldest first, rather than loaded whole
+func (h *Hub) deliverQueuedMessages(ctx context.Context, client *Client, chatReg ChatRegistration) {
+	// Paged over a snapshot of IDs: reads released meanwhile take messages off the
+	// queue, which would shift offsets and skip the ones behind them
+	messageIDs, err := h.redis.GetQueuedMessageIDs(ctx, chatReg.ChatUUID)
+	if err != nil {
+		h.logger.Warn("failed to get queued messages", "chat_uuid", chatReg.ChatUUID, "error", err)
+		return
+	}
 
-		for msgID, queuedMsg := range messages {
-			fmt.Printf("[DEBUG] Queued message %s from sender %s\n", msgID, queuedMsg.SenderParticipant)
+	delivered := 0
+	for start := 0; start < len(messageIDs); start += queuePageSize {
+		page := messageIDs[start:min(start+queuePageSize, len(messageIDs))]
+		messages, err := h.redis.GetQueuedMessagesByID(ctx, chatReg.ChatUUID, page)
+		if err != nil {
+			h.logger.Warn("failed to get queued messages", "chat_uuid", chatReg.ChatUUID, "error", err)
+			return
+		}
 
-			// Don't deliver own messages
-			if queuedMsg.SenderParticipant == chatReg.ParticipantID {
-				fmt.Printf("[DEBUG] Skipping own message %s\n", msgID)
+		for _, queuedMsg := range messages {
+			// Own messages and ones this participant already has aren't delivered
+			if !queuedMsg.PendingFor(chatReg.ParticipantID) {
 				continue
 			}
 
-			fmt.Printf("[DEBUG] DELIVERING queued message %s to device %s\n", msgID, deviceUUID)
+			// Stamped with when it was sent, not when it finally arrives
+			timestamp := queuedMsg.QueuedAt
+			if timestamp == 0 {
+				timestamp = time.Now().Unix()
+			}
+
+			// The queue doesn't keep ttl_after_read, so a disappearing message is told apart here
+			readTTL, _ := h.redis.GetReadTTL(ctx, chatReg.ChatUUID, queuedMsg.MessageID)
 
 			err := client.SendMessage(&WSMessage{
 				Type: TypeMessageReceived,
 				Payload: MessageReceivedPayload{
 					ChatUUID:         chatReg.ChatUUID,
-					MessageID:        msgID,
+					MessageID:        queuedMsg.MessageID,
 					SenderUUID:       queuedMsg.SenderParticipant,
 					SenderDeviceUUID: queuedMsg.SenderDeviceUUID,
 					EncryptedContent: base64.StdEncoding.EncodeToString(queuedMsg.EncryptedContent),
-					Timestamp:        time.Now().Unix(),
+					Timestamp:        timestamp,
+					AttachmentIDs:    queuedMsg.AttachmentIDs,
+					TTLAfterRead:     int64(readTTL.Seconds()),
 				},
 			})
 			if err != nil {
-				fmt.Printf("[DEBUG] Error sending queued message: %v\n", err)
+				h.logger.Warn("failed to deliver queued message", "chat_uuid", chatReg.ChatUUID, "error", err)
 			} else {
-				fmt.Printf("[DEBUG] Queued message sent successfully\n")
+				delivered++
 				// Notify sender that recipient received the message
-				h.sendDeliveryConfirmation(ctx, chatReg.ChatUUID, msgID, queuedMsg.SenderParticipant)
+				h.sendDeliveryConfirmation(ctx, chatReg.ChatUUID, queuedMsg.MessageID, queuedMsg.SenderParticipant, chatReg.ParticipantID)
 			}
 		}
 	}
-	fmt.Printf("[DEBUG] Finished checking queued messages\n")
-
-	client.SendMessage(&WSMessage{
-		Type: TypeChatRegisterAck,
-		Payload: ChatRegisterAckPayload{
-			Registered: registered,
-			Failed:     failed,
-		},
-	})
+	h.logger.Debug("queued messages delivered", "chat_uuid", chatReg.ChatUUID, "count", delivered)
 }
 
-func (h *Hub) handleMessageSend(ctx context.Context, client *Client, msg *WSMessage) {
-	if !client.IsAuthed() {
-		client.SendMessage(&WSMessage{
-			Type: TypeError,
-			Payload: ErrorPayload{
-				Code:    "not_authenticated",
-				Message: "Must authenticate first",
-			},
-		})
+// replayMessageStates resends delivery and read receipts for a participant's messages
+// Messages every recipient has read are forgotten once replayed - nothing can change after that
+func (h *Hub) replayMessageStates(ctx context.Context, client *Client, chatUUID, participantID string) {
+	states, err := h.redis.GetMessageStates(ctx, chatUUID, participantID)
+	if err != nil {
+		h.logger.Warn("failed to get message states", "chat_uuid", chatUUID, "error", err)
+		return
+	}
+	if len(states) == 0 {
 		return
 	}
 
-	payloadBytes, _ := json.Marshal(msg.Payload)
-	var payload MessageSendPayload
-	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil {
+		return
+	}
+
+	readBy := make(map[string]int)
+	for _, state := range states {
+		switch state.State {
+		case redisdb.MessageDelivered:
+			client.SendMessage(&WSMessage{
+				Type: TypeMessageDelivered,
+				Payload: MessageDeliveredPayload{
+					ChatUUID:      chatUUID,
+					MessageID:     state.MessageID,
+					RecipientUUID: state.RecipientID,
+				},
+			})
+		case redisdb.MessageRead:
+			client.SendMessage(&WSMessage{
+				Type: TypeMessageReadAck,
+				Payload: MessageReadAckPayload{
+					ChatUUID:   chatUUID,
+					MessageID:  state.MessageID,
+					ReaderUUID: state.RecipientID,
+				},
+			})
+			readBy[state.MessageID]++
+		}
+	}
+
+	recipients := len(chat.OtherParticipants(participantID))
+	for messageID, readers := range readBy {
+		if readers >= recipients {
+			h.redis.ForgetMessageState(ctx, chatUUID, participantID, messageID)
+		}
+	}
+
+	h.logger.Debug("message states replayed", "chat_uuid", chatUUID, "count", len(states))
+}
+
+// allowEvent counts a WebSocket event against the device's budget for its category
+// Each category has its own window, so a burst of typing never eats into the send budget
+// A rejected event comes with the rate.limit_warning to send back
+func (h *Hub) allowEvent(ctx context.Context, client *Client, category string) (RateLimitWarningPayload, bool) {
+	limit := h.rateLimits[category]
+	count, allowed, retryAfter, _ := h.redis.CheckEventRateLimit(ctx, client.GetDeviceUUID(), category, limit)
+	return rateLimitWarning(count, limit, retryAfter), allowed
+}
+
+func rateLimitWarning(count, limit int, retryAfter time.Duration) RateLimitWarningPayload {
+	return RateLimitWarningPayload{
+		Current:           count,
+		Limit:             limit,
+		RetryAfterSeconds: redisdb.RetryAfterSeconds(retryAfter),
+	}
+}
+
+// allowChatSend counts a message against the device's budget for one chat
+// A device spread across many chats can't pour its whole send budget into a single recipient
+func (h *Hub) allowChatSend(ctx context.Context, client *Client, chatUUID string) bool {
+	count, allowed, retryAfter, _ := h.redis.CheckChatRateLimit(ctx, client.GetDeviceUUID(), chatUUID, h.chatSendRateLimit)
+	if !allowed {
+		warning := rateLimitWarning(count, h.chatSendRateLimit, retryAfter)
+		warning.ChatUUID = chatUUID
 		client.SendMessage(&WSMessage{
-			Type: TypeError,
-			Payload: ErrorPayload{
-				Code:    "invalid_payload",
-				Message: "Invalid message payload",
-			},
+			Type:    TypeRateLimitWarning,
+			Payload: warning,
 		})
-		return
 	}
+	return allowed
+}
 
-	deviceUUID := client.GetDeviceUUID()
+// maxAttachmentsPerMessage caps the attachment references one message.send may carry
+const maxAttachmentsPerMessage = 10
+
+// outgoingMessage is what message.send and message.schedule both carry
+type outgoingMessage struct {
+	ChatUUID          string
+	EncryptedContent  string
+	ParticipantID     string
+	ParticipantSecret string
+	AttachmentIDs     []string
+}
 
-	fmt.Printf("[DEBUG] ========================================\n")
-	fmt.Printf("[DEBUG] MESSAGE SEND from device: %s\n", deviceUUID)
-	fmt.Printf("[DEBUG] Chat UUID: %s\n", payload.ChatUUID)
-	fmt.Printf("[DEBUG] Sender Participant ID: %s\n", payload.ParticipantID)
-	fmt.Printf("[DEBUG] Message ID: %s\n", payload.MessageID)
+// validateOutgoing runs the checks a message goes through whether it's sent now or scheduled:
+// rate limits with abuse escalation, credentials, size and attachments
+// The client has been told why when ok is false
+func (h *Hub) validateOutgoing(ctx context.Context, client *Client, event string, m outgoingMessage) (*redisdb.Chat, []byte, bool) {
+	deviceUUID := client.GetDeviceUUID()
 
 	// Rate limiting
-	count, allowed, _ := h.redis.CheckRateLimit(ctx, deviceUUID, h.rateLimitPerMinute)
+	warning, allowed := h.allowEvent(ctx, client, redisdb.RateCategorySend)
 	if !allowed {
-		fmt.Printf("[DEBUG] Rate limit exceeded for device %s\n", deviceUUID)
-		action, _ := h.redis.HandleAbuse(ctx, deviceUUID, "rate_limit_exceeded")
+		h.logger.Warn("rate limit exceeded", "device_uuid", deviceUUID)
+		action, _ := h.redis.HandleAbuse(ctx, deviceUUID, "rate_limit_exceeded", h.abuseBanDuration)
 		if action == "ban" {
 			client.SendMessage(&WSMessage{
 				Type:    TypeBanned,
-				Payload: BannedPayload{Reason: "rate_limit_abuse"},
+				Payload: BannedPayload{Reason: "rate_limit_abuse", ExpiresIn: int64(h.abuseBanDuration.Seconds())},
 			})
 			h.unregister <- client
-			return
+			return nil, nil, false
 		}
 		client.SendMessage(&WSMessage{
-			Type: TypeRateLimitWarning,
-			Payload: RateLimitWarningPayload{
-				Current: count,
-				Limit:   h.rateLimitPerMinute,
-			},
+			Type:    TypeRateLimitWarning,
+			Payload: warning,
 		})
-		return
+		return nil, nil, false
+	}
+	if !h.allowChatSend(ctx, client, m.ChatUUID) {
+		h.logger.Debug(event+" rejected", "reason", "chat_rate_limit", "chat_uuid", m.ChatUUID)
+		return nil, nil, false
 	}
 
 	// Validate sender's participant credentials
-	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
-	fmt.Printf("[DEBUG] Sender validation: valid=%v, err=%v\n", valid, err)
-
+	valid, err := h.redis.ValidateParticipant(ctx, m.ChatUUID, m.ParticipantID, m.ParticipantSecret)
 	if err != nil || !valid {
-		fmt.Printf("[DEBUG] MESSAGE REJECTED: Invalid sender credentials\n")
+		h.logger.Debug(event+" rejected", "reason", "invalid_credentials", "chat_uuid", m.ChatUUID)
+		sendError(client, errcode.InvalidCredentials, "Invalid participant credentials")
+		return nil, nil, false
+	}
+
+	// Get chat to find the recipients' participant IDs
+	chat, err := h.redis.GetChat(ctx, m.ChatUUID)
+	if err != nil {
+		h.logger.Debug(event+" rejected", "reason", "chat_not_found", "chat_uuid", m.ChatUUID)
+		sendError(client, errcode.ChatNotFound, "Chat not found")
+		return nil, nil, false
+	}
+
+	content, err := base64.StdEncoding.DecodeString(m.EncryptedContent)
+	if err != nil || len(content) > h.messageMaxSize {
+		h.logger.Debug(event+" rejected", "reason", "message_too_large", "chat_uuid", m.ChatUUID)
+		sendError(client, errcode.MessageTooLarge, fmt.Sprintf("Message exceeds %d byte limit", h.messageMaxSize))
+		return nil, nil, false
+	}
+
+	if len(m.AttachmentIDs) > maxAttachmentsPerMessage {
+		sendError(client, errcode.TooManyAttachments, fmt.Sprintf("At most %d attachments per message", maxAttachmentsPerMessage))
+		return nil, nil, false
+	}
+	if ok, err := h.redis.AttachmentsExist(ctx, m.ChatUUID, m.AttachmentIDs); err != nil || !ok {
+		h.logger.Debug(event+" rejected", "reason", "unknown_attachment", "chat_uuid", m.ChatUUID)
+		sendError(client, errcode.AttachmentNotFound, "Attachment not found in this chat")
+		return nil, nil, false
+	}
+
+	return chat, content, true
+}
+
+// recordOutgoing claims a validated message's ID and runs the duplicate-content abuse check
+// dup is true for a message ID already sent, which the caller acknowledges again and drops.
+// If Redis can't tell, the message goes out rather than risk losing it. ok is false once banned
+func (h *Hub) recordOutgoing(ctx context.Context, client *Client, event string, chat *redisdb.Chat, senderID, messageID string, content []byte) (dup, ok bool) {
+	deviceUUID := client.GetDeviceUUID()
+
+	if messageID != "" {
+		if first, err := h.redis.MarkMessageSent(ctx, chat.ChatUUID, messageID, chat.TTLSeconds); err == nil && !first {
+			h.logger.Debug(event+" deduplicated", "chat_uuid", chat.ChatUUID)
+			return true, true
+		}
+		if err := h.redis.RecordMessageSender(ctx, chat, messageID, senderID); err != nil {
+			h.logger.Error("failed to record message sender", "chat_uuid", chat.ChatUUID, "error", err)
+		}
+	}
+
+	msgHash := sha256Hash(string(content))
+	if err := h.redis.RecordMessage(ctx, deviceUUID, msgHash); err != nil {
+		action, _ := h.redis.HandleAbuse(ctx, deviceUUID, err.Error(), h.abuseBanDuration)
+		if action == "ban" {
+			client.SendMessage(&WSMessage{
+				Type:    TypeBanned,
+				Payload: BannedPayload{Reason: "abuse", ExpiresIn: int64(h.abuseBanDuration.Seconds())},
+			})
+			h.unregister <- client
+			return false, false
+		}
+	}
+	return false, true
+}
+
+func (h *Hub) handleMessageSend(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
 		client.SendMessage(&WSMessage{
 			Type: TypeError,
 			Payload: ErrorPayload{
-				Code:    "invalid_credentials",
-				Message: "Invalid participant credentials",
+				Code:    errcode.NotAuthenticated,
+				Message: "Must authenticate first",
 			},
 		})
 		return
 	}
 
-	// Get chat to find recipient's participant ID
-	chat, err := h.redis.GetChat(ctx, payload.ChatUUID)
-	if err != nil {
-		fmt.Printf("[DEBUG] MESSAGE REJECTED: Chat not found - %v\n", err)
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageSendPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
 		client.SendMessage(&WSMessage{
 			Type: TypeError,
 			Payload: ErrorPayload{
-				Code:    "chat_not_found",
-				Message: "Chat not found",
+				Code:    errcode.InvalidPayload,
+				Message: "Invalid message payload",
 			},
 		})
 		return
 	}
 
-	fmt.Printf("[DEBUG] Chat found: participant_a=%s, participant_b=%s\n", chat.ParticipantA, chat.ParticipantB)
-
-	// Determine recipient's participant ID
-	recipientParticipantID := chat.ParticipantA
-	if chat.ParticipantA == payload.ParticipantID {
-		recipientParticipantID = chat.ParticipantB
-	}
-
-	fmt.Printf("[DEBUG] Recipient participant ID: %s\n", recipientParticipantID)
-
-	// Check if recipient is online via chatParticipants mapping
-	h.mu.RLock()
-	recipientKey := chatParticipantKey(payload.ChatUUID, recipientParticipantID)
-	recipientDeviceUUID, recipientRegistered := h.chatParticipants[recipientKey]
+	deviceUUID := client.GetDeviceUUID()
 
-	fmt.Printf("[DEBUG] Looking up recipient key: %s\n", recipientKey)
-	fmt.Printf("[DEBUG] Recipient registered: %v\n", recipientRegistered)
-	fmt.Printf("[DEBUG] Recipient device UUID: %s\n", recipientDeviceUUID)
+	h.logger.Debug("message.send", "device_uuid", deviceUUID, "chat_uuid", payload.ChatUUID)
 
-	var recipient *Client
-	var online bool
-	if recipientRegistered {
-		recipient, online = h.clients[recipientDeviceUUID]
-		fmt.Printf("[DEBUG] Recipient online: %v, client exists: %v\n", online, recipient != nil)
+	chat, content, ok := h.validateOutgoing(ctx, client, "message.send", outgoingMessage{
+		ChatUUID:          payload.ChatUUID,
+		EncryptedContent:  payload.EncryptedContent,
+		ParticipantID:     payload.ParticipantID,
+		ParticipantSecret: payload.ParticipantSecret,
+		AttachmentIDs:     payload.AttachmentIDs,
+	})
+	if !ok {
+		return
 	}
 
-	// Debug: Print all current mappings
-	fmt.Printf("[DEBUG] All chatParticipants mappings:\n")
-	for k, v := range h.chatParticipants {
-		fmt.Printf("[DEBUG]   %s -> %s\n", k, v)
+	if payload.TTLAfterRead < 0 {
+		sendError(client, errcode.InvalidTTL, "ttl_after_read must not be negative")
+		return
 	}
-	fmt.Printf("[DEBUG] All connected clients:\n")
-	for k := range h.clients {
-		fmt.Printf("[DEBUG]   %s\n", k)
+
+	ack := &WSMessage{
+		Type: TypeMessageAck,
+		Payload: MessageAckPayload{
+			ChatUUID:  payload.ChatUUID,
+			MessageID: payload.MessageID,
+		},
 	}
-	h.mu.RUnlock()
 
-	content, err := base64.StdEncoding.DecodeString(payload.EncryptedContent)
-	if err != nil || len(content) > 10240 {
-		fmt.Printf("[DEBUG] MESSAGE REJECTED: Content too large or invalid base64\n")
-		client.SendMessage(&WSMessage{
-			Type: TypeError,
-			Payload: ErrorPayload{
-				Code:    "message_too_large",
-				Message: "Message exceeds 10KB limit",
-			},
-		})
+	// A retried send is acked again but not delivered or queued a second time
+	dup, ok := h.recordOutgoing(ctx, client, "message.send", chat, payload.ParticipantID, payload.MessageID, content)
+	if !ok {
+		return
+	}
+	if dup {
+		client.SendMessage(ack)
 		return
 	}
 
-	msgHash := sha256Hash(string(content))
-	if err := h.redis.RecordMessage(ctx, deviceUUID, msgHash); err != nil {
-		action, _ := h.redis.HandleAbuse(ctx, deviceUUID, err.Error())
-		if action == "ban" {
-			client.SendMessage(&WSMessage{
-				Type:    TypeBanned,
-				Payload: BannedPayload{Reason: "abuse"},
-			})
-			h.unregister <- client
-			return
+	// Set before delivery so even an immediate read starts the timer
+	if payload.TTLAfterRead > 0 && payload.MessageID != "" {
+		if err := h.redis.SetReadTTL(ctx, chat, payload.MessageID, time.Duration(payload.TTLAfterRead)*time.Second); err != nil {
+			h.logger.Warn("failed to set read ttl", "chat_uuid", payload.ChatUUID, "error", err)
 		}
 	}
 
@@ -534,58 +1047,129 @@ func (h *Hub) handleMessageSend(ctx context.Context, client *Client, msg *WSMess
 			SenderDeviceUUID: deviceUUID,
 			EncryptedContent: payload.EncryptedContent,
 			Timestamp:        time.Now().Unix(),
+			AttachmentIDs:    payload.AttachmentIDs,
+			TTLAfterRead:     payload.TTLAfterRead,
 		},
 	}
 
-	if online && recipient != nil {
-		fmt.Printf("[DEBUG] DELIVERING message to online recipient\n")
-		recipient.SendMessage(outMsg)
-		// Notify sender that recipient received the message immediately
-		h.sendDeliveryConfirmation(ctx, payload.ChatUUID, payload.MessageID, payload.ParticipantID)
-	} else {
-		fmt.Printf("[DEBUG] QUEUING message (recipient offline or not registered)\n")
-		// Queue message with sender's device UUID
-		err := h.redis.QueueMessageWithDevice(ctx, payload.ChatUUID, payload.MessageID, payload.ParticipantID, deviceUUID, content)
-		if err != nil {
-			fmt.Printf("[DEBUG] ERROR queuing message: %v\n", err)
-		} else {
-			fmt.Printf("[DEBUG] Message queued successfully: chat=%s, msgID=%s\n", payload.ChatUUID, payload.MessageID)
-		}
-		// Always try to send push when recipient is offline
-		h.sendPushNotification(ctx, recipientParticipantID, payload.ChatUUID)
+	if dropped := h.deliverMessage(ctx, chat, payload.ParticipantID, deviceUUID, payload.MessageID, content, payload.AttachmentIDs, outMsg); dropped > 0 {
+		client.SendMessage(&WSMessage{
+			Type:    TypeQueueTrimmed,
+			Payload: QueueTrimmedPayload{ChatUUID: payload.ChatUUID, Dropped: dropped},
+		})
 	}
 
 	// Send acknowledgment back to sender
-	client.SendMessage(&WSMessage{
-		Type: TypeMessageAck,
-		Payload: MessageAckPayload{
-			ChatUUID:  payload.ChatUUID,
-			MessageID: payload.MessageID,
-		},
-	})
-	fmt.Printf("[DEBUG] Sent message.ack for %s\n", payload.MessageID)
+	client.SendMessage(ack)
+}
+
+// deliverMessage fans a message out to every other participant of the chat
+// It's queued once for the ones offline and they're all woken with one push batch
+// Returns how many older queued messages were dropped to make room
+func (h *Hub) deliverMessage(ctx context.Context, chat *redisdb.Chat, senderParticipant, senderDeviceUUID, messageID string, content []byte, attachmentIDs []string, outMsg *WSMessage) int64 {
+	chatUUID := chat.ChatUUID
+	var dropped int64
+	var offline []string
+	for _, recipientParticipant := range chat.OtherParticipants(senderParticipant) {
+		recipientParticipantID := recipientParticipant.ID
+
+		// Check if recipient is online on this instance
+		h.mu.RLock()
+		recipientKey := chatParticipantKey(chatUUID, recipientParticipantID)
+		recipientDeviceUUID, recipientRegistered := h.chatParticipants[recipientKey]
+
+		var recipient *Client
+		var online bool
+		if recipientRegistered {
+			recipient, online = h.clients[recipientDeviceUUID]
+		}
+		h.mu.RUnlock()
+
+		// A recipient that can't take the message is treated as offline
+		delivered := false
+		if online && recipient != nil {
+			if err := recipient.SendMessage(outMsg); err != nil {
+				h.logger.Warn("local delivery failed, queuing", "chat_uuid", chatUUID, "error", err)
+			} else {
+				delivered = true
+				if p, ok := outMsg.Payload.(MessageReceivedPayload); ok {
+					h.trackDelivery(recipient, p)
+				}
+			}
+		}
 
-	fmt.Printf("[DEBUG] ========================================\n")
+		if delivered {
+			h.logger.Debug("delivering message", "chat_uuid", chatUUID, "online", true)
+			// Notify sender that recipient received the message immediately
+			h.sendDeliveryConfirmation(ctx, chatUUID, messageID, senderParticipant, recipientParticipantID)
+		} else if !online && h.routeToParticipant(ctx, chat, recipientParticipantID, outMsg) {
+			// Owning instance delivers and sends the delivery confirmation back
+			h.logger.Debug("message relayed", "chat_uuid", chatUUID)
+		} else {
+			h.logger.Debug("queuing message", "chat_uuid", chatUUID, "online", false)
+			offline = append(offline, recipientParticipantID)
+		}
+	}
+	if len(offline) == 0 {
+		return 0
+	}
+
+	// Queued once, with sender's device UUID, for exactly the recipients that didn't get it
+	n, err := h.redis.QueueMessageFor(ctx, chatUUID, messageID, senderParticipant, senderDeviceUUID, content, attachmentIDs, offline, h.maxQueuedMessages)
+	if err != nil {
+		h.logger.Error("failed to queue message", "chat_uuid", chatUUID, "error", err)
+	}
+	if n > 0 {
+		h.logger.Info("message queue trimmed", "chat_uuid", chatUUID, "dropped", n)
+		dropped = n
+	}
+	for _, recipientParticipantID := range offline {
+		h.redis.SetMessageState(ctx, chat, messageID, senderParticipant, recipientParticipantID, redisdb.MessageQueued)
+	}
+	// Always try to send push when recipient is offline
+	h.sendPushNotifications(ctx, chatUUID, offline)
+	return dropped
 }
 
 // sendPushNotification sends a BLIND wake-up push for a specific chat
 // Uses participant ID to look up the FCM token (not device UUID)
 func (h *Hub) sendPushNotification(ctx context.Context, recipientParticipantID, chatUUID string) {
-	fmt.Printf("[DEBUG] PUSH: Attempting to send push for chat %s to participant %s\n", chatUUID, recipientParticipantID)
+	h.sendPushNotifications(ctx, chatUUID, []string{recipientParticipantID})
+}
 
-	if !firebase.IsInitialized() {
-		fmt.Printf("[DEBUG] PUSH: Firebase NOT initialized - cannot send push\n")
+// sendPushNotifications wakes several participants of a chat with a single push batch
+// Registrations FCM reports as invalid are removed one by one
+func (h *Hub) sendPushNotifications(ctx context.Context, chatUUID string, participantIDs []string) {
+	if len(participantIDs) == 0 {
+		return
+	}
+	if !h.pushReady() {
+		h.logger.Debug("push skipped: firebase not initialized", "chat_uuid", chatUUID)
 		return
 	}
-	fmt.Printf("[DEBUG] PUSH: Firebase is initialized\n")
+	// Tracked here too so Shutdown waits for pushes sent from a reader's goroutine
+	defer firebase.Track()()
 
-	// Get push token using participant ID
-	fcmToken, err := h.redis.GetPushTokenForChat(ctx, chatUUID, recipientParticipantID)
-	if err != nil {
-		fmt.Printf("[DEBUG] PUSH: No FCM token found for chat %s, participant %s: %v\n", chatUUID, recipientParticipantID, err)
+	var tokens, recipients []string
+	for _, participantID := range participantIDs {
+		// Muted chats still get the queued message on reconnect, just no wake-up
+		if muted, _ := h.redis.IsChatMuted(ctx, chatUUID, participantID); muted {
+			h.logger.Debug("push skipped: chat muted", "chat_uuid", chatUUID)
+			continue
+		}
+
+		// Get push token using participant ID
+		fcmToken, err := h.redis.GetPushTokenForChat(ctx, chatUUID, participantID)
+		if err != nil {
+			h.logger.Debug("push skipped: no token registered", "chat_uuid", chatUUID)
+			continue
+		}
+		tokens = append(tokens, fcmToken)
+		recipients = append(recipients, participantID)
+	}
+	if len(tokens) == 0 {
 		return
 	}
-	fmt.Printf("[DEBUG] PUSH: Found FCM token: %.20s...\n", fcmToken)
 
 	// BLIND WAKE-UP: No chat info in push payload
 	// Prevents metadata leakage - server doesn't reveal which chat
@@ -593,12 +1177,19 @@ func (h *Hub) sendPushNotification(ctx context.Context, recipientParticipantID,
 		"type": "wake",
 	}
 
-	fmt.Printf("[DEBUG] PUSH: Sending push notification...\n")
-	err = firebase.SendPush(ctx, fcmToken, data)
-	if err != nil {
-		fmt.Printf("[DEBUG] PUSH: Failed to send - %v\n", err)
-	} else {
-		fmt.Printf("[DEBUG] PUSH: Push sent successfully\n")
+	for i, result := range h.sendPushBatch(ctx, tokens, data, h.pushOptions) {
+		if errors.Is(result.Err, firebase.ErrTokenInvalid) {
+			// The app was uninstalled or the token rotated; stop pushing to it
+			h.logger.Info("push token invalid, registration removed", "chat_uuid", chatUUID)
+			h.redis.DeletePushForChat(ctx, chatUUID, recipients[i])
+		} else if errors.Is(result.Err, firebase.ErrCircuitOpen) {
+			// Logged once by the breaker rather than for every message
+			h.logger.Debug("push skipped, fcm circuit open", "chat_uuid", chatUUID)
+		} else if result.Err != nil {
+			h.logger.Warn("push failed", "chat_uuid", chatUUID, "error", result.Err)
+		} else {
+			h.logger.Debug("push sent", "chat_uuid", chatUUID)
+		}
 	}
 }
 
@@ -612,129 +1203,251 @@ func (h *Hub) handleMessageRead(ctx context.Context, client *Client, msg *WSMess
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
 		return
 	}
+	// Reading a message acknowledges its delivery too
+	h.ackDelivery(client, payload.ChatUUID, payload.MessageID)
 
-	h.redis.DeleteQueuedMessage(ctx, payload.ChatUUID, payload.MessageID)
+	if _, allowed := h.allowEvent(ctx, client, redisdb.RateCategoryRead); !allowed {
+		h.logger.Debug("message.read dropped", "reason", "rate_limited", "chat_uuid", payload.ChatUUID)
+		return
+	}
 
 	chat, err := h.redis.GetChat(ctx, payload.ChatUUID)
 	if err != nil {
 		return
 	}
 
-	// Find sender's participant ID (whoever is not us)
-	// We need to check who we are in this chat
-	deviceUUID := client.GetDeviceUUID()
-
-	// Find our participant ID
-	var ourParticipantID, otherParticipantID string
-	h.mu.RLock()
-	for key, devUUID := range h.chatParticipants {
-		if devUUID == deviceUUID {
-			// Key is chatUUID:participantID
-			if len(key) > len(payload.ChatUUID)+1 {
-				ourParticipantID = key[len(payload.ChatUUID)+1:]
-			}
-		}
+	// Find our participant ID from the chat record so the ack goes to everyone else
+	self := chat.ParticipantByDevice(client.GetDeviceUUID())
+	if self == nil {
+		h.logger.Debug("message.read ignored", "reason", "not_participant", "chat_uuid", payload.ChatUUID)
+		return
 	}
-	h.mu.RUnlock()
 
-	if chat.ParticipantA == ourParticipantID {
-		otherParticipantID = chat.ParticipantB
-	} else {
-		otherParticipantID = chat.ParticipantA
-	}
+	// Other recipients may still be waiting for their copy
+	h.redis.ReleaseQueuedMessage(ctx, payload.ChatUUID, payload.MessageID, self.ID)
 
-	// Find other participant's device
-	h.mu.RLock()
-	otherKey := chatParticipantKey(payload.ChatUUID, otherParticipantID)
-	otherDeviceUUID, found := h.chatParticipants[otherKey]
-	var other *Client
-	var online bool
-	if found {
-		other, online = h.clients[otherDeviceUUID]
-	}
-	h.mu.RUnlock()
+	h.redis.SetMessageState(ctx, chat, payload.MessageID, "", self.ID, redisdb.MessageRead)
+	h.startReadTTL(ctx, payload.ChatUUID, payload.MessageID, self.ID)
 
-	if online && other != nil {
-		other.SendMessage(&WSMessage{
+	for _, other := range chat.OtherParticipants(self.ID) {
+		h.routeToParticipant(ctx, chat, other.ID, &WSMessage{
 			Type: TypeMessageReadAck,
 			Payload: MessageReadAckPayload{
-				ChatUUID:  payload.ChatUUID,
-				MessageID: payload.MessageID,
+				ChatUUID:   payload.ChatUUID,
+				MessageID:  payload.MessageID,
+				ReaderUUID: self.ID,
 			},
 		})
 	}
 }
 
-func (h *Hub) handleTyping(ctx context.Context, client *Client, msg *WSMessage) {
+// handleChatMute mutes or unmutes push notifications for one of the client's chats
+func (h *Hub) handleChatMute(ctx context.Context, client *Client, msg *WSMessage) {
 	if !client.IsAuthed() {
 		return
 	}
 
 	payloadBytes, _ := json.Marshal(msg.Payload)
-	var payload TypingPayload
+	var payload ChatMutePayload
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		sendError(client, errcode.InvalidPayload, "Invalid mute payload")
 		return
 	}
 
-	// Validate credentials
 	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
 	if err != nil || !valid {
+		sendError(client, errcode.InvalidCredentials, "Invalid participant credentials")
 		return
 	}
 
 	chat, err := h.redis.GetChat(ctx, payload.ChatUUID)
 	if err != nil {
+		sendError(client, errcode.ChatNotFound, "Chat not found")
 		return
 	}
 
-	// Find other participant
-	otherParticipantID := chat.ParticipantA
-	if chat.ParticipantA == payload.ParticipantID {
-		otherParticipantID = chat.ParticipantB
+	muted := msg.Type == TypeChatMute
+	if err := h.redis.SetChatMuted(ctx, chat, payload.ParticipantID, muted); err != nil {
+		h.logger.Error("failed to set chat mute", "chat_uuid", payload.ChatUUID, "error", err)
+		sendError(client, errcode.Internal, "Failed to update mute")
+		return
 	}
 
-	h.mu.RLock()
-	otherKey := chatParticipantKey(payload.ChatUUID, otherParticipantID)
-	otherDeviceUUID, found := h.chatParticipants[otherKey]
-	var other *Client
-	var online bool
-	if found {
-		other, online = h.clients[otherDeviceUUID]
+	client.SendMessage(&WSMessage{
+		Type:    TypeChatMuteAck,
+		Payload: ChatMuteAckPayload{ChatUUID: payload.ChatUUID, Muted: muted},
+	})
+}
+
+// handleChatRotateSecret replaces a participant's secret without disturbing the chat
+// Routing is keyed by participant ID, so registrations made with the old secret keep working
+func (h *Hub) handleChatRotateSecret(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		sendError(client, errcode.NotAuthenticated, "Must authenticate first")
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload ChatRotateSecretPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil || payload.NewSecret == "" {
+		sendError(client, errcode.InvalidPayload, "Invalid rotate secret payload")
+		return
+	}
+
+	err := h.redis.RotateParticipantSecret(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret, payload.NewSecret)
+	if errors.Is(err, redisdb.ErrInvalidSecret) {
+		sendError(client, errcode.InvalidCredentials, "Invalid participant credentials")
+		return
+	}
+	if err != nil {
+		sendError(client, errcode.ChatNotFound, "Chat not found")
+		return
+	}
+
+	h.logger.Info("participant secret rotated", "chat_uuid", payload.ChatUUID)
+	client.SendMessage(&WSMessage{
+		Type:    TypeChatSecretRotated,
+		Payload: ChatSecretRotatedPayload{ChatUUID: payload.ChatUUID, ParticipantID: payload.ParticipantID},
+	})
+}
+
+// handleChatExtend keeps an active chat alive longer at either participant's request
+// Every participant is told the new lifetime, the requester even if it hasn't registered the chat
+func (h *Hub) handleChatExtend(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		sendError(client, errcode.NotAuthenticated, "Must authenticate first")
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload ChatExtendPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		sendError(client, errcode.InvalidPayload, "Invalid extend payload")
+		return
+	}
+	if !redisdb.ValidChatTTL(payload.TTL) {
+		sendError(client, errcode.InvalidTTL, "Invalid TTL, must be 5, 30, 60, 180, or 300")
+		return
+	}
+
+	chat, err := h.redis.ExtendChat(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret, payload.TTL, h.maxChatLifetime)
+	switch {
+	case errors.Is(err, redisdb.ErrInvalidSecret):
+		sendError(client, errcode.InvalidCredentials, "Invalid participant credentials")
+		return
+	case errors.Is(err, redisdb.ErrChatNotActive):
+		sendError(client, errcode.ChatNotActive, "Only active chats can be extended")
+		return
+	case errors.Is(err, redisdb.ErrChatNotExtended):
+		sendError(client, errcode.InvalidTTL, "TTL would not extend the chat")
+		return
+	case errors.Is(err, redisdb.ErrChatLifetimeExceeded):
+		sendError(client, errcode.ChatLifetimeMax, "Chat would outlive its maximum lifetime")
+		return
+	case err != nil:
+		sendError(client, errcode.ChatNotFound, "Chat not found")
+		return
+	}
+
+	h.logger.Info("chat extended", "chat_uuid", chat.ChatUUID, "ttl_seconds", chat.TTLSeconds)
+	extended := &WSMessage{
+		Type: TypeChatExtended,
+		Payload: ChatExtendedPayload{
+			ChatUUID:   chat.ChatUUID,
+			TTLSeconds: chat.TTLSeconds,
+			ExpiresAt:  chat.ExpiresAt().Unix(),
+			ExtendedBy: payload.ParticipantID,
+		},
+	}
+	for _, p := range chat.Participants {
+		if !h.routeToParticipant(ctx, chat, p.ID, extended) && p.ID == payload.ParticipantID {
+			client.SendMessage(extended)
+		}
+	}
+}
+
+// maxPingNonceLength bounds the nonce echoed back in a pong
+const maxPingNonceLength = 64
+
+// handlePing answers an application-level ping so clients can measure the round trip
+// Works before auth and touches nothing but the connection
+func (h *Hub) handlePing(client *Client, msg *WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload PingPayload
+	// A bare ping without a payload still gets its pong
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil || len(payload.Nonce) > maxPingNonceLength {
+		sendError(client, errcode.InvalidPayload, "Invalid ping payload")
+		return
+	}
+
+	client.SendMessage(&WSMessage{
+		Type: TypePong,
+		Payload: PongPayload{
+			Nonce:      payload.Nonce,
+			Timestamp:  payload.Timestamp,
+			ServerTime: time.Now().UnixMilli(),
+		},
+	})
+}
+
+func (h *Hub) handleTyping(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload TypingPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return
+	}
+
+	// Indicators are best-effort, so over budget they're dropped rather than warned about
+	if _, allowed := h.allowEvent(ctx, client, redisdb.RateCategoryTyping); !allowed {
+		return
+	}
+
+	// Validate credentials
+	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
+	if err != nil || !valid {
+		return
+	}
+
+	chat, err := h.redis.GetChat(ctx, payload.ChatUUID)
+	if err != nil {
+		return
 	}
-	h.mu.RUnlock()
 
-	if online && other != nil {
-		other.SendMessage(&WSMessage{
+	// Tell every other participant who started or stopped typing
+	for _, other := range chat.OtherParticipants(payload.ParticipantID) {
+		h.routeToParticipant(ctx, chat, other.ID, &WSMessage{
 			Type: TypeTypingIndicator,
 			Payload: TypingPayload{
-				ChatUUID: payload.ChatUUID,
+				ChatUUID:      payload.ChatUUID,
+				ParticipantID: payload.ParticipantID,
+				IsTyping:      msg.Type == TypeTypingStart,
 			},
 		})
 	}
 }
 
-// sendDeliveryConfirmation notifies sender that recipient received their message
-func (h *Hub) sendDeliveryConfirmation(ctx context.Context, chatUUID, messageID, senderParticipantID string) {
-	h.mu.RLock()
-	senderKey := chatParticipantKey(chatUUID, senderParticipantID)
-	senderDeviceUUID, found := h.chatParticipants[senderKey]
-	var senderClient *Client
-	var online bool
-	if found {
-		senderClient, online = h.clients[senderDeviceUUID]
-	}
-	h.mu.RUnlock()
-
-	if online && senderClient != nil {
-		senderClient.SendMessage(&WSMessage{
-			Type: TypeMessageDelivered,
-			Payload: MessageDeliveredPayload{
-				ChatUUID:  chatUUID,
-				MessageID: messageID,
-			},
-		})
-		fmt.Printf("[DEBUG] Sent message.delivered to sender for %s\n", messageID)
+// sendDeliveryConfirmation notifies sender that one recipient received their message
+func (h *Hub) sendDeliveryConfirmation(ctx context.Context, chatUUID, messageID, senderParticipantID, recipientParticipantID string) {
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil {
+		return
 	}
+
+	// Recorded first so a sender that's offline now still hears about it on chat.register
+	h.redis.SetMessageState(ctx, chat, messageID, senderParticipantID, recipientParticipantID, redisdb.MessageDelivered)
+
+	h.routeToParticipant(ctx, chat, senderParticipantID, &WSMessage{
+		Type: TypeMessageDelivered,
+		Payload: MessageDeliveredPayload{
+			ChatUUID:      chatUUID,
+			MessageID:     messageID,
+			RecipientUUID: recipientParticipantID,
+		},
+	})
 }
 
 // handlePushRegister registers an FCM token for a specific chat
@@ -745,23 +1458,34 @@ func (h *Hub) handlePushRegister(ctx context.Context, client *Client, msg *WSMes
 	payloadBytes, _ := json.Marshal(msg.Payload)
 	var payload PushRegisterPayload
 	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
-		fmt.Printf("[DEBUG] PUSH REGISTER: Invalid payload - %v\n", err)
+		h.logger.Debug("push.register rejected", "reason", "invalid_payload")
 		// Don't send response - client may have disconnected
 		return
 	}
 
-	fmt.Printf("[DEBUG] PUSH REGISTER: chat=%s participant=%s token=%.20s...\n",
-		payload.ChatUUID, payload.ParticipantID, payload.FCMToken)
+	h.logger.Debug("push.register", "chat_uuid", payload.ChatUUID)
 
 	// Validate using credentials from payload (not client auth state)
 	if payload.ParticipantID == "" || payload.ParticipantSecret == "" {
-		fmt.Printf("[DEBUG] PUSH REGISTER: Missing credentials in payload\n")
+		h.logger.Debug("push.register rejected", "reason", "missing_credentials", "chat_uuid", payload.ChatUUID)
 		return
 	}
 
 	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
 	if err != nil || !valid {
-		fmt.Printf("[DEBUG] PUSH REGISTER: Invalid credentials - valid=%v err=%v\n", valid, err)
+		h.logger.Debug("push.register rejected", "reason", "invalid_credentials", "chat_uuid", payload.ChatUUID)
+		return
+	}
+
+	// Refused now rather than failing at every send
+	if !h.pushTokenAccepted(ctx, payload.FCMToken) {
+		h.logger.Debug("push.register rejected", "reason", "invalid_token", "chat_uuid", payload.ChatUUID)
+		if client.IsAuthed() {
+			client.SendMessage(&WSMessage{
+				Type:    TypePushRegisterAck,
+				Payload: PushRegisterAckPayload{ChatUUID: payload.ChatUUID, Code: errcode.InvalidPushToken},
+			})
+		}
 		return
 	}
 
@@ -769,9 +1493,7 @@ func (h *Hub) handlePushRegister(ctx context.Context, client *Client, msg *WSMes
 	err = h.redis.RegisterPushForChat(ctx, payload.ChatUUID, payload.ParticipantID, payload.FCMToken)
 
 	if err != nil {
-		fmt.Printf("[DEBUG] PUSH REGISTER: Failed to store token - %v\n", err)
-	} else {
-		fmt.Printf("[DEBUG] PUSH REGISTER: Success - token stored in Redis\n")
+		h.logger.Error("failed to store push token", "chat_uuid", payload.ChatUUID, "error", err)
 	}
 
 	// Try to send ack, but don't fail if client disconnected
@@ -786,6 +1508,31 @@ func (h *Hub) handlePushRegister(ctx context.Context, client *Client, msg *WSMes
 	}
 }
 
+// pushTokenValidator returns the FCM check for registered tokens, or nil when it's off
+func pushTokenValidator(enabled bool) func(ctx context.Context, fcmToken string) error {
+	if !enabled {
+		return nil
+	}
+	return firebase.ValidateToken
+}
+
+// pushTokenAccepted reports whether a token may be registered
+// Malformed tokens are always refused; with validation on, so are tokens FCM rejects
+// If FCM can't be asked the token is given the benefit of the doubt
+func (h *Hub) pushTokenAccepted(ctx context.Context, fcmToken string) bool {
+	if !firebase.WellFormedToken(fcmToken) {
+		return false
+	}
+	if h.validateToken == nil || !h.pushReady() {
+		return true
+	}
+	err := h.validateToken(ctx, fcmToken)
+	if err != nil && !errors.Is(err, firebase.ErrTokenInvalid) {
+		h.logger.Warn("push token not validated", "error", err)
+	}
+	return !errors.Is(err, firebase.ErrTokenInvalid)
+}
+
 // handlePushUnregister removes push registration for a specific chat
 // NOTE: Does NOT require client.IsAuthed() because validation is done via payload credentials
 func (h *Hub) handlePushUnregister(ctx context.Context, client *Client, msg *WSMessage) {
@@ -795,17 +1542,17 @@ func (h *Hub) handlePushUnregister(ctx context.Context, client *Client, msg *WSM
 		return
 	}
 
-	fmt.Printf("[DEBUG] PUSH UNREGISTER: chat=%s participant=%s\n", payload.ChatUUID, payload.ParticipantID)
+	h.logger.Debug("push.unregister", "chat_uuid", payload.ChatUUID)
 
 	// Validate using credentials from payload
 	if payload.ParticipantID == "" || payload.ParticipantSecret == "" {
-		fmt.Printf("[DEBUG] PUSH UNREGISTER: Missing credentials in payload\n")
+		h.logger.Debug("push.unregister rejected", "reason", "missing_credentials", "chat_uuid", payload.ChatUUID)
 		return
 	}
 
 	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
 	if err != nil || !valid {
-		fmt.Printf("[DEBUG] PUSH UNREGISTER: Invalid credentials\n")
+		h.logger.Debug("push.unregister rejected", "reason", "invalid_credentials", "chat_uuid", payload.ChatUUID)
 		return
 	}
 
@@ -813,9 +1560,7 @@ func (h *Hub) handlePushUnregister(ctx context.Context, client *Client, msg *WSM
 	err = h.redis.DeletePushForChat(ctx, payload.ChatUUID, payload.ParticipantID)
 
 	if err != nil {
-		fmt.Printf("[DEBUG] PUSH UNREGISTER: Failed - %v\n", err)
-	} else {
-		fmt.Printf("[DEBUG] PUSH UNREGISTER: Success\n")
+		h.logger.Error("failed to delete push token", "chat_uuid", payload.ChatUUID, "error", err)
 	}
 
 	// Try to send ack if client still connected
@@ -849,15 +1594,13 @@ func (h *Hub) handlePushBurnAll(ctx context.Context, client *Client, msg *WSMess
 		return
 	}
 
-	fmt.Printf("[DEBUG] PUSH BURN ALL: participant_ids=%v\n", payload.ParticipantIDs)
-
 	// Delete all push registrations for these participant IDs
 	deleted, err := h.redis.DeleteAllPushForDevice(ctx, payload.ParticipantIDs)
 	if err != nil {
 		deleted = 0
 	}
 
-	fmt.Printf("[DEBUG] PUSH BURN ALL: deleted=%d\n", deleted)
+	h.logger.Debug("push.burn_all", "participants", len(payload.ParticipantIDs), "deleted", deleted)
 
 	client.SendMessage(&WSMessage{
 		Type: TypePushBurnAllAck,
@@ -880,36 +1623,15 @@ func (h *Hub) BroadcastToChat(ctx context.Context, chatUUID string, msg *WSMessa
 		return err
 	}
 
-	h.mu.RLock()
-	defer h.mu.RUnlock()
-
-	// Use participant mapping to find clients
-	keyA := chatParticipantKey(chatUUID, chat.ParticipantA)
-	keyB := chatParticipantKey(chatUUID, chat.ParticipantB)
-
-	if deviceA, ok := h.chatParticipants[keyA]; ok {
-		if clientA, ok := h.clients[deviceA]; ok {
-			clientA.SendMessage(msg)
-		}
-	}
-	if deviceB, ok := h.chatParticipants[keyB]; ok {
-		if clientB, ok := h.clients[deviceB]; ok {
-			clientB.SendMessage(msg)
-		}
+	for _, p := range chat.Participants {
+		h.routeToParticipant(ctx, chat, p.ID, msg)
 	}
 
 	return nil
 }
 
-func abs(n int64) int64 {
-	if n < 0 {
-		return -n
-	}
-	return n
-}
-
-func computeSignature(key, deviceUUID string, timestamp int64) string {
-	data := fmt.Sprintf("%s:%d", deviceUUID, timestamp)
+func computeSignature(key, deviceUUID string, timestamp int64, nonce string) string {
+	data := fmt.Sprintf("%s:%d:%s", deviceUUID, timestamp, nonce)
 	h := hmac.New(sha256.New, []byte(key))
 	h.Write([]byte(data))
 	return hex.EncodeToString(h.Sum(nil))
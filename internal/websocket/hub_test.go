@@ -0,0 +1,3805 @@
+package websocket
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"nihil/internal/audit"
+	"nihil/internal/config"
+	"nihil/internal/errcode"
+	"nihil/internal/firebase"
+	"nihil/internal/logging"
+	redisdb "nihil/internal/redis"
+)
+
+// To run these tests, you need Redis running locally:
+// docker run -d -p 6379:6379 redis:7-alpine
+
+func setupTestHub(t *testing.T) *Hub {
+	client, err := redisdb.NewClient("redis://localhost:6379")
+	if err != nil {
+		t.Skipf("Redis not available: %v", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	return NewHub(client, &config.Config{
+		RateLimitPerMinute:  120,
+		WSSendRateLimit:     120,
+		WSChatSendRateLimit: 60,
+		WSTypingRateLimit:   600,
+		WSReadRateLimit:     300,
+		MessageMaxSize:      10240,
+		PreKeyLowThreshold:  3,
+		ChatSweepInterval:   time.Second,
+	}, logging.Discard())
+}
+
+// newTestClient creates an authenticated client with no socket behind it
+func newTestClient(h *Hub, deviceUUID string) *Client {
+	c := &Client{
+		hub:        h,
+		send:       make(chan []byte, 256),
+		deviceUUID: deviceUUID,
+		authed:     true,
+
+		protocolVersion: MaxProtocolVersion,
+	}
+	h.mu.Lock()
+	h.connections[c] = true
+	h.mu.Unlock()
+	h.addClient(context.Background(), c)
+	return c
+}
+
+// waitMessage waits for the next outbound message, for events relayed asynchronously
+func waitMessage(t *testing.T, c *Client) WSMessage {
+	t.Helper()
+	select {
+	case data := <-c.send:
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Invalid outbound message: %v", err)
+		}
+		return msg
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for an outbound message")
+		return WSMessage{}
+	}
+}
+
+// nextMessage pops the next queued outbound message, failing if there is none
+func nextMessage(t *testing.T, c *Client) WSMessage {
+	t.Helper()
+	select {
+	case data := <-c.send:
+		var msg WSMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			t.Fatalf("Invalid outbound message: %v", err)
+		}
+		return msg
+	default:
+		t.Fatal("Expected an outbound message, got none")
+		return WSMessage{}
+	}
+}
+
+func TestSweepExpiredChats(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-sweep-" + suffix
+	token := "test-sweep-token-" + suffix
+	deviceA := "sweep-device-a-" + suffix
+	deviceB := "sweep-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 5, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	h.redis.QueueMessage(ctx, chatUUID, "msg-1", "pa", []byte("ciphertext"))
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.chatParticipants[chatParticipantKey(chatUUID, "pa")] = deviceA
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	// Not yet expired
+	h.sweepExpiredChats(ctx, time.Now())
+	if _, err := h.redis.GetChat(ctx, chatUUID); err != nil {
+		t.Fatalf("Chat expired too early: %v", err)
+	}
+
+	h.sweepExpiredChats(ctx, time.Now().Add(10*time.Second))
+
+	for _, c := range []*Client{clientA, clientB} {
+		msg := nextMessage(t, c)
+		if msg.Type != TypeChatExpired {
+			t.Errorf("Expected %s, got %s", TypeChatExpired, msg.Type)
+		}
+	}
+	if _, err := h.redis.GetChat(ctx, chatUUID); err == nil {
+		t.Error("Chat still exists after sweep")
+	}
+	if queued, _ := h.redis.GetQueuedMessages(ctx, chatUUID); len(queued) != 0 {
+		t.Errorf("Expected queued messages to be removed, got %d", len(queued))
+	}
+	if len(h.chatParticipants) != 0 {
+		t.Errorf("Expected participant mappings to be removed, got %v", h.chatParticipants)
+	}
+
+	// A second sweep over a now-missing chat must be a no-op
+	h.sweepExpiredChats(ctx, time.Now().Add(10*time.Second))
+
+	t.Logf("✓ Expired chat swept and both participants notified")
+}
+
+func TestCrossInstanceDelivery(t *testing.T) {
+	hubA := setupTestHub(t)
+	hubB := setupTestHub(t)
+	go hubA.Run()
+	go hubB.Run()
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-relay-" + suffix
+	token := "test-relay-token-" + suffix
+	deviceA := "relay-device-a-" + suffix
+	deviceB := "relay-device-b-" + suffix
+
+	if err := hubA.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	if _, _, err := hubA.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	defer hubA.redis.DeleteChat(ctx, chatUUID)
+
+	// Sender on instance A, recipient on instance B
+	clientA := newTestClient(hubA, deviceA)
+	clientB := newTestClient(hubB, deviceB)
+	hubA.chatParticipants[chatParticipantKey(chatUUID, "pa")] = deviceA
+	hubB.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	// Let the subscriptions reach Redis before publishing
+	time.Sleep(100 * time.Millisecond)
+
+	hubA.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-1",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+
+	if msg := waitMessage(t, clientB); msg.Type != TypeMessageReceived {
+		t.Fatalf("Expected %s on instance B, got %s", TypeMessageReceived, msg.Type)
+	}
+
+	// Sender gets its ack locally and the delivery confirmation relayed back
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		seen[waitMessage(t, clientA).Type] = true
+	}
+	if !seen[TypeMessageAck] || !seen[TypeMessageDelivered] {
+		t.Errorf("Expected %s and %s on instance A, got %v", TypeMessageAck, TypeMessageDelivered, seen)
+	}
+
+	if queued, _ := hubA.redis.GetQueuedMessages(ctx, chatUUID); len(queued) != 0 {
+		t.Errorf("Expected nothing queued for an online recipient, got %d", len(queued))
+	}
+
+	t.Logf("✓ Message delivered across instances")
+}
+
+// serveTestHub exposes the hub over a real WebSocket endpoint
+// Pumps are only started when pump is true, to simulate a stuck writer
+func serveTestHub(t *testing.T, h *Hub, pump bool) string {
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(h, conn)
+		h.Register(client)
+		if pump {
+			go client.WritePump()
+			go client.ReadPump()
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func dialTestHub(t *testing.T, url string) *websocket.Conn {
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to dial hub: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// waitConnections blocks until the hub has registered n connections
+func waitConnections(t *testing.T, h *Hub, n int) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		h.mu.RLock()
+		count := len(h.connections)
+		h.mu.RUnlock()
+		if count == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %d connections", n)
+}
+
+func TestWritePump_Compression(t *testing.T) {
+	h := &Hub{compressThreshold: 1024}
+
+	// Echoes every frame back through the client's send buffer
+	upgrader := websocket.Upgrader{EnableCompression: true}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(h, conn)
+		go client.WritePump()
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				client.Close()
+				return
+			}
+			client.send <- message
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	dialer := websocket.Dialer{EnableCompression: true}
+	conn, resp, err := dialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); !strings.Contains(ext, "permessage-deflate") {
+		t.Fatalf("Expected permessage-deflate negotiated, got %q", ext)
+	}
+
+	for _, size := range []int{64, 64 * 1024} {
+		content := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte("nihil"), size))
+		sent, _ := json.Marshal(WSMessage{Type: TypeMessageReceived, Payload: json.RawMessage(strconv.Quote(content))})
+		if err := conn.WriteMessage(websocket.TextMessage, sent); err != nil {
+			t.Fatalf("Failed to send %d byte message: %v", len(sent), err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		_, received, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to read %d byte message: %v", len(sent), err)
+		}
+		if !bytes.Equal(received, sent) {
+			t.Errorf("Expected %d byte message back intact, got %d bytes", len(sent), len(received))
+		}
+	}
+
+	t.Logf("✓ Compression negotiated and messages round-trip")
+}
+
+func TestReadPump_PongWait(t *testing.T) {
+	h := &Hub{
+		unregister: make(chan *Client),
+		writeWait:  time.Second,
+		pongWait:   300 * time.Millisecond,
+		pingPeriod: 100 * time.Millisecond,
+	}
+
+	// Pumps only, the hub isn't running
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		client := NewClient(h, conn)
+		go client.WritePump()
+		go client.ReadPump()
+	}))
+	t.Cleanup(srv.Close)
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	waitUnregister := func(within time.Duration) bool {
+		select {
+		case <-h.unregister:
+			return true
+		case <-time.After(within):
+			return false
+		}
+	}
+
+	// A peer that keeps reading answers every ping and stays connected
+	live := dialTestHub(t, url)
+	go func() {
+		for {
+			if _, _, err := live.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	if waitUnregister(3 * h.pongWait) {
+		t.Fatal("Expected a responsive peer to stay connected")
+	}
+	live.Close()
+	waitUnregister(time.Second)
+
+	// One that never reads never answers a ping
+	start := time.Now()
+	dialTestHub(t, url)
+	if !waitUnregister(5 * h.pongWait) {
+		t.Fatal("Expected an unresponsive peer to be disconnected")
+	}
+	if elapsed := time.Since(start); elapsed < h.pongWait {
+		t.Errorf("Expected disconnect after the %v pong wait, got %v", h.pongWait, elapsed)
+	}
+
+	t.Logf("✓ Peers that stop answering pings are dropped after the pong wait")
+}
+
+func TestShutdown_DrainsClients(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+
+	conn := dialTestHub(t, serveTestHub(t, h, true))
+	waitConnections(t, h, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	var msg WSMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read shutdown notice: %v", err)
+	}
+	if msg.Type != TypeServerShutdown {
+		t.Errorf("Expected %s, got %s", TypeServerShutdown, msg.Type)
+	}
+
+	_, _, err := conn.ReadMessage()
+	if !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Errorf("Expected a clean close, got %v", err)
+	}
+
+	t.Logf("✓ Client notified and closed on shutdown")
+}
+
+func TestShutdown_RefusesNewConnections(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	url := serveTestHub(t, h, true)
+
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatalf("Shutdown failed: %v", err)
+	}
+
+	conn := dialTestHub(t, url)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseNoStatusReceived) {
+		t.Errorf("Expected connection to be closed, got %v", err)
+	}
+
+	t.Logf("✓ New connections refused after shutdown")
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+
+	// No WritePump, so this client never finishes draining
+	dialTestHub(t, serveTestHub(t, h, false))
+	waitConnections(t, h, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	if err := h.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown blocked for %v", elapsed)
+	}
+
+	t.Logf("✓ Shutdown gives up on stuck clients at the deadline")
+}
+
+func TestGroupMessageFanOut(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-group-" + suffix
+	token := "test-group-token-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", "group-device-a-"+suffix, token, 3600, 3); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+
+	clients := map[string]*Client{"pa": newTestClient(h, "group-device-a-"+suffix)}
+	h.chatParticipants[chatParticipantKey(chatUUID, "pa")] = "group-device-a-" + suffix
+	for _, id := range []string{"pb", "pc"} {
+		deviceUUID := "group-device-" + id + "-" + suffix
+		if _, _, err := h.redis.JoinChat(ctx, token, deviceUUID, id, "s"+id); err != nil {
+			t.Fatalf("Failed to join chat: %v", err)
+		}
+		clients[id] = newTestClient(h, deviceUUID)
+		h.chatParticipants[chatParticipantKey(chatUUID, id)] = deviceUUID
+	}
+
+	h.HandleMessage(clients["pa"], &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-1",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+
+	for _, id := range []string{"pb", "pc"} {
+		if msg := nextMessage(t, clients[id]); msg.Type != TypeMessageReceived {
+			t.Errorf("Expected %s for %s, got %s", TypeMessageReceived, id, msg.Type)
+		}
+	}
+
+	// One delivery confirmation per recipient, then the ack
+	delivered := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		msg := nextMessage(t, clients["pa"])
+		if msg.Type != TypeMessageDelivered {
+			t.Fatalf("Expected %s, got %s", TypeMessageDelivered, msg.Type)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		recipient, _ := payload["recipient_uuid"].(string)
+		delivered[recipient] = true
+	}
+	if !delivered["pb"] || !delivered["pc"] {
+		t.Errorf("Expected delivery confirmations for pb and pc, got %v", delivered)
+	}
+	if msg := nextMessage(t, clients["pa"]); msg.Type != TypeMessageAck {
+		t.Errorf("Expected %s, got %s", TypeMessageAck, msg.Type)
+	}
+
+	t.Logf("✓ Group message delivered to every other participant")
+}
+
+func TestGroupQueue_ReadByOneKeptForOthers(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-group-queue-" + suffix
+	token := "test-group-queue-token-" + suffix
+	devices := map[string]string{}
+	for _, id := range []string{"pa", "pb", "pc"} {
+		devices[id] = "group-queue-device-" + id + "-" + suffix
+	}
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", devices["pa"], token, 3600, 3); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	for _, id := range []string{"pb", "pc"} {
+		if _, _, err := h.redis.JoinChat(ctx, token, devices[id], id, "s"+id); err != nil {
+			t.Fatalf("Failed to join chat: %v", err)
+		}
+	}
+
+	// pb and pc are both offline when pa sends
+	clientA := newTestClient(h, devices["pa"])
+	defer h.DisconnectDevice(devices["pa"])
+	h.chatParticipants[chatParticipantKey(chatUUID, "pa")] = devices["pa"]
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-1",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+
+	// Registers a participant and reads the message it was waiting for
+	readQueued := func(id string) {
+		t.Helper()
+		c := newTestClient(h, devices[id])
+		h.HandleMessage(c, &WSMessage{
+			Type:    TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{ChatUUID: chatUUID, ParticipantID: id, ParticipantSecret: "s" + id}}},
+		})
+		for {
+			msg := nextMessage(t, c)
+			if msg.Type != TypeMessageReceived {
+				continue
+			}
+			payload, _ := msg.Payload.(map[string]interface{})
+			if payload["message_id"] != "msg-1" {
+				t.Fatalf("Expected msg-1 for %s, got %v", id, payload["message_id"])
+			}
+			break
+		}
+		h.HandleMessage(c, &WSMessage{
+			Type:    TypeMessageRead,
+			Payload: MessageReadPayload{ChatUUID: chatUUID, MessageID: "msg-1"},
+		})
+	}
+
+	readQueued("pb")
+	defer h.DisconnectDevice(devices["pb"])
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-1"); queued == nil {
+		t.Fatal("Expected the message to stay queued for pc after pb read it")
+	}
+	if n, _ := h.redis.GetPendingMessageCount(ctx, chatUUID, "pb"); n != 0 {
+		t.Errorf("Expected nothing pending for pb, got %d", n)
+	}
+
+	readQueued("pc")
+	defer h.DisconnectDevice(devices["pc"])
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-1"); queued != nil {
+		t.Error("Expected the message to leave the queue once every recipient read it")
+	}
+
+	t.Logf("✓ A queued group message stays until every offline recipient has it")
+}
+
+func TestMessageSizeLimit(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-size-" + suffix
+	token := "test-size-token-" + suffix
+	deviceA := "size-device-a-" + suffix
+	deviceB := "size-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.chatParticipants[chatParticipantKey(chatUUID, "pa")] = deviceA
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	send := func(messageID string, size int) *WSMessage {
+		// Vary content so duplicate detection doesn't kick in
+		content := []byte(strings.Repeat(messageID[len(messageID)-1:], size))
+		return &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString(content),
+			},
+		}
+	}
+
+	// Exactly at the limit is delivered, and its full frame fits the read limit
+	under := send("msg-1", h.messageMaxSize)
+	frame, _ := json.Marshal(under)
+	if int64(len(frame)) > h.readLimit() {
+		t.Errorf("Frame of %d bytes exceeds read limit %d", len(frame), h.readLimit())
+	}
+	h.HandleMessage(clientA, under)
+	if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+		t.Errorf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+	}
+
+	// One byte over is rejected before it reaches the recipient
+	h.HandleMessage(clientA, send("msg-2", h.messageMaxSize+1))
+	for len(clientA.send) > 1 {
+		nextMessage(t, clientA)
+	}
+	msg := nextMessage(t, clientA)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeError || payload["code"] != string(errcode.MessageTooLarge) {
+		t.Errorf("Expected message_too_large error, got %s %v", msg.Type, payload)
+	}
+	if len(clientB.send) != 0 {
+		t.Error("Oversized message reached the recipient")
+	}
+
+	t.Logf("✓ Message at the limit delivered, one byte over rejected")
+}
+
+func TestCheckPreKeySupply_NotifiesOnce(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	deviceUUID := "prekey-device-" + time.Now().Format("150405.000000")
+	preKeys := make([]redisdb.PreKey, 5)
+	for i := range preKeys {
+		preKeys[i] = redisdb.PreKey{ID: i + 1, PublicKey: "pk"}
+	}
+	err := h.redis.StoreKeyBundle(ctx, deviceUUID, 1, "identity", redisdb.SignedPreKey{ID: 1}, preKeys)
+	if err != nil {
+		t.Fatalf("Failed to store key bundle: %v", err)
+	}
+	defer h.redis.DeleteKeyBundle(ctx, deviceUUID)
+
+	client := newTestClient(h, deviceUUID)
+
+	// Drain everything; threshold is 3 so the 3rd consume crosses it
+	for i := 0; i < 5; i++ {
+		h.redis.GetKeyBundle(ctx, deviceUUID)
+		h.CheckPreKeySupply(ctx, deviceUUID)
+	}
+
+	msg := nextMessage(t, client)
+	if msg.Type != TypeKeysReplenish {
+		t.Fatalf("Expected %s, got %s", TypeKeysReplenish, msg.Type)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["count"] != float64(2) {
+		t.Errorf("Expected count 2, got %v", payload["count"])
+	}
+	if len(client.send) != 0 {
+		t.Errorf("Expected exactly one notification, got %d more", len(client.send))
+	}
+
+	// Replenishing re-arms the notification
+	h.redis.AddPreKeys(ctx, deviceUUID, preKeys[:1])
+	h.redis.GetKeyBundle(ctx, deviceUUID)
+	h.CheckPreKeySupply(ctx, deviceUUID)
+	if msg := nextMessage(t, client); msg.Type != TypeKeysReplenish {
+		t.Errorf("Expected %s after replenish, got %s", TypeKeysReplenish, msg.Type)
+	}
+
+	t.Logf("✓ Low prekey supply reported once per shortage")
+}
+
+func TestHandleAuth_RejectsReplayedNonce(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	deviceUUID := "auth-device-" + time.Now().Format("150405.000000")
+	publicKey := "test-public-key"
+	_, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+	auth := func(nonce string) WSMessage {
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		timestamp := time.Now().Unix()
+		h.handleAuth(ctx, client, &WSMessage{
+			Type: TypeAuth,
+			Payload: AuthPayload{
+				DeviceUUID: deviceUUID,
+				Timestamp:  timestamp,
+				Nonce:      nonce,
+				Signature:  computeSignature(publicKey, deviceUUID, timestamp, nonce),
+			},
+		})
+		h.removeClient(ctx, deviceUUID)
+		return nextMessage(t, client)
+	}
+
+	if msg := auth("nonce-1"); msg.Type != TypeAuthSuccess {
+		t.Fatalf("Expected %s for fresh nonce, got %s", TypeAuthSuccess, msg.Type)
+	}
+
+	msg := auth("nonce-1")
+	if msg.Type != TypeAuthFailed {
+		t.Fatalf("Expected %s for replayed nonce, got %s", TypeAuthFailed, msg.Type)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["reason"] != "replayed_nonce" {
+		t.Errorf("Expected reason replayed_nonce, got %v", payload["reason"])
+	}
+
+	if msg := auth("nonce-2"); msg.Type != TypeAuthSuccess {
+		t.Errorf("Expected %s for second fresh nonce, got %s", TypeAuthSuccess, msg.Type)
+	}
+
+	t.Logf("✓ Replayed auth rejected, fresh nonce accepted")
+}
+
+func TestMessageStates_ReplayedOnRegister(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-receipts-" + suffix
+	token := "test-receipts-token-" + suffix
+	deviceA := "receipts-device-a-" + suffix
+	deviceB := "receipts-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	register := func(deviceUUID, participantID, secret string) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+				ChatUUID:          chatUUID,
+				ParticipantID:     participantID,
+				ParticipantSecret: secret,
+			}}},
+		})
+		return c
+	}
+	// drain returns the message types sent before the register ack
+	drain := func(c *Client) []string {
+		var types []string
+		for {
+			msg := nextMessage(t, c)
+			if msg.Type == TypeChatRegisterAck {
+				return types
+			}
+			types = append(types, msg.Type)
+		}
+	}
+
+	// A sends while B is offline, then goes offline itself
+	clientA := register(deviceA, "pa", "sa")
+	drain(clientA)
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-1",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+	if msg := nextMessage(t, clientA); msg.Type != TypeMessageAck {
+		t.Fatalf("Expected %s, got %s", TypeMessageAck, msg.Type)
+	}
+	h.DisconnectDevice(deviceA)
+
+	// B comes online and receives the queued message
+	clientB := register(deviceB, "pb", "sb")
+	if types := drain(clientB); len(types) != 1 || types[0] != TypeMessageReceived {
+		t.Fatalf("Expected queued message for B, got %v", types)
+	}
+
+	clientA = register(deviceA, "pa", "sa")
+	if types := drain(clientA); len(types) != 1 || types[0] != TypeMessageDelivered {
+		t.Fatalf("Expected replayed delivery receipt, got %v", types)
+	}
+	h.DisconnectDevice(deviceA)
+
+	// B reads it while A is offline
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chatUUID, MessageID: "msg-1"},
+	})
+
+	clientA = register(deviceA, "pa", "sa")
+	if types := drain(clientA); len(types) != 1 || types[0] != TypeMessageReadAck {
+		t.Fatalf("Expected replayed read receipt, got %v", types)
+	}
+	h.DisconnectDevice(deviceA)
+
+	// Fully read messages are not replayed again
+	clientA = register(deviceA, "pa", "sa")
+	if types := drain(clientA); len(types) != 0 {
+		t.Errorf("Expected no receipts after read was replayed, got %v", types)
+	}
+
+	t.Logf("✓ Delivery and read receipts replayed to a sender that was offline")
+}
+
+func TestPresence_QueryAndSubscribe(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-presence-" + suffix
+	token := "test-presence-token-" + suffix
+	deviceA := "presence-device-a-" + suffix
+	deviceB := "presence-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientB := newTestClient(h, deviceB)
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	presence := func(msgType string) {
+		h.HandleMessage(clientB, &WSMessage{
+			Type:    msgType,
+			Payload: PresencePayload{ChatUUID: chatUUID, ParticipantID: "pb", ParticipantSecret: "sb"},
+		})
+	}
+	online := func(msg WSMessage) bool {
+		payload, _ := msg.Payload.(map[string]interface{})
+		if participants, ok := payload["participants"].([]interface{}); ok && len(participants) == 1 {
+			payload, _ = participants[0].(map[string]interface{})
+		}
+		if payload["participant_id"] != "pa" {
+			t.Fatalf("Expected status for pa, got %v", payload)
+		}
+		return payload["online"] == true
+	}
+
+	presence(TypePresenceSubscribe)
+	if msg := nextMessage(t, clientB); msg.Type != TypePresenceStatus || online(msg) {
+		t.Fatalf("Expected pa offline, got %s %v", msg.Type, msg.Payload)
+	}
+
+	// A connects and registers the chat
+	clientA := newTestClient(h, deviceA)
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+			ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa",
+		}}},
+	})
+	if msg := nextMessage(t, clientB); msg.Type != TypePresenceUpdate || !online(msg) {
+		t.Fatalf("Expected pa online update, got %s %v", msg.Type, msg.Payload)
+	}
+
+	presence(TypePresenceQuery)
+	if msg := nextMessage(t, clientB); msg.Type != TypePresenceStatus || !online(msg) {
+		t.Fatalf("Expected pa online, got %s %v", msg.Type, msg.Payload)
+	}
+
+	h.DisconnectDevice(deviceA)
+	if msg := nextMessage(t, clientB); msg.Type != TypePresenceUpdate || online(msg) {
+		t.Fatalf("Expected pa offline update, got %s %v", msg.Type, msg.Payload)
+	}
+
+	// Disconnecting drops the subscription
+	h.DisconnectDevice(deviceB)
+	h.mu.RLock()
+	subs := len(h.presenceSubs)
+	h.mu.RUnlock()
+	if subs != 0 {
+		t.Errorf("Expected no presence subscriptions after disconnect, got %d", subs)
+	}
+
+	t.Logf("✓ Presence queried and pushed to subscribers")
+}
+
+func TestTypingIndicator_StartStop(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-typing-" + suffix
+	token := "test-typing-token-" + suffix
+	deviceA := "typing-device-a-" + suffix
+	deviceB := "typing-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	for _, tc := range []struct {
+		msgType  string
+		isTyping bool
+	}{
+		{TypeTypingStart, true},
+		{TypeTypingStop, false},
+	} {
+		h.HandleMessage(clientA, &WSMessage{
+			Type:    tc.msgType,
+			Payload: TypingPayload{ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa"},
+		})
+
+		msg := nextMessage(t, clientB)
+		if msg.Type != TypeTypingIndicator {
+			t.Fatalf("Expected %s, got %s", TypeTypingIndicator, msg.Type)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		if payload["chat_uuid"] != chatUUID {
+			t.Errorf("Expected chat_uuid %s, got %v", chatUUID, payload["chat_uuid"])
+		}
+		if payload["is_typing"] != tc.isTyping {
+			t.Errorf("%s: expected is_typing=%v, got %v", tc.msgType, tc.isTyping, payload["is_typing"])
+		}
+	}
+
+	t.Logf("✓ typing.stop clears the indicator")
+}
+
+func TestRateLimit_SendAndTypingBudgets(t *testing.T) {
+	h := setupTestHub(t)
+	h.rateLimits[redisdb.RateCategorySend] = 2
+	h.rateLimits[redisdb.RateCategoryTyping] = 20
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-wsrate-" + suffix
+	token := "test-wsrate-token-" + suffix
+	deviceA := "wsrate-device-a-" + suffix
+	deviceB := "wsrate-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceA)
+	defer h.redis.Unban(ctx, deviceA)
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+
+	typing := func(n int) {
+		t.Helper()
+		for i := 0; i < n; i++ {
+			h.HandleMessage(clientA, &WSMessage{
+				Type:    TypeTypingStart,
+				Payload: TypingPayload{ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa"},
+			})
+			if msg := nextMessage(t, clientB); msg.Type != TypeTypingIndicator {
+				t.Fatalf("Expected %s, got %s", TypeTypingIndicator, msg.Type)
+			}
+		}
+	}
+	send := func(messageID string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte(messageID)),
+			},
+		})
+	}
+
+	// A burst of typing well past the send limit leaves the send budget untouched
+	typing(5)
+	for _, id := range []string{"msg-1", "msg-2"} {
+		send(id)
+		if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+			t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+		}
+	}
+	for len(clientA.send) > 0 {
+		nextMessage(t, clientA)
+	}
+
+	// The third send is over budget and warned
+	send("msg-3")
+	if msg := nextMessage(t, clientA); msg.Type != TypeRateLimitWarning {
+		t.Fatalf("Expected %s, got %s", TypeRateLimitWarning, msg.Type)
+	}
+	if len(clientB.send) != 0 {
+		t.Error("Rate limited message reached the recipient")
+	}
+
+	// Typing still goes through on its own budget
+	typing(5)
+
+	// Repeat abuse bans the device
+	go func() { <-h.unregister }()
+	send("msg-4")
+	if msg := nextMessage(t, clientA); msg.Type != TypeBanned {
+		t.Fatalf("Expected %s, got %s", TypeBanned, msg.Type)
+	}
+
+	t.Logf("✓ Sends warned then banned over budget, typing unaffected")
+}
+
+func TestRateLimit_PerChatBudget(t *testing.T) {
+	h := setupTestHub(t)
+	h.rateLimits[redisdb.RateCategorySend] = 10
+	h.chatSendRateLimit = 2
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	deviceA := "chatrate-device-a-" + suffix
+	defer h.redis.PurgeDevice(ctx, deviceA)
+	clientA := newTestClient(h, deviceA)
+
+	// deviceA talks to a different recipient in each chat
+	chats := make([]string, 2)
+	recipients := make([]*Client, 2)
+	for i := range chats {
+		chats[i] = fmt.Sprintf("test-chatrate-%d-%s", i, suffix)
+		token := fmt.Sprintf("test-chatrate-token-%d-%s", i, suffix)
+		deviceB := fmt.Sprintf("chatrate-device-b%d-%s", i, suffix)
+		if err := h.redis.CreateChat(ctx, chats[i], "pa", "sa", deviceA, token, 3600, 2); err != nil {
+			t.Fatalf("Failed to create chat: %v", err)
+		}
+		defer h.redis.DeleteChat(ctx, chats[i])
+		if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+			t.Fatalf("Failed to join chat: %v", err)
+		}
+		recipients[i] = newTestClient(h, deviceB)
+		h.chatParticipants[chatParticipantKey(chats[i], "pb")] = deviceB
+	}
+
+	send := func(chat int, messageID string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chats[chat],
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte(messageID)),
+			},
+		})
+	}
+
+	for _, id := range []string{"msg-1", "msg-2"} {
+		send(0, id)
+		if msg := nextMessage(t, recipients[0]); msg.Type != TypeMessageReceived {
+			t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+		}
+	}
+	for len(clientA.send) > 0 {
+		nextMessage(t, clientA)
+	}
+
+	// The first chat is at its cap even though the device budget isn't
+	send(0, "msg-3")
+	msg := nextMessage(t, clientA)
+	if msg.Type != TypeRateLimitWarning {
+		t.Fatalf("Expected %s, got %s", TypeRateLimitWarning, msg.Type)
+	}
+	payload := msg.Payload.(map[string]interface{})
+	if payload["chat_uuid"] != chats[0] {
+		t.Errorf("Expected warning for chat %s, got %v", chats[0], payload["chat_uuid"])
+	}
+	// Both sends were just now, so the window has room again in about a minute
+	if retry, _ := payload["retry_after_seconds"].(float64); retry < 58 || retry > 60 {
+		t.Errorf("Expected retry_after_seconds close to 60, got %v", payload["retry_after_seconds"])
+	}
+	if len(recipients[0].send) != 0 {
+		t.Error("Rate limited message reached the recipient")
+	}
+
+	// The device's other chat is unaffected
+	send(1, "msg-4")
+	if msg := nextMessage(t, recipients[1]); msg.Type != TypeMessageReceived {
+		t.Fatalf("Expected %s in the other chat, got %s", TypeMessageReceived, msg.Type)
+	}
+
+	t.Logf("✓ One chat hitting its cap leaves the device's other chats alone")
+}
+
+func TestStuckClient_EvictedAndQueued(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-stuck-" + suffix
+	token := "test-stuck-token-" + suffix
+	deviceA := "stuck-device-a-" + suffix
+	deviceB := "stuck-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.mu.Lock()
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+	h.mu.Unlock()
+
+	// B's writer is wedged: its buffer is full and nothing drains it
+	for len(clientB.send) < cap(clientB.send) {
+		clientB.send <- []byte("{}")
+	}
+
+	send := func(messageID string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte(messageID)),
+			},
+		})
+	}
+
+	for i := 1; i <= maxBufferFullSends; i++ {
+		send(fmt.Sprintf("msg-%d", i))
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if _, ok := h.GetClient(deviceB); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the stuck client to be evicted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := h.BufferFullEvictions(); n != 1 {
+		t.Errorf("Expected 1 buffer-full eviction, got %d", n)
+	}
+
+	// Everything B couldn't take was queued, and so is what follows the eviction
+	send("msg-after")
+	_, total, err := h.redis.GetQueuedMessagesRange(ctx, chatUUID, 0, 10)
+	if err != nil {
+		t.Fatalf("Failed to read queue: %v", err)
+	}
+	if total != maxBufferFullSends+1 {
+		t.Errorf("Expected %d queued messages, got %d", maxBufferFullSends+1, total)
+	}
+
+	t.Logf("✓ Stuck client evicted after %d full sends, its messages queued", maxBufferFullSends)
+}
+
+func TestLogout_QueuesInsteadOfDelivering(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-logout-" + suffix
+	token := "test-logout-token-" + suffix
+	deviceA := "logout-device-a-" + suffix
+	deviceB := "logout-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	clientB.protocolVersion = ProtocolV2
+	h.mu.Lock()
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+	h.mu.Unlock()
+
+	h.HandleMessage(clientB, &WSMessage{Type: TypeLogout})
+	if msg := nextMessage(t, clientB); msg.Type != TypeLogoutAck {
+		t.Fatalf("Expected %s, got %s", TypeLogoutAck, msg.Type)
+	}
+	if !clientB.isLoggedOut() {
+		t.Fatal("Expected ReadPump told to stop reading")
+	}
+	if _, ok := h.GetClient(deviceB); ok {
+		t.Fatal("Expected the logged out client unregistered")
+	}
+
+	// The unregister from ReadPump exiting closes the connection
+	h.unregister <- clientB
+	if _, ok := <-clientB.send; ok {
+		t.Fatal("Expected the connection closed after the ack")
+	}
+
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-after-logout",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("hello")),
+		},
+	})
+
+	if msg := nextMessage(t, clientA); msg.Type != TypeMessageAck {
+		t.Fatalf("Expected %s, got %s", TypeMessageAck, msg.Type)
+	}
+	select {
+	case data := <-clientA.send:
+		t.Errorf("Expected no delivery confirmation, got %s", data)
+	default:
+	}
+	if queued, _ := h.redis.GetQueuedMessages(ctx, chatUUID); len(queued) != 1 {
+		t.Errorf("Expected the message queued for the logged out device, got %d", len(queued))
+	}
+	if _, err := h.redis.GetChat(ctx, chatUUID); err != nil {
+		t.Errorf("Expected the chat left in place, got %v", err)
+	}
+
+	t.Logf("✓ Logout unregisters the client and later messages are queued")
+}
+
+func TestLogout_PipelinedFramesIgnored(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	ctx := context.Background()
+
+	deviceUUID := "logout-pipelined-" + time.Now().Format("150405.000000")
+	publicKey := "test-public-key"
+	if _, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+	conn := dialTestHub(t, serveTestHub(t, h, true))
+	send := func(msg WSMessage) {
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatalf("Failed to send %s: %v", msg.Type, err)
+		}
+	}
+	read := func() (WSMessage, error) {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		var msg WSMessage
+		err := conn.ReadJSON(&msg)
+		return msg, err
+	}
+	auth := func(nonce string) WSMessage {
+		timestamp := time.Now().Unix()
+		return WSMessage{Type: TypeAuth, Payload: AuthPayload{
+			DeviceUUID:      deviceUUID,
+			Timestamp:       timestamp,
+			Nonce:           nonce,
+			Signature:       computeSignature(publicKey, deviceUUID, timestamp, nonce),
+			ProtocolVersion: ProtocolV2,
+		}}
+	}
+
+	send(auth("pipelined-nonce-1"))
+	if msg, err := read(); err != nil || msg.Type != TypeAuthSuccess {
+		t.Fatalf("Expected %s, got %s %v", TypeAuthSuccess, msg.Type, err)
+	}
+
+	// Frames written right behind the logout, before the server closes the connection
+	send(WSMessage{Type: TypeLogout})
+	send(WSMessage{Type: TypePing, Payload: PingPayload{}})
+	send(auth("pipelined-nonce-2"))
+
+	if msg, err := read(); err != nil || msg.Type != TypeLogoutAck {
+		t.Fatalf("Expected %s, got %s %v", TypeLogoutAck, msg.Type, err)
+	}
+	if msg, err := read(); err == nil {
+		t.Fatalf("Expected the connection closed after the ack, got %s", msg.Type)
+	} else if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseNoStatusReceived) {
+		t.Fatalf("Expected a close frame, got %v", err)
+	}
+
+	waitConnections(t, h, 0)
+	if _, ok := h.GetClient(deviceUUID); ok {
+		t.Error("Expected the pipelined auth not to register the logged out client again")
+	}
+
+	t.Logf("✓ Frames pipelined after logout are ignored without touching the closed connection")
+}
+
+func TestMessageSend_DeduplicatesMessageID(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-dedup-" + suffix
+	token := "test-dedup-token-" + suffix
+	deviceA := "dedup-device-a-" + suffix
+	deviceB := "dedup-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	clientB := newTestClient(h, deviceB)
+	h.mu.Lock()
+	h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+	h.mu.Unlock()
+
+	send := func() {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         "msg-retried",
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("hello")),
+			},
+		})
+	}
+
+	send()
+	var acks []string
+	for len(clientA.send) > 0 {
+		data := <-clientA.send
+		if bytes.Contains(data, []byte(TypeMessageAck)) {
+			acks = append(acks, string(data))
+		}
+	}
+	send()
+	if len(clientA.send) != 1 {
+		t.Fatalf("Expected only an ack for the retry, got %d messages", len(clientA.send))
+	}
+	acks = append(acks, string(<-clientA.send))
+
+	if len(acks) != 2 || acks[0] != acks[1] {
+		t.Errorf("Expected two identical acks, got %v", acks)
+	}
+	if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+		t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+	}
+	if len(clientB.send) != 0 {
+		t.Errorf("Expected one delivery, got %d more", len(clientB.send))
+	}
+	if queued, _ := h.redis.GetQueuedMessages(ctx, chatUUID); len(queued) != 0 {
+		t.Errorf("Expected nothing queued, got %d", len(queued))
+	}
+
+	t.Logf("✓ Retried message.send acked again without redelivery")
+}
+
+func TestDeviceConnectionLimit(t *testing.T) {
+	for _, policy := range []string{ConnPolicyReplace, ConnPolicyReject} {
+		t.Run(policy, func(t *testing.T) {
+			h := setupTestHub(t)
+			h.maxDeviceConns = 2
+			h.deviceConnPolicy = policy
+			ctx := context.Background()
+
+			deviceUUID := "conn-limit-" + policy + "-" + time.Now().Format("150405.000000")
+			publicKey := "test-public-key"
+			_, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatalf("Failed to create subscription: %v", err)
+			}
+			defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+			connect := func(i int) (*Client, WSMessage) {
+				client := &Client{hub: h, send: make(chan []byte, 16)}
+				h.mu.Lock()
+				h.connections[client] = true
+				h.mu.Unlock()
+
+				timestamp := time.Now().Unix()
+				nonce := fmt.Sprintf("conn-%d", i)
+				h.handleAuth(ctx, client, &WSMessage{
+					Type: TypeAuth,
+					Payload: AuthPayload{
+						DeviceUUID: deviceUUID,
+						Timestamp:  timestamp,
+						Nonce:      nonce,
+						Signature:  computeSignature(publicKey, deviceUUID, timestamp, nonce),
+					},
+				})
+				return client, nextMessage(t, client)
+			}
+
+			var clients []*Client
+			for i := 0; i < 2; i++ {
+				c, msg := connect(i)
+				if msg.Type != TypeAuthSuccess {
+					t.Fatalf("Connection %d: expected %s, got %s", i+1, TypeAuthSuccess, msg.Type)
+				}
+				clients = append(clients, c)
+			}
+			defer h.removeClient(ctx, deviceUUID)
+
+			third, msg := connect(2)
+			switch policy {
+			case ConnPolicyReplace:
+				if msg.Type != TypeAuthSuccess {
+					t.Fatalf("Expected %s, got %s", TypeAuthSuccess, msg.Type)
+				}
+				if evicted := nextMessage(t, clients[0]); evicted.Type != TypeSessionReplaced {
+					t.Errorf("Expected %s for oldest, got %s", TypeSessionReplaced, evicted.Type)
+				}
+				if _, open := <-clients[0].send; open {
+					t.Error("Expected oldest connection's buffer to be closed")
+				}
+				if len(clients[1].send) != 0 {
+					t.Error("Expected newer connection to be left alone")
+				}
+				if c, _ := h.GetClient(deviceUUID); c != third {
+					t.Error("Expected newest connection to own the device")
+				}
+			case ConnPolicyReject:
+				if msg.Type != TypeAuthFailed {
+					t.Fatalf("Expected %s, got %s", TypeAuthFailed, msg.Type)
+				}
+				if third.IsAuthed() {
+					t.Error("Expected rejected connection to stay unauthenticated")
+				}
+			}
+
+			h.mu.RLock()
+			live := len(h.connections)
+			h.mu.RUnlock()
+			if want := map[string]int{ConnPolicyReplace: 2, ConnPolicyReject: 3}[policy]; live != want {
+				t.Errorf("Expected %d tracked connections, got %d", want, live)
+			}
+
+			t.Logf("✓ Connection over the per-device limit handled by %s policy", policy)
+		})
+	}
+}
+
+func TestDeviceConnectionLimit_CountsPendingAuth(t *testing.T) {
+	h := setupTestHub(t)
+	h.maxDeviceConns = 1
+	h.deviceConnPolicy = ConnPolicyReject
+
+	deviceUUID := "conn-limit-pending-" + time.Now().Format("150405.000000")
+	connect := func() *Client {
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		h.mu.Lock()
+		h.connections[client] = true
+		h.mu.Unlock()
+		return client
+	}
+
+	// Two auths for the device arrive together; neither has finished authenticating
+	first, second := connect(), connect()
+	if !h.admitDeviceConnection(first, deviceUUID) {
+		t.Fatal("Expected the first connection admitted")
+	}
+	if h.admitDeviceConnection(second, deviceUUID) {
+		t.Error("Expected the second connection refused while the first is still authenticating")
+	}
+
+	// Another device is unaffected
+	if !h.admitDeviceConnection(second, deviceUUID+"-other") {
+		t.Error("Expected a different device admitted")
+	}
+
+	t.Logf("✓ A connection still authenticating holds its device's slot")
+}
+
+func TestAuthResume(t *testing.T) {
+	h := setupTestHub(t)
+	h.resumeTTL = time.Second
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-resume-" + suffix
+	deviceUUID := "resume-device-" + suffix
+	publicKey := "test-public-key"
+
+	_, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceUUID, "test-resume-token-"+suffix, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+
+	connect := func() *Client {
+		c := &Client{hub: h, send: make(chan []byte, 16)}
+		h.mu.Lock()
+		h.connections[c] = true
+		h.mu.Unlock()
+		return c
+	}
+	resumeToken := func(msg WSMessage) string {
+		if msg.Type != TypeAuthSuccess {
+			t.Fatalf("Expected %s, got %s %v", TypeAuthSuccess, msg.Type, msg.Payload)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		token, _ := payload["resume_token"].(string)
+		if token == "" {
+			t.Fatal("Expected a resume token in auth.success")
+		}
+		return token
+	}
+	resume := func(token string) (*Client, WSMessage) {
+		c := connect()
+		h.HandleMessage(c, &WSMessage{
+			Type:    TypeAuthResume,
+			Payload: AuthResumePayload{DeviceUUID: deviceUUID, ResumeToken: token},
+		})
+		return c, nextMessage(t, c)
+	}
+
+	// Full auth, then register the chat
+	client := connect()
+	timestamp := time.Now().Unix()
+	h.handleAuth(ctx, client, &WSMessage{
+		Type: TypeAuth,
+		Payload: AuthPayload{
+			DeviceUUID: deviceUUID,
+			Timestamp:  timestamp,
+			Nonce:      "resume-nonce",
+			Signature:  computeSignature(publicKey, deviceUUID, timestamp, "resume-nonce"),
+		},
+	})
+	token := resumeToken(nextMessage(t, client))
+	h.HandleMessage(client, &WSMessage{
+		Type: TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+			ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa",
+		}}},
+	})
+	nextMessage(t, client)
+	h.DisconnectDevice(deviceUUID)
+
+	// Resume within the window restores the registration
+	client, msg := resume(token)
+	next := resumeToken(msg)
+	if ack := nextMessage(t, client); ack.Type != TypeChatRegisterAck {
+		t.Fatalf("Expected %s, got %s", TypeChatRegisterAck, ack.Type)
+	}
+	h.mu.RLock()
+	mapped := h.chatParticipants[chatParticipantKey(chatUUID, "pa")]
+	h.mu.RUnlock()
+	if mapped != deviceUUID {
+		t.Errorf("Expected chat registration restored, got %q", mapped)
+	}
+
+	// Tokens are single use
+	if _, msg := resume(token); msg.Type != TypeAuthFailed {
+		t.Errorf("Expected reused token to fail, got %s", msg.Type)
+	}
+
+	// After the window the token is gone
+	h.DisconnectDevice(deviceUUID)
+	time.Sleep(1500 * time.Millisecond)
+	if _, msg := resume(next); msg.Type != TypeAuthFailed {
+		t.Errorf("Expected expired token to fail, got %s", msg.Type)
+	}
+
+	t.Logf("✓ Resume token restores registrations once, within its window")
+}
+
+func TestAuth_SubscriptionGrace(t *testing.T) {
+	h := setupTestHub(t)
+	h.redis.SetSubscriptionGrace(time.Hour)
+	ctx := context.Background()
+
+	deviceUUID := "grace-device-" + time.Now().Format("150405.000000")
+	publicKey := "test-public-key"
+	_, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+	defer h.removeClient(ctx, deviceUUID)
+
+	client := &Client{hub: h, send: make(chan []byte, 16)}
+	timestamp := time.Now().Unix()
+	h.handleAuth(ctx, client, &WSMessage{
+		Type: TypeAuth,
+		Payload: AuthPayload{
+			DeviceUUID: deviceUUID,
+			Timestamp:  timestamp,
+			Nonce:      "grace-nonce",
+			Signature:  computeSignature(publicKey, deviceUUID, timestamp, "grace-nonce"),
+		},
+	})
+
+	msg := nextMessage(t, client)
+	if msg.Type != TypeAuthSuccess {
+		t.Fatalf("Expected %s during grace, got %s", TypeAuthSuccess, msg.Type)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	sub, _ := payload["subscription"].(map[string]interface{})
+	if sub["status"] != "grace" {
+		t.Errorf("Expected grace status, got %v", sub["status"])
+	}
+	if msg := nextMessage(t, client); msg.Type != TypeSubGrace {
+		t.Errorf("Expected %s warning, got %s", TypeSubGrace, msg.Type)
+	}
+
+	t.Logf("✓ Expired subscription authenticates with a warning during grace")
+}
+
+func TestMessageEditDelete(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-edits-" + suffix
+	token := "test-edits-token-" + suffix
+	deviceA := "edits-device-a-" + suffix
+	deviceB := "edits-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	register := func(deviceUUID, participantID, secret string) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+				ChatUUID:          chatUUID,
+				ParticipantID:     participantID,
+				ParticipantSecret: secret,
+			}}},
+		})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	send := func(c *Client, messageID, text string) {
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte(text)),
+			},
+		})
+	}
+
+	clientA := register(deviceA, "pa", "sa")
+
+	t.Run("edit_queued", func(t *testing.T) {
+		send(clientA, "msg-edit", "original")
+		if msg := nextMessage(t, clientA); msg.Type != TypeMessageAck {
+			t.Fatalf("Expected %s, got %s", TypeMessageAck, msg.Type)
+		}
+
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageEdit,
+			Payload: MessageEditPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         "msg-edit",
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("edited")),
+			},
+		})
+
+		queued, err := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-edit")
+		if err != nil || queued == nil {
+			t.Fatalf("Expected message still queued: %v", err)
+		}
+		if string(queued.EncryptedContent) != "edited" {
+			t.Errorf("Expected queued content replaced, got %q", queued.EncryptedContent)
+		}
+
+		// Only the sender may edit
+		clientB := newTestClient(h, deviceB)
+		h.HandleMessage(clientB, &WSMessage{
+			Type: TypeMessageEdit,
+			Payload: MessageEditPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pb",
+				ParticipantSecret: "sb",
+				MessageID:         "msg-edit",
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("hijacked")),
+			},
+		})
+		msg := nextMessage(t, clientB)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != TypeError || payload["code"] != string(errcode.NotMessageSender) {
+			t.Errorf("Expected not_message_sender error, got %s %v", msg.Type, payload)
+		}
+		h.DisconnectDevice(deviceB)
+	})
+
+	t.Run("delete_delivered", func(t *testing.T) {
+		clientB := register(deviceB, "pb", "sb")
+		defer h.DisconnectDevice(deviceB)
+
+		send(clientA, "msg-delete", "to be unsent")
+		if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+			t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+		}
+		for nextMessage(t, clientA).Type != TypeMessageAck {
+		}
+
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageDelete,
+			Payload: MessageDeletePayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         "msg-delete",
+			},
+		})
+
+		msg := nextMessage(t, clientB)
+		if msg.Type != TypeMessageDeleted {
+			t.Fatalf("Expected %s, got %s", TypeMessageDeleted, msg.Type)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		if payload["message_id"] != "msg-delete" || payload["sender_uuid"] != "pa" {
+			t.Errorf("Unexpected delete payload %v", payload)
+		}
+		if sender, _ := h.redis.GetMessageSender(ctx, chatUUID, "msg-delete"); sender != "" {
+			t.Error("Expected receipt tracking dropped for the deleted message")
+		}
+	})
+
+	t.Run("sender_kept_after_receipts", func(t *testing.T) {
+		clientB := register(deviceB, "pb", "sb")
+		defer h.DisconnectDevice(deviceB)
+
+		send(clientA, "msg-owned", "mine")
+		if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+			t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+		}
+		// The sender has seen the final state, so the receipt record is gone
+		h.redis.ForgetMessageState(ctx, chatUUID, "pa", "msg-owned")
+
+		deleteAs := func(messageID string) errcode.Code {
+			h.HandleMessage(clientB, &WSMessage{
+				Type: TypeMessageDelete,
+				Payload: MessageDeletePayload{
+					ChatUUID:          chatUUID,
+					ParticipantID:     "pb",
+					ParticipantSecret: "sb",
+					MessageID:         messageID,
+				},
+			})
+			msg := nextMessage(t, clientB)
+			payload, _ := msg.Payload.(map[string]interface{})
+			code, _ := payload["code"].(string)
+			return errcode.Code(code)
+		}
+		if code := deleteAs("msg-owned"); code != errcode.NotMessageSender {
+			t.Errorf("Expected %s once receipts are gone, got %q", errcode.NotMessageSender, code)
+		}
+		if code := deleteAs("msg-never-sent"); code != errcode.NotFound {
+			t.Errorf("Expected %s for an unknown message, got %q", errcode.NotFound, code)
+		}
+	})
+
+	t.Logf("✓ Queued message edited in place, delivered message deletion forwarded, other senders refused")
+}
+
+func TestMessageRead_RoutesToCorrectPeer(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	reader := "read-reader-" + suffix
+	peer1 := "read-peer1-" + suffix
+	peer2 := "read-peer2-" + suffix
+	outsider := "read-outsider-" + suffix
+	chat1 := "test-read-1-" + suffix
+	chat2 := "test-read-2-" + suffix
+
+	// The reader is a participant in two chats, with a different peer in each
+	if err := h.redis.CreateChat(ctx, chat1, "p1", "s1", peer1, "token1-"+suffix, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chat1)
+	h.redis.JoinChat(ctx, "token1-"+suffix, reader, "r1", "rs1")
+	if err := h.redis.CreateChat(ctx, chat2, "p2", "s2", peer2, "token2-"+suffix, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chat2)
+	h.redis.JoinChat(ctx, "token2-"+suffix, reader, "r2", "rs2")
+
+	register := func(deviceUUID string, regs ...ChatRegistration) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{Type: TypeChatRegister, Payload: ChatRegisterPayload{Chats: regs}})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	clientPeer1 := register(peer1, ChatRegistration{ChatUUID: chat1, ParticipantID: "p1", ParticipantSecret: "s1"})
+	defer h.DisconnectDevice(peer1)
+	clientPeer2 := register(peer2, ChatRegistration{ChatUUID: chat2, ParticipantID: "p2", ParticipantSecret: "s2"})
+	defer h.DisconnectDevice(peer2)
+	clientReader := register(reader,
+		ChatRegistration{ChatUUID: chat1, ParticipantID: "r1", ParticipantSecret: "rs1"},
+		ChatRegistration{ChatUUID: chat2, ParticipantID: "r2", ParticipantSecret: "rs2"},
+	)
+	defer h.DisconnectDevice(reader)
+
+	// Drop the presence notices from the reader coming online
+	for len(clientPeer1.send) > 0 {
+		<-clientPeer1.send
+	}
+	for len(clientPeer2.send) > 0 {
+		<-clientPeer2.send
+	}
+
+	h.HandleMessage(clientReader, &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chat2, MessageID: "msg-2"},
+	})
+
+	msg := nextMessage(t, clientPeer2)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeMessageReadAck || payload["reader_uuid"] != "r2" {
+		t.Fatalf("Expected read ack from r2, got %s %v", msg.Type, payload)
+	}
+	if len(clientPeer1.send) != 0 {
+		t.Error("Read ack leaked to the peer in the other chat")
+	}
+
+	// A device outside the chat can't mark messages read or clear the queue
+	h.redis.QueueMessage(ctx, chat1, "msg-queued", "p1", []byte("ciphertext"))
+	h.HandleMessage(newTestClient(h, outsider), &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chat1, MessageID: "msg-queued"},
+	})
+	defer h.DisconnectDevice(outsider)
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chat1, "msg-queued"); queued == nil {
+		t.Error("Expected a non-participant's read to leave the queue alone")
+	}
+	if len(clientPeer1.send) != 0 {
+		t.Error("Expected no read ack for a non-participant")
+	}
+
+	t.Logf("✓ Read acks go to the peer of the chat that was read")
+}
+
+func TestChatMute_SkipsPush(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var pushes []string
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		pushes = append(pushes, fcmTokens...)
+		return make([]firebase.PushResult, len(fcmTokens))
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-mute-" + suffix
+	token := "test-mute-token-" + suffix
+	deviceA := "mute-device-a-" + suffix
+	deviceB := "mute-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	if err := h.redis.RegisterPushForChat(ctx, chatUUID, "pb", "fcm-token-b"); err != nil {
+		t.Fatalf("Failed to register push: %v", err)
+	}
+	defer h.redis.DeletePushForChat(ctx, chatUUID, "pb")
+
+	// B mutes the chat, then goes offline
+	clientB := newTestClient(h, deviceB)
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeChatMute,
+		Payload: ChatMutePayload{ChatUUID: chatUUID, ParticipantID: "pb", ParticipantSecret: "sb"},
+	})
+	if msg := nextMessage(t, clientB); msg.Type != TypeChatMuteAck {
+		t.Fatalf("Expected %s, got %s", TypeChatMuteAck, msg.Type)
+	}
+	h.DisconnectDevice(deviceB)
+
+	clientA := newTestClient(h, deviceA)
+	defer h.DisconnectDevice(deviceA)
+	send := func(messageID string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext " + messageID)),
+			},
+		})
+	}
+
+	send("msg-muted")
+	if len(pushes) != 0 {
+		t.Fatalf("Expected no push for a muted chat, got %d", len(pushes))
+	}
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-muted"); queued == nil {
+		t.Fatal("Expected the message queued for the muted recipient")
+	}
+
+	// Unmuting brings the wake-up push back
+	clientB = newTestClient(h, deviceB)
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeChatUnmute,
+		Payload: ChatMutePayload{ChatUUID: chatUUID, ParticipantID: "pb", ParticipantSecret: "sb"},
+	})
+	h.DisconnectDevice(deviceB)
+	send("msg-unmuted")
+	if len(pushes) != 1 || pushes[0] != "fcm-token-b" {
+		t.Errorf("Expected one push after unmuting, got %v", pushes)
+	}
+
+	t.Logf("✓ Muted chat queues messages without a push")
+}
+
+func TestProtocolVersion_Negotiation(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	deviceUUID := "protocol-device-" + time.Now().Format("150405.000000")
+	publicKey := "test-public-key"
+	_, err := h.redis.RestoreSubscription(ctx, deviceUUID, publicKey, "1_week_solo", "solo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+	defer h.removeClient(ctx, deviceUUID)
+
+	auth := func(nonce string, requested int) (*Client, WSMessage) {
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		timestamp := time.Now().Unix()
+		h.handleAuth(ctx, client, &WSMessage{
+			Type: TypeAuth,
+			Payload: AuthPayload{
+				DeviceUUID:      deviceUUID,
+				Timestamp:       timestamp,
+				Nonce:           nonce,
+				Signature:       computeSignature(publicKey, deviceUUID, timestamp, nonce),
+				ProtocolVersion: requested,
+			},
+		})
+		return client, nextMessage(t, client)
+	}
+
+	cases := []struct {
+		name      string
+		requested int
+		want      int
+	}{
+		{"legacy", 0, ProtocolV1},
+		{"v2", ProtocolV2, ProtocolV2},
+		{"newer", MaxProtocolVersion + 1, MaxProtocolVersion},
+	}
+	for _, tc := range cases {
+		client, msg := auth("protocol-nonce-"+tc.name, tc.requested)
+		if msg.Type != TypeAuthSuccess {
+			t.Fatalf("%s: expected %s, got %s", tc.name, TypeAuthSuccess, msg.Type)
+		}
+		payload, _ := msg.Payload.(map[string]interface{})
+		if payload["protocol_version"] != float64(tc.want) || payload["max_protocol_version"] != float64(MaxProtocolVersion) {
+			t.Errorf("%s: unexpected versions in auth.success: %v", tc.name, payload)
+		}
+		if client.ProtocolVersion() != tc.want {
+			t.Errorf("%s: expected client on v%d, got v%d", tc.name, tc.want, client.ProtocolVersion())
+		}
+		h.removeClient(ctx, deviceUUID)
+	}
+
+	if _, msg := auth("protocol-nonce-invalid", -1); msg.Type != TypeAuthFailed {
+		t.Errorf("Expected unsupported version to fail auth, got %s", msg.Type)
+	}
+
+	t.Logf("✓ Protocol version negotiated at auth and advertised in auth.success")
+}
+
+func TestProtocolVersion_GatesPresence(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	legacy := newTestClient(h, "protocol-v1-"+suffix)
+	legacy.SetProtocolVersion(ProtocolV1)
+	current := newTestClient(h, "protocol-v2-"+suffix)
+	defer h.removeClient(ctx, legacy.GetDeviceUUID())
+	defer h.removeClient(ctx, current.GetDeviceUUID())
+
+	update := &WSMessage{Type: TypePresenceUpdate, Payload: PresenceUpdatePayload{ChatUUID: "chat-" + suffix}}
+	legacy.SendMessage(update)
+	current.SendMessage(update)
+
+	if msg := nextMessage(t, current); msg.Type != TypePresenceUpdate {
+		t.Errorf("Expected %s for a v2 client, got %s", TypePresenceUpdate, msg.Type)
+	}
+	if len(legacy.send) != 0 {
+		t.Errorf("Expected %s withheld from a v1 client", TypePresenceUpdate)
+	}
+	for _, msgType := range []string{TypeQueueTrimmed, TypeSubGrace, TypeKeysReplenish, TypeSessionReplaced} {
+		legacy.SendMessage(&WSMessage{Type: msgType})
+		if len(legacy.send) != 0 {
+			t.Errorf("Expected %s withheld from a v1 client", msgType)
+			<-legacy.send
+		}
+	}
+
+	// v1 messages still go through
+	legacy.SendMessage(&WSMessage{Type: TypeTypingIndicator})
+	if msg := nextMessage(t, legacy); msg.Type != TypeTypingIndicator {
+		t.Errorf("Expected %s for a v1 client, got %s", TypeTypingIndicator, msg.Type)
+	}
+
+	// A v1 client asking for presence is told the type is unsupported
+	h.HandleMessage(legacy, &WSMessage{Type: TypePresenceQuery, Payload: PresencePayload{ChatUUID: "chat-" + suffix}})
+	msg := nextMessage(t, legacy)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeError || payload["code"] != string(errcode.UnsupportedType) {
+		t.Errorf("Expected unsupported_type error, got %s %v", msg.Type, payload)
+	}
+
+	t.Logf("✓ Newer message types gated by the client's protocol version")
+}
+
+func TestPushTokenInvalid_DeletesRegistration(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	pushes := 0
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		pushes += len(fcmTokens)
+		return []firebase.PushResult{{Token: fcmTokens[0], Err: fmt.Errorf("%w: UNREGISTERED", firebase.ErrTokenInvalid)}}
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-dead-token-" + suffix
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", "dead-token-device-"+suffix, "test-dead-token-"+suffix, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if err := h.redis.RegisterPushForChat(ctx, chatUUID, "pa", "fcm-dead-token"); err != nil {
+		t.Fatalf("Failed to register push: %v", err)
+	}
+	defer h.redis.DeletePushForChat(ctx, chatUUID, "pa")
+
+	h.sendPushNotification(ctx, "pa", chatUUID)
+	if pushes != 1 {
+		t.Fatalf("Expected one push attempt, got %d", pushes)
+	}
+	if _, err := h.redis.GetPushTokenForChat(ctx, chatUUID, "pa"); err == nil {
+		t.Error("Expected the dead push registration deleted")
+	}
+
+	// Nothing left to push to
+	h.sendPushNotification(ctx, "pa", chatUUID)
+	if pushes != 1 {
+		t.Errorf("Expected no push after the token was dropped, got %d attempts", pushes)
+	}
+
+	t.Logf("✓ Push registration removed when FCM rejects the token")
+}
+
+func TestGroupPush_Batched(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var batches [][]string
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		batches = append(batches, fcmTokens)
+		results := make([]firebase.PushResult, len(fcmTokens))
+		for i, fcmToken := range fcmTokens {
+			results[i].Token = fcmToken
+			if fcmToken == "fcm-token-c" {
+				results[i].Err = fmt.Errorf("%w: UNREGISTERED", firebase.ErrTokenInvalid)
+			}
+		}
+		return results
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-group-push-" + suffix
+	token := "test-group-push-token-" + suffix
+	deviceA := "group-push-a-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 3); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	for _, p := range []string{"b", "c"} {
+		if _, _, err := h.redis.JoinChat(ctx, token, "group-push-"+p+"-"+suffix, "p"+p, "s"+p); err != nil {
+			t.Fatalf("Failed to join chat: %v", err)
+		}
+		if err := h.redis.RegisterPushForChat(ctx, chatUUID, "p"+p, "fcm-token-"+p); err != nil {
+			t.Fatalf("Failed to register push: %v", err)
+		}
+		defer h.redis.DeletePushForChat(ctx, chatUUID, "p"+p)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	defer h.DisconnectDevice(deviceA)
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-group-push",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+
+	if len(batches) != 1 || len(batches[0]) != 2 {
+		t.Fatalf("Expected one batch of 2 tokens, got %v", batches)
+	}
+
+	// Only the rejected token's registration is dropped
+	if _, err := h.redis.GetPushTokenForChat(ctx, chatUUID, "pb"); err != nil {
+		t.Error("Expected the working registration kept")
+	}
+	if _, err := h.redis.GetPushTokenForChat(ctx, chatUUID, "pc"); err == nil {
+		t.Error("Expected the invalid registration deleted")
+	}
+
+	t.Logf("✓ Offline group members woken with one push batch")
+}
+
+func TestScheduledMessage_DeliveredWhenDue(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-schedule-" + suffix
+	token := "test-schedule-token-" + suffix
+	deviceA := "schedule-device-a-" + suffix
+	deviceB := "schedule-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	register := func(deviceUUID, participantID, secret string) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+				ChatUUID:          chatUUID,
+				ParticipantID:     participantID,
+				ParticipantSecret: secret,
+			}}},
+		})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	schedule := func(c *Client, messageID string, deliverAt time.Time) WSMessage {
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeMessageSchedule,
+			Payload: MessageSchedulePayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("later")),
+				DeliverAt:         deliverAt.Unix(),
+			},
+		})
+		return nextMessage(t, c)
+	}
+
+	clientA := register(deviceA, "pa", "sa")
+	defer h.DisconnectDevice(deviceA)
+	clientB := register(deviceB, "pb", "sb")
+	defer h.DisconnectDevice(deviceB)
+
+	// The chat expires in 60s
+	for _, tc := range []struct {
+		deliverAt time.Time
+		code      errcode.Code
+	}{
+		{time.Now().Add(-time.Second), errcode.InvalidDeliverAt},
+		{time.Now().Add(2 * time.Minute), errcode.DeliverAfterExpiry},
+	} {
+		msg := schedule(clientA, "msg-rejected", tc.deliverAt)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != TypeError || payload["code"] != string(tc.code) {
+			t.Errorf("Expected %s error, got %s %v", tc.code, msg.Type, payload)
+		}
+	}
+
+	// Checked like message.send: an ID is required and attachments must exist in the chat
+	if msg := schedule(clientA, "", time.Now().Add(30*time.Second)); msg.Type != TypeError || msg.Payload.(map[string]interface{})["code"] != string(errcode.InvalidPayload) {
+		t.Errorf("Expected %s for a missing message_id, got %s %v", errcode.InvalidPayload, msg.Type, msg.Payload)
+	}
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSchedule,
+		Payload: MessageSchedulePayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-attachment",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("later")),
+			DeliverAt:         time.Now().Add(30 * time.Second).Unix(),
+			AttachmentIDs:     []string{"no-such-attachment"},
+		},
+	})
+	if msg := nextMessage(t, clientA); msg.Type != TypeError || msg.Payload.(map[string]interface{})["code"] != string(errcode.AttachmentNotFound) {
+		t.Errorf("Expected %s for an unknown attachment, got %s %v", errcode.AttachmentNotFound, msg.Type, msg.Payload)
+	}
+
+	deliverAt := time.Now().Add(30 * time.Second)
+	if msg := schedule(clientA, "msg-scheduled", deliverAt); msg.Type != TypeMessageScheduled {
+		t.Fatalf("Expected %s, got %s", TypeMessageScheduled, msg.Type)
+	}
+	// A retry is confirmed again without storing a second copy
+	if msg := schedule(clientA, "msg-scheduled", deliverAt); msg.Type != TypeMessageScheduled {
+		t.Fatalf("Expected %s for a retry, got %s", TypeMessageScheduled, msg.Type)
+	}
+
+	// Not due yet
+	h.deliverDueMessages(ctx, time.Now())
+	select {
+	case data := <-clientB.send:
+		t.Fatalf("Expected nothing delivered early, got %s", data)
+	default:
+	}
+
+	h.deliverDueMessages(ctx, deliverAt.Add(time.Second))
+	msg := nextMessage(t, clientB)
+	if msg.Type != TypeMessageReceived {
+		t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["message_id"] != "msg-scheduled" || payload["sender_uuid"] != "pa" {
+		t.Errorf("Unexpected delivered payload %v", payload)
+	}
+	for nextMessage(t, clientA).Type != TypeMessageAck {
+	}
+
+	// Delivered exactly once
+	h.deliverDueMessages(ctx, deliverAt.Add(time.Second))
+	select {
+	case data := <-clientB.send:
+		t.Errorf("Expected a single delivery, got %s", data)
+	default:
+	}
+
+	t.Logf("✓ Scheduled message held until due, past-expiry schedules rejected")
+}
+
+func TestChatRotateSecret_KeepsRouting(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-rotate-" + suffix
+	token := "test-rotate-token-" + suffix
+	deviceA := "rotate-device-a-" + suffix
+	deviceB := "rotate-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	register := func(deviceUUID, participantID, secret string) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+				ChatUUID:          chatUUID,
+				ParticipantID:     participantID,
+				ParticipantSecret: secret,
+			}}},
+		})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	send := func(c *Client, secret, messageID string) WSMessage {
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: secret,
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("hello")),
+			},
+		})
+		return nextMessage(t, c)
+	}
+
+	clientA := register(deviceA, "pa", "sa")
+	defer h.DisconnectDevice(deviceA)
+	clientB := register(deviceB, "pb", "sb")
+	defer h.DisconnectDevice(deviceB)
+
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeChatRotateSecret,
+		Payload: ChatRotateSecretPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "wrong",
+			NewSecret:         "sa2",
+		},
+	})
+	msg := nextMessage(t, clientA)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeError || payload["code"] != string(errcode.InvalidCredentials) {
+		t.Fatalf("Expected invalid credentials error, got %s %v", msg.Type, payload)
+	}
+
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeChatRotateSecret,
+		Payload: ChatRotateSecretPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			NewSecret:         "sa2",
+		},
+	})
+	if msg := nextMessage(t, clientA); msg.Type != TypeChatSecretRotated {
+		t.Fatalf("Expected %s, got %s", TypeChatSecretRotated, msg.Type)
+	}
+
+	msg = send(clientA, "sa", "msg-old-secret")
+	payload, _ = msg.Payload.(map[string]interface{})
+	if msg.Type != TypeError || payload["code"] != string(errcode.InvalidCredentials) {
+		t.Errorf("Expected old secret rejected, got %s %v", msg.Type, payload)
+	}
+
+	// B's registration is by participant ID, so it still receives A's messages
+	send(clientA, "sa2", "msg-new-secret")
+	if msg := nextMessage(t, clientB); msg.Type != TypeMessageReceived {
+		t.Fatalf("Expected %s, got %s", TypeMessageReceived, msg.Type)
+	}
+
+	t.Logf("✓ Secret rotated in place, old secret refused, routing unchanged")
+}
+
+func TestChatJoined_QueuedForOfflineCreator(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var pushed []string
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		pushed = append(pushed, fcmTokens...)
+		return make([]firebase.PushResult, len(fcmTokens))
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-joined-" + suffix
+	token := "test-joined-token-" + suffix
+	deviceA := "joined-device-a-" + suffix
+	deviceB := "joined-device-b-" + suffix
+
+	if _, err := h.redis.RestoreSubscription(ctx, deviceA, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceA)
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if err := h.redis.RegisterPushForChat(ctx, chatUUID, "pa", "fcm-token-a"); err != nil {
+		t.Fatalf("Failed to register push: %v", err)
+	}
+	defer h.redis.DeletePushForChat(ctx, chatUUID, "pa")
+
+	// The creator is offline when the invitation is accepted
+	chat, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb")
+	if err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	h.NotifyChatJoined(ctx, chat, "pb", deviceB)
+
+	if len(pushed) != 1 || pushed[0] != "fcm-token-a" {
+		t.Errorf("Expected a wake-up push to the creator, got %v", pushed)
+	}
+
+	client := &Client{hub: h, send: make(chan []byte, 16)}
+	defer h.removeClient(ctx, deviceA)
+	if !h.completeAuth(ctx, client, deviceA, ProtocolV1) {
+		t.Fatal("Expected auth to succeed")
+	}
+	if msg := nextMessage(t, client); msg.Type != TypeAuthSuccess {
+		t.Fatalf("Expected %s, got %s", TypeAuthSuccess, msg.Type)
+	}
+	msg := nextMessage(t, client)
+	if msg.Type != TypeChatJoined {
+		t.Fatalf("Expected pending %s, got %s", TypeChatJoined, msg.Type)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["chat_uuid"] != chatUUID || payload["participant_id"] != "pb" || payload["joiner_device_uuid"] != deviceB {
+		t.Errorf("Unexpected chat.joined payload %v", payload)
+	}
+
+	// Replayed once only
+	if events, _ := h.redis.PopJoinEvents(ctx, deviceA); len(events) != 0 {
+		t.Errorf("Expected pending joins cleared, got %d", len(events))
+	}
+
+	t.Logf("✓ Offline creator woken and given chat.joined on its next auth")
+}
+
+func TestQueuedMessage_KeepsOriginalTimestamp(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-queued-at-" + suffix
+	token := "test-queued-at-token-" + suffix
+	deviceA := "queued-at-device-a-" + suffix
+	deviceB := "queued-at-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 300, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	before := time.Now().Unix()
+	if err := h.redis.QueueMessage(ctx, chatUUID, "msg-queued-at", "pa", []byte("ciphertext")); err != nil {
+		t.Fatalf("Failed to queue message: %v", err)
+	}
+	queued, err := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-queued-at")
+	if err != nil || queued == nil {
+		t.Fatalf("Expected message queued: %v", err)
+	}
+	if queued.QueuedAt < before || queued.QueuedAt > time.Now().Unix() {
+		t.Errorf("Expected queued_at set when queued, got %d", queued.QueuedAt)
+	}
+
+	// Pretend it has been waiting a while
+	sentAt := time.Now().Add(-2 * time.Minute).Unix()
+	queued.QueuedAt = sentAt
+	if _, err := h.redis.UpdateQueuedMessage(ctx, queued, chatUUID, queued.EncryptedContent); err != nil {
+		t.Fatalf("Failed to backdate queued message: %v", err)
+	}
+
+	clientB := newTestClient(h, deviceB)
+	defer h.DisconnectDevice(deviceB)
+	h.HandleMessage(clientB, &WSMessage{
+		Type: TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pb",
+			ParticipantSecret: "sb",
+		}}},
+	})
+
+	msg := nextMessage(t, clientB)
+	for msg.Type != TypeMessageReceived {
+		msg = nextMessage(t, clientB)
+	}
+	payload, _ := msg.Payload.(map[string]interface{})
+	if payload["timestamp"] != float64(sentAt) {
+		t.Errorf("Expected original timestamp %d, got %v", sentAt, payload["timestamp"])
+	}
+
+	t.Logf("✓ Queued message delivered with its original timestamp")
+}
+
+func TestSendBufferOverflowPolicies(t *testing.T) {
+	h := setupTestHub(t)
+	go h.Run()
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-overflow-" + suffix
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+
+	saturated := func(size int) *Client {
+		c := &Client{hub: h, send: make(chan []byte, size), protocolVersion: MaxProtocolVersion}
+		for i := 0; i < size; i++ {
+			c.SendMessage(&WSMessage{Type: TypeTypingIndicator, Payload: TypingPayload{ChatUUID: fmt.Sprintf("typing-%d", i)}})
+		}
+		return c
+	}
+	received := func(messageID string) *WSMessage {
+		return &WSMessage{
+			Type: TypeMessageReceived,
+			Payload: MessageReceivedPayload{
+				ChatUUID:         chatUUID,
+				MessageID:        messageID,
+				SenderUUID:       "pa",
+				EncryptedContent: base64.StdEncoding.EncodeToString([]byte(messageID)),
+			},
+		}
+	}
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		h.overflowPolicy = OverflowDropOldest
+		c := saturated(2)
+
+		if err := c.SendMessage(&WSMessage{Type: TypeTypingIndicator, Payload: TypingPayload{ChatUUID: "typing-2"}}); err != nil {
+			t.Fatalf("Expected room made for the new message, got %v", err)
+		}
+		msg := nextMessage(t, c)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if payload["chat_uuid"] != "typing-1" {
+			t.Errorf("Expected the oldest message dropped, next is %v", payload["chat_uuid"])
+		}
+
+		// message.received never pushes anything out; the caller queues it instead
+		c.SendMessage(&WSMessage{Type: TypeTypingIndicator, Payload: TypingPayload{ChatUUID: "typing-3"}})
+		if err := c.SendMessage(received("msg-refused")); !errors.Is(err, ErrClientBufferFull) {
+			t.Errorf("Expected message.received refused on a full buffer, got %v", err)
+		}
+		if len(c.send) != cap(c.send) {
+			t.Errorf("Expected the buffer untouched, got %d of %d", len(c.send), cap(c.send))
+		}
+	})
+
+	t.Run("drop_oldest_requeues_received", func(t *testing.T) {
+		h.overflowPolicy = OverflowDropOldest
+		evictions := h.BufferFullEvictions()
+		c := &Client{hub: h, send: make(chan []byte, 1), protocolVersion: MaxProtocolVersion}
+
+		if err := c.SendMessage(received("msg-buffered")); err != nil {
+			t.Fatalf("Failed to buffer message: %v", err)
+		}
+		if err := c.SendMessage(&WSMessage{Type: TypeTypingIndicator, Payload: TypingPayload{ChatUUID: chatUUID}}); err != nil {
+			t.Fatalf("Expected room made for the new message, got %v", err)
+		}
+
+		queued, err := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-buffered")
+		if err != nil || queued == nil {
+			t.Fatalf("Expected the dropped message.received requeued: %v", err)
+		}
+		if string(queued.EncryptedContent) != "msg-buffered" || queued.SenderParticipant != "pa" {
+			t.Errorf("Unexpected requeued message %+v", queued)
+		}
+		if n := h.BufferFullEvictions() - evictions; n != 1 {
+			t.Errorf("Expected the client evicted to pick it up on reconnect, got %d evictions", n)
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		h.overflowPolicy = OverflowDisconnect
+		evictions := h.BufferFullEvictions()
+		c := saturated(1)
+
+		for i := 0; i < maxBufferFullSends; i++ {
+			err := c.SendMessage(&WSMessage{Type: TypeTypingIndicator, Payload: TypingPayload{ChatUUID: "typing-x"}})
+			if !errors.Is(err, ErrClientBufferFull) {
+				t.Fatalf("Expected ErrClientBufferFull, got %v", err)
+			}
+		}
+		if msg := nextMessage(t, c); msg.Payload.(map[string]interface{})["chat_uuid"] != "typing-0" {
+			t.Errorf("Expected the buffered message kept, got %v", msg.Payload)
+		}
+		if n := h.BufferFullEvictions() - evictions; n != 1 {
+			t.Errorf("Expected 1 eviction after %d full sends, got %d", maxBufferFullSends, n)
+		}
+	})
+
+	t.Logf("✓ Overflow policies drop, requeue and evict as configured")
+}
+
+func TestHandleAuth_UnknownVsKeyExpired(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	subscribed := "auth-key-expired-" + suffix
+	if _, err := h.redis.RestoreSubscription(ctx, subscribed, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, subscribed)
+	h.redis.GetRedis().Del(ctx, "pubkey:"+subscribed)
+
+	for _, tc := range []struct {
+		deviceUUID string
+		reason     string
+	}{
+		{"auth-unknown-" + suffix, "device_unknown"},
+		{subscribed, "key_expired"},
+	} {
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		timestamp := time.Now().Unix()
+		h.handleAuth(ctx, client, &WSMessage{
+			Type: TypeAuth,
+			Payload: AuthPayload{
+				DeviceUUID: tc.deviceUUID,
+				Timestamp:  timestamp,
+				Nonce:      "nonce-" + tc.reason,
+				Signature:  computeSignature("test-key", tc.deviceUUID, timestamp, "nonce-"+tc.reason),
+			},
+		})
+
+		msg := nextMessage(t, client)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != TypeAuthFailed || payload["reason"] != tc.reason {
+			t.Errorf("Expected auth.failed %s, got %s %v", tc.reason, msg.Type, payload)
+		}
+	}
+
+	t.Logf("✓ auth.failed tells re-activation apart from key re-registration")
+}
+
+func TestSubscriptionUpdated_OnClaimWhileConnected(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	device := "subupdate-device-" + suffix
+	code := "SUBUPDATE-" + suffix
+	defer h.redis.PurgeDevice(ctx, device)
+
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	if _, err := h.redis.RestoreSubscription(ctx, device, "test-key", "1_week_solo", "solo", expiresAt); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	client := newTestClient(h, device)
+
+	h.HandleMessage(client, &WSMessage{Type: TypeSubQuery})
+	msg := nextMessage(t, client)
+	if msg.Type != TypeSubStatus {
+		t.Fatalf("Expected %s, got %s", TypeSubStatus, msg.Type)
+	}
+
+	// Claiming another code while connected extends the subscription and tells the device
+	h.redis.CreateActivationCode(ctx, &redisdb.ActivationCode{Code: code, Plan: "1_day_solo", Type: "solo", Status: "pending"})
+	sub, _, err := h.redis.ClaimActivationCode(ctx, code, device, "test-key")
+	if err != nil {
+		t.Fatalf("Failed to claim code: %v", err)
+	}
+	h.NotifySubscriptionUpdated(ctx, device)
+
+	msg = nextMessage(t, client)
+	if msg.Type != TypeSubUpdated {
+		t.Fatalf("Expected %s, got %s", TypeSubUpdated, msg.Type)
+	}
+	var info SubscriptionInfo
+	data, _ := json.Marshal(msg.Payload)
+	json.Unmarshal(data, &info)
+	if !info.ExpiresAt.Equal(sub.ExpiresAt) || !info.ExpiresAt.After(expiresAt) {
+		t.Errorf("Expected extended expiry %v, got %v", sub.ExpiresAt, info.ExpiresAt)
+	}
+	if info.Status != redisdb.SubscriptionActive {
+		t.Errorf("Expected status %s, got %s", redisdb.SubscriptionActive, info.Status)
+	}
+
+	t.Logf("✓ Claiming a code while connected pushes the new expiry")
+}
+
+func TestSubscriptionExpiry_WarnsOncePerThreshold(t *testing.T) {
+	h := setupTestHub(t)
+	h.expiryWarnings = []time.Duration{24 * time.Hour, time.Hour}
+	h.expiryDisconnect = true
+	ctx := context.Background()
+
+	device := "subexpiry-device-" + time.Now().Format("150405.000000")
+	defer h.redis.PurgeDevice(ctx, device)
+
+	expiresAt := time.Now().Add(48 * time.Hour).Truncate(time.Second)
+	if _, err := h.redis.RestoreSubscription(ctx, device, "test-key", "1_week_solo", "solo", expiresAt); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	client := newTestClient(h, device)
+
+	steps := []struct {
+		name   string
+		before time.Duration // how long before expiry the check runs
+		want   int           // subscription.expiring messages expected
+	}{
+		{"before_any_threshold", 30 * time.Hour, 0},
+		{"day_ahead", 23 * time.Hour, 1},
+		{"day_ahead_again", 22 * time.Hour, 0},
+		{"hour_ahead", 30 * time.Minute, 1},
+		{"hour_ahead_again", 10 * time.Minute, 0},
+	}
+	for _, step := range steps {
+		h.checkSubscriptionExpiry(ctx, device, expiresAt.Add(-step.before))
+		got := 0
+		for len(client.send) > 0 {
+			if msg := nextMessage(t, client); msg.Type == TypeSubExpiring {
+				got++
+			}
+		}
+		if got != step.want {
+			t.Errorf("%s: expected %d %s, got %d", step.name, step.want, TypeSubExpiring, got)
+		}
+	}
+
+	// Past the grace period the device is told once and disconnected
+	h.checkSubscriptionExpiry(ctx, device, expiresAt.Add(time.Minute))
+	var types []string
+	for data := range client.send {
+		var msg WSMessage
+		json.Unmarshal(data, &msg)
+		types = append(types, msg.Type)
+	}
+	if len(types) != 2 || types[0] != TypeSubExpired || types[1] != TypeError {
+		t.Fatalf("Expected %s then disconnect, got %v", TypeSubExpired, types)
+	}
+	if _, ok := h.GetClient(device); ok {
+		t.Error("Expected expired device disconnected")
+	}
+
+	t.Logf("✓ Expiry warnings fire once per threshold, then expired and disconnect")
+}
+
+func TestMessageSend_AttachmentsScopedToChat(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-wsattach-" + suffix
+	token := "test-wsattach-token-" + suffix
+	deviceA := "wsattach-device-a-" + suffix
+	deviceB := "wsattach-device-b-" + suffix
+	defer h.redis.PurgeDevice(ctx, deviceA)
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	chat, _ := h.redis.GetChat(ctx, chatUUID)
+	if err := h.redis.CreateAttachment(ctx, chat, &redisdb.Attachment{AttachmentID: "att-1", ChatUUID: chatUUID}); err != nil {
+		t.Fatalf("Failed to create attachment: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	send := func(messageID string, attachmentIDs ...string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte(messageID)),
+				AttachmentIDs:     attachmentIDs,
+			},
+		})
+	}
+
+	// An attachment issued for some other chat isn't routed
+	send("msg-1", "att-1", "att-elsewhere")
+	msg := nextMessage(t, clientA)
+	if payload, _ := msg.Payload.(map[string]interface{}); msg.Type != TypeError || payload["code"] != string(errcode.AttachmentNotFound) {
+		t.Fatalf("Expected %s, got %s %v", errcode.AttachmentNotFound, msg.Type, msg.Payload)
+	}
+
+	// B is offline, so the reference has to survive the queue
+	send("msg-2", "att-1")
+	for len(clientA.send) > 0 {
+		nextMessage(t, clientA)
+	}
+	queued, err := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-2")
+	if err != nil || queued == nil {
+		t.Fatalf("Expected msg-2 queued, got %v", err)
+	}
+	if len(queued.AttachmentIDs) != 1 || queued.AttachmentIDs[0] != "att-1" {
+		t.Errorf("Expected queued attachment att-1, got %v", queued.AttachmentIDs)
+	}
+
+	t.Logf("✓ Messages only carry attachments of their own chat, through the queue too")
+}
+
+func TestHandleAuth_TimestampWindow(t *testing.T) {
+	h := setupTestHub(t)
+	h.redis.SetAuthWindow(60 * time.Second)
+	t.Cleanup(func() { h.redis.SetAuthWindow(redisdb.DefaultAuthWindow) })
+	ctx := context.Background()
+
+	deviceUUID := "auth-window-" + time.Now().Format("150405.000000")
+	if _, err := h.redis.RestoreSubscription(ctx, deviceUUID, "test-key", "1_week_solo", "solo", time.Now().Add(time.Hour)); err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+	for _, tc := range []struct {
+		name   string
+		skew   int64
+		expect string
+	}{
+		// Ahead of the clock, so a second ticking over mid-test can only move it back inside
+		{"at_window", 60, TypeAuthSuccess},
+		{"one_second_over", -61, TypeAuthFailed},
+	} {
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		timestamp := time.Now().Unix() + tc.skew
+		h.handleAuth(ctx, client, &WSMessage{
+			Type: TypeAuth,
+			Payload: AuthPayload{
+				DeviceUUID: deviceUUID,
+				Timestamp:  timestamp,
+				Nonce:      "nonce-" + tc.name,
+				Signature:  computeSignature("test-key", deviceUUID, timestamp, "nonce-"+tc.name),
+			},
+		})
+
+		msg := nextMessage(t, client)
+		if msg.Type != tc.expect {
+			t.Errorf("%s: expected %s, got %s %v", tc.name, tc.expect, msg.Type, msg.Payload)
+		}
+		if payload, _ := msg.Payload.(map[string]interface{}); tc.expect == TypeAuthFailed && payload["reason"] != "timestamp_expired" {
+			t.Errorf("%s: expected timestamp_expired, got %v", tc.name, payload["reason"])
+		}
+		h.DisconnectDevice(deviceUUID)
+	}
+
+	t.Logf("✓ WebSocket auth honours the configured timestamp window")
+}
+
+func TestHandleAuth_FailuresAudited(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	audit.SetSink(audit.NewJSONSink(&buf))
+	t.Cleanup(func() { audit.SetSink(nil) })
+
+	deviceUUID := "audit-auth-device-" + time.Now().Format("150405.000000")
+	_, err := h.redis.RestoreSubscription(ctx, deviceUUID, "test-public-key", "1_week_solo", "solo", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("Failed to create subscription: %v", err)
+	}
+	defer h.redis.PurgeDevice(ctx, deviceUUID)
+
+	cases := []struct {
+		reason  string
+		payload AuthPayload
+	}{
+		{"timestamp_expired", AuthPayload{DeviceUUID: deviceUUID, Timestamp: 1, Nonce: "n1", Signature: "x"}},
+		{"invalid_nonce", AuthPayload{DeviceUUID: deviceUUID, Timestamp: time.Now().Unix(), Signature: "x"}},
+		{"device_unknown", AuthPayload{DeviceUUID: deviceUUID + "-unknown", Timestamp: time.Now().Unix(), Nonce: "n2", Signature: "x"}},
+		{"invalid_signature", AuthPayload{DeviceUUID: deviceUUID, Timestamp: time.Now().Unix(), Nonce: "n3", Signature: "x"}},
+	}
+	for _, tc := range cases {
+		buf.Reset()
+		client := &Client{hub: h, send: make(chan []byte, 16)}
+		h.handleAuth(ctx, client, &WSMessage{Type: TypeAuth, Payload: tc.payload})
+		if msg := nextMessage(t, client); msg.Type != TypeAuthFailed {
+			t.Fatalf("%s: expected %s, got %s", tc.reason, TypeAuthFailed, msg.Type)
+		}
+
+		var e audit.Event
+		if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+			t.Fatalf("%s: expected one audit event, got %q", tc.reason, buf.String())
+		}
+		if e.Type != audit.EventAuthFailed || e.Reason != tc.reason {
+			t.Errorf("Expected auth_failed for %s, got %+v", tc.reason, e)
+		}
+		if e.Device != audit.HashDevice(tc.payload.DeviceUUID) || strings.Contains(buf.String(), deviceUUID) {
+			t.Errorf("%s: expected only the hashed device ID, got %s", tc.reason, buf.String())
+		}
+	}
+
+	t.Logf("✓ Auth failures audited by reason with a hashed device ID")
+}
+
+func TestDeliveryAck_RequeuedOnDisconnect(t *testing.T) {
+	h := setupTestHub(t)
+	h.ackTimeout = time.Minute
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-delivery-ack-" + suffix
+	token := "test-delivery-ack-token-" + suffix
+	deviceA := "delivery-ack-a-" + suffix
+	deviceB := "delivery-ack-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	connectB := func() *Client {
+		c := newTestClient(h, deviceB)
+		h.mu.Lock()
+		h.chatParticipants[chatParticipantKey(chatUUID, "pb")] = deviceB
+		h.mu.Unlock()
+		return c
+	}
+	send := func(messageID string) {
+		h.HandleMessage(clientA, &WSMessage{
+			Type: TypeMessageSend,
+			Payload: MessageSendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				MessageID:         messageID,
+				EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("hello")),
+			},
+		})
+	}
+	queued := func() []string {
+		msgs, _ := h.redis.GetQueuedMessages(ctx, chatUUID)
+		var ids []string
+		for id := range msgs {
+			ids = append(ids, id)
+		}
+		return ids
+	}
+
+	// Delivered live, then the recipient drops before acknowledging one of them
+	clientB := connectB()
+	send("msg-acked")
+	send("msg-unacked")
+	var sentAt float64
+	for _, want := range []string{"msg-acked", "msg-unacked"} {
+		msg := nextMessage(t, clientB)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != TypeMessageReceived || payload["message_id"] != want {
+			t.Fatalf("Expected %s for %s, got %s %v", TypeMessageReceived, want, msg.Type, payload)
+		}
+		sentAt, _ = payload["timestamp"].(float64)
+	}
+	if ids := queued(); len(ids) != 0 {
+		t.Fatalf("Expected nothing queued for an online recipient, got %v", ids)
+	}
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeMessageReceivedAck,
+		Payload: MessageReceivedAckPayload{ChatUUID: chatUUID, MessageID: "msg-acked"},
+	})
+	h.dropClient(clientB, nil)
+
+	if ids := queued(); len(ids) != 1 || ids[0] != "msg-unacked" {
+		t.Fatalf("Expected only the unacked message queued, got %v", ids)
+	}
+	// Requeued for pb alone, still stamped with when it was sent
+	requeued, _, err := h.redis.GetQueuedMessagesRange(ctx, chatUUID, 0, 1)
+	if err != nil || len(requeued) != 1 {
+		t.Fatalf("Failed to read the requeued message: %v", err)
+	}
+	if requeued[0].QueuedAt != int64(sentAt) {
+		t.Errorf("Expected queued_at %d from the original send, got %d", int64(sentAt), requeued[0].QueuedAt)
+	}
+	if len(requeued[0].Recipients) != 1 || requeued[0].Recipients[0] != "pb" {
+		t.Errorf("Expected the message requeued for pb only, got %v", requeued[0].Recipients)
+	}
+
+	// Redelivered once the device reconnects and registers the chat
+	clientB = connectB()
+	h.deliverQueuedMessages(ctx, clientB, ChatRegistration{ChatUUID: chatUUID, ParticipantID: "pb"})
+	msg := nextMessage(t, clientB)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeMessageReceived || payload["message_id"] != "msg-unacked" {
+		t.Fatalf("Expected msg-unacked redelivered, got %s %v", msg.Type, payload)
+	}
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chatUUID, MessageID: "msg-unacked"},
+	})
+
+	// A connected client that never acks has the message queued once the timeout passes
+	send("msg-slow")
+	h.sweepUnacked(ctx, time.Now())
+	if ids := queued(); len(ids) != 0 {
+		t.Fatalf("Expected nothing requeued before the timeout, got %v", ids)
+	}
+	h.sweepUnacked(ctx, time.Now().Add(h.ackTimeout))
+	if ids := queued(); len(ids) != 1 || ids[0] != "msg-slow" {
+		t.Errorf("Expected msg-slow requeued after the timeout, got %v", ids)
+	}
+	h.dropClient(clientB, nil)
+
+	t.Logf("✓ Unacknowledged deliveries requeued on disconnect and after the timeout")
+}
+
+func TestBroadcast_ReachesLocalClients(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	clients := []*Client{
+		newTestClient(h, "broadcast-a-"+suffix),
+		newTestClient(h, "broadcast-b-"+suffix),
+		newTestClient(h, "broadcast-c-"+suffix),
+	}
+	for _, c := range clients {
+		defer h.removeClient(ctx, c.GetDeviceUUID())
+	}
+
+	// Not yet authenticated - nothing to announce to
+	pending := &Client{hub: h, send: make(chan []byte, 8)}
+	h.mu.Lock()
+	h.connections[pending] = true
+	h.mu.Unlock()
+
+	// A v1 client doesn't know the message type
+	legacy := newTestClient(h, "broadcast-v1-"+suffix)
+	legacy.protocolVersion = ProtocolV1
+	defer h.removeClient(ctx, legacy.GetDeviceUUID())
+
+	sent := h.Broadcast(ctx, &WSMessage{
+		Type:    TypeAnnouncement,
+		Payload: AnnouncementPayload{Text: "Restarting in 5 minutes", Severity: SeverityWarning},
+	})
+	if sent != len(clients) {
+		t.Errorf("Expected %d clients reached, got %d", len(clients), sent)
+	}
+
+	for _, c := range clients {
+		msg := nextMessage(t, c)
+		if msg.Type != TypeAnnouncement {
+			t.Fatalf("Expected %s, got %s", TypeAnnouncement, msg.Type)
+		}
+		payload := msg.Payload.(map[string]any)
+		if payload["text"] != "Restarting in 5 minutes" || payload["severity"] != SeverityWarning {
+			t.Errorf("Unexpected announcement payload %v", payload)
+		}
+	}
+	if len(pending.send) != 0 || len(legacy.send) != 0 {
+		t.Error("Expected no announcement for unauthenticated or v1 clients")
+	}
+
+	// Relayed from another instance it goes out here too, but not when it's our own
+	announcement, _ := json.Marshal(WSMessage{Type: TypeAnnouncement, Payload: AnnouncementPayload{Text: "hi", Severity: SeverityInfo}})
+	h.deliverRelayed(ctx, &relayEnvelope{Origin: h.instanceID, Message: announcement, Broadcast: true})
+	if len(clients[0].send) != 0 {
+		t.Error("Expected our own broadcast not to be sent twice")
+	}
+	h.deliverRelayed(ctx, &relayEnvelope{Origin: "other-instance", Message: announcement, Broadcast: true})
+	for _, c := range clients {
+		if msg := nextMessage(t, c); msg.Type != TypeAnnouncement {
+			t.Errorf("Expected a relayed %s, got %s", TypeAnnouncement, msg.Type)
+		}
+	}
+
+	t.Logf("✓ Broadcast reaches every authenticated local client")
+}
+
+func TestDisappearingMessage_ExpiresAfterRead(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-disappear-" + suffix
+	sender := "disappear-sender-" + suffix
+	reader := "disappear-reader-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "p1", "s1", sender, "token-disappear-"+suffix, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	h.redis.JoinChat(ctx, "token-disappear-"+suffix, reader, "p2", "s2")
+
+	register := func(deviceUUID string, reg ChatRegistration) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{Type: TypeChatRegister, Payload: ChatRegisterPayload{Chats: []ChatRegistration{reg}}})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	senderClient := register(sender, ChatRegistration{ChatUUID: chatUUID, ParticipantID: "p1", ParticipantSecret: "s1"})
+	defer h.DisconnectDevice(sender)
+	readerClient := register(reader, ChatRegistration{ChatUUID: chatUUID, ParticipantID: "p2", ParticipantSecret: "s2"})
+	defer h.DisconnectDevice(reader)
+
+	h.HandleMessage(senderClient, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			MessageID:         "msg-disappear",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+			ParticipantID:     "p1",
+			ParticipantSecret: "s1",
+			TTLAfterRead:      60,
+		},
+	})
+
+	var received WSMessage
+	for received = nextMessage(t, readerClient); received.Type != TypeMessageReceived; received = nextMessage(t, readerClient) {
+	}
+	if ttl := received.Payload.(map[string]any)["ttl_after_read"]; ttl != float64(60) {
+		t.Errorf("Expected ttl_after_read 60 on delivery, got %v", ttl)
+	}
+
+	// Nothing is timed until the message is read
+	h.sweepExpiredMessages(ctx, time.Now().Add(2*time.Hour))
+
+	readAt := time.Now()
+	h.HandleMessage(readerClient, &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chatUUID, MessageID: "msg-disappear"},
+	})
+	// A later read doesn't restart the timer
+	if _, started, _ := h.redis.StartReadTTL(ctx, chatUUID, "msg-disappear", "p2", readAt.Add(30*time.Second)); started {
+		t.Error("Expected only the first read to start the timer")
+	}
+
+	// A copy still queued goes when the timer runs out
+	h.redis.QueueMessage(ctx, chatUUID, "msg-disappear", "p1", []byte("ciphertext"))
+	for len(senderClient.send) > 0 {
+		<-senderClient.send
+	}
+	for len(readerClient.send) > 0 {
+		<-readerClient.send
+	}
+
+	h.sweepExpiredMessages(ctx, readAt.Add(58*time.Second))
+	if len(senderClient.send) != 0 || len(readerClient.send) != 0 {
+		t.Fatal("Expected nothing to expire before the deadline")
+	}
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-disappear"); queued == nil {
+		t.Fatal("Expected the queued copy kept until the deadline")
+	}
+
+	h.sweepExpiredMessages(ctx, readAt.Add(61*time.Second))
+	for _, c := range []*Client{senderClient, readerClient} {
+		msg := nextMessage(t, c)
+		if msg.Type != TypeMessageExpired {
+			t.Fatalf("Expected %s, got %s", TypeMessageExpired, msg.Type)
+		}
+		if id := msg.Payload.(map[string]any)["message_id"]; id != "msg-disappear" {
+			t.Errorf("Expected msg-disappear to expire, got %v", id)
+		}
+	}
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-disappear"); queued != nil {
+		t.Error("Expected the queued copy purged at the deadline")
+	}
+
+	// Expired once only
+	h.sweepExpiredMessages(ctx, readAt.Add(2*time.Minute))
+	if len(senderClient.send) != 0 || len(readerClient.send) != 0 {
+		t.Error("Expected the message to expire only once")
+	}
+
+	t.Logf("✓ Disappearing message expires at its deadline after the first read")
+}
+
+func TestDisappearingMessage_TimedPerReader(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-disappear-group-" + suffix
+	token := "token-disappear-group-" + suffix
+	devices := map[string]string{}
+	for _, id := range []string{"pa", "pb", "pc"} {
+		devices[id] = "disappear-group-" + id + "-" + suffix
+	}
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "spa", devices["pa"], token, 3600, 3); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	for _, id := range []string{"pb", "pc"} {
+		if _, _, err := h.redis.JoinChat(ctx, token, devices[id], id, "s"+id); err != nil {
+			t.Fatalf("Failed to join chat: %v", err)
+		}
+	}
+
+	register := func(id string) *Client {
+		c := newTestClient(h, devices[id])
+		h.HandleMessage(c, &WSMessage{
+			Type:    TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{ChatUUID: chatUUID, ParticipantID: id, ParticipantSecret: "s" + id}}},
+		})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+
+	// pc is offline, so its copy is queued
+	clientA := register("pa")
+	defer h.DisconnectDevice(devices["pa"])
+	clientB := register("pb")
+	defer h.DisconnectDevice(devices["pb"])
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			MessageID:         "msg-disappear",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+			ParticipantID:     "pa",
+			ParticipantSecret: "spa",
+			TTLAfterRead:      60,
+		},
+	})
+
+	readAt := time.Now()
+	h.HandleMessage(clientB, &WSMessage{
+		Type:    TypeMessageRead,
+		Payload: MessageReadPayload{ChatUUID: chatUUID, MessageID: "msg-disappear"},
+	})
+	for len(clientA.send) > 0 {
+		<-clientA.send
+	}
+	for len(clientB.send) > 0 {
+		<-clientB.send
+	}
+
+	// pb's copy runs out; pa and pb hear about it, pc's queued copy stays
+	h.sweepExpiredMessages(ctx, readAt.Add(61*time.Second))
+	for _, c := range []*Client{clientA, clientB} {
+		if msg := nextMessage(t, c); msg.Type != TypeMessageExpired {
+			t.Fatalf("Expected %s, got %s", TypeMessageExpired, msg.Type)
+		}
+	}
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-disappear"); queued == nil {
+		t.Fatal("Expected pc's queued copy to outlive pb's timer")
+	}
+
+	// pc still gets it with the full TTL, its own timer starting when it reads
+	clientC := newTestClient(h, devices["pc"])
+	defer h.DisconnectDevice(devices["pc"])
+	h.HandleMessage(clientC, &WSMessage{
+		Type:    TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{ChatUUID: chatUUID, ParticipantID: "pc", ParticipantSecret: "spc"}}},
+	})
+	var received WSMessage
+	for received = nextMessage(t, clientC); received.Type != TypeMessageReceived; received = nextMessage(t, clientC) {
+	}
+	if ttl := received.Payload.(map[string]any)["ttl_after_read"]; ttl != float64(60) {
+		t.Errorf("Expected ttl_after_read 60 for pc, got %v", ttl)
+	}
+	if _, started, _ := h.redis.StartReadTTL(ctx, chatUUID, "msg-disappear", "pc", time.Now()); !started {
+		t.Error("Expected pc's first read to start its own timer")
+	}
+
+	t.Logf("✓ Each reader's copy of a disappearing message runs out on its own")
+}
+
+func TestHandleAuth_TimestampExpiredReportsServerTime(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	deviceUUID := "skew-device-" + time.Now().Format("150405.000000")
+	client := &Client{hub: h, send: make(chan []byte, 16)}
+
+	// A device whose clock is an hour behind
+	before := time.Now()
+	h.handleAuth(ctx, client, &WSMessage{Type: TypeAuth, Payload: AuthPayload{
+		DeviceUUID: deviceUUID,
+		Timestamp:  before.Add(-time.Hour).Unix(),
+		Nonce:      "n1",
+		Signature:  "x",
+	}})
+	msg := nextMessage(t, client)
+	if msg.Type != TypeAuthFailed {
+		t.Fatalf("Expected %s, got %s", TypeAuthFailed, msg.Type)
+	}
+	payload := msg.Payload.(map[string]any)
+	if payload["reason"] != "timestamp_expired" {
+		t.Fatalf("Expected timestamp_expired, got %v", payload["reason"])
+	}
+	serverTimeMs, _ := payload["server_time_ms"].(float64)
+	if int64(serverTimeMs) < before.UnixMilli() || int64(serverTimeMs) > time.Now().UnixMilli() {
+		t.Errorf("Expected server_time_ms to be the server's clock, got %v", payload["server_time_ms"])
+	}
+	if serverTime, _ := payload["server_time"].(float64); int64(serverTime) != int64(serverTimeMs)/1000 {
+		t.Errorf("Expected server_time to match server_time_ms, got %v", payload["server_time"])
+	}
+
+	// Other failures don't need the clock
+	h.handleAuth(ctx, client, &WSMessage{Type: TypeAuth, Payload: AuthPayload{
+		DeviceUUID: deviceUUID,
+		Timestamp:  time.Now().Unix(),
+		Signature:  "x",
+	}})
+	if _, ok := nextMessage(t, client).Payload.(map[string]any)["server_time"]; ok {
+		t.Error("Expected server_time only on timestamp_expired")
+	}
+
+	t.Logf("✓ timestamp_expired tells the device the server's time")
+}
+
+func TestChatRegister_CapAndStaleMappings(t *testing.T) {
+	h := setupTestHub(t)
+	h.maxChatRegs = 2
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	deviceUUID := "cap-device-" + suffix
+	chats := make([]ChatRegistration, 3)
+	for i := range chats {
+		chatUUID := fmt.Sprintf("test-cap-%d-%s", i, suffix)
+		if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceUUID, fmt.Sprintf("test-cap-token-%d-%s", i, suffix), 60, 2); err != nil {
+			t.Fatalf("Failed to create chat: %v", err)
+		}
+		defer h.redis.DeleteChat(ctx, chatUUID)
+		chats[i] = ChatRegistration{ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa"}
+	}
+
+	client := newTestClient(h, deviceUUID)
+	register := func(regs ...ChatRegistration) ChatRegisterAckPayload {
+		h.HandleMessage(client, &WSMessage{Type: TypeChatRegister, Payload: ChatRegisterPayload{Chats: regs}})
+		for {
+			msg := nextMessage(t, client)
+			if msg.Type != TypeChatRegisterAck {
+				continue
+			}
+			var ack ChatRegisterAckPayload
+			data, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(data, &ack)
+			return ack
+		}
+	}
+
+	if ack := register(chats...); ack.Registered != 2 || ack.Failed != 1 || ack.Limited != 1 {
+		t.Errorf("Expected 2 registered and 1 over the cap, got %+v", ack)
+	}
+	// Chats already held can be registered again at the cap
+	if ack := register(chats[0]); ack.Registered != 1 || ack.Limited != 0 {
+		t.Errorf("Expected a re-registration accepted at the cap, got %+v", ack)
+	}
+	if n := h.ChatMappings(); n != 2 {
+		t.Errorf("Expected 2 chat mappings, got %d", n)
+	}
+
+	// A mapping left behind for a device that's gone is reaped; live ones stay
+	h.mu.Lock()
+	h.chatParticipants[chatParticipantKey(chats[2].ChatUUID, "ghost")] = "gone-device-" + suffix
+	h.mu.Unlock()
+	if reaped := h.reapStaleMappings(); reaped != 1 {
+		t.Errorf("Expected 1 stale mapping reaped, got %d", reaped)
+	}
+	if n := h.ChatMappings(); n != 2 {
+		t.Errorf("Expected the 2 live mappings kept, got %d", n)
+	}
+	if n := h.StaleMappingsReaped(); n != 1 {
+		t.Errorf("Expected the reaped count reported, got %d", n)
+	}
+
+	t.Logf("✓ Chat registrations capped per device and stale mappings reaped")
+}
+
+func TestChatRegister_InvalidGetsNoQueuedMessages(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-register-invalid-" + suffix
+	token := "test-register-invalid-token-" + suffix
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", "register-invalid-a-"+suffix, token, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, "register-invalid-b-"+suffix, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	h.redis.QueueMessage(ctx, chatUUID, "msg-1", "pa", []byte("ciphertext"))
+
+	// The right participant ID with the wrong secret, from a device outside the chat
+	outsider := newTestClient(h, "register-invalid-outsider-"+suffix)
+	defer h.DisconnectDevice("register-invalid-outsider-" + suffix)
+	h.HandleMessage(outsider, &WSMessage{
+		Type:    TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{ChatUUID: chatUUID, ParticipantID: "pb", ParticipantSecret: "wrong"}}},
+	})
+	for len(outsider.send) > 0 {
+		if msg := nextMessage(t, outsider); msg.Type == TypeMessageReceived {
+			t.Fatal("Expected no queued messages for a registration that failed")
+		}
+	}
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-1"); queued == nil {
+		t.Error("Expected the message still queued for pb")
+	}
+
+	t.Logf("✓ Queued messages go only to chats that registered")
+}
+
+func TestChatRegister_ReportsPendingCount(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-pending-" + suffix
+	deviceA := "pending-device-a-" + suffix
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, "test-pending-token-"+suffix, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, "test-pending-token-"+suffix, "pending-device-b-"+suffix, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+
+	// Three from the peer and two of A's own, still queued for the peer
+	for i := 0; i < 3; i++ {
+		h.redis.QueueMessage(ctx, chatUUID, fmt.Sprintf("from-b-%d", i), "pb", []byte("hi"))
+	}
+	for i := 0; i < 2; i++ {
+		h.redis.QueueMessage(ctx, chatUUID, fmt.Sprintf("from-a-%d", i), "pa", []byte("hi"))
+	}
+	if n, err := h.redis.GetQueuedMessageCount(ctx, chatUUID); err != nil || n != 5 {
+		t.Fatalf("Expected 5 queued messages, got %d (%v)", n, err)
+	}
+
+	client := newTestClient(h, deviceA)
+	h.HandleMessage(client, &WSMessage{
+		Type:    TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{ChatUUID: chatUUID, ParticipantID: "pa", ParticipantSecret: "sa"}}},
+	})
+	var ack ChatRegisterAckPayload
+	for {
+		msg := nextMessage(t, client)
+		if msg.Type == TypeChatRegisterAck {
+			data, _ := json.Marshal(msg.Payload)
+			json.Unmarshal(data, &ack)
+			break
+		}
+	}
+	if got := ack.Pending[chatUUID]; got != 3 {
+		t.Errorf("Expected 3 pending for pa, excluding its own, got %d", got)
+	}
+
+	t.Logf("✓ chat.register.ack reports messages waiting, without the participant's own")
+}
+
+func TestPushRegister_ValidatesToken(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-push-token-" + suffix
+	deviceUUID := "push-token-device-" + suffix
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceUUID, "test-push-token-invite-"+suffix, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteAllPushForChat(ctx, chatUUID)
+
+	client := newTestClient(h, deviceUUID)
+	register := func(token string) PushRegisterAckPayload {
+		h.HandleMessage(client, &WSMessage{Type: TypePushRegister, Payload: PushRegisterPayload{
+			ChatUUID: chatUUID, FCMToken: token, ParticipantID: "pa", ParticipantSecret: "sa",
+		}})
+		msg := nextMessage(t, client)
+		var ack PushRegisterAckPayload
+		data, _ := json.Marshal(msg.Payload)
+		json.Unmarshal(data, &ack)
+		return ack
+	}
+	wellFormed := "dQw4w9WgXcQ:APA91bH" + strings.Repeat("x7_Kq-Z", 20)
+
+	if ack := register(wellFormed); !ack.Success || ack.Code != "" {
+		t.Errorf("Expected a well-formed token registered, got %+v", ack)
+	}
+	for _, garbage := range []string{"", "not a token", "<script>alert(1)</script>"} {
+		if ack := register(garbage); ack.Success || ack.Code != errcode.InvalidPushToken {
+			t.Errorf("Expected %q refused with %s, got %+v", garbage, errcode.InvalidPushToken, ack)
+		}
+	}
+
+	// With validation on, a token FCM rejects is refused too; an FCM outage isn't held against it
+	h.pushReady = func() bool { return true }
+	validateErr := fmt.Errorf("%w: SENDER_ID_MISMATCH", firebase.ErrTokenInvalid)
+	h.validateToken = func(ctx context.Context, fcmToken string) error { return validateErr }
+	if ack := register(wellFormed); ack.Success || ack.Code != errcode.InvalidPushToken {
+		t.Errorf("Expected a foreign-project token refused, got %+v", ack)
+	}
+	validateErr = firebase.ErrCircuitOpen
+	if ack := register(wellFormed); !ack.Success {
+		t.Errorf("Expected the token accepted while FCM can't be asked, got %+v", ack)
+	}
+
+	t.Logf("✓ push.register refuses malformed and FCM-rejected tokens")
+}
+
+func TestPing_EchoesNonce(t *testing.T) {
+	h := setupTestHub(t)
+	// Not authenticated - a ping works before auth
+	client := &Client{hub: h, send: make(chan []byte, 16)}
+
+	before := time.Now().UnixMilli()
+	h.HandleMessage(client, &WSMessage{Type: TypePing, Payload: PingPayload{Nonce: "rtt-42", Timestamp: 1234}})
+	msg := nextMessage(t, client)
+	if msg.Type != TypePong {
+		t.Fatalf("Expected %s, got %s", TypePong, msg.Type)
+	}
+	var pong PongPayload
+	data, _ := json.Marshal(msg.Payload)
+	json.Unmarshal(data, &pong)
+	if pong.Nonce != "rtt-42" || pong.Timestamp != 1234 {
+		t.Errorf("Expected the nonce and timestamp echoed, got %+v", pong)
+	}
+	if pong.ServerTime < before {
+		t.Errorf("Expected the server time in the pong, got %d", pong.ServerTime)
+	}
+
+	// A bare ping is answered too
+	h.HandleMessage(client, &WSMessage{Type: TypePing})
+	if msg := nextMessage(t, client); msg.Type != TypePong {
+		t.Errorf("Expected %s for a ping without payload, got %s", TypePong, msg.Type)
+	}
+
+	h.HandleMessage(client, &WSMessage{Type: TypePing, Payload: PingPayload{Nonce: strings.Repeat("n", maxPingNonceLength+1)}})
+	if msg := nextMessage(t, client); msg.Type != TypeError {
+		t.Errorf("Expected an oversized nonce refused, got %s", msg.Type)
+	}
+
+	t.Logf("✓ ping answered with a pong echoing the nonce")
+}
+
+func TestChatExtend_UpToMaxLifetime(t *testing.T) {
+	h := setupTestHub(t)
+	h.maxChatLifetime = 10 * time.Minute
+	ctx := context.Background()
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-extend-" + suffix
+	token := "test-extend-token-" + suffix
+	deviceA := "extend-device-a-" + suffix
+	deviceB := "extend-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 60, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+
+	register := func(deviceUUID, participantID, secret string) *Client {
+		c := newTestClient(h, deviceUUID)
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatRegister,
+			Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+				ChatUUID:          chatUUID,
+				ParticipantID:     participantID,
+				ParticipantSecret: secret,
+			}}},
+		})
+		for nextMessage(t, c).Type != TypeChatRegisterAck {
+		}
+		return c
+	}
+	extend := func(c *Client, ttl int) {
+		h.HandleMessage(c, &WSMessage{
+			Type: TypeChatExtend,
+			Payload: ChatExtendPayload{
+				ChatUUID:          chatUUID,
+				ParticipantID:     "pa",
+				ParticipantSecret: "sa",
+				TTL:               ttl,
+			},
+		})
+	}
+
+	clientA := register(deviceA, "pa", "sa")
+	defer h.DisconnectDevice(deviceA)
+	clientB := register(deviceB, "pb", "sb")
+	defer h.DisconnectDevice(deviceB)
+
+	extend(clientA, 300)
+	for _, c := range []*Client{clientA, clientB} {
+		msg := nextMessage(t, c)
+		payload, _ := msg.Payload.(map[string]interface{})
+		if msg.Type != TypeChatExtended || payload["extended_by"] != "pa" {
+			t.Fatalf("Expected %s from pa, got %s %v", TypeChatExtended, msg.Type, payload)
+		}
+		if ttl, _ := payload["ttl_seconds"].(float64); ttl < 300 {
+			t.Errorf("Expected ttl_seconds of at least 300, got %v", payload["ttl_seconds"])
+		}
+	}
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil || chat.TTLSeconds < 300 {
+		t.Fatalf("Expected the stored chat extended, got %v (%v)", chat, err)
+	}
+	if time.Until(chat.ExpiresAt()) < 290*time.Second {
+		t.Errorf("Expected the chat to expire about 5 minutes from now, got %v", chat.ExpiresAt())
+	}
+
+	// Under a lower cap the same extension is refused
+	h.maxChatLifetime = 2 * time.Minute
+	extend(clientA, 300)
+	msg := nextMessage(t, clientA)
+	payload, _ := msg.Payload.(map[string]interface{})
+	if msg.Type != TypeError || payload["code"] != string(errcode.ChatLifetimeMax) {
+		t.Fatalf("Expected %s, got %s %v", errcode.ChatLifetimeMax, msg.Type, payload)
+	}
+	if after, _ := h.redis.GetChat(ctx, chatUUID); after == nil || after.TTLSeconds != chat.TTLSeconds {
+		t.Error("Expected a refused extension to leave the chat alone")
+	}
+
+	t.Logf("✓ chat.extend lengthens an active chat for everyone, up to the lifetime cap")
+}
+
+func TestMessageSend_FullBufferQueuesAndPushes(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var pushes []string
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		pushes = append(pushes, fcmTokens...)
+		return make([]firebase.PushResult, len(fcmTokens))
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-full-buffer-" + suffix
+	token := "test-full-buffer-token-" + suffix
+	deviceA := "full-buffer-device-a-" + suffix
+	deviceB := "full-buffer-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	if err := h.redis.RegisterPushForChat(ctx, chatUUID, "pb", "fcm-token-b"); err != nil {
+		t.Fatalf("Failed to register push: %v", err)
+	}
+
+	// B is online and registered, but has stopped draining its buffer
+	clientB := newTestClient(h, deviceB)
+	defer h.DisconnectDevice(deviceB)
+	h.HandleMessage(clientB, &WSMessage{
+		Type: TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pb",
+			ParticipantSecret: "sb",
+		}}},
+	})
+	for len(clientB.send) < cap(clientB.send) {
+		clientB.send <- []byte(`{"type":"typing.indicator"}`)
+	}
+
+	clientA := newTestClient(h, deviceA)
+	defer h.DisconnectDevice(deviceA)
+	h.HandleMessage(clientA, &WSMessage{
+		Type: TypeMessageSend,
+		Payload: MessageSendPayload{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pa",
+			ParticipantSecret: "sa",
+			MessageID:         "msg-full-buffer",
+			EncryptedContent:  base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+		},
+	})
+	if msg := nextMessage(t, clientA); msg.Type != TypeMessageAck {
+		t.Fatalf("Expected %s, got %s", TypeMessageAck, msg.Type)
+	}
+
+	if queued, _ := h.redis.GetQueuedMessage(ctx, chatUUID, "msg-full-buffer"); queued == nil {
+		t.Fatal("Expected the message queued for the recipient with a full buffer")
+	}
+	if len(pushes) != 1 || pushes[0] != "fcm-token-b" {
+		t.Errorf("Expected a wake-up push to B, got %v", pushes)
+	}
+
+	t.Logf("✓ A full send buffer falls back to queue and push instead of losing the message")
+}
+
+func TestDeliverRelayed_FullBufferQueuesAndPushes(t *testing.T) {
+	h := setupTestHub(t)
+	ctx := context.Background()
+
+	var pushes []string
+	h.pushReady = func() bool { return true }
+	h.sendPushBatch = func(ctx context.Context, fcmTokens []string, data map[string]string, opts firebase.PushOptions) []firebase.PushResult {
+		pushes = append(pushes, fcmTokens...)
+		return make([]firebase.PushResult, len(fcmTokens))
+	}
+
+	suffix := time.Now().Format("150405.000000")
+	chatUUID := "test-relay-full-" + suffix
+	token := "test-relay-full-token-" + suffix
+	deviceA := "relay-full-device-a-" + suffix
+	deviceB := "relay-full-device-b-" + suffix
+
+	if err := h.redis.CreateChat(ctx, chatUUID, "pa", "sa", deviceA, token, 3600, 2); err != nil {
+		t.Fatalf("Failed to create chat: %v", err)
+	}
+	defer h.redis.DeleteChat(ctx, chatUUID)
+	defer h.redis.DeleteQueuedMessages(ctx, chatUUID)
+	if _, _, err := h.redis.JoinChat(ctx, token, deviceB, "pb", "sb"); err != nil {
+		t.Fatalf("Failed to join chat: %v", err)
+	}
+	if err := h.redis.RegisterPushForChat(ctx, chatUUID, "pb", "fcm-token-b"); err != nil {
+		t.Fatalf("Failed to register push: %v", err)
+	}
+
+	// B is connected here and registered, but has stopped draining its buffer
+	clientB := newTestClient(h, deviceB)
+	defer h.DisconnectDevice(deviceB)
+	h.HandleMessage(clientB, &WSMessage{
+		Type: TypeChatRegister,
+		Payload: ChatRegisterPayload{Chats: []ChatRegistration{{
+			ChatUUID:          chatUUID,
+			ParticipantID:     "pb",
+			ParticipantSecret: "sb",
+		}}},
+	})
+	for len(clientB.send) < cap(clientB.send) {
+		clientB.send <- []byte(`{"type":"typing.indicator"}`)
+	}
+
+	// A sent it on another instance, which relayed it here
+	message, _ := json.Marshal(&WSMessage{
+		Type: TypeMessageReceived,
+		Payload: MessageReceivedPayload{
+			ChatUUID:         chatUUID,
+			MessageID:        "msg-relay-full",
+			SenderUUID:       "pa",
+			SenderDeviceUUID: deviceA,
+			EncryptedContent: base64.StdEncoding.EncodeToString([]byte("ciphertext")),
+			Timestamp:        time.Now().Unix(),
+		},
+	})
+	h.deliverRelayed(ctx, &relayEnvelope{
+		Origin:        "other-instance",
+		DeviceUUID:    deviceB,
+		ChatUUID:      chatUUID,
+		ParticipantID: "pb",
+		Message:       message,
+	})
+
+	queued, _ := h.redis.GetQueuedMessagesByID(ctx, chatUUID, []string{"msg-relay-full"})
+	if len(queued) != 1 {
+		t.Fatal("Expected the relayed message queued for the recipient with a full buffer")
+	}
+	if len(queued[0].Recipients) != 1 || queued[0].Recipients[0] != "pb" {
+		t.Errorf("Expected the message pending for pb, got %v", queued[0].Recipients)
+	}
+	if len(pushes) != 1 || pushes[0] != "fcm-token-b" {
+		t.Errorf("Expected a wake-up push to B, got %v", pushes)
+	}
+
+	t.Logf("✓ A relayed message for a full send buffer is queued and pushed")
+}
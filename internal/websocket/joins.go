@@ -0,0 +1,55 @@
+package websocket
+
+import (
+	"context"
+
+	redisdb "nihil/internal/redis"
+)
+
+// NotifyChatJoined tells everyone already in the chat that a participant joined
+// Participants not connected anywhere get the event queued for their next auth
+// and a wake-up push, so a creator who was offline still learns the chat went active
+func (h *Hub) NotifyChatJoined(ctx context.Context, chat *redisdb.Chat, participantID, joinerDeviceUUID string) {
+	event := redisdb.JoinEvent{
+		ChatUUID:         chat.ChatUUID,
+		ParticipantID:    participantID,
+		JoinerDeviceUUID: joinerDeviceUUID,
+	}
+	joinedMsg := joinedMessage(event)
+
+	var offline []string
+	for _, p := range chat.OtherParticipants(participantID) {
+		if h.SendToDevice(ctx, p.DeviceUUID, joinedMsg) {
+			continue
+		}
+		if err := h.redis.QueueJoinEvent(ctx, p.DeviceUUID, event); err != nil {
+			h.logger.Warn("failed to queue join event", "chat_uuid", chat.ChatUUID, "error", err)
+			continue
+		}
+		offline = append(offline, p.ID)
+	}
+	h.sendPushNotifications(ctx, chat.ChatUUID, offline)
+}
+
+// replayJoinEvents delivers the join events queued while the device was offline
+func (h *Hub) replayJoinEvents(ctx context.Context, client *Client) {
+	events, err := h.redis.PopJoinEvents(ctx, client.GetDeviceUUID())
+	if err != nil {
+		h.logger.Warn("failed to get join events", "error", err)
+		return
+	}
+	for _, event := range events {
+		client.SendMessage(joinedMessage(event))
+	}
+}
+
+func joinedMessage(event redisdb.JoinEvent) *WSMessage {
+	return &WSMessage{
+		Type: TypeChatJoined,
+		Payload: ChatJoinedPayload{
+			ChatUUID:         event.ChatUUID,
+			JoinerDeviceUUID: event.JoinerDeviceUUID,
+			ParticipantID:    event.ParticipantID,
+		},
+	}
+}
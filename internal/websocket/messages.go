@@ -1,6 +1,10 @@
 package websocket
 
-import "time"
+import (
+	"time"
+
+	"nihil/internal/errcode"
+)
 
 // Message types
 const (
@@ -30,6 +34,49 @@ const (
 	TypePushUnregisterAck = "push.unregister.ack"
 	TypePushBurnAll       = "push.burn_all"
 	TypePushBurnAllAck    = "push.burn_all.ack"
+	TypeServerShutdown    = "server.shutdown"
+	TypeKeysReplenish     = "keys.replenish_needed"
+	TypeSessionReplaced   = "session.replaced"
+	TypeQueueTrimmed      = "queue.trimmed"
+	TypeAuthResume        = "auth.resume"
+	TypeSubGrace          = "subscription.grace"
+	TypeMessageEdit       = "message.edit"
+	TypeMessageEdited     = "message.edited"
+	TypeMessageDelete     = "message.delete"
+	TypeMessageDeleted    = "message.deleted"
+	TypeChatMute          = "chat.mute"
+	TypeChatUnmute        = "chat.unmute"
+	TypeChatMuteAck       = "chat.mute.ack"
+	TypeMessageSchedule   = "message.schedule"
+	TypeMessageScheduled  = "message.scheduled"
+	TypeChatRotateSecret  = "chat.rotate_secret"
+	TypeChatSecretRotated = "chat.secret_rotated"
+	TypeChatExtend        = "chat.extend"
+	TypeChatExtended      = "chat.extended"
+	TypeSubQuery          = "subscription.query"
+	TypeSubStatus         = "subscription.status"
+	TypeSubUpdated        = "subscription.updated"
+	TypeSubExpiring       = "subscription.expiring"
+	TypeLogout            = "logout"
+	TypeLogoutAck         = "logout.ack"
+	TypeParticipantLeft   = "chat.participant_left"
+
+	TypeMessageReceivedAck = "message.received.ack" // client confirms it processed a message.received
+	TypeAnnouncement       = "system.announcement"  // operator notice to every connected client
+	TypeMessageExpired     = "message.expired"      // a disappearing message's timer ran out
+
+	// Application-level keepalive; understood by every version and answered before auth
+	TypePing = "ping"
+	TypePong = "pong"
+)
+
+// Presence message types
+const (
+	TypePresenceQuery       = "presence.query"
+	TypePresenceSubscribe   = "presence.subscribe"
+	TypePresenceUnsubscribe = "presence.unsubscribe"
+	TypePresenceStatus      = "presence.status" // reply to query/subscribe
+	TypePresenceUpdate      = "presence.update" // pushed to subscribers
 )
 
 type WSMessage struct {
@@ -41,15 +88,36 @@ type AuthPayload struct {
 	DeviceUUID string `json:"device_uuid"`
 	Signature  string `json:"signature"`
 	Timestamp  int64  `json:"timestamp"`
+	Nonce      string `json:"nonce"` // client-generated, single use within the timestamp window
+
+	ProtocolVersion int `json:"protocol_version,omitempty"` // omitted by clients that predate versioning, treated as v1
 }
 
 type AuthSuccessPayload struct {
 	Chats        []ChatInfo       `json:"chats"`
 	Subscription SubscriptionInfo `json:"subscription"`
+	ResumeToken  string           `json:"resume_token,omitempty"` // single use, for auth.resume after a drop
+
+	// Negotiated version plus the range this server speaks
+	ProtocolVersion    int `json:"protocol_version"`
+	MinProtocolVersion int `json:"min_protocol_version"`
+	MaxProtocolVersion int `json:"max_protocol_version"`
+}
+
+// AuthResumePayload - reconnect with the resume token from the last auth.success instead of re-authenticating
+type AuthResumePayload struct {
+	DeviceUUID  string `json:"device_uuid"`
+	ResumeToken string `json:"resume_token"`
+
+	ProtocolVersion int `json:"protocol_version,omitempty"`
 }
 
 type AuthFailedPayload struct {
 	Reason string `json:"reason"`
+
+	// Set for timestamp_expired so a device with a wrong clock can work out its offset and retry
+	ServerTime   int64 `json:"server_time,omitempty"`    // unix seconds
+	ServerTimeMs int64 `json:"server_time_ms,omitempty"` // unix milliseconds
 }
 
 type ChatInfo struct {
@@ -61,6 +129,7 @@ type ChatInfo struct {
 
 type SubscriptionInfo struct {
 	Plan      string    `json:"plan"`
+	Status    string    `json:"status"` // "active" or "grace"
 	ExpiresAt time.Time `json:"expires_at"`
 }
 
@@ -78,6 +147,10 @@ type ChatRegistration struct {
 type ChatRegisterAckPayload struct {
 	Registered int `json:"registered"`
 	Failed     int `json:"failed"`
+	Limited    int `json:"limited,omitempty"` // of Failed, how many were over the device's chat cap
+	// Pending is chat UUID -> messages that were queued for the participant when it registered
+	// Chats with nothing waiting are left out
+	Pending map[string]int64 `json:"pending,omitempty"`
 }
 
 // ChatJoinedPayload - sent to chat creator when someone joins
@@ -93,15 +166,24 @@ type MessageSendPayload struct {
 	EncryptedContent  string `json:"encrypted_content"`
 	ParticipantID     string `json:"participant_id"`
 	ParticipantSecret string `json:"participant_secret"`
+
+	// Attachments uploaded out-of-band; their keys and metadata belong inside EncryptedContent
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+
+	// Seconds the message lives after it is first read, 0 to keep it for the chat's lifetime
+	// Clients enforce it locally; the server drops its own copy and sends message.expired
+	TTLAfterRead int64 `json:"ttl_after_read,omitempty"`
 }
 
 type MessageReceivedPayload struct {
-	ChatUUID         string `json:"chat_uuid"`
-	MessageID        string `json:"message_id"`
-	SenderUUID       string `json:"sender_uuid"`        // Participant ID (for routing)
-	SenderDeviceUUID string `json:"sender_device_uuid"` // Device UUID (for Signal decryption)
-	EncryptedContent string `json:"encrypted_content"`
-	Timestamp        int64  `json:"timestamp"`
+	ChatUUID         string   `json:"chat_uuid"`
+	MessageID        string   `json:"message_id"`
+	SenderUUID       string   `json:"sender_uuid"`        // Participant ID (for routing)
+	SenderDeviceUUID string   `json:"sender_device_uuid"` // Device UUID (for Signal decryption)
+	EncryptedContent string   `json:"encrypted_content"`
+	Timestamp        int64    `json:"timestamp"`
+	AttachmentIDs    []string `json:"attachment_ids,omitempty"`
+	TTLAfterRead     int64    `json:"ttl_after_read,omitempty"`
 }
 
 // MessageAckPayload - server acknowledges receipt of message.send
@@ -112,7 +194,17 @@ type MessageAckPayload struct {
 }
 
 // MessageDeliveredPayload - server confirms recipient received the message
+// Sent once per recipient; RecipientUUID is the participant ID that received it
 type MessageDeliveredPayload struct {
+	ChatUUID      string `json:"chat_uuid"`
+	MessageID     string `json:"message_id"`
+	RecipientUUID string `json:"recipient_uuid"`
+}
+
+// MessageReceivedAckPayload - the recipient processed a message.received
+// Until this or a message.read arrives the server may queue the message again, so
+// clients must ignore a message ID they have already seen
+type MessageReceivedAckPayload struct {
 	ChatUUID  string `json:"chat_uuid"`
 	MessageID string `json:"message_id"`
 }
@@ -123,14 +215,134 @@ type MessageReadPayload struct {
 }
 
 type MessageReadAckPayload struct {
+	ChatUUID   string `json:"chat_uuid"`
+	MessageID  string `json:"message_id"`
+	ReaderUUID string `json:"reader_uuid,omitempty"` // Participant ID that read the message
+}
+
+// MessageEditPayload - the sender replaces a message's content
+type MessageEditPayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	MessageID         string `json:"message_id"`
+	EncryptedContent  string `json:"encrypted_content"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+// MessageEditedPayload - forwarded to the other participants
+// Clients should only apply it if SenderUUID sent the original message
+type MessageEditedPayload struct {
+	ChatUUID         string `json:"chat_uuid"`
+	MessageID        string `json:"message_id"`
+	SenderUUID       string `json:"sender_uuid"`
+	SenderDeviceUUID string `json:"sender_device_uuid"` // Device UUID (for Signal decryption)
+	EncryptedContent string `json:"encrypted_content"`
+	Timestamp        int64  `json:"timestamp"`
+}
+
+// MessageSchedulePayload - a message.send to be delivered at DeliverAt (unix seconds)
+type MessageSchedulePayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	MessageID         string `json:"message_id"`
+	EncryptedContent  string `json:"encrypted_content"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+	DeliverAt         int64  `json:"deliver_at"`
+
+	// Attachments uploaded out-of-band, checked when scheduled as for message.send
+	AttachmentIDs []string `json:"attachment_ids,omitempty"`
+}
+
+// MessageScheduledPayload - confirms a message is stored for later delivery
+// The sender gets the usual message.ack once it is actually sent
+type MessageScheduledPayload struct {
+	ChatUUID  string `json:"chat_uuid"`
+	MessageID string `json:"message_id"`
+	DeliverAt int64  `json:"deliver_at"`
+}
+
+// MessageDeletePayload - the sender unsends a message
+type MessageDeletePayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	MessageID         string `json:"message_id"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+// MessageDeletedPayload - forwarded to the other participants
+type MessageDeletedPayload struct {
+	ChatUUID   string `json:"chat_uuid"`
+	MessageID  string `json:"message_id"`
+	SenderUUID string `json:"sender_uuid"`
+}
+
+// MessageExpiredPayload - sent to every participant once a disappearing message's timer runs out
+type MessageExpiredPayload struct {
 	ChatUUID  string `json:"chat_uuid"`
 	MessageID string `json:"message_id"`
 }
 
+// ChatMutePayload - chat.mute and chat.unmute; a muted chat still queues messages but sends no push
+type ChatMutePayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+type ChatMuteAckPayload struct {
+	ChatUUID string `json:"chat_uuid"`
+	Muted    bool   `json:"muted"`
+}
+
+// ChatRotateSecretPayload - chat.rotate_secret; the current secret proves the
+// participant, new_secret is what it authenticates with from then on
+type ChatRotateSecretPayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+	NewSecret         string `json:"new_secret"`
+}
+
+type ChatSecretRotatedPayload struct {
+	ChatUUID      string `json:"chat_uuid"`
+	ParticipantID string `json:"participant_id"`
+}
+
+// ChatExtendPayload - chat.extend; keeps an active chat alive for ttl more seconds,
+// one of the TTLs a chat can be created with
+type ChatExtendPayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+	TTL               int    `json:"ttl"`
+}
+
+// ChatExtendedPayload tells every participant a chat's new lifetime
+type ChatExtendedPayload struct {
+	ChatUUID   string `json:"chat_uuid"`
+	TTLSeconds int    `json:"ttl_seconds"` // counted from the chat's creation
+	ExpiresAt  int64  `json:"expires_at"`  // unix seconds
+	ExtendedBy string `json:"extended_by"` // participant ID
+}
+
+// PingPayload is optional - whatever the client sends is echoed in the pong
+type PingPayload struct {
+	Nonce     string `json:"nonce,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"` // client clock, in whatever unit it likes
+}
+
+// PongPayload answers a ping so the client can work out the round trip
+type PongPayload struct {
+	Nonce      string `json:"nonce,omitempty"`
+	Timestamp  int64  `json:"timestamp,omitempty"`
+	ServerTime int64  `json:"server_time_ms"` // unix milliseconds when the pong was sent
+}
+
 type TypingPayload struct {
 	ChatUUID          string `json:"chat_uuid"`
 	ParticipantID     string `json:"participant_id,omitempty"`
 	ParticipantSecret string `json:"participant_secret,omitempty"`
+	IsTyping          bool   `json:"is_typing"` // set by the server on typing.indicator
 }
 
 type ChatExpiredPayload struct {
@@ -138,22 +350,99 @@ type ChatExpiredPayload struct {
 	Reason   string `json:"reason"`
 }
 
+// ParticipantLeftPayload tells the rest of a chat that someone left it
+type ParticipantLeftPayload struct {
+	ChatUUID      string `json:"chat_uuid"`
+	ParticipantID string `json:"participant_id"`
+	Remaining     int    `json:"remaining"` // participants still in the chat
+}
+
+// ServerShutdownPayload tells a client this instance is going away so it can reconnect elsewhere
+type ServerShutdownPayload struct {
+	Reconnect bool `json:"reconnect"`
+}
+
+// Announcement severities
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// AnnouncementPayload is an operator notice, e.g. that a deploy will briefly disconnect clients
+type AnnouncementPayload struct {
+	Text     string `json:"text"`
+	Severity string `json:"severity"`
+}
+
+// KeysReplenishPayload asks a device to upload more one-time prekeys via /keys/replenish
+type KeysReplenishPayload struct {
+	Count int64 `json:"count"` // prekeys left on the server
+}
+
+// PresencePayload - presence.query, presence.subscribe and presence.unsubscribe
+type PresencePayload struct {
+	ChatUUID          string `json:"chat_uuid"`
+	ParticipantID     string `json:"participant_id"`
+	ParticipantSecret string `json:"participant_secret"`
+}
+
+// PresenceStatusPayload - current status of every other participant in a chat
+type PresenceStatusPayload struct {
+	ChatUUID     string                `json:"chat_uuid"`
+	Participants []ParticipantPresence `json:"participants"`
+}
+
+type ParticipantPresence struct {
+	ParticipantID string `json:"participant_id"`
+	Online        bool   `json:"online"`
+}
+
+// PresenceUpdatePayload - pushed to subscribers when a participant connects or disconnects
+type PresenceUpdatePayload struct {
+	ChatUUID      string `json:"chat_uuid"`
+	ParticipantID string `json:"participant_id"`
+	Online        bool   `json:"online"`
+}
+
+// QueueTrimmedPayload - tells a sender the oldest undelivered messages were dropped
+type QueueTrimmedPayload struct {
+	ChatUUID string `json:"chat_uuid"`
+	Dropped  int64  `json:"dropped"`
+}
+
+// SubGracePayload - the subscription expired but still works until GraceEndsAt
+type SubGracePayload struct {
+	GraceEndsAt time.Time `json:"grace_ends_at"`
+	RenewURL    string    `json:"renew_url"`
+}
+
+// SubExpiringPayload - the subscription expires soon, sent once per warning threshold
+type SubExpiringPayload struct {
+	ExpiresAt time.Time `json:"expires_at"`
+	ExpiresIn int64     `json:"expires_in"` // seconds
+	RenewURL  string    `json:"renew_url"`
+}
+
 type SubExpiredPayload struct {
 	RenewURL string `json:"renew_url"`
 }
 
 type RateLimitWarningPayload struct {
-	Current int `json:"current"`
-	Limit   int `json:"limit"`
+	Current           int    `json:"current"`
+	Limit             int    `json:"limit"`
+	RetryAfterSeconds int    `json:"retry_after_seconds"` // until the window has room again
+	ChatUUID          string `json:"chat_uuid,omitempty"` // set when the per-chat limit was hit rather than the device's
 }
 
 type BannedPayload struct {
-	Reason string `json:"reason"`
+	Reason    string `json:"reason"`
+	ExpiresIn int64  `json:"expires_in,omitempty"` // seconds left, omitted for permanent bans
 }
 
 type ErrorPayload struct {
-	Code    string `json:"code"`
-	Message string `json:"message"`
+	Code    errcode.Code `json:"code"`
+	Message string       `json:"message"`
 }
 
 // Push notification payloads
@@ -165,8 +454,9 @@ type PushRegisterPayload struct {
 }
 
 type PushRegisterAckPayload struct {
-	ChatUUID string `json:"chat_uuid"`
-	Success  bool   `json:"success"`
+	ChatUUID string       `json:"chat_uuid"`
+	Success  bool         `json:"success"`
+	Code     errcode.Code `json:"code,omitempty"` // why a token was refused, e.g. ERR_INVALID_PUSH_TOKEN
 }
 
 type PushUnregisterPayload struct {
@@ -0,0 +1,27 @@
+package websocket
+
+import "context"
+
+// CheckPreKeySupply asks a device to replenish once its prekeys run low
+// Called after a prekey is handed out; each shortage is reported only once
+// A device that isn't connected is asked again on the next check
+func (h *Hub) CheckPreKeySupply(ctx context.Context, deviceUUID string) {
+	count, err := h.redis.GetPreKeyCount(ctx, deviceUUID)
+	if err != nil || count >= int64(h.preKeyLowThreshold) {
+		return
+	}
+
+	first, err := h.redis.MarkPreKeysLow(ctx, deviceUUID)
+	if err != nil || !first {
+		return
+	}
+
+	sent := h.SendToDevice(ctx, deviceUUID, &WSMessage{
+		Type:    TypeKeysReplenish,
+		Payload: KeysReplenishPayload{Count: count},
+	})
+	if !sent {
+		h.redis.ClearPreKeysLow(ctx, deviceUUID)
+	}
+	h.logger.Debug("prekeys low", "device_uuid", deviceUUID, "count", count, "notified", sent)
+}
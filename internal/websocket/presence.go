@@ -0,0 +1,146 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"nihil/internal/errcode"
+	redisdb "nihil/internal/redis"
+)
+
+// handlePresence answers presence.query and presence.subscribe with the peers' current status
+// Subscribers are also sent presence.update whenever a peer connects or disconnects
+func (h *Hub) handlePresence(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload PresencePayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		return
+	}
+
+	valid, err := h.redis.ValidateParticipant(ctx, payload.ChatUUID, payload.ParticipantID, payload.ParticipantSecret)
+	if err != nil || !valid {
+		client.SendMessage(&WSMessage{
+			Type: TypeError,
+			Payload: ErrorPayload{
+				Code:    errcode.InvalidCredentials,
+				Message: "Invalid participant credentials",
+			},
+		})
+		return
+	}
+
+	switch msg.Type {
+	case TypePresenceSubscribe:
+		h.mu.Lock()
+		if h.presenceSubs[client] == nil {
+			h.presenceSubs[client] = make(map[string]bool)
+		}
+		h.presenceSubs[client][payload.ChatUUID] = true
+		h.mu.Unlock()
+	case TypePresenceUnsubscribe:
+		h.mu.Lock()
+		delete(h.presenceSubs[client], payload.ChatUUID)
+		h.mu.Unlock()
+		return
+	}
+
+	chat, err := h.redis.GetChat(ctx, payload.ChatUUID)
+	if err != nil {
+		return
+	}
+
+	others := chat.OtherParticipants(payload.ParticipantID)
+	status := make([]ParticipantPresence, 0, len(others))
+	for _, other := range others {
+		status = append(status, ParticipantPresence{
+			ParticipantID: other.ID,
+			Online:        h.isParticipantOnline(ctx, chat, other.ID),
+		})
+	}
+
+	client.SendMessage(&WSMessage{
+		Type: TypePresenceStatus,
+		Payload: PresenceStatusPayload{
+			ChatUUID:     payload.ChatUUID,
+			Participants: status,
+		},
+	})
+}
+
+// isParticipantOnline reports whether a participant is registered here or its device is present elsewhere
+func (h *Hub) isParticipantOnline(ctx context.Context, chat *redisdb.Chat, participantID string) bool {
+	h.mu.RLock()
+	deviceUUID, registered := h.chatParticipants[chatParticipantKey(chat.ChatUUID, participantID)]
+	_, connected := h.clients[deviceUUID]
+	h.mu.RUnlock()
+	if registered && connected {
+		return true
+	}
+
+	p := chat.Participant(participantID)
+	if p == nil || p.DeviceUUID == "" {
+		return false
+	}
+	present, err := h.redis.IsPresent(ctx, p.DeviceUUID)
+	return err == nil && present
+}
+
+// isPresenceSubscribed reports whether a client asked for presence updates in a chat
+func (h *Hub) isPresenceSubscribed(client *Client, chatUUID string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.presenceSubs[client][chatUUID]
+}
+
+// notifyPresence tells the other participants' subscribed clients that a participant came or went
+// Peers on other instances are relayed the update and filtered by their own instance
+func (h *Hub) notifyPresence(ctx context.Context, chatUUID, participantID string, online bool) {
+	chat, err := h.redis.GetChat(ctx, chatUUID)
+	if err != nil {
+		return
+	}
+
+	msg := &WSMessage{
+		Type: TypePresenceUpdate,
+		Payload: PresenceUpdatePayload{
+			ChatUUID:      chatUUID,
+			ParticipantID: participantID,
+			Online:        online,
+		},
+	}
+
+	for _, other := range chat.OtherParticipants(participantID) {
+		h.mu.RLock()
+		deviceUUID, registered := h.chatParticipants[chatParticipantKey(chatUUID, other.ID)]
+		var local *Client
+		if registered {
+			local = h.clients[deviceUUID]
+		}
+		h.mu.RUnlock()
+
+		if local != nil {
+			if h.isPresenceSubscribed(local, chatUUID) {
+				local.SendMessage(msg)
+			}
+			continue
+		}
+		h.routeToParticipant(ctx, chat, other.ID, msg)
+	}
+}
+
+// notifyOffline announces that a device's registered chat participants went offline
+// Takes the chatParticipants keys that were removed for the device
+func (h *Hub) notifyOffline(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		chatUUID, participantID, ok := strings.Cut(key, ":")
+		if !ok {
+			continue
+		}
+		h.notifyPresence(ctx, chatUUID, participantID, false)
+	}
+}
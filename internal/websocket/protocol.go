@@ -0,0 +1,81 @@
+package websocket
+
+// Protocol versions - a client states the version it speaks in auth and the
+// server only sends it message types that version understands
+const (
+	ProtocolV1 = 1 // original message set
+	ProtocolV2 = 2 // every message type added since v1, see messageMinVersion
+
+	MinProtocolVersion = ProtocolV1
+	MaxProtocolVersion = ProtocolV2
+)
+
+// Subprotocols are the Sec-WebSocket-Protocol values a client may connect with, preferred first
+// They version the connection itself, before auth; message-level versions are negotiated in auth
+var Subprotocols = []string{"nihil.v1"}
+
+// messageMinVersion lists the message types newer than v1, both directions
+// Types not listed here are understood by every supported version. Two newer types
+// are left out on purpose:
+//   - server.shutdown also goes to connections that haven't authed and so have no
+//     version yet; it's always followed by the close frame v1 clients already handle
+//   - ping works before auth for the same reason, and pong only ever answers a ping,
+//     which a v1 client never sends
+var messageMinVersion = map[string]int{
+	TypeKeysReplenish:       ProtocolV2,
+	TypeSessionReplaced:     ProtocolV2,
+	TypeQueueTrimmed:        ProtocolV2,
+	TypeSubGrace:            ProtocolV2,
+	TypePresenceQuery:       ProtocolV2,
+	TypePresenceSubscribe:   ProtocolV2,
+	TypePresenceUnsubscribe: ProtocolV2,
+	TypePresenceStatus:      ProtocolV2,
+	TypePresenceUpdate:      ProtocolV2,
+	TypeMessageEdit:         ProtocolV2,
+	TypeMessageEdited:       ProtocolV2,
+	TypeMessageDelete:       ProtocolV2,
+	TypeMessageDeleted:      ProtocolV2,
+	TypeChatMute:            ProtocolV2,
+	TypeChatUnmute:          ProtocolV2,
+	TypeChatMuteAck:         ProtocolV2,
+	TypeMessageSchedule:     ProtocolV2,
+	TypeMessageScheduled:    ProtocolV2,
+	TypeChatRotateSecret:    ProtocolV2,
+	TypeChatSecretRotated:   ProtocolV2,
+	TypeChatExtend:          ProtocolV2,
+	TypeChatExtended:        ProtocolV2,
+	TypeSubQuery:            ProtocolV2,
+	TypeSubStatus:           ProtocolV2,
+	TypeSubUpdated:          ProtocolV2,
+	TypeSubExpiring:         ProtocolV2,
+	TypeLogout:              ProtocolV2,
+	TypeLogoutAck:           ProtocolV2,
+	TypeParticipantLeft:     ProtocolV2,
+	TypeMessageReceivedAck:  ProtocolV2,
+	TypeAnnouncement:        ProtocolV2,
+	TypeMessageExpired:      ProtocolV2,
+}
+
+// negotiateProtocol picks the version to speak with a client
+// Clients that predate negotiation send no version and get v1; a newer client
+// is talked down to the newest version this server knows
+func negotiateProtocol(requested int) (int, bool) {
+	switch {
+	case requested == 0:
+		return ProtocolV1, true
+	case requested < MinProtocolVersion:
+		return 0, false
+	case requested > MaxProtocolVersion:
+		return MaxProtocolVersion, true
+	default:
+		return requested, true
+	}
+}
+
+// supportsType reports whether a client speaking version can handle msgType
+func supportsType(version int, msgType string) bool {
+	if version == 0 {
+		version = MinProtocolVersion
+	}
+	return version >= messageMinVersion[msgType]
+}
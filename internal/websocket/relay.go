@@ -0,0 +1,272 @@
+package websocket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	redisdb "nihil/internal/redis"
+)
+
+// relayEnvelope carries a hub event to the instance holding the recipient's connection
+// Events addressed to a device rather than a chat participant have no ChatUUID
+type relayEnvelope struct {
+	Origin        string          `json:"origin"`
+	DeviceUUID    string          `json:"device_uuid"`
+	ChatUUID      string          `json:"chat_uuid"`
+	ParticipantID string          `json:"participant_id"`
+	Message       json.RawMessage `json:"message"`
+
+	Disconnect *ErrorPayload `json:"disconnect,omitempty"` // close the device's connections with this notice instead
+	Broadcast  bool          `json:"broadcast,omitempty"`  // for every local client rather than one device
+}
+
+// addClient makes an authenticated client reachable from every instance
+// Returns false, doing nothing, for a client the hub has already closed
+func (h *Hub) addClient(ctx context.Context, client *Client) bool {
+	deviceUUID := client.GetDeviceUUID()
+
+	h.mu.Lock()
+	// A client evicted while it was authenticating must not be routed to again
+	// Evictions close the client under h.mu, so this can't miss one
+	if client.IsClosed() {
+		h.mu.Unlock()
+		return false
+	}
+	h.clients[deviceUUID] = client
+	h.mu.Unlock()
+
+	if err := h.subscription.Add(ctx, deviceUUID); err != nil {
+		h.logger.Warn("failed to subscribe device", "device_uuid", deviceUUID, "error", err)
+	}
+	if err := h.redis.SetPresence(ctx, deviceUUID, h.instanceID); err != nil {
+		h.logger.Warn("failed to set presence", "device_uuid", deviceUUID, "error", err)
+	}
+	if err := h.redis.SaveDeviceSession(ctx, deviceUUID, h.deviceSession(client)); err != nil {
+		h.logger.Warn("failed to register session", "device_uuid", deviceUUID, "error", err)
+	}
+	return true
+}
+
+// removeClient drops cross-instance routing for a device that left this instance
+func (h *Hub) removeClient(ctx context.Context, deviceUUID string) {
+	if err := h.subscription.Remove(ctx, deviceUUID); err != nil {
+		h.logger.Warn("failed to unsubscribe device", "device_uuid", deviceUUID, "error", err)
+	}
+	if err := h.redis.ClearPresence(ctx, deviceUUID, h.instanceID); err != nil {
+		h.logger.Warn("failed to clear presence", "device_uuid", deviceUUID, "error", err)
+	}
+}
+
+// routeToParticipant delivers an event to a chat participant wherever they are connected
+// Local clients are tried first, then any other instance reporting the device present
+// Returns false if no instance could take the event
+func (h *Hub) routeToParticipant(ctx context.Context, chat *redisdb.Chat, participantID string, msg *WSMessage) bool {
+	h.mu.RLock()
+	deviceUUID, registered := h.chatParticipants[chatParticipantKey(chat.ChatUUID, participantID)]
+	var local *Client
+	if registered {
+		local = h.clients[deviceUUID]
+	}
+	h.mu.RUnlock()
+
+	if local != nil {
+		local.SendMessage(msg)
+		return true
+	}
+
+	// Not registered here - resolve the device from the chat record
+	p := chat.Participant(participantID)
+	if p == nil || p.DeviceUUID == "" {
+		return false
+	}
+	deviceUUID = p.DeviceUUID
+	if _, connected := h.GetClient(deviceUUID); connected {
+		// Connected here but hasn't registered this chat yet
+		return false
+	}
+
+	present, err := h.redis.IsPresent(ctx, deviceUUID)
+	if err != nil || !present {
+		return false
+	}
+
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	data, err := json.Marshal(relayEnvelope{
+		Origin:        h.instanceID,
+		DeviceUUID:    deviceUUID,
+		ChatUUID:      chat.ChatUUID,
+		ParticipantID: participantID,
+		Message:       msgBytes,
+	})
+	if err != nil {
+		return false
+	}
+
+	receivers, err := h.redis.PublishToDevice(ctx, deviceUUID, data)
+	if err != nil {
+		h.logger.Warn("failed to relay event", "chat_uuid", chat.ChatUUID, "type", msg.Type, "error", err)
+		return false
+	}
+
+	h.logger.Debug("event relayed", "chat_uuid", chat.ChatUUID, "type", msg.Type, "receivers", receivers)
+	return receivers > 0
+}
+
+// SendToDevice delivers an event to a device wherever it is connected
+// Returns false if the device isn't connected to any instance
+func (h *Hub) SendToDevice(ctx context.Context, deviceUUID string, msg *WSMessage) bool {
+	if client, ok := h.GetClient(deviceUUID); ok {
+		return client.SendMessage(msg) == nil
+	}
+
+	present, err := h.redis.IsPresent(ctx, deviceUUID)
+	if err != nil || !present {
+		return false
+	}
+
+	msgBytes, err := json.Marshal(msg)
+	if err != nil {
+		return false
+	}
+	data, err := json.Marshal(relayEnvelope{
+		Origin:     h.instanceID,
+		DeviceUUID: deviceUUID,
+		Message:    msgBytes,
+	})
+	if err != nil {
+		return false
+	}
+
+	receivers, err := h.redis.PublishToDevice(ctx, deviceUUID, data)
+	if err != nil {
+		h.logger.Warn("failed to relay event", "type", msg.Type, "error", err)
+		return false
+	}
+	return receivers > 0
+}
+
+// runRelay delivers events published by other instances to local clients
+func (h *Hub) runRelay() {
+	for m := range h.subscription.Channel() {
+		var env relayEnvelope
+		if err := json.Unmarshal([]byte(m.Payload), &env); err != nil {
+			h.logger.Warn("invalid relay envelope", "error", err)
+			continue
+		}
+		h.deliverRelayed(context.Background(), &env)
+	}
+}
+
+// deliverRelayed hands a relayed event to the local client it was addressed to
+// A message that can't be delivered is queued so it isn't lost; other events are dropped
+func (h *Hub) deliverRelayed(ctx context.Context, env *relayEnvelope) {
+	if env.Disconnect != nil {
+		// The origin already closed its own connections
+		if env.Origin != h.instanceID {
+			h.disconnectDevice(env.DeviceUUID, *env.Disconnect)
+		}
+		return
+	}
+
+	var msg WSMessage
+	if err := json.Unmarshal(env.Message, &msg); err != nil {
+		h.logger.Warn("invalid relayed message", "chat_uuid", env.ChatUUID, "error", err)
+		return
+	}
+
+	if env.Broadcast {
+		// The origin already sent it to its own clients
+		if env.Origin != h.instanceID {
+			h.broadcastLocal(&msg)
+		}
+		return
+	}
+
+	if env.ChatUUID == "" {
+		if client, ok := h.GetClient(env.DeviceUUID); ok {
+			client.SendMessage(&msg)
+		}
+		return
+	}
+
+	h.mu.RLock()
+	deviceUUID, registered := h.chatParticipants[chatParticipantKey(env.ChatUUID, env.ParticipantID)]
+	var client *Client
+	if registered && deviceUUID == env.DeviceUUID {
+		client = h.clients[deviceUUID]
+	}
+	h.mu.RUnlock()
+
+	if msg.Type == TypePresenceUpdate {
+		if client != nil && h.isPresenceSubscribed(client, env.ChatUUID) {
+			client.SendMessage(&msg)
+		}
+		return
+	}
+
+	if msg.Type != TypeMessageReceived {
+		if client != nil {
+			client.SendMessage(&msg)
+		}
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageReceivedPayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		h.logger.Warn("invalid relayed message payload", "chat_uuid", env.ChatUUID, "error", err)
+		return
+	}
+
+	// A client that can't take the message is treated as offline, as in deliverMessage
+	if client != nil {
+		err := client.SendMessage(&msg)
+		if err == nil {
+			h.logger.Debug("delivering relayed message", "chat_uuid", env.ChatUUID)
+			h.trackDelivery(client, payload)
+			h.sendDeliveryConfirmation(ctx, payload.ChatUUID, payload.MessageID, payload.SenderUUID, env.ParticipantID)
+			return
+		}
+		h.logger.Warn("relayed delivery failed, queuing", "chat_uuid", env.ChatUUID, "error", err)
+	}
+
+	h.logger.Debug("queuing relayed message", "chat_uuid", env.ChatUUID)
+	content, err := base64.StdEncoding.DecodeString(payload.EncryptedContent)
+	if err != nil {
+		return
+	}
+	_, err = h.redis.QueueMessageFor(ctx, payload.ChatUUID, payload.MessageID, payload.SenderUUID, payload.SenderDeviceUUID, content, payload.AttachmentIDs, []string{env.ParticipantID}, h.maxQueuedMessages)
+	if err != nil {
+		h.logger.Error("failed to queue message", "chat_uuid", payload.ChatUUID, "error", err)
+	}
+	h.sendPushNotification(ctx, env.ParticipantID, payload.ChatUUID)
+}
+
+// runPresenceRefresher keeps presence and resume tokens alive for every locally-connected device
+func (h *Hub) runPresenceRefresher() {
+	ticker := time.NewTicker(redisdb.PresenceTTL / 3)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.mu.RLock()
+		devices := make([]string, 0, len(h.clients))
+		for deviceUUID := range h.clients {
+			devices = append(devices, deviceUUID)
+		}
+		h.mu.RUnlock()
+
+		ctx := context.Background()
+		for _, deviceUUID := range devices {
+			if err := h.redis.SetPresence(ctx, deviceUUID, h.instanceID); err != nil {
+				h.logger.Warn("failed to refresh presence", "device_uuid", deviceUUID, "error", err)
+			}
+		}
+		h.refreshResumeTokens(ctx)
+		h.refreshSessions(ctx)
+	}
+}
@@ -0,0 +1,199 @@
+package websocket
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	redisdb "nihil/internal/redis"
+)
+
+// completeAuth finishes authenticating a device whose credentials have been verified
+// Checks the subscription and connection limit, then sends auth.success with a fresh resume token
+// and the negotiated protocol version
+func (h *Hub) completeAuth(ctx context.Context, client *Client, deviceUUID string, version int) bool {
+	sub, err := h.redis.GetSubscription(ctx, deviceUUID)
+	var state string
+	if err == nil {
+		state = h.redis.SubscriptionState(sub, time.Now())
+	}
+	if state != redisdb.SubscriptionActive && state != redisdb.SubscriptionGrace {
+		h.logger.Info("auth failed", "reason", "subscription_expired")
+		client.SendMessage(&WSMessage{
+			Type:    TypeSubExpired,
+			Payload: SubExpiredPayload{RenewURL: "https://nihil.app"},
+		})
+		return false
+	}
+
+	if !h.admitDeviceConnection(client, deviceUUID) {
+		h.logger.Info("auth failed", "reason", "too_many_connections")
+		client.SendMessage(&WSMessage{
+			Type:    TypeAuthFailed,
+			Payload: AuthFailedPayload{Reason: "too_many_connections"},
+		})
+		return false
+	}
+
+	client.SetProtocolVersion(version)
+	client.SetDeviceUUID(deviceUUID)
+	if !h.addClient(ctx, client) {
+		h.logger.Debug("auth abandoned", "reason", "connection_closed", "device_uuid", deviceUUID)
+		return false
+	}
+
+	h.logger.Debug("auth success", "device_uuid", deviceUUID)
+
+	// Without a token the client just falls back to a full auth next time
+	token, err := newResumeToken()
+	if err == nil {
+		err = h.redis.CreateResumeSession(ctx, token, deviceUUID, h.resumeTTL)
+	}
+	if err != nil {
+		h.logger.Warn("failed to issue resume token", "device_uuid", deviceUUID, "error", err)
+		token = ""
+	}
+	client.SetResumeToken(token)
+
+	// Note: Chats are stored client-side, so we return empty list
+	// Client will send chat.register with their local chats
+	chats := make([]ChatInfo, 0)
+
+	client.SendMessage(&WSMessage{
+		Type: TypeAuthSuccess,
+		Payload: AuthSuccessPayload{
+			Chats:              chats,
+			Subscription:       subscriptionInfo(sub, state),
+			ResumeToken:        token,
+			ProtocolVersion:    version,
+			MinProtocolVersion: MinProtocolVersion,
+			MaxProtocolVersion: MaxProtocolVersion,
+		},
+	})
+
+	if state == redisdb.SubscriptionGrace {
+		client.SendMessage(&WSMessage{
+			Type: TypeSubGrace,
+			Payload: SubGracePayload{
+				GraceEndsAt: h.redis.SubscriptionGraceEnds(sub),
+				RenewURL:    "https://nihil.app",
+			},
+		})
+	}
+
+	h.replayJoinEvents(ctx, client)
+	return true
+}
+
+// handleAuthResume re-authenticates a reconnecting device with its single-use resume token
+// The chats it had registered are restored without re-validating each secret
+func (h *Hub) handleAuthResume(ctx context.Context, client *Client, msg *WSMessage) {
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload AuthResumePayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil || payload.ResumeToken == "" {
+		client.SendMessage(&WSMessage{
+			Type:    TypeAuthFailed,
+			Payload: AuthFailedPayload{Reason: "invalid_payload"},
+		})
+		return
+	}
+
+	version, ok := negotiateProtocol(payload.ProtocolVersion)
+	if !ok {
+		h.logger.Info("auth failed", "reason", "unsupported_protocol", "protocol_version", payload.ProtocolVersion)
+		client.SendMessage(&WSMessage{
+			Type:    TypeAuthFailed,
+			Payload: AuthFailedPayload{Reason: "unsupported_protocol"},
+		})
+		return
+	}
+
+	session, err := h.redis.ConsumeResumeSession(ctx, payload.ResumeToken)
+	if err != nil || session.DeviceUUID != payload.DeviceUUID {
+		h.logger.Info("auth failed", "reason", "resume_invalid")
+		client.SendMessage(&WSMessage{
+			Type:    TypeAuthFailed,
+			Payload: AuthFailedPayload{Reason: "resume_invalid"},
+		})
+		return
+	}
+
+	banned, reason, remaining, _ := h.redis.IsBanned(ctx, session.DeviceUUID)
+	if banned {
+		h.logger.Info("auth rejected: device banned", "device_uuid", session.DeviceUUID, "reason", reason)
+		client.SendMessage(&WSMessage{
+			Type:    TypeBanned,
+			Payload: BannedPayload{Reason: reason, ExpiresIn: int64(remaining.Seconds())},
+		})
+		return
+	}
+
+	if !h.completeAuth(ctx, client, session.DeviceUUID, version) {
+		return
+	}
+
+	// Skip chats that ended while the device was away
+	restored := make([]ChatRegistration, 0, len(session.Participants))
+	for chatUUID, participantID := range session.Participants {
+		chat, err := h.redis.GetChat(ctx, chatUUID)
+		if err != nil || chat.Participant(participantID) == nil {
+			continue
+		}
+		restored = append(restored, ChatRegistration{ChatUUID: chatUUID, ParticipantID: participantID})
+	}
+
+	h.mu.Lock()
+	for _, chatReg := range restored {
+		h.chatParticipants[chatParticipantKey(chatReg.ChatUUID, chatReg.ParticipantID)] = session.DeviceUUID
+	}
+	h.mu.Unlock()
+
+	token := client.ResumeToken()
+	for _, chatReg := range restored {
+		if token != "" {
+			h.redis.AddResumeParticipant(ctx, token, chatReg.ChatUUID, chatReg.ParticipantID)
+		}
+		h.deliverQueuedMessages(ctx, client, chatReg)
+		h.replayMessageStates(ctx, client, chatReg.ChatUUID, chatReg.ParticipantID)
+		h.notifyPresence(ctx, chatReg.ChatUUID, chatReg.ParticipantID, true)
+	}
+
+	h.logger.Debug("auth resumed", "device_uuid", session.DeviceUUID, "chats", len(restored))
+
+	client.SendMessage(&WSMessage{
+		Type: TypeChatRegisterAck,
+		Payload: ChatRegisterAckPayload{
+			Registered: len(restored),
+			Failed:     len(session.Participants) - len(restored),
+		},
+	})
+}
+
+// refreshResumeTokens keeps connected clients' resume tokens from expiring
+// A token only starts running down once its connection is gone
+func (h *Hub) refreshResumeTokens(ctx context.Context) {
+	h.mu.RLock()
+	tokens := make([]string, 0, len(h.connections))
+	for client := range h.connections {
+		if token := client.ResumeToken(); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, token := range tokens {
+		if err := h.redis.RefreshResumeSession(ctx, token, h.resumeTTL); err != nil {
+			h.logger.Warn("failed to refresh resume token", "error", err)
+		}
+	}
+}
+
+func newResumeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"time"
+
+	"nihil/internal/errcode"
+	redisdb "nihil/internal/redis"
+)
+
+const (
+	// schedulePollInterval is how often due scheduled messages are looked for
+	schedulePollInterval = time.Second
+
+	// scheduleBatchSize caps the messages delivered per poll
+	scheduleBatchSize = 100
+)
+
+// handleMessageSchedule stores a message to be sent at a later time
+// It's checked like message.send; the delivery time must fall within the chat's lifetime
+func (h *Hub) handleMessageSchedule(ctx context.Context, client *Client, msg *WSMessage) {
+	if !client.IsAuthed() {
+		sendError(client, errcode.NotAuthenticated, "Must authenticate first")
+		return
+	}
+
+	payloadBytes, _ := json.Marshal(msg.Payload)
+	var payload MessageSchedulePayload
+	if err := json.Unmarshal(payloadBytes, &payload); err != nil {
+		sendError(client, errcode.InvalidPayload, "Invalid message payload")
+		return
+	}
+
+	// The ID keys the stored message, so it can't be left out
+	if payload.MessageID == "" {
+		sendError(client, errcode.InvalidPayload, "message_id is required")
+		return
+	}
+
+	chat, content, ok := h.validateOutgoing(ctx, client, "message.schedule", outgoingMessage{
+		ChatUUID:          payload.ChatUUID,
+		EncryptedContent:  payload.EncryptedContent,
+		ParticipantID:     payload.ParticipantID,
+		ParticipantSecret: payload.ParticipantSecret,
+		AttachmentIDs:     payload.AttachmentIDs,
+	})
+	if !ok {
+		return
+	}
+
+	deliverAt := time.Unix(payload.DeliverAt, 0)
+	if !deliverAt.After(time.Now()) {
+		sendError(client, errcode.InvalidDeliverAt, "Delivery time must be in the future")
+		return
+	}
+	if deliverAt.After(chat.ExpiresAt()) {
+		h.logger.Debug("message.schedule rejected", "reason", "after_expiry", "chat_uuid", payload.ChatUUID)
+		sendError(client, errcode.DeliverAfterExpiry, "Delivery time is after the chat expires")
+		return
+	}
+
+	scheduled := &WSMessage{
+		Type: TypeMessageScheduled,
+		Payload: MessageScheduledPayload{
+			ChatUUID:  payload.ChatUUID,
+			MessageID: payload.MessageID,
+			DeliverAt: payload.DeliverAt,
+		},
+	}
+
+	// A retried schedule is confirmed again but stored only once
+	dup, ok := h.recordOutgoing(ctx, client, "message.schedule", chat, payload.ParticipantID, payload.MessageID, content)
+	if !ok {
+		return
+	}
+	if dup {
+		client.SendMessage(scheduled)
+		return
+	}
+
+	err := h.redis.ScheduleMessage(ctx, &redisdb.ScheduledMessage{
+		ChatUUID:          payload.ChatUUID,
+		MessageID:         payload.MessageID,
+		SenderParticipant: payload.ParticipantID,
+		SenderDeviceUUID:  client.GetDeviceUUID(),
+		EncryptedContent:  content,
+		AttachmentIDs:     payload.AttachmentIDs,
+		DeliverAt:         deliverAt,
+	})
+	if err != nil {
+		h.logger.Error("failed to schedule message", "chat_uuid", payload.ChatUUID, "error", err)
+		sendError(client, errcode.Internal, "Failed to schedule message")
+		return
+	}
+
+	client.SendMessage(scheduled)
+}
+
+// runScheduler delivers scheduled messages as they fall due
+func (h *Hub) runScheduler() {
+	ticker := time.NewTicker(schedulePollInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.deliverDueMessages(context.Background(), time.Now())
+	}
+}
+
+// deliverDueMessages sends every scheduled message due at or before now
+// Delivery is the same as message.send; the sender gets its message.ack when it goes out
+func (h *Hub) deliverDueMessages(ctx context.Context, now time.Time) {
+	for {
+		due, err := h.redis.PopDueScheduledMessages(ctx, now, scheduleBatchSize)
+		if err != nil {
+			h.logger.Error("failed to get due scheduled messages", "error", err)
+			return
+		}
+
+		for _, scheduled := range due {
+			h.deliverScheduled(ctx, scheduled)
+		}
+
+		if len(due) < scheduleBatchSize {
+			return
+		}
+	}
+}
+
+func (h *Hub) deliverScheduled(ctx context.Context, scheduled *redisdb.ScheduledMessage) {
+	// The chat may have expired or been deleted since
+	chat, err := h.redis.GetChat(ctx, scheduled.ChatUUID)
+	if err != nil {
+		h.logger.Debug("scheduled message dropped", "reason", "chat_not_found", "chat_uuid", scheduled.ChatUUID)
+		return
+	}
+
+	outMsg := &WSMessage{
+		Type: TypeMessageReceived,
+		Payload: MessageReceivedPayload{
+			ChatUUID:         scheduled.ChatUUID,
+			MessageID:        scheduled.MessageID,
+			SenderUUID:       scheduled.SenderParticipant,
+			SenderDeviceUUID: scheduled.SenderDeviceUUID,
+			EncryptedContent: base64.StdEncoding.EncodeToString(scheduled.EncryptedContent),
+			Timestamp:        time.Now().Unix(),
+			AttachmentIDs:    scheduled.AttachmentIDs,
+		},
+	}
+	if dropped := h.deliverMessage(ctx, chat, scheduled.SenderParticipant, scheduled.SenderDeviceUUID, scheduled.MessageID, scheduled.EncryptedContent, scheduled.AttachmentIDs, outMsg); dropped > 0 {
+		h.routeToParticipant(ctx, chat, scheduled.SenderParticipant, &WSMessage{
+			Type:    TypeQueueTrimmed,
+			Payload: QueueTrimmedPayload{ChatUUID: scheduled.ChatUUID, Dropped: dropped},
+		})
+	}
+
+	// The sender learns the message went out wherever it's connected now
+	h.routeToParticipant(ctx, chat, scheduled.SenderParticipant, &WSMessage{
+		Type: TypeMessageAck,
+		Payload: MessageAckPayload{
+			ChatUUID:  scheduled.ChatUUID,
+			MessageID: scheduled.MessageID,
+		},
+	})
+	h.logger.Debug("scheduled message delivered", "chat_uuid", scheduled.ChatUUID)
+}
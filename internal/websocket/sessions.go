@@ -0,0 +1,152 @@
+package websocket
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/google/uuid"
+
+	redisdb "nihil/internal/redis"
+)
+
+// Policies for a device that authenticates with maxDeviceConns connections already open
+const (
+	ConnPolicyReplace = "replace" // close the device's oldest connection
+	ConnPolicyReject  = "reject"  // refuse the new connection
+)
+
+// admitDeviceConnection enforces the per-device connection limit for a client about to authenticate
+// Under the replace policy the oldest connections are told session.replaced and closed
+// An admitted client holds its slot from here, before h.mu is released, see reserveDevice
+// Returns false if the client must be refused
+func (h *Hub) admitDeviceConnection(client *Client, deviceUUID string) bool {
+	if h.maxDeviceConns <= 0 {
+		return true
+	}
+
+	h.mu.Lock()
+	var existing []*Client
+	for c := range h.connections {
+		if c != client && c.holdsDeviceSlot(deviceUUID) {
+			existing = append(existing, c)
+		}
+	}
+
+	if len(existing) < h.maxDeviceConns {
+		client.reserveDevice(deviceUUID)
+		h.mu.Unlock()
+		return true
+	}
+	if h.deviceConnPolicy == ConnPolicyReject {
+		h.mu.Unlock()
+		return false
+	}
+
+	// Evict oldest first until the new client fits
+	var evicted []*Client
+	for len(existing) >= h.maxDeviceConns {
+		oldest := 0
+		for i, c := range existing {
+			if c.AuthedAt().Before(existing[oldest].AuthedAt()) {
+				oldest = i
+			}
+		}
+		c := existing[oldest]
+		existing = append(existing[:oldest], existing[oldest+1:]...)
+
+		// Forgotten here so the later unregister from its ReadPump is a no-op
+		delete(h.connections, c)
+		delete(h.presenceSubs, c)
+		if h.clients[deviceUUID] == c {
+			delete(h.clients, deviceUUID)
+		}
+		evicted = append(evicted, c)
+
+		// Closed under h.mu so its own ReadPump can't add it back, see addClient
+		// WritePump flushes the notice, sends a close frame and exits; frames its
+		// ReadPump still reads are ignored and its unregister is a no-op
+		c.SendMessage(&WSMessage{Type: TypeSessionReplaced})
+		c.Close()
+	}
+	client.reserveDevice(deviceUUID)
+	h.mu.Unlock()
+
+	for _, c := range evicted {
+		h.releaseClient(c)
+	}
+
+	h.logger.Info("device connections replaced", "device_uuid", deviceUUID, "evicted", len(evicted))
+	return true
+}
+
+// handleLogout closes a connection the client is done with, e.g. when the app is locked
+// Messages for the device are queued and pushed from here on instead of written to a
+// socket nobody reads until the ping timeout. Nothing in Redis is purged
+func (h *Hub) handleLogout(client *Client) {
+	h.logger.Debug("client logged out", "device_uuid", client.GetDeviceUUID())
+	h.forgetClient(client, &WSMessage{Type: TypeLogoutAck})
+	// ReadPump stops here and its unregister closes the send buffer, so nothing read
+	// after the logout is handled; WritePump then flushes the ack and closes the conn
+	client.logOut()
+}
+
+func newSessionID() string {
+	return uuid.New().String()
+}
+
+// deviceSession is how a connection appears in the device's session registry
+func (h *Hub) deviceSession(c *Client) redisdb.DeviceSession {
+	return redisdb.DeviceSession{
+		ID:              c.SessionID(),
+		InstanceID:      h.instanceID,
+		ConnectedAt:     c.AuthedAt(),
+		ProtocolVersion: c.ProtocolVersion(),
+	}
+}
+
+// releaseClient cleans up after a connection the hub has forgotten, however it left
+// Unacknowledged messages go back in the queue and its session is deregistered
+func (h *Hub) releaseClient(c *Client) {
+	h.requeueUnacked(c)
+
+	if sessionID := c.SessionID(); sessionID != "" {
+		if err := h.redis.RemoveDeviceSession(context.Background(), c.GetDeviceUUID(), sessionID); err != nil {
+			h.logger.Warn("failed to deregister session", "device_uuid", c.GetDeviceUUID(), "error", err)
+		}
+	}
+}
+
+// refreshSessions keeps every local connection's registry entry from going stale
+func (h *Hub) refreshSessions(ctx context.Context) {
+	h.mu.RLock()
+	sessions := make(map[*Client]redisdb.DeviceSession, len(h.connections))
+	for c := range h.connections {
+		if c.IsAuthed() {
+			sessions[c] = h.deviceSession(c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for c, session := range sessions {
+		if err := h.redis.SaveDeviceSession(ctx, c.GetDeviceUUID(), session); err != nil {
+			h.logger.Warn("failed to refresh session", "device_uuid", c.GetDeviceUUID(), "error", err)
+		}
+	}
+}
+
+// disconnectEverywhere closes the device's connections here and on every other instance
+func (h *Hub) disconnectEverywhere(deviceUUID string, notice ErrorPayload) {
+	h.disconnectDevice(deviceUUID, notice)
+
+	data, err := json.Marshal(relayEnvelope{
+		Origin:     h.instanceID,
+		DeviceUUID: deviceUUID,
+		Disconnect: &notice,
+	})
+	if err != nil {
+		return
+	}
+	if _, err := h.redis.PublishToDevice(context.Background(), deviceUUID, data); err != nil {
+		h.logger.Warn("failed to relay disconnect", "device_uuid", deviceUUID, "error", err)
+	}
+}
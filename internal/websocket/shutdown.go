@@ -0,0 +1,60 @@
+package websocket
+
+import "context"
+
+// Shutdown stops accepting connections and drains every connected client
+// Clients are told to reconnect elsewhere, then each send buffer is flushed
+// Connections still flushing when ctx expires are closed outright
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.closing = true
+
+	clients := make([]*Client, 0, len(h.connections))
+	for client := range h.connections {
+		clients = append(clients, client)
+	}
+	devices := make([]string, 0, len(h.clients))
+	for deviceUUID := range h.clients {
+		devices = append(devices, deviceUUID)
+	}
+
+	// Forget every client so later routing and unregisters leave them alone
+	h.connections = make(map[*Client]bool)
+	h.clients = make(map[string]*Client)
+	h.chatParticipants = make(map[string]string)
+	h.presenceSubs = make(map[*Client]map[string]bool)
+
+	for _, client := range clients {
+		// Never blocks - a client with a full buffer just misses the notice
+		client.SendMessage(&WSMessage{
+			Type:    TypeServerShutdown,
+			Payload: ServerShutdownPayload{Reconnect: true},
+		})
+		// WritePump flushes what's buffered, sends a close frame and exits
+		client.Close()
+	}
+	h.mu.Unlock()
+
+	h.logger.Info("hub shutting down", "connections", len(clients))
+
+	for _, deviceUUID := range devices {
+		h.removeClient(ctx, deviceUUID)
+	}
+	h.subscription.Close()
+
+	// Each write is bounded by the client's write wait; ctx bounds the drain as a whole
+	for i, client := range clients {
+		select {
+		case <-client.done:
+		case <-ctx.Done():
+			for _, c := range clients[i:] {
+				c.conn.Close()
+			}
+			h.logger.Warn("hub shutdown deadline exceeded", "remaining", len(clients)-i)
+			return ctx.Err()
+		}
+	}
+
+	h.logger.Info("hub drained")
+	return nil
+}
@@ -0,0 +1,136 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"nihil/internal/errcode"
+	redisdb "nihil/internal/redis"
+)
+
+// subscriptionInfo is the view of a subscription sent to its device
+func subscriptionInfo(sub *redisdb.Subscription, state string) SubscriptionInfo {
+	return SubscriptionInfo{
+		Plan:      sub.Plan,
+		Status:    state,
+		ExpiresAt: sub.ExpiresAt,
+	}
+}
+
+// handleSubscriptionQuery replies with the device's current subscription
+func (h *Hub) handleSubscriptionQuery(ctx context.Context, client *Client) {
+	if !client.IsAuthed() {
+		sendError(client, errcode.NotAuthenticated, "Must authenticate first")
+		return
+	}
+
+	sub, err := h.redis.GetSubscription(ctx, client.GetDeviceUUID())
+	if err != nil {
+		sendError(client, errcode.NoSubscription, "No subscription found")
+		return
+	}
+
+	client.SendMessage(&WSMessage{
+		Type:    TypeSubStatus,
+		Payload: subscriptionInfo(sub, h.redis.SubscriptionState(sub, time.Now())),
+	})
+}
+
+// NotifySubscriptionUpdated sends the device its subscription after it changed,
+// e.g. a claimed code extended it, wherever the device is connected
+// A device that isn't connected sees the change at its next auth.success
+func (h *Hub) NotifySubscriptionUpdated(ctx context.Context, deviceUUID string) {
+	sub, err := h.redis.GetSubscription(ctx, deviceUUID)
+	if err != nil {
+		return
+	}
+
+	h.SendToDevice(ctx, deviceUUID, &WSMessage{
+		Type:    TypeSubUpdated,
+		Payload: subscriptionInfo(sub, h.redis.SubscriptionState(sub, time.Now())),
+	})
+}
+
+// expiryCheckInterval is how often connected devices' subscriptions are checked for expiry
+const expiryCheckInterval = time.Minute
+
+// runExpiryNotifier warns connected devices before their subscription expires
+func (h *Hub) runExpiryNotifier() {
+	ticker := time.NewTicker(expiryCheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		h.notifyExpiringSubscriptions(context.Background(), time.Now())
+	}
+}
+
+// notifyExpiringSubscriptions checks every device connected to this instance
+// Each instance only looks at its own connections, so a device is checked once
+func (h *Hub) notifyExpiringSubscriptions(ctx context.Context, now time.Time) {
+	h.mu.RLock()
+	devices := make([]string, 0, len(h.clients))
+	for deviceUUID := range h.clients {
+		devices = append(devices, deviceUUID)
+	}
+	h.mu.RUnlock()
+
+	for _, deviceUUID := range devices {
+		h.checkSubscriptionExpiry(ctx, deviceUUID, now)
+	}
+}
+
+// checkSubscriptionExpiry sends subscription.expiring once per crossed threshold,
+// then subscription.expired once the grace period is over
+func (h *Hub) checkSubscriptionExpiry(ctx context.Context, deviceUUID string, now time.Time) {
+	client, ok := h.GetClient(deviceUUID)
+	if !ok {
+		return
+	}
+	sub, err := h.redis.GetSubscription(ctx, deviceUUID)
+	if err != nil {
+		return
+	}
+
+	switch h.redis.SubscriptionState(sub, now) {
+	case redisdb.SubscriptionActive:
+		// Only the tightest threshold crossed fires, so a device that connects an
+		// hour before expiry isn't also told about the day-ahead warning
+		threshold := time.Duration(-1)
+		remaining := sub.ExpiresAt.Sub(now)
+		for _, w := range h.expiryWarnings {
+			if remaining <= w && (threshold < 0 || w < threshold) {
+				threshold = w
+			}
+		}
+		if threshold < 0 {
+			return
+		}
+		if first, err := h.redis.MarkSubscriptionNotice(ctx, deviceUUID, "expiring_"+threshold.String(), sub.ExpiresAt); err != nil || !first {
+			return
+		}
+		client.SendMessage(&WSMessage{
+			Type: TypeSubExpiring,
+			Payload: SubExpiringPayload{
+				ExpiresAt: sub.ExpiresAt,
+				ExpiresIn: int64(remaining.Seconds()),
+				RenewURL:  "https://nihil.app",
+			},
+		})
+
+	case redisdb.SubscriptionExpired:
+		if first, err := h.redis.MarkSubscriptionNotice(ctx, deviceUUID, "expired", sub.ExpiresAt); err != nil || !first {
+			return
+		}
+		h.logger.Info("subscription expired while connected", "device_uuid", deviceUUID)
+		client.SendMessage(&WSMessage{
+			Type:    TypeSubExpired,
+			Payload: SubExpiredPayload{RenewURL: "https://nihil.app"},
+		})
+		if h.expiryDisconnect {
+			h.disconnectDevice(deviceUUID, ErrorPayload{
+				Code:    errcode.SubscriptionExpired,
+				Message: "Subscription expired",
+			})
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package websocket
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// runChatSweeper periodically expires chats whose TTL has passed, and disappearing messages
+// The Redis key TTL is only a backstop - this is what enforces the chosen lifetime
+func (h *Hub) runChatSweeper() {
+	if h.sweepInterval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(h.sweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		h.sweepExpiredChats(context.Background(), now)
+		h.sweepExpiredMessages(context.Background(), now)
+		h.reapStaleMappings()
+	}
+}
+
+// sweepExpiredChats notifies participants of every expired chat and removes its state
+func (h *Hub) sweepExpiredChats(ctx context.Context, now time.Time) {
+	chats, err := h.redis.GetExpiredChats(ctx, now)
+	if err != nil {
+		h.logger.Error("failed to get expired chats", "error", err)
+		return
+	}
+
+	for _, chat := range chats {
+		reason := "ttl_expired"
+		if chat.Status != "active" {
+			reason = "invitation_expired"
+		}
+
+		// Chat may have been deleted since it was fetched - nothing to notify then
+		h.BroadcastToChat(ctx, chat.ChatUUID, &WSMessage{
+			Type: TypeChatExpired,
+			Payload: ChatExpiredPayload{
+				ChatUUID: chat.ChatUUID,
+				Reason:   reason,
+			},
+		})
+
+		h.redis.DeleteQueuedMessages(ctx, chat.ChatUUID)
+		h.redis.DeleteChat(ctx, chat.ChatUUID)
+		h.removeChatMappings(chat.ChatUUID)
+
+		h.logger.Debug("chat expired", "chat_uuid", chat.ChatUUID, "reason", reason)
+	}
+}
+
+// removeChatMappings drops all in-memory participant routes for a chat
+func (h *Hub) removeChatMappings(chatUUID string) {
+	prefix := chatUUID + ":"
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for key := range h.chatParticipants {
+		if strings.HasPrefix(key, prefix) {
+			delete(h.chatParticipants, key)
+		}
+	}
+}
+
+// reapStaleMappings drops chat mappings whose device is no longer connected here
+// Disconnects clean up after themselves, so this only catches mappings a missed cleanup leaked
+func (h *Hub) reapStaleMappings() int {
+	h.mu.Lock()
+	reaped := 0
+	for key, deviceUUID := range h.chatParticipants {
+		if _, ok := h.clients[deviceUUID]; !ok {
+			delete(h.chatParticipants, key)
+			reaped++
+		}
+	}
+	remaining := len(h.chatParticipants)
+	h.mu.Unlock()
+
+	if reaped > 0 {
+		h.staleMappingsReaped.Add(int64(reaped))
+		h.logger.Warn("reaped stale chat mappings", "reaped", reaped, "remaining", remaining)
+	}
+	return reaped
+}
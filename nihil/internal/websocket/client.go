@@ -1,140 +0,0 @@
-package websocket
-
-import (
-	"context"
-	"encoding/json"
-	"sync"
-	"time"
-
-	"github.com/gorilla/websocket"
-)
-
-const (
-	writeWait      = 10 * time.Second
-	pongWait       = 60 * time.Second
-	pingPeriod     = (pongWait * 9) / 10
-	maxMessageSize = 10240
-)
-
-type Client struct {
-	hub        *Hub
-	conn       *websocket.Conn
-	send       chan []byte
-	deviceUUID string
-	authed     bool
-	mu         sync.RWMutex
-}
-
-func NewClient(hub *Hub, conn *websocket.Conn) *Client {
-	return &Client{
-		hub:    hub,
-		conn:   conn,
-		send:   make(chan []byte, 256),
-		authed: false,
-	}
-}
-
-func (c *Client) GetDeviceUUID() string {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.deviceUUID
-}
-
-func (c *Client) SetDeviceUUID(uuid string) {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-	c.deviceUUID = uuid
-	c.authed = true
-}
-
-func (c *Client) IsAuthed() bool {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
-	return c.authed
-}
-
-func (c *Client) SendMessage(msg *WSMessage) error {
-	data, err := json.Marshal(msg)
-	if err != nil {
-		return err
-	}
-
-	select {
-	case c.send <- data:
-		return nil
-	default:
-		return ErrClientBufferFull
-	}
-}
-
-func (c *Client) ReadPump() {
-	defer func() {
-		c.hub.unregister <- c
-		c.conn.Close()
-	}()
-
-	c.conn.SetReadLimit(maxMessageSize)
-	c.conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.conn.SetPongHandler(func(string) error {
-		c.conn.SetReadDeadline(time.Now().Add(pongWait))
-		return nil
-	})
-
-	for {
-		_, message, err := c.conn.ReadMessage()
-		if err != nil {
-			break
-		}
-
-		var msg WSMessage
-		if err := json.Unmarshal(message, &msg); err != nil {
-			c.SendMessage(&WSMessage{
-				Type: TypeError,
-				Payload: ErrorPayload{
-					Code:    "invalid_json",
-					Message: "Invalid JSON message",
-				},
-			})
-			continue
-		}
-
-		c.hub.HandleMessage(c, &msg)
-	}
-}
-
-func (c *Client) WritePump() {
-	ticker := time.NewTicker(pingPeriod)
-	defer func() {
-		ticker.Stop()
-		c.conn.Close()
-	}()
-
-	for {
-		select {
-		case message, ok := <-c.send:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				c.conn.WriteMessage(websocket.CloseMessage, []byte{})
-				return
-			}
-
-			if err := c.conn.WriteMessage(websocket.TextMessage, message); err != nil {
-				return
-			}
-
-		case <-ticker.C:
-			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
-				return
-			}
-		}
-	}
-}
-
-func (c *Client) Close() {
-	close(c.send)
-}
-
-func (c *Client) Context() context.Context {
-	return context.Background()
-}
\ No newline at end of file